@@ -16,20 +16,79 @@ const (
 	Set  CommandType = "set"
 
 	// Other commands
-	Info     CommandType = "info"
-	ReplConf CommandType = "replconf"
-	Psync    CommandType = "psync"
-	Config   CommandType = "config"
-	Wait     CommandType = "wait"
-	Keys     CommandType = "keys"
-	Incr     CommandType = "incr"
-	Multi    CommandType = "multi"
-	Exec     CommandType = "exec"
-	Discard  CommandType = "discard"
-	Type     CommandType = "type"
-	XAdd     CommandType = "xadd"
-	XRange   CommandType = "xrange"
-	XRead    CommandType = "xread"
+	Info         CommandType = "info"
+	ReplConf     CommandType = "replconf"
+	Psync        CommandType = "psync"
+	Config       CommandType = "config"
+	Wait         CommandType = "wait"
+	Keys         CommandType = "keys"
+	Incr         CommandType = "incr"
+	IncrBy       CommandType = "incrby"
+	Decr         CommandType = "decr"
+	DecrBy       CommandType = "decrby"
+	IncrByFloat  CommandType = "incrbyfloat"
+	Expire       CommandType = "expire"
+	PExpire      CommandType = "pexpire"
+	ExpireAt     CommandType = "expireat"
+	PExpireAt    CommandType = "pexpireat"
+	TTL          CommandType = "ttl"
+	PTTL         CommandType = "pttl"
+	ExpireTime   CommandType = "expiretime"
+	PExpireTime  CommandType = "pexpiretime"
+	Persist      CommandType = "persist"
+	Del          CommandType = "del"
+	Unlink       CommandType = "unlink"
+	Exists       CommandType = "exists"
+	Rename       CommandType = "rename"
+	RenameNX     CommandType = "renamenx"
+	Copy         CommandType = "copy"
+	Move         CommandType = "move"
+	Select       CommandType = "select"
+	SwapDB       CommandType = "swapdb"
+	FlushDB      CommandType = "flushdb"
+	FlushAll     CommandType = "flushall"
+	Save         CommandType = "save"
+	Object       CommandType = "object"
+	Memory       CommandType = "memory"
+	Dump         CommandType = "dump"
+	Restore      CommandType = "restore"
+	RandomKey    CommandType = "randomkey"
+	DBSize       CommandType = "dbsize"
+	Touch        CommandType = "touch"
+	Scan         CommandType = "scan"
+	Multi        CommandType = "multi"
+	Exec         CommandType = "exec"
+	Discard      CommandType = "discard"
+	Watch        CommandType = "watch"
+	Unwatch      CommandType = "unwatch"
+	Type         CommandType = "type"
+	XAdd         CommandType = "xadd"
+	XLen         CommandType = "xlen"
+	XDel         CommandType = "xdel"
+	XTrim        CommandType = "xtrim"
+	XRange       CommandType = "xrange"
+	XRevRange    CommandType = "xrevrange"
+	XRead        CommandType = "xread"
+	XGroup       CommandType = "xgroup"
+	XReadGroup   CommandType = "xreadgroup"
+	XAck         CommandType = "xack"
+	XPending     CommandType = "xpending"
+	XClaim       CommandType = "xclaim"
+	XAutoClaim   CommandType = "xautoclaim"
+	XInfo        CommandType = "xinfo"
+	XSetID       CommandType = "xsetid"
+	CommandCmd   CommandType = "command"
+	Subscribe    CommandType = "subscribe"
+	Unsubscribe  CommandType = "unsubscribe"
+	PSubscribe   CommandType = "psubscribe"
+	PUnsubscribe CommandType = "punsubscribe"
+	Publish      CommandType = "publish"
+	SSubscribe   CommandType = "ssubscribe"
+	SUnsubscribe CommandType = "sunsubscribe"
+	SPublish     CommandType = "spublish"
+	PubSub       CommandType = "pubsub"
+	Quit         CommandType = "quit"
+	Reset        CommandType = "reset"
 
 	Unknown CommandType = "unknown"
 )
@@ -39,6 +98,37 @@ type Command struct {
 	Args        [][]byte
 	Raw         []byte
 	ReplCnt     int32
+
+	propagate []byte       // what replicas get instead of Raw, see Rewrite
+	spec      *commandSpec // set once the command is known to be valid
+}
+
+// Rewrite replaces what gets propagated to replicas for this command, e.g. a
+// relative EXPIRE becomes an absolute PEXPIREAT
+func (c *Command) Rewrite(args ...string) {
+	c.propagate = resp.EncodeArrayBulkStrings(args)
+}
+
+// RewriteAll is Rewrite with several commands, e.g. the XCLAIMs an XREADGROUP
+// amounts to. With none the command isn't propagated.
+func (c *Command) RewriteAll(cmds [][]string) {
+	c.propagate = []byte{}
+	for _, args := range cmds {
+		c.propagate = append(c.propagate, resp.EncodeArrayBulkStrings(args)...)
+	}
+}
+
+// NoPropagate keeps this command from reaching the replicas, for writes that
+// didn't change anything
+func (c *Command) NoPropagate() {
+	c.propagate = []byte{}
+}
+
+func (c *Command) propagatedRaw() []byte {
+	if c.propagate != nil {
+		return c.propagate
+	}
+	return c.Raw
 }
 
 func ParseCommandFromRESP(r resp.RESP) (*Command, error) {
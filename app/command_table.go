@@ -0,0 +1,635 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/resp"
+)
+
+/*
+The command table: how each command is called, what it does to the dataset
+and where its keys are, after Redis' commands.def. Arity and subcommands are
+checked from it before a command runs, COMMAND reports it.
+*/
+
+// Flags of a command, listed by COMMAND INFO in this order
+type commandFlags uint32
+
+const (
+	cmdWrite commandFlags = 1 << iota
+	cmdReadonly
+	cmdDenyOOM
+	cmdAdmin
+	cmdPubSub
+	cmdNoScript
+	cmdBlocking
+	cmdLoading
+	cmdStale
+	cmdSkipSlowlog
+	cmdFast
+	cmdNoAsyncLoading
+	cmdNoMulti
+	cmdMovableKeys // set from the key specs
+	cmdAllowBusy
+)
+
+var commandFlagNames = []string{
+	"write", "readonly", "denyoom", "admin", "pubsub", "noscript", "blocking", "loading", "stale",
+	"skip_slowlog", "fast", "no_async_loading", "no_multi", "movablekeys", "allow_busy",
+}
+
+// ACL categories of a command, listed by COMMAND INFO in this order
+type aclCategories uint32
+
+const (
+	aclKeyspace aclCategories = 1 << iota
+	aclRead
+	aclWrite
+	aclSet
+	aclSortedSet
+	aclList
+	aclHash
+	aclString
+	aclStream
+	aclPubSub
+	aclAdmin
+	aclFast
+	aclSlow
+	aclBlocking
+	aclDangerous
+	aclConnection
+	aclTransaction
+)
+
+var aclCategoryNames = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string", "stream", "pubsub",
+	"admin", "fast", "slow", "blocking", "dangerous", "connection", "transaction",
+}
+
+// Categories that follow from the flags, like Redis' setImplicitACLCategories
+func (f commandFlags) aclCategories() aclCategories {
+	var acl aclCategories
+	if f&cmdWrite != 0 {
+		acl |= aclWrite
+	}
+	if f&cmdReadonly != 0 {
+		acl |= aclRead
+	}
+	if f&cmdAdmin != 0 {
+		acl |= aclAdmin | aclDangerous
+	}
+	if f&cmdPubSub != 0 {
+		acl |= aclPubSub
+	}
+	if f&cmdBlocking != 0 {
+		acl |= aclBlocking
+	}
+	if f&cmdFast != 0 {
+		acl |= aclFast
+	} else {
+		acl |= aclSlow
+	}
+	return acl
+}
+
+// Where keys are in the arguments of a command, like Redis' key specs: the
+// search begins at a fixed index or after a keyword, then takes the keys in
+// a range from there. Indexes count the command name as 0.
+type keySpec struct {
+	flags     string // RO, RW, OW or RM then what's done with the key, or not_key for shard channels, space separated
+	index     int    // first key, when there's no keyword
+	keyword   string // the keys follow this keyword, searched from startFrom on
+	startFrom int
+	lastKey   int // last key relative to the first one, -1 for the last argument
+	keyStep   int
+	limit     int // with lastKey -1, the keys are the first 1/limit of the rest
+}
+
+// The key at index
+func keyAt(index int, flags string) keySpec {
+	return keySpec{flags: flags, index: index, keyStep: 1}
+}
+
+// All the arguments from index on are keys
+func keysFrom(index int, flags string) keySpec {
+	return keySpec{flags: flags, index: index, lastKey: -1, keyStep: 1}
+}
+
+// Indexes of the keys in argv, false if argv doesn't hold them where ks says
+func (ks keySpec) keys(argv []string) ([]int, bool) {
+	first := ks.index
+	if ks.keyword != "" {
+		first = 0
+		for i := ks.startFrom; i < len(argv); i++ {
+			if strings.EqualFold(argv[i], ks.keyword) {
+				first = i + 1
+				break
+			}
+		}
+		if first == 0 {
+			return nil, false
+		}
+	}
+
+	last := first + ks.lastKey
+	if ks.lastKey < 0 {
+		last = len(argv) + ks.lastKey
+		if ks.limit > 1 {
+			last = first + (last-first+1)/ks.limit - 1
+		}
+	}
+	if first >= len(argv) || last >= len(argv) || last < first {
+		return nil, false
+	}
+	indexes := make([]int, 0, (last-first)/ks.keyStep+1)
+	for i := first; i <= last; i += ks.keyStep {
+		indexes = append(indexes, i)
+	}
+	return indexes, true
+}
+
+type commandSpec struct {
+	name        string         // lower case, without the container for subcommands
+	run         commandHandler // nil for subcommands
+	arity       int            // arguments counting the name, -N for at least N
+	flags       commandFlags
+	acl         aclCategories // besides the ones implied by flags
+	keySpecs    []keySpec
+	tips        []string
+	group       string
+	since       string
+	summary     string
+	subcommands []*commandSpec
+	parent      *commandSpec // of a subcommand
+}
+
+// Name with the container for subcommands, e.g. "object|encoding"
+func (spec *commandSpec) fullName() string {
+	if spec.parent != nil {
+		return spec.parent.name + "|" + spec.name
+	}
+	return spec.name
+}
+
+// Subcommands run with the handler of their container
+func (spec *commandSpec) handler() commandHandler {
+	if spec.parent != nil {
+		return spec.parent.handler()
+	}
+	return spec.run
+}
+
+func (spec *commandSpec) arityOK(argc int) bool {
+	if spec.arity < 0 {
+		return argc >= -spec.arity
+	}
+	return argc == spec.arity
+}
+
+func (spec *commandSpec) subcommand(name string) *commandSpec {
+	for _, sub := range spec.subcommands {
+		if strings.EqualFold(sub.name, name) {
+			return sub
+		}
+	}
+	return nil
+}
+
+// Key positions of COMMAND INFO, from the key specs at fixed indexes. The
+// keys after a keyword can't be described this way.
+func (spec *commandSpec) legacyKeyRange() (first, last, step int) {
+	for _, ks := range spec.keySpecs {
+		if ks.keyword != "" || ks.limit > 1 {
+			continue
+		}
+		l := ks.index + ks.lastKey
+		if ks.lastKey < 0 {
+			l = ks.lastKey
+		}
+		switch {
+		case first == 0:
+			first, last, step = ks.index, l, ks.keyStep
+		case last >= 0 && l < 0:
+			last = l
+		case last >= 0:
+			last = max(last, l)
+		}
+		first = min(first, ks.index)
+	}
+	return first, last, step
+}
+
+// Indexes of the keys in argv, run by this spec. false if they can't be
+// found where the key specs say. Arguments that aren't keys are left out.
+func (spec *commandSpec) keys(argv []string) ([]int, bool) {
+	var indexes []int
+	for _, ks := range spec.keySpecs {
+		if slices.Contains(strings.Fields(ks.flags), "not_key") {
+			continue
+		}
+		found, ok := ks.keys(argv)
+		if !ok {
+			return nil, false
+		}
+		indexes = append(indexes, found...)
+	}
+	return indexes, true
+}
+
+var commandTable map[CommandType]*commandSpec
+
+func init() {
+	commandTable = make(map[CommandType]*commandSpec, len(commandSpecs))
+	for _, spec := range commandSpecs {
+		spec.init(nil)
+		commandTable[CommandType(spec.name)] = spec
+	}
+}
+
+func (spec *commandSpec) init(parent *commandSpec) {
+	spec.parent = parent
+	for _, ks := range spec.keySpecs {
+		if ks.keyword != "" {
+			spec.flags |= cmdMovableKeys
+		}
+	}
+	spec.acl |= spec.flags.aclCategories()
+	for _, sub := range spec.subcommands {
+		sub.init(spec)
+	}
+}
+
+// The spec cmd runs with, its subcommand's for container commands, or the
+// error reply if it's unknown or has a wrong number of arguments
+func lookupCommand(cmd *Command) (*commandSpec, []byte) {
+	spec, ok := commandTable[cmd.CommandType]
+	if !ok {
+		var args strings.Builder
+		for _, arg := range cmd.Args {
+			if args.Len() >= 128 {
+				break
+			}
+			fmt.Fprintf(&args, "'%.*s' ", 128-args.Len(), arg)
+		}
+		return nil, resp.EncodeError(fmt.Sprintf("unknown command '%.128s', with args beginning with: %s", cmd.CommandType, args.String()))
+	}
+	if len(spec.subcommands) > 0 && len(cmd.Args) > 0 {
+		sub := spec.subcommand(string(cmd.Args[0]))
+		if sub == nil {
+			return nil, resp.EncodeError(fmt.Sprintf("unknown subcommand '%.128s'. Try %s HELP.", cmd.Args[0], strings.ToUpper(spec.name)))
+		}
+		spec = sub
+	}
+	if !spec.arityOK(len(cmd.Args) + 1) {
+		return nil, resp.EncodeError(fmt.Sprintf("wrong number of arguments for '%s' command", spec.fullName()))
+	}
+	return spec, nil
+}
+
+// The spec for a command name as given to COMMAND INFO, "container|sub" for
+// a subcommand. nil if there's none.
+func lookupCommandByName(name string) *commandSpec {
+	container, sub, isSub := strings.Cut(strings.ToLower(name), "|")
+	spec := commandTable[CommandType(container)]
+	if spec == nil || !isSub {
+		return spec
+	}
+	return spec.subcommand(sub)
+}
+
+// All the commands, ordered by name
+func sortedCommandSpecs() []*commandSpec {
+	specs := make([]*commandSpec, 0, len(commandTable))
+	for _, spec := range commandTable {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].name < specs[j].name })
+	return specs
+}
+
+/*
+The commands
+*/
+
+var commandSpecs = []*commandSpec{
+	// connection
+	{name: "ping", run: ping, arity: -1, flags: cmdFast, acl: aclConnection,
+		group: "connection", since: "1.0.0", summary: "Returns the server's liveliness response."},
+	{name: "echo", run: echo, arity: 2, flags: cmdFast, acl: aclConnection,
+		group: "connection", since: "1.0.0", summary: "Returns the given string."},
+	{name: "select", run: selectDB, arity: 2, flags: cmdLoading | cmdStale | cmdFast, acl: aclConnection,
+		group: "connection", since: "1.0.0", summary: "Changes the selected database."},
+	{name: "quit", run: quit, arity: -1, flags: cmdAllowBusy | cmdNoScript | cmdLoading | cmdStale | cmdFast, acl: aclConnection,
+		group: "connection", since: "1.0.0", summary: "Closes the connection."},
+	{name: "reset", run: reset, arity: 1, flags: cmdNoScript | cmdLoading | cmdStale | cmdFast | cmdAllowBusy, acl: aclConnection,
+		group: "connection", since: "6.2.0", summary: "Resets the connection."},
+
+	// string
+	{name: "get", run: get, arity: 2, flags: cmdReadonly | cmdFast, acl: aclString,
+		keySpecs: []keySpec{keyAt(1, "RO access")},
+		group:    "string", since: "1.0.0", summary: "Returns the string value of a key."},
+	{name: "set", run: set, arity: -3, flags: cmdWrite | cmdDenyOOM, acl: aclString,
+		keySpecs: []keySpec{keyAt(1, "RW access update variable_flags")},
+		group:    "string", since: "1.0.0", summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist."},
+	{name: "incr", run: incr, arity: 2, flags: cmdWrite | cmdDenyOOM | cmdFast, acl: aclString,
+		keySpecs: []keySpec{keyAt(1, "RW access update")},
+		group:    "string", since: "1.0.0", summary: "Increments the integer value of a key by one. Uses 0 as initial value if the key doesn't exist."},
+	{name: "incrby", run: incrby, arity: 3, flags: cmdWrite | cmdDenyOOM | cmdFast, acl: aclString,
+		keySpecs: []keySpec{keyAt(1, "RW access update")},
+		group:    "string", since: "1.0.0", summary: "Increments the integer value of a key by a number. Uses 0 as initial value if the key doesn't exist."},
+	{name: "decr", run: decr, arity: 2, flags: cmdWrite | cmdDenyOOM | cmdFast, acl: aclString,
+		keySpecs: []keySpec{keyAt(1, "RW access update")},
+		group:    "string", since: "1.0.0", summary: "Decrements the integer value of a key by one. Uses 0 as initial value if the key doesn't exist."},
+	{name: "decrby", run: decrby, arity: 3, flags: cmdWrite | cmdDenyOOM | cmdFast, acl: aclString,
+		keySpecs: []keySpec{keyAt(1, "RW access update")},
+		group:    "string", since: "1.0.0", summary: "Decrements a number from the integer value of a key. Uses 0 as initial value if the key doesn't exist."},
+	{name: "incrbyfloat", run: incrbyfloat, arity: 3, flags: cmdWrite | cmdDenyOOM | cmdFast, acl: aclString,
+		keySpecs: []keySpec{keyAt(1, "RW access update")},
+		group:    "string", since: "2.6.0", summary: "Increment the floating point value of a key by a number. Uses 0 as initial value if the key doesn't exist."},
+
+	// generic
+	{name: "keys", run: keys, arity: 2, flags: cmdReadonly, acl: aclKeyspace | aclDangerous,
+		tips:  []string{"request_policy:all_shards", "nondeterministic_output_order"},
+		group: "generic", since: "1.0.0", summary: "Returns all key names that match a pattern."},
+	{name: "expire", run: expire, arity: -3, flags: cmdWrite | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RW update")},
+		group:    "generic", since: "1.0.0", summary: "Sets the expiration time of a key in seconds."},
+	{name: "pexpire", run: pexpire, arity: -3, flags: cmdWrite | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RW update")},
+		group:    "generic", since: "2.6.0", summary: "Sets the expiration time of a key in milliseconds."},
+	{name: "expireat", run: expireat, arity: -3, flags: cmdWrite | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RW update")},
+		group:    "generic", since: "1.2.0", summary: "Sets the expiration time of a key to a Unix timestamp."},
+	{name: "pexpireat", run: pexpireat, arity: -3, flags: cmdWrite | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RW update")},
+		group:    "generic", since: "2.6.0", summary: "Sets the expiration time of a key to a Unix milliseconds timestamp."},
+	{name: "ttl", run: ttl, arity: 2, flags: cmdReadonly | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RO access")}, tips: []string{"nondeterministic_output"},
+		group: "generic", since: "1.0.0", summary: "Returns the expiration time in seconds of a key."},
+	{name: "pttl", run: pttl, arity: 2, flags: cmdReadonly | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RO access")}, tips: []string{"nondeterministic_output"},
+		group: "generic", since: "2.6.0", summary: "Returns the expiration time in milliseconds of a key."},
+	{name: "expiretime", run: expiretime, arity: 2, flags: cmdReadonly | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RO access")},
+		group:    "generic", since: "7.0.0", summary: "Returns the expiration time of a key as a Unix timestamp."},
+	{name: "pexpiretime", run: pexpiretime, arity: 2, flags: cmdReadonly | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RO access")},
+		group:    "generic", since: "7.0.0", summary: "Returns the expiration time of a key as a Unix milliseconds timestamp."},
+	{name: "persist", run: persist, arity: 2, flags: cmdWrite | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RW update")},
+		group:    "generic", since: "2.2.0", summary: "Removes the expiration time of a key."},
+	{name: "del", run: del, arity: -2, flags: cmdWrite, acl: aclKeyspace,
+		keySpecs: []keySpec{keysFrom(1, "RM delete")},
+		group:    "generic", since: "1.0.0", summary: "Deletes one or more keys."},
+	{name: "unlink", run: unlink, arity: -2, flags: cmdWrite | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keysFrom(1, "RM delete")},
+		group:    "generic", since: "4.0.0", summary: "Asynchronously deletes one or more keys."},
+	{name: "exists", run: exists, arity: -2, flags: cmdReadonly | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keysFrom(1, "RO")},
+		group:    "generic", since: "1.0.0", summary: "Determines whether one or more keys exist."},
+	{name: "touch", run: touch, arity: -2, flags: cmdReadonly | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keysFrom(1, "RO")},
+		group:    "generic", since: "3.2.1", summary: "Returns the number of existing keys out of those specified after updating the time they were last accessed."},
+	{name: "rename", run: rename, arity: 3, flags: cmdWrite, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RW access delete"), keyAt(2, "OW update")},
+		group:    "generic", since: "1.0.0", summary: "Renames a key and overwrites the destination."},
+	{name: "renamenx", run: renamenx, arity: 3, flags: cmdWrite | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RW access delete"), keyAt(2, "OW insert")},
+		group:    "generic", since: "1.0.0", summary: "Renames a key only when the target key name doesn't exist."},
+	{name: "copy", run: copyKey, arity: -3, flags: cmdWrite | cmdDenyOOM, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RO access"), keyAt(2, "OW update")},
+		group:    "generic", since: "6.2.0", summary: "Copies the value of a key to a new key."},
+	{name: "move", run: move, arity: 3, flags: cmdWrite | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RW update")},
+		group:    "generic", since: "1.0.0", summary: "Moves a key to another database."},
+	{name: "dump", run: dump, arity: 2, flags: cmdReadonly, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RO access")}, tips: []string{"nondeterministic_output"},
+		group: "generic", since: "2.6.0", summary: "Returns a serialized representation of the value stored at a key."},
+	{name: "restore", run: restore, arity: -4, flags: cmdWrite | cmdDenyOOM, acl: aclKeyspace | aclDangerous,
+		keySpecs: []keySpec{keyAt(1, "OW update")},
+		group:    "generic", since: "2.6.0", summary: "Creates a key from the serialized representation of a value."},
+	{name: "randomkey", run: randomkey, arity: 1, flags: cmdReadonly, acl: aclKeyspace,
+		tips:  []string{"request_policy:all_shards", "nondeterministic_output"},
+		group: "generic", since: "1.0.0", summary: "Returns a random key name from the database."},
+	{name: "scan", run: scan, arity: -2, flags: cmdReadonly, acl: aclKeyspace,
+		tips:  []string{"nondeterministic_output", "request_policy:special"},
+		group: "generic", since: "2.8.0", summary: "Iterates over the key names in the database."},
+	{name: "type", run: keytype, arity: 2, flags: cmdReadonly | cmdFast, acl: aclKeyspace,
+		keySpecs: []keySpec{keyAt(1, "RO")},
+		group:    "generic", since: "1.0.0", summary: "Determines the type of value stored at a key."},
+	{name: "object", run: object, arity: -2,
+		group: "generic", since: "2.2.3", summary: "A container for object introspection commands.",
+		subcommands: []*commandSpec{
+			{name: "encoding", arity: 3, flags: cmdReadonly, acl: aclKeyspace,
+				keySpecs: []keySpec{keyAt(2, "RO")}, tips: []string{"nondeterministic_output"},
+				group: "generic", since: "2.2.3", summary: "Returns the internal encoding of a Redis object."},
+			{name: "freq", arity: 3, flags: cmdReadonly, acl: aclKeyspace,
+				keySpecs: []keySpec{keyAt(2, "RO")}, tips: []string{"nondeterministic_output"},
+				group: "generic", since: "4.0.0", summary: "Returns the logarithmic access frequency counter of a Redis object."},
+			{name: "idletime", arity: 3, flags: cmdReadonly, acl: aclKeyspace,
+				keySpecs: []keySpec{keyAt(2, "RO")}, tips: []string{"nondeterministic_output"},
+				group: "generic", since: "2.2.3", summary: "Returns the time since the last access to a Redis object."},
+			{name: "refcount", arity: 3, flags: cmdReadonly, acl: aclKeyspace,
+				keySpecs: []keySpec{keyAt(2, "RO")}, tips: []string{"nondeterministic_output"},
+				group: "generic", since: "2.2.3", summary: "Returns the reference count of a value of a key."},
+			{name: "help", arity: 2, flags: cmdLoading | cmdStale, acl: aclKeyspace,
+				group: "generic", since: "6.2.0", summary: "Returns helpful text about the different subcommands."},
+		}},
+	{name: "wait", run: wait, arity: 3, flags: cmdBlocking, acl: aclConnection,
+		group: "generic", since: "3.0.0", summary: "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed."},
+
+	// server
+	{name: "info", run: info, arity: -1, flags: cmdLoading | cmdStale, acl: aclDangerous,
+		tips:  []string{"nondeterministic_output", "request_policy:all_shards", "response_policy:special"},
+		group: "server", since: "1.0.0", summary: "Returns information and statistics about the server."},
+	{name: "config", run: config, arity: -2,
+		group: "server", since: "2.0.0", summary: "A container for server configuration commands.",
+		subcommands: []*commandSpec{
+			{name: "get", arity: 3, flags: cmdAdmin | cmdNoScript | cmdLoading | cmdStale,
+				group: "server", since: "2.0.0", summary: "Returns the effective values of configuration parameters."},
+			{name: "help", arity: 2, flags: cmdLoading | cmdStale,
+				group: "server", since: "5.0.0", summary: "Returns helpful text about the different subcommands."},
+		}},
+	{name: "replconf", run: replConf, arity: -1, flags: cmdAdmin | cmdNoScript | cmdLoading | cmdStale | cmdAllowBusy,
+		group: "server", since: "3.0.0", summary: "An internal command for configuring the replication stream."},
+	{name: "psync", run: psync, arity: -3, flags: cmdAdmin | cmdNoScript | cmdNoAsyncLoading | cmdNoMulti,
+		group: "server", since: "2.8.0", summary: "An internal command used in replication."},
+	{name: "swapdb", run: swapdb, arity: 3, flags: cmdWrite | cmdFast, acl: aclKeyspace | aclDangerous,
+		group: "server", since: "4.0.0", summary: "Swaps two Redis databases."},
+	{name: "flushdb", run: flushdb, arity: -1, flags: cmdWrite, acl: aclKeyspace | aclDangerous,
+		tips:  []string{"request_policy:all_shards", "response_policy:all_succeeded"},
+		group: "server", since: "1.0.0", summary: "Remove all keys from the current database."},
+	{name: "flushall", run: flushall, arity: -1, flags: cmdWrite, acl: aclKeyspace | aclDangerous,
+		tips:  []string{"request_policy:all_shards", "response_policy:all_succeeded"},
+		group: "server", since: "1.0.0", summary: "Removes all keys from all databases."},
+	{name: "save", run: save, arity: 1, flags: cmdAdmin | cmdNoScript | cmdNoAsyncLoading | cmdNoMulti,
+		group: "server", since: "1.0.0", summary: "Synchronously saves the database(s) to disk."},
+	{name: "dbsize", run: dbsize, arity: 1, flags: cmdReadonly | cmdFast, acl: aclKeyspace,
+		tips:  []string{"request_policy:all_shards", "response_policy:agg_sum"},
+		group: "server", since: "1.0.0", summary: "Returns the number of keys in the database."},
+	{name: "memory", run: memory, arity: -2,
+		group: "server", since: "4.0.0", summary: "A container for memory diagnostics commands.",
+		subcommands: []*commandSpec{
+			{name: "doctor", arity: 2,
+				tips:  []string{"nondeterministic_output", "request_policy:all_shards", "response_policy:special"},
+				group: "server", since: "4.0.0", summary: "Outputs a memory problems report."},
+			{name: "stats", arity: 2,
+				tips:  []string{"nondeterministic_output", "request_policy:all_shards", "response_policy:special"},
+				group: "server", since: "4.0.0", summary: "Returns details about memory usage."},
+			{name: "usage", arity: -3, flags: cmdReadonly,
+				keySpecs: []keySpec{keyAt(2, "RO")},
+				group:    "server", since: "4.0.0", summary: "Estimates the memory usage of a key."},
+			{name: "help", arity: 2, flags: cmdLoading | cmdStale,
+				group: "server", since: "4.0.0", summary: "Returns helpful text about the different subcommands."},
+		}},
+	{name: "command", run: commandCmd, arity: -1, flags: cmdLoading | cmdStale, acl: aclConnection,
+		tips:  []string{"nondeterministic_output_order"},
+		group: "server", since: "2.8.13", summary: "Returns detailed information about all commands.",
+		subcommands: []*commandSpec{
+			{name: "count", arity: 2, flags: cmdLoading | cmdStale, acl: aclConnection,
+				group: "server", since: "2.8.13", summary: "Returns a count of commands."},
+			{name: "docs", arity: -2, flags: cmdLoading | cmdStale, acl: aclConnection,
+				tips:  []string{"nondeterministic_output_order"},
+				group: "server", since: "7.0.0", summary: "Returns documentary information about one, multiple or all commands."},
+			{name: "getkeys", arity: -3, flags: cmdLoading | cmdStale, acl: aclConnection,
+				group: "server", since: "2.8.13", summary: "Extracts the key names from an arbitrary command."},
+			{name: "info", arity: -2, flags: cmdLoading | cmdStale, acl: aclConnection,
+				tips:  []string{"nondeterministic_output_order"},
+				group: "server", since: "2.8.13", summary: "Returns information about one, multiple or all commands."},
+			{name: "list", arity: -2, flags: cmdLoading | cmdStale, acl: aclConnection,
+				tips:  []string{"nondeterministic_output_order"},
+				group: "server", since: "7.0.0", summary: "Returns a list of command names."},
+			{name: "help", arity: 2, flags: cmdLoading | cmdStale, acl: aclConnection,
+				group: "server", since: "5.0.0", summary: "Returns helpful text about the different subcommands."},
+		}},
+
+	// transactions
+	{name: "multi", run: multi, arity: 1, flags: cmdNoScript | cmdLoading | cmdStale | cmdFast | cmdAllowBusy, acl: aclTransaction,
+		group: "transactions", since: "1.2.0", summary: "Starts a transaction."},
+	{name: "exec", run: exec, arity: 1, flags: cmdNoScript | cmdLoading | cmdStale | cmdSkipSlowlog, acl: aclTransaction,
+		group: "transactions", since: "1.2.0", summary: "Executes all commands in a transaction."},
+	{name: "discard", run: discard, arity: 1, flags: cmdNoScript | cmdLoading | cmdStale | cmdFast | cmdAllowBusy, acl: aclTransaction,
+		group: "transactions", since: "2.0.0", summary: "Discards a transaction."},
+	{name: "watch", run: watch, arity: -2, flags: cmdNoScript | cmdLoading | cmdStale | cmdFast | cmdAllowBusy, acl: aclTransaction,
+		keySpecs: []keySpec{keysFrom(1, "RO")},
+		group:    "transactions", since: "2.2.0", summary: "Monitors changes to keys to determine the execution of a transaction."},
+	{name: "unwatch", run: unwatch, arity: 1, flags: cmdNoScript | cmdLoading | cmdStale | cmdFast | cmdAllowBusy, acl: aclTransaction,
+		group: "transactions", since: "2.2.0", summary: "Forgets about watched keys of a transaction."},
+
+	// pubsub
+	{name: "subscribe", run: subscribe, arity: -2, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale,
+		group: "pubsub", since: "2.0.0", summary: "Listens for messages published to channels."},
+	{name: "unsubscribe", run: unsubscribe, arity: -1, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale,
+		group: "pubsub", since: "2.0.0", summary: "Stops listening to messages posted to channels."},
+	{name: "psubscribe", run: psubscribe, arity: -2, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale,
+		group: "pubsub", since: "2.0.0", summary: "Listens for messages published to channels that match one or more patterns."},
+	{name: "punsubscribe", run: punsubscribe, arity: -1, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale,
+		group: "pubsub", since: "2.0.0", summary: "Stops listening to messages published to channels that match one or more patterns."},
+	{name: "publish", run: publish, arity: 3, flags: cmdPubSub | cmdLoading | cmdStale | cmdFast,
+		group: "pubsub", since: "2.0.0", summary: "Posts a message to a channel."},
+	{name: "ssubscribe", run: ssubscribe, arity: -2, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale,
+		keySpecs: []keySpec{keysFrom(1, "not_key")},
+		group:    "pubsub", since: "7.0.0", summary: "Listens for messages published to shard channels."},
+	{name: "sunsubscribe", run: sunsubscribe, arity: -1, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale,
+		keySpecs: []keySpec{keysFrom(1, "not_key")},
+		group:    "pubsub", since: "7.0.0", summary: "Stops listening to messages posted to shard channels."},
+	{name: "spublish", run: spublish, arity: 3, flags: cmdPubSub | cmdLoading | cmdStale | cmdFast,
+		keySpecs: []keySpec{keyAt(1, "not_key")},
+		group:    "pubsub", since: "7.0.0", summary: "Post a message to a shard channel"},
+	{name: "pubsub", run: pubsubCmd, arity: -2,
+		group: "pubsub", since: "2.8.0", summary: "A container for Pub/Sub commands.",
+		subcommands: []*commandSpec{
+			{name: "channels", arity: -2, flags: cmdPubSub | cmdLoading | cmdStale,
+				group: "pubsub", since: "2.8.0", summary: "Returns the active channels."},
+			{name: "numpat", arity: 2, flags: cmdPubSub | cmdLoading | cmdStale,
+				group: "pubsub", since: "2.8.0", summary: "Returns a count of unique pattern subscriptions."},
+			{name: "numsub", arity: -2, flags: cmdPubSub | cmdLoading | cmdStale,
+				group: "pubsub", since: "2.8.0", summary: "Returns a count of subscribers to channels."},
+			{name: "shardchannels", arity: -2, flags: cmdPubSub | cmdLoading | cmdStale,
+				group: "pubsub", since: "7.0.0", summary: "Returns the active shard channels."},
+			{name: "shardnumsub", arity: -2, flags: cmdPubSub | cmdLoading | cmdStale,
+				group: "pubsub", since: "7.0.0", summary: "Returns the count of subscribers of shard channels."},
+			{name: "help", arity: 2, flags: cmdLoading | cmdStale,
+				group: "pubsub", since: "6.2.0", summary: "Returns helpful text about the different subcommands."},
+		}},
+
+	// stream
+	{name: "xadd", run: xadd, arity: -5, flags: cmdWrite | cmdDenyOOM | cmdFast, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RW update")}, tips: []string{"nondeterministic_output"},
+		group: "stream", since: "5.0.0", summary: "Appends a new message to a stream. Creates the key if it doesn't exist."},
+	{name: "xlen", run: xlen, arity: 2, flags: cmdReadonly | cmdFast, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RO")},
+		group:    "stream", since: "5.0.0", summary: "Return the number of messages in a stream."},
+	{name: "xdel", run: xdel, arity: -3, flags: cmdWrite | cmdFast, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RW delete")},
+		group:    "stream", since: "5.0.0", summary: "Returns the number of messages after removing them from a stream."},
+	{name: "xtrim", run: xtrim, arity: -4, flags: cmdWrite, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RW delete")}, tips: []string{"nondeterministic_output"},
+		group: "stream", since: "5.0.0", summary: "Deletes messages from the beginning of a stream."},
+	{name: "xrange", run: xrange, arity: -4, flags: cmdReadonly, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RO access")},
+		group:    "stream", since: "5.0.0", summary: "Returns the messages from a stream within a range of IDs."},
+	{name: "xrevrange", run: xrevrange, arity: -4, flags: cmdReadonly, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RO access")},
+		group:    "stream", since: "5.0.0", summary: "Returns the messages from a stream within a range of IDs in reverse order."},
+	{name: "xread", run: xread, arity: -4, flags: cmdReadonly | cmdBlocking, acl: aclStream,
+		keySpecs: []keySpec{{flags: "RO access", keyword: "STREAMS", startFrom: 1, lastKey: -1, keyStep: 1, limit: 2}},
+		group:    "stream", since: "5.0.0", summary: "Returns messages from multiple streams with IDs greater than the ones requested. Blocks until a message is available otherwise."},
+	{name: "xreadgroup", run: xreadgroup, arity: -7, flags: cmdWrite | cmdBlocking, acl: aclStream,
+		keySpecs: []keySpec{{flags: "RW access update", keyword: "STREAMS", startFrom: 4, lastKey: -1, keyStep: 1, limit: 2}},
+		group:    "stream", since: "5.0.0", summary: "Returns new or historical messages from a stream for a consumer in a group. Blocks until a message is available otherwise."},
+	{name: "xgroup", run: xgroup, arity: -2,
+		group: "stream", since: "5.0.0", summary: "A container for consumer groups commands.",
+		subcommands: []*commandSpec{
+			{name: "create", arity: -5, flags: cmdWrite | cmdDenyOOM, acl: aclStream,
+				keySpecs: []keySpec{keyAt(2, "RW insert")},
+				group:    "stream", since: "5.0.0", summary: "Creates a consumer group."},
+			{name: "createconsumer", arity: 5, flags: cmdWrite | cmdDenyOOM, acl: aclStream,
+				keySpecs: []keySpec{keyAt(2, "RW insert")},
+				group:    "stream", since: "6.2.0", summary: "Creates a consumer in a consumer group."},
+			{name: "delconsumer", arity: 5, flags: cmdWrite, acl: aclStream,
+				keySpecs: []keySpec{keyAt(2, "RW delete")},
+				group:    "stream", since: "5.0.0", summary: "Deletes a consumer from a consumer group."},
+			{name: "destroy", arity: 4, flags: cmdWrite, acl: aclStream,
+				keySpecs: []keySpec{keyAt(2, "RW delete")},
+				group:    "stream", since: "5.0.0", summary: "Destroys a consumer group."},
+			{name: "setid", arity: -5, flags: cmdWrite, acl: aclStream,
+				keySpecs: []keySpec{keyAt(2, "RW update")},
+				group:    "stream", since: "5.0.0", summary: "Sets the last-delivered ID of a consumer group."},
+			{name: "help", arity: 2, flags: cmdLoading | cmdStale, acl: aclStream,
+				group: "stream", since: "5.0.0", summary: "Returns helpful text about the different subcommands."},
+		}},
+	{name: "xack", run: xack, arity: -4, flags: cmdWrite | cmdFast, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RW update")},
+		group:    "stream", since: "5.0.0", summary: "Returns the number of messages that were successfully acknowledged by the consumer group member of a stream."},
+	{name: "xpending", run: xpending, arity: -3, flags: cmdReadonly, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RO access")}, tips: []string{"nondeterministic_output"},
+		group: "stream", since: "5.0.0", summary: "Returns the information and entries from a stream consumer group's pending entries list."},
+	{name: "xclaim", run: xclaim, arity: -6, flags: cmdWrite | cmdFast, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RW update")}, tips: []string{"nondeterministic_output"},
+		group: "stream", since: "5.0.0", summary: "Changes, or acquires, ownership of a message in a consumer group, as if the message was delivered a consumer group member."},
+	{name: "xautoclaim", run: xautoclaim, arity: -6, flags: cmdWrite | cmdFast, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RW update")}, tips: []string{"nondeterministic_output"},
+		group: "stream", since: "6.2.0", summary: "Changes, or acquires, ownership of messages in a consumer group, as if the messages were delivered to as consumer group member."},
+	{name: "xinfo", run: xinfo, arity: -2,
+		group: "stream", since: "5.0.0", summary: "A container for stream introspection commands.",
+		subcommands: []*commandSpec{
+			{name: "consumers", arity: 4, flags: cmdReadonly, acl: aclStream,
+				keySpecs: []keySpec{keyAt(2, "RO access")}, tips: []string{"nondeterministic_output"},
+				group: "stream", since: "5.0.0", summary: "Returns a list of the consumers in a consumer group."},
+			{name: "groups", arity: 3, flags: cmdReadonly, acl: aclStream,
+				keySpecs: []keySpec{keyAt(2, "RO access")},
+				group:    "stream", since: "5.0.0", summary: "Returns a list of the consumer groups of a stream."},
+			{name: "stream", arity: -3, flags: cmdReadonly, acl: aclStream,
+				keySpecs: []keySpec{keyAt(2, "RO access")},
+				group:    "stream", since: "5.0.0", summary: "Returns information about a stream."},
+			{name: "help", arity: 2, flags: cmdLoading | cmdStale, acl: aclStream,
+				group: "stream", since: "5.0.0", summary: "Returns helpful text about the different subcommands."},
+		}},
+	{name: "xsetid", run: xsetid, arity: -3, flags: cmdWrite | cmdDenyOOM | cmdFast, acl: aclStream,
+		keySpecs: []keySpec{keyAt(1, "RW update")},
+		group:    "stream", since: "5.0.0", summary: "An internal command for replicating stream values."},
+}
@@ -86,3 +86,61 @@ func TestParseSetCommandFromRESP(t *testing.T) {
 	fmt.Println("raw string", string(command.Raw))
 	assert.EqualValues(t, Set, command.CommandType)
 }
+
+func TestParseBinaryBulkStringFromRESP(t *testing.T) {
+	raw := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$6\r\na\r\nb\x00c\r\n"
+	reader := bufio.NewReader(strings.NewReader(raw))
+	r, err := resp.ReadNextResp(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command, err := ParseCommandFromRESP(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, Set, command.CommandType)
+	assert.Equal(t, []byte("a\r\nb\x00c"), command.Args[1])
+	assert.Equal(t, raw, string(command.Raw))
+}
+
+func TestCommandTable(t *testing.T) {
+	for name, spec := range commandTable {
+		assert.EqualValues(t, name, spec.name)
+		assert.NotNil(t, spec.run, name)
+		assert.NotZero(t, spec.arity, name)
+		for _, sub := range spec.subcommands {
+			assert.Nil(t, sub.run, sub.fullName())
+			assert.NotZero(t, sub.arity, sub.fullName())
+			assert.Same(t, spec, sub.parent, sub.fullName())
+		}
+	}
+}
+
+func TestLegacyKeyRange(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		first, last, step int
+	}{
+		{"get", 1, 1, 1},
+		{"watch", 1, -1, 1},
+		{"ping", 0, 0, 0},
+		{"xread", 0, 0, 0},
+		{"object|encoding", 2, 2, 1},
+	} {
+		first, last, step := lookupCommandByName(tc.name).legacyKeyRange()
+		assert.Equal(t, []int{tc.first, tc.last, tc.step}, []int{first, last, step}, tc.name)
+	}
+}
+
+func TestParseRejectsHugeLengths(t *testing.T) {
+	for _, raw := range []string{
+		"$9999999999\r\n",
+		"*2\r\n$3\r\nGET\r\n$536870913\r\n",
+		"*9999999999\r\n",
+	} {
+		_, err := resp.ReadNextResp(bufio.NewReader(strings.NewReader(raw)))
+		var protoErr *resp.ProtocolError
+		assert.ErrorAs(t, err, &protoErr, raw)
+	}
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"bufio"
 	"net"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/internal"
 )
 
 type Batch struct {
@@ -19,6 +22,14 @@ type Connection struct {
 	reader  *bufio.Reader
 	isBatch bool
 	batch   *Batch
+	inExec  bool         // running the commands of a transaction, they mustn't block
+	db      *internal.DB // selected db, all commands of the connection work on it
+	dbIndex int
+	watch   *internal.Watch // keys WATCHed for the next EXEC, nil if none ever were
+
+	subs            [numSubKinds]map[string]struct{} // channels and patterns subscribed to
+	out             *outputBuffer                    // set once subscribed, all writes go through it
+	closeAfterReply bool                             // QUIT was sent
 }
 
 func NewConnection(id ConnectionID, conn net.Conn) *Connection {
@@ -30,11 +41,37 @@ func NewConnection(id ConnectionID, conn net.Conn) *Connection {
 	}
 }
 
+// Make the db at index the target of the following commands, false if it doesn't exist
+func (c *Connection) selectDB(s *Server, index int) bool {
+	if index < 0 || index >= len(s.dbs) {
+		return false
+	}
+	c.db = s.dbs[index]
+	c.dbIndex = index
+	return true
+}
+
+// Leave the MULTI state, forgetting the queued commands and the watched keys
+func (c *Connection) discardBatch() {
+	c.isBatch = false
+	c.batch = nil
+	c.unwatch()
+}
+
+func (c *Connection) unwatch() {
+	if c.watch != nil {
+		c.watch.Unwatch()
+	}
+}
+
 func (c *Connection) Close() error {
 	return c.conn.Close()
 }
 
 func (c *Connection) sendBytes(bytes []byte) error {
+	if c.out != nil {
+		return c.out.write(bytes)
+	}
 	_, err := c.conn.Write(bytes)
 	return err
 }
@@ -47,3 +84,122 @@ func (c *Connection) readResponse(buf []byte) ([]byte, error) {
 
 	return buf[:n], nil
 }
+
+// Output of a connection that others write to as well: the messages
+// published to a subscriber are only queued, written by whoever isn't
+// waiting on the connection already, so a slow subscriber never blocks
+// PUBLISH. Past limit bytes queued the connection is closed, like Redis'
+// client-output-buffer-limit for pubsub clients.
+type outputBuffer struct {
+	conn    net.Conn
+	limit   int64  // 0 for no limit
+	onLimit func() // called when the limit closes the connection
+
+	mu      sync.Mutex
+	queue   [][]byte
+	size    int64 // bytes in queue
+	writing bool  // a goroutine is writing, it goes on until the queue is empty
+	closed  bool
+}
+
+func newOutputBuffer(conn net.Conn, limit int64, onLimit func()) *outputBuffer {
+	return &outputBuffer{conn: conn, limit: limit, onLimit: onLimit}
+}
+
+// Queue b without waiting for it to be written
+func (o *outputBuffer) push(b []byte) {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return
+	}
+	o.queue = append(o.queue, b)
+	o.size += int64(len(b))
+	if o.limit > 0 && o.size > o.limit {
+		o.closeLocked()
+		o.mu.Unlock()
+		o.onLimit()
+		return
+	}
+	start := !o.writing
+	o.writing = true
+	o.mu.Unlock()
+
+	if start {
+		go o.flush()
+	}
+}
+
+// Write a reply of the connection itself after what's queued. It's written
+// right away when nothing else is, the connection's goroutine can wait.
+func (o *outputBuffer) write(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	if o.writing {
+		o.queue = append(o.queue, b)
+		o.size += int64(len(b))
+		o.mu.Unlock()
+		return nil
+	}
+	o.writing = true
+	o.mu.Unlock()
+
+	_, err := o.conn.Write(b)
+	if err != nil {
+		o.close()
+		return err
+	}
+	o.mu.Lock()
+	if len(o.queue) == 0 {
+		o.writing = false
+		o.mu.Unlock()
+		return nil
+	}
+	o.mu.Unlock()
+	// Messages were queued meanwhile, the connection goes on reading commands
+	go o.flush()
+	return nil
+}
+
+// Write the queue until it's empty, the caller set o.writing
+func (o *outputBuffer) flush() {
+	for {
+		o.mu.Lock()
+		if o.closed || len(o.queue) == 0 {
+			o.writing = false
+			o.mu.Unlock()
+			return
+		}
+		bufs := net.Buffers(o.queue)
+		o.queue, o.size = nil, 0
+		o.mu.Unlock()
+
+		if _, err := bufs.WriteTo(o.conn); err != nil {
+			o.close()
+			return
+		}
+	}
+}
+
+func (o *outputBuffer) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closeLocked()
+}
+
+// Closing the connection also ends its read loop, which unsubscribes it
+func (o *outputBuffer) closeLocked() {
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.writing = false
+	o.queue, o.size = nil, 0
+	o.conn.Close()
+}
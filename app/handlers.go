@@ -4,7 +4,8 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
-	"path/filepath"
+	"math"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -20,99 +21,237 @@ const (
 	PONG       = "PONG"
 	QUEUED     = "QUEUED"
 	FULLRESYNC = "FULLRESYNC"
+	WRONGTYPE  = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	OOM        = "OOM command not allowed when used memory > 'maxmemory'."
 	EMPTY_FILE = "524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2"
 )
 
 type commandHandler func(*Server, *Connection, *Command) ([]byte, error)
 
-var commandHandlersMap = map[CommandType]commandHandler{
-	Ping:     ping,
-	Echo:     echo,
-	Set:      set,
-	Get:      get,
-	Info:     info,
-	Wait:     wait,
-	Config:   config,
-	ReplConf: replConf,
-	Psync:    psync,
-	Keys:     keys,
-	Incr:     incr,
-	Multi:    multi,
-	Exec:     exec,
-	Discard:  discard,
-	Type:     keytype,
-	XAdd:     xadd,
-	XRange:   xrange,
-	XRead:    xread,
+// Commands propagated to replicas besides the write commands of the table,
+// so the clients of the replicas get the messages too
+var propagatedNonWrites = map[CommandType]bool{
+	Publish:  true,
+	SPublish: true,
+}
+
+// Commands that run right away inside MULTI instead of being queued
+var notQueuedCommands = map[CommandType]bool{
+	Multi:   true,
+	Exec:    true,
+	Discard: true,
+	Watch:   true,
+	Quit:    true,
+	Reset:   true,
+}
+
+// Commands that can run in the subscribed mode
+var subscribedModeCommands = map[CommandType]bool{
+	Subscribe:    true,
+	Unsubscribe:  true,
+	PSubscribe:   true,
+	PUnsubscribe: true,
+	SSubscribe:   true,
+	SUnsubscribe: true,
+	Ping:         true,
+	Quit:         true,
+	Reset:        true,
 }
 
 func HandleCommand(s *Server, c *Connection, cmd *Command) error {
-	handler, err := resolveHandler(cmd.CommandType)
+	bytes, err := processCommand(s, c, cmd)
 	if err != nil {
-		handler = unknown
-		if c.isBatch {
-			c.batch.isError = true
-		}
+		return err
+	}
+
+	// Replicas don't reply to the propagated writes, only to REPLCONF GETACK
+	if isFromMaster(s, c) && cmd.CommandType != ReplConf {
+		bytes = nil
+	}
+
+	err = c.sendBytes(bytes)
+	if err == nil && isFromMaster(s, c) {
+		log.Printf("Received %v bytes from master:", len(cmd.Raw))
+		// s.mu.Lock() // Don't need to lock cause a connection is handled sequentially
+		s.asSlave.offset += int64(len(cmd.Raw))
+		// s.mu.Unlock()
+	}
+	return err
+}
+
+// Run cmd, or queue it inside MULTI, and propagate it to the replicas,
+// returning its reply. s.cmdMu is held meanwhile so the replicas get the
+// writes in the order they ran, but not while replying: a client that
+// doesn't read its replies would hold up every other one.
+func processCommand(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	// A transaction runs alone, other commands only keep transactions out
+	if c.isBatch && cmd.CommandType == Exec {
+		s.cmdMu.Lock()
+		defer s.cmdMu.Unlock()
+	} else {
+		s.cmdMu.RLock()
+		defer s.cmdMu.RUnlock()
 	}
 
-	// Queue the command if this is a batch
-	if c.isBatch && cmd.CommandType != Exec && cmd.CommandType != Discard {
-		c.batch.handlerQueue = append(c.batch.handlerQueue, handler)
+	if reply := rejectCommand(s, c, cmd); reply != nil {
+		return reply, nil
+	}
+	if c.isBatch && !notQueuedCommands[cmd.CommandType] {
+		c.batch.handlerQueue = append(c.batch.handlerQueue, cmd.spec.handler())
 		c.batch.commandQueue = append(c.batch.commandQueue, cmd)
-		_, err := c.conn.Write(resp.EncodeSimpleString(QUEUED))
-		return err
+		return resp.EncodeSimpleString(QUEUED), nil
 	}
 
+	handler := cmd.spec.handler()
 	bytes, err := handler(s, c, cmd)
-
 	if err != nil {
-		return fmt.Errorf("error handling command %v: %w", cmd.CommandType, err)
+		return nil, fmt.Errorf("error handling command %v: %w", cmd.CommandType, err)
 	}
+	maybeReplicateCommand(s, c, cmd, bytes)
+	return bytes, nil
+}
 
-	// Nothing to propagate, the handler has handled everything
-	// if len(bytes) == 0 {
-	// 	return nil
-	// }
+// Error reply for a command that can't run: unknown, with a wrong number of
+// arguments, not allowed in the subscribed mode or in a transaction, or denied
+// for lack of memory. Inside MULTI the transaction is discarded at EXEC. nil if cmd can run, with
+// cmd.spec set.
+func rejectCommand(s *Server, c *Connection, cmd *Command) []byte {
+	spec, reply := lookupCommand(cmd)
+	if reply == nil && c.subscribed() && !subscribedModeCommands[cmd.CommandType] {
+		reply = resp.EncodeError(fmt.Sprintf("Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", spec.fullName()))
+	}
+	if reply == nil && c.isBatch && spec.flags&cmdNoMulti != 0 {
+		reply = resp.EncodeError("Command not allowed inside a transaction")
+	}
+	if reply != nil {
+		if c.isBatch {
+			c.batch.isError = true
+		}
+		return reply
+	}
+	cmd.spec = spec
+	return rejectOOM(s, c, cmd)
+}
 
-	_, err = c.conn.Write(bytes)
-	if err == nil {
-		maybeReplicateCommand(s, cmd)
+// Evict keys if the dataset is over maxmemory, then return the OOM error
+// reply if cmd can't run because memory is still over the limit
+func rejectOOM(s *Server, c *Connection, cmd *Command) []byte {
+	// Replicas apply whatever their master sends
+	if isFromMaster(s, c) {
+		return nil
+	}
 
-		if isFromMaster(s, c) {
-			log.Printf("Received %v bytes from master:", len(cmd.Raw))
-			// s.mu.Lock() // Don't need to lock cause a connection is handled sequentially
-			s.asSlave.offset += int64(len(cmd.Raw))
-			// s.mu.Unlock()
+	evicted, ok := s.evictor.PerformEvictions()
+	if s.isMaster {
+		for _, k := range evicted {
+			del := &Command{CommandType: Del, Raw: resp.EncodeArrayBulkStrings([]string{"DEL", k.Key})}
+			propagate(s, k.DB, del)
 		}
 	}
-	return err
+	if ok {
+		return nil
+	}
+
+	switch {
+	case c.isBatch && cmd.CommandType == Exec:
+		for _, queued := range c.batch.commandQueue {
+			if queued.spec.flags&cmdDenyOOM != 0 {
+				c.discardBatch()
+				return resp.EncodeErrorNoPrefix("EXECABORT Transaction discarded because of: " + OOM)
+			}
+		}
+	case c.isBatch && cmd.CommandType != Discard:
+		// Don't let the queue grow either
+		c.batch.isError = true
+		return resp.EncodeErrorNoPrefix(OOM)
+	case cmd.spec.flags&cmdDenyOOM != 0:
+		return resp.EncodeErrorNoPrefix(OOM)
+	}
+	return nil
 }
 
-func resolveHandler(cmd CommandType) (commandHandler, error) {
-	if f, ok := commandHandlersMap[cmd]; ok {
-		return f, nil
+// Propagate cmd unless its reply is an error, a command that failed changed nothing
+func maybeReplicateCommand(s *Server, c *Connection, cmd *Command, reply []byte) {
+	if propagates(s, cmd, reply) {
+		propagate(s, c.dbIndex, cmd)
 	}
-	return nil, fmt.Errorf("unknown command type: %v", cmd)
 }
 
-func maybeReplicateCommand(s *Server, cmd *Command) {
-	if cmd.CommandType == Set && s.isMaster {
-		// FOR NOW: master's repl offset increases with each write command
-		s.mu.Lock()
-		s.asMaster.repl_offset += int64(len(cmd.Raw))
+// Whether cmd, which replied reply, is sent to the replicas
+func propagates(s *Server, cmd *Command, reply []byte) bool {
+	if len(reply) > 0 && reply[0] == byte(resp.ERROR) {
+		return false
+	}
+	propagated := cmd.spec.flags&cmdWrite != 0 || propagatedNonWrites[cmd.CommandType]
+	return propagated && s.isMaster
+}
+
+// A write of a transaction, with the db it ran against
+type propagatedWrite struct {
+	dbIndex int
+	cmd     *Command
+}
+
+// Send cmd to the replicas as a write to the db at dbIndex
+func propagate(s *Server, dbIndex int, cmd *Command) {
+	raw := cmd.propagatedRaw()
+	if len(raw) == 0 {
+		return
+	}
+
+	// FOR NOW: master's repl offset increases with each write command
+	s.mu.Lock()
+	raw = withSelect(s, dbIndex, raw)
+	s.asMaster.repl_offset += int64(len(raw))
+	s.mu.Unlock()
+
+	replicateAll(s, cmd, raw)
+}
+
+// Send the writes that ran in a transaction to the replicas wrapped in
+// MULTI/EXEC, so they apply them all at once too
+func propagateTransaction(s *Server, exec *Command, writes []propagatedWrite) {
+	var raw []byte
+	s.mu.Lock()
+	for _, w := range writes {
+		if cmdRaw := w.cmd.propagatedRaw(); len(cmdRaw) > 0 {
+			raw = append(raw, withSelect(s, w.dbIndex, cmdRaw)...)
+		}
+	}
+	if len(raw) == 0 {
 		s.mu.Unlock()
+		return
+	}
+	raw = append(resp.EncodeArrayBulkStrings([]string{"MULTI"}), raw...)
+	raw = append(raw, resp.EncodeArrayBulkStrings([]string{"EXEC"})...)
+	s.asMaster.repl_offset += int64(len(raw))
+	s.mu.Unlock()
 
-		if len(s.asMaster.slaves) > 0 {
-			log.Println("Replicating command to", len(s.asMaster.slaves), "slaves")
-			for _, slave := range s.asMaster.slaves {
-				go replicate(slave, cmd)
-			}
+	replicateAll(s, exec, raw)
+}
+
+// Replicas apply commands to the db selected in the stream, prepend a SELECT
+// to raw when it was run against another db. The caller holds s.mu.
+func withSelect(s *Server, dbIndex int, raw []byte) []byte {
+	if s.asMaster.selectedDB == dbIndex {
+		return raw
+	}
+	s.asMaster.selectedDB = dbIndex
+	selectCmd := resp.EncodeArrayBulkStrings([]string{"SELECT", strconv.Itoa(dbIndex)})
+	return append(selectCmd, raw...)
+}
+
+func replicateAll(s *Server, cmd *Command, raw []byte) {
+	if len(s.asMaster.slaves) > 0 {
+		log.Println("Replicating command to", len(s.asMaster.slaves), "slaves")
+		for _, slave := range s.asMaster.slaves {
+			go replicate(slave, cmd, raw)
 		}
 	}
 }
 
-func replicate(slave *Slave, command *Command) (int, error) {
-	n, err := slave.connection.conn.Write(command.Raw)
+func replicate(slave *Slave, command *Command, raw []byte) (int, error) {
+	n, err := slave.connection.conn.Write(raw)
 	if err != nil {
 		log.Printf("Error replicating %v to %v: %v\n", command.CommandType, slave.connection.conn.RemoteAddr(), err)
 	} else {
@@ -130,22 +269,30 @@ func ping(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 	if isFromMaster(s, c) {
 		return nil, nil // Master connection -> do nothing
 	}
+	if len(cmd.Args) > 1 {
+		return resp.EncodeError("wrong number of arguments for 'ping' command"), nil
+	}
+
+	// Subscribers tell replies from messages by their shape
+	if c.subscribed() {
+		message := ""
+		if len(cmd.Args) == 1 {
+			message = string(cmd.Args[0])
+		}
+		return resp.EncodeArrayBulkStrings([]string{"pong", message}), nil
+	}
+	if len(cmd.Args) == 1 {
+		return resp.EncodeBulkString(string(cmd.Args[0])), nil
+	}
 	return resp.EncodeSimpleString(PONG), nil
 }
 
 func echo(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) != 1 {
-		return resp.EncodeError("wrong number of arguments for 'echo' command"), nil
-	}
 	return resp.EncodeBulkString(string(cmd.Args[0])), nil
 }
 
 func get(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) < 1 {
-		return resp.EncodeError(fmt.Sprintf("wrong number of arguments for GET: %v", len(cmd.Args))), nil
-	}
-
-	v, err := s.db.StringGet(string(cmd.Args[0]))
+	v, err := c.db.StringGet(string(cmd.Args[0]))
 	if err != nil {
 		switch e := err.(type) {
 		case *internal.KeyNotFoundError:
@@ -167,10 +314,10 @@ func get(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 
 func set(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 	if len(cmd.Args) != 2 && len(cmd.Args) != 4 {
-		return resp.EncodeError(fmt.Sprintf("wrong number of arguments for SET: %v", len(cmd.Args))), nil
+		return resp.EncodeError("syntax error"), nil
 	}
 
-	err := setInternal(s, cmd)
+	err := setInternal(c, cmd)
 	if isFromMaster(s, c) {
 		// No need to respond to the master
 		return nil, err
@@ -182,27 +329,27 @@ func set(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 	return resp.EncodeSimpleString(OK), nil
 }
 
-func setInternal(s *Server, cmd *Command) error {
+func setInternal(c *Connection, cmd *Command) error {
 	key := string(cmd.Args[0])
 	val := cmd.Args[1]
-	var expiryMilis int64 = s.db.Options.ExpiryTime
+	var expiryMilis int64 = c.db.Options.DefaultTTLMilli
 
 	// resolve expiry
 	if len(cmd.Args) == 4 {
 		expiryType := ToLowerString(cmd.Args[2])
-		expiryNum, err := strconv.ParseInt(string(cmd.Args[3]), 10, 64)
-		if err != nil {
-			return err
+		expiryNum, ok := internal.ParseInt64(cmd.Args[3])
+		if !ok {
+			return fmt.Errorf("value is not an integer or out of range")
 		}
 
-		expiryNum, err = resolveExpiry(expiryType, expiryNum)
+		expiryNum, err := resolveExpiry(expiryType, expiryNum)
 		if err != nil {
 			return err
 		}
 		expiryMilis = expiryNum
 	}
 
-	s.db.StringSet(key, val, expiryMilis)
+	c.db.StringSet(key, val, expiryMilis)
 	return nil
 }
 
@@ -217,29 +364,37 @@ func resolveExpiry(expiryType string, expiryNum int64) (int64, error) {
 	}
 }
 
-func config(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) == 0 {
-		return resp.EncodeError("wrong number of arguments for CONFIG commands"), nil
-	}
-
-	subCmd := ToLowerString(cmd.Args[0])
-	if subCmd == "get" {
-		if len(cmd.Args) != 2 {
-			return resp.EncodeError("wrong number of arguments for CONFIG GET"), nil
-		}
+var configHelp = []string{
+	"CONFIG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"GET <parameter>",
+	"    Return the parameter and its value.",
+	"HELP",
+	"    Print this help.",
+}
 
-		subCmd1 := ToLowerString(cmd.Args[1])
-		switch subCmd1 {
-		case "dir":
-			return resp.EncodeArrayBulkStrings([]string{"dir", s.db.Options.Dir}), nil
-		case "dbfilename":
-			return resp.EncodeArrayBulkStrings([]string{"dbfilename", s.db.Options.DbFilename}), nil
-		default:
-			return resp.EncodeError("unknown CONFIG parameter"), nil
-		}
+func config(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	if cmd.spec.name == "help" {
+		return encodeHelp(configHelp), nil
+	}
+
+	switch ToLowerString(cmd.Args[1]) {
+	case "dir":
+		return resp.EncodeArrayBulkStrings([]string{"dir", s.options.Dir}), nil
+	case "dbfilename":
+		return resp.EncodeArrayBulkStrings([]string{"dbfilename", s.options.DbFilename}), nil
+	case "maxmemory":
+		return resp.EncodeArrayBulkStrings([]string{"maxmemory", strconv.FormatInt(s.evictor.MaxMemory, 10)}), nil
+	case "maxmemory-policy":
+		return resp.EncodeArrayBulkStrings([]string{"maxmemory-policy", s.evictor.Policy.String()}), nil
+	case "maxmemory-samples":
+		return resp.EncodeArrayBulkStrings([]string{"maxmemory-samples", strconv.Itoa(s.evictor.Samples)}), nil
+	case "databases":
+		return resp.EncodeArrayBulkStrings([]string{"databases", strconv.Itoa(s.options.Databases)}), nil
+	case "default-ttl-ms":
+		return resp.EncodeArrayBulkStrings([]string{"default-ttl-ms", strconv.FormatInt(s.options.DefaultTTLMilli, 10)}), nil
+	default:
+		return resp.EncodeError("unknown CONFIG parameter"), nil
 	}
-
-	return resp.EncodeError("unknown CONFIG subcommand"), nil
 }
 
 func wait(s *Server, c *Connection, cmd *Command) ([]byte, error) {
@@ -247,10 +402,6 @@ func wait(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 		return resp.EncodeError("only available in master mode"), nil
 	}
 
-	if len(cmd.Args) != 2 {
-		return resp.EncodeError("wrong number of arguments for WAIT"), nil
-	}
-
 	numRepls, err := strconv.Atoi(string(cmd.Args[0]))
 	if err != nil {
 		return resp.EncodeError("Innalid numreplicas of arguments for WAIT"), nil
@@ -261,6 +412,14 @@ func wait(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 		return resp.EncodeError("Innalid timeout of arguments for WAIT"), nil
 	}
 	log.Println("numRepls:", numRepls, "timeout:", timeout)
+	if c.inExec {
+		// Transactions don't wait, count the replicas that acked already
+		numRepls = 0
+	} else {
+		// Other clients go on while waiting for the replicas
+		s.cmdMu.RUnlock()
+		defer s.cmdMu.RLock()
+	}
 	cnt := countReplicasAcked(s.asMaster, numRepls, timeout)
 	return resp.EncodeInterger(int64(cnt)), nil
 }
@@ -298,8 +457,38 @@ func countReplicasAcked(m AsMasterInfo, numRepls int, timeoutMilis int) int {
 }
 
 func info(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	var infos []string = make([]string, 0, 4)
+	sections := []struct {
+		name  string
+		lines func(s *Server) []string
+	}{
+		{"memory", infoMemory},
+		{"replication", infoReplication},
+		{"stats", infoStats},
+		{"keyspace", infoKeyspace},
+	}
+
+	requested := make(map[string]bool, len(cmd.Args))
+	for _, arg := range cmd.Args {
+		requested[ToLowerString(arg)] = true
+	}
+	all := len(requested) == 0 || requested["all"] || requested["default"] || requested["everything"]
+
+	var infos []string = make([]string, 0, 8)
+	for _, section := range sections {
+		if !all && !requested[section.name] {
+			continue
+		}
+		if len(infos) > 0 {
+			infos = append(infos, "")
+		}
+		infos = append(infos, "# "+strings.ToUpper(section.name[:1])+section.name[1:])
+		infos = append(infos, section.lines(s)...)
+	}
+
+	return resp.EncodeBulkString(strings.Join(infos, "\n")), nil
+}
 
+func infoReplication(s *Server) []string {
 	var role string
 	if s.isMaster {
 		role = "master"
@@ -307,13 +496,8 @@ func info(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 		role = "slave"
 	}
 
-	infos = append(infos,
-		"role:"+role,
-	)
-
-	if len(cmd.Args) > 0 {
-		// TODO: add more info
-		log.Println("TODO: add more info for cmd.Agrs:", cmd.Args)
+	infos := []string{
+		"role:" + role,
 	}
 
 	if s.isMaster {
@@ -322,8 +506,491 @@ func info(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 			"master_repl_offset:"+strconv.FormatInt(s.asMaster.repl_offset, 10),
 		)
 	}
+	return infos
+}
+
+func infoStats(s *Server) []string {
+	var expiredKeys int64
+	for _, db := range s.dbs {
+		expiredKeys += db.ExpiredKeys()
+	}
+	stalePerc := math.Float64frombits(s.stats.expiredStalePerc.Load()) * 100
+	return []string{
+		"expired_keys:" + strconv.FormatInt(expiredKeys, 10),
+		"expired_stale_perc:" + strconv.FormatFloat(stalePerc, 'f', 2, 64),
+		"evicted_keys:" + strconv.FormatInt(s.evictor.EvictedKeys(), 10),
+		"pubsub_channels:" + strconv.Itoa(s.pubsub.count(subChannel)),
+		"pubsub_patterns:" + strconv.Itoa(s.pubsub.count(subPattern)),
+		"pubsubshard_channels:" + strconv.Itoa(s.pubsub.count(subShard)),
+		"client_output_buffer_limit_disconnections:" + strconv.FormatInt(s.stats.outputLimitDisconnections.Load(), 10),
+	}
+}
 
-	return resp.EncodeBulkString(strings.Join(infos, "\n")), nil
+// used_memory only estimates the keys and values, it's what maxmemory is compared with
+func infoMemory(s *Server) []string {
+	return []string{
+		"used_memory:" + strconv.FormatInt(s.evictor.UsedMemory(), 10),
+		"maxmemory:" + strconv.FormatInt(s.evictor.MaxMemory, 10),
+		"maxmemory_policy:" + s.evictor.Policy.String(),
+	}
+}
+
+// One line per non empty db
+func infoKeyspace(s *Server) []string {
+	infos := make([]string, 0)
+	for idx, db := range s.dbs {
+		keys, expires := db.KeyspaceStats()
+		if keys == 0 {
+			continue
+		}
+		infos = append(infos, fmt.Sprintf("db%d:keys=%d,expires=%d", idx, keys, expires))
+	}
+	return infos
+}
+
+const (
+	lfuPolicyNotSelected = "An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."
+	lfuPolicySelected    = "An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."
+)
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+func object(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	subCmd := cmd.spec.name
+	if subCmd == "help" {
+		return encodeHelp(objectHelp), nil
+	}
+
+	obj, err := c.db.Object(string(cmd.Args[1]))
+	if err != nil {
+		if _, ok := err.(internal.KeyError); ok {
+			return resp.EncodeNullBulkString(), nil
+		}
+		return encodeDBError(err), nil
+	}
+
+	switch subCmd {
+	case "encoding":
+		return resp.EncodeBulkString(obj.Encoding), nil
+	case "idletime":
+		if s.evictor.Policy.IsLFU() {
+			return resp.EncodeError(lfuPolicySelected), nil
+		}
+		return resp.EncodeInterger(obj.IdleSeconds), nil
+	case "freq":
+		if !s.evictor.Policy.IsLFU() {
+			return resp.EncodeError(lfuPolicyNotSelected), nil
+		}
+		return resp.EncodeInterger(int64(obj.Freq)), nil
+	default:
+		// Values are never shared between keys
+		return resp.EncodeInterger(1), nil
+	}
+}
+
+var memoryHelp = []string{
+	"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"DOCTOR",
+	"    Return memory problems reports.",
+	"STATS",
+	"    Return information about the memory usage of the server.",
+	"USAGE <key> [SAMPLES <count>]",
+	"    Return memory in bytes used by <key> and its value. Nested values are",
+	"    sampled up to <count> times (default: 5, 0 means sample all).",
+	"HELP",
+	"    Print this help.",
+}
+
+func memory(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	switch cmd.spec.name {
+	case "usage":
+		return memoryUsage(c, cmd), nil
+	case "stats":
+		return encodeMemoryStats(memoryStats(s)), nil
+	case "doctor":
+		return resp.EncodeBulkString(memoryDoctor(s)), nil
+	default:
+		return encodeHelp(memoryHelp), nil
+	}
+}
+
+// Values keep track of their size as they change, so SAMPLES is validated
+// but the estimate is always over the whole value
+func memoryUsage(c *Connection, cmd *Command) []byte {
+	args := cmd.Args[2:]
+	for len(args) > 0 {
+		if ToLowerString(args[0]) != "samples" || len(args) < 2 {
+			return resp.EncodeError("syntax error")
+		}
+		samples, ok := internal.ParseInt64(args[1])
+		if !ok {
+			return resp.EncodeError("value is not an integer or out of range")
+		}
+		if samples < 0 {
+			return resp.EncodeError("syntax error")
+		}
+		args = args[2:]
+	}
+
+	obj, err := c.db.Object(string(cmd.Args[1]))
+	if err != nil {
+		if _, ok := err.(internal.KeyError); ok {
+			return resp.EncodeNullBulkString()
+		}
+		return encodeDBError(err)
+	}
+	return resp.EncodeInterger(obj.MemoryUsage)
+}
+
+type dbMemoryStats struct {
+	index    int
+	overhead internal.HashtableOverhead
+}
+
+type memoryStatsReport struct {
+	peakAllocated  int64
+	totalAllocated int64
+	overheadTotal  int64 // heap that isn't the dataset
+	keys           int
+	datasetBytes   int64 // the keys and values, with their hash tables
+	dbs            []dbMemoryStats
+}
+
+func memoryStats(s *Server) memoryStatsReport {
+	r := memoryStatsReport{totalAllocated: s.allocatedMemory()}
+	r.peakAllocated = s.stats.peakAllocated.Load()
+	for idx, db := range s.dbs {
+		keys, _ := db.KeyspaceStats()
+		if keys == 0 {
+			continue
+		}
+		overhead := db.HashtableOverhead()
+		r.keys += keys
+		r.datasetBytes += db.UsedMemory() + overhead.Main + overhead.Expires
+		r.dbs = append(r.dbs, dbMemoryStats{index: idx, overhead: overhead})
+	}
+	r.overheadTotal = max(r.totalAllocated-r.datasetBytes, 0)
+	return r
+}
+
+func encodeMemoryStats(r memoryStatsReport) []byte {
+	var bytesPerKey int64
+	if r.keys > 0 {
+		bytesPerKey = r.datasetBytes / int64(r.keys)
+	}
+	var datasetPerc float64
+	if r.totalAllocated > 0 {
+		datasetPerc = float64(r.datasetBytes) / float64(r.totalAllocated) * 100
+	}
+
+	reply := [][]byte{
+		resp.EncodeBulkString("peak.allocated"), resp.EncodeInterger(r.peakAllocated),
+		resp.EncodeBulkString("total.allocated"), resp.EncodeInterger(r.totalAllocated),
+		resp.EncodeBulkString("overhead.total"), resp.EncodeInterger(r.overheadTotal),
+		resp.EncodeBulkString("keys.count"), resp.EncodeInterger(int64(r.keys)),
+		resp.EncodeBulkString("keys.bytes-per-key"), resp.EncodeInterger(bytesPerKey),
+		resp.EncodeBulkString("dataset.bytes"), resp.EncodeInterger(r.datasetBytes),
+		resp.EncodeBulkString("dataset.percentage"), resp.EncodeBulkString(strconv.FormatFloat(datasetPerc, 'f', -1, 64)),
+	}
+	for _, db := range r.dbs {
+		reply = append(reply,
+			resp.EncodeBulkString(fmt.Sprintf("db.%d", db.index)),
+			resp.EncodeArray([][]byte{
+				resp.EncodeBulkString("overhead.hashtable.main"), resp.EncodeInterger(db.overhead.Main),
+				resp.EncodeBulkString("overhead.hashtable.expires"), resp.EncodeInterger(db.overhead.Expires),
+			}),
+		)
+	}
+	return resp.EncodeArray(reply)
+}
+
+const doctorEmptyThreshold = 5 << 20 // bytes of heap under which there's nothing to diagnose
+
+// Plain text report of the memory issues spotted in the stats, like Redis' MEMORY DOCTOR
+func memoryDoctor(s *Server) string {
+	r := memoryStats(s)
+	if r.totalAllocated < doctorEmptyThreshold {
+		return "Hi Sam, this instance is empty or is using very little memory, my issues detector can't be used in these conditions. Please, leave for your mission on Earth and fill it with some data. The new Sam and I will be back to our programming as soon as I finished rebooting.\n"
+	}
+
+	var issues []string
+	if r.peakAllocated > r.totalAllocated*3/2 {
+		issues = append(issues, " * Peak memory: In the past this instance used more than 150% the memory that is currently using. The runtime doesn't return freed memory to the system right away, so the process may look bigger than the dataset for a while. This is harmless, the memory will be reused as soon as you fill the instance with more data.")
+	}
+	if r.totalAllocated > 0 && r.datasetBytes*2 < r.totalAllocated && r.keys > 0 {
+		issues = append(issues, " * High overhead: less than half of the memory in use holds the dataset. This is expected with many small keys, or after big values were deleted and the garbage collector didn't run yet.")
+	}
+	if s.evictor.MaxMemory > 0 && s.evictor.Policy == internal.NoEviction && s.evictor.UsedMemory()*10 >= s.evictor.MaxMemory*9 {
+		issues = append(issues, " * Near maxmemory: the dataset uses 90% or more of maxmemory and the policy is noeviction, so writes will soon be refused with an OOM error. Consider raising maxmemory or picking an eviction policy.")
+	}
+
+	if len(issues) == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. I can only account for what occurs on this base.\n"
+	}
+	return "Sam, I detected a few issues in this Redis instance memory implants:\n\n" +
+		strings.Join(issues, "\n\n") +
+		"\n\nI'm here to keep you safe, Sam. I want to help you.\n"
+}
+
+// Reply of the HELP subcommands, one simple string per line
+var commandHelp = []string{
+	"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"(no subcommand)",
+	"    Return details about all commands.",
+	"COUNT",
+	"    Return the total number of commands in this server.",
+	"LIST [FILTERBY (MODULE <module-name>|ACLCAT <category>|PATTERN <pattern>)]",
+	"    Return a list of all commands in this server.",
+	"INFO [<command-name> ...]",
+	"    Return details about multiple commands.",
+	"    If no command names are given, details about all commands are returned.",
+	"DOCS [<command-name> ...]",
+	"    Return documentation details about multiple commands.",
+	"    If no command names are given, documentation details for all",
+	"    commands are returned.",
+	"GETKEYS <full-command>",
+	"    Return the keys from a full command.",
+	"HELP",
+	"    Print this help.",
+}
+
+// COMMAND [COUNT | DOCS | GETKEYS | INFO | LIST | HELP]
+func commandCmd(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	if len(cmd.Args) == 0 {
+		return encodeCommandInfos(sortedCommandSpecs()), nil
+	}
+
+	args := cmd.Args[1:]
+	switch cmd.spec.name {
+	case "count":
+		return resp.EncodeInterger(int64(len(commandTable))), nil
+	case "info":
+		if len(args) == 0 {
+			return encodeCommandInfos(sortedCommandSpecs()), nil
+		}
+		infos := make([][]byte, len(args))
+		for i, name := range args {
+			if spec := lookupCommandByName(string(name)); spec != nil {
+				infos[i] = encodeCommandInfo(spec)
+			} else {
+				infos[i] = resp.EncodeNullBulkString()
+			}
+		}
+		return resp.EncodeArray(infos), nil
+	case "docs":
+		specs := sortedCommandSpecs()
+		if len(args) > 0 {
+			// Unknown names are left out
+			specs = specs[:0]
+			for _, name := range args {
+				if spec := lookupCommandByName(string(name)); spec != nil {
+					specs = append(specs, spec)
+				}
+			}
+		}
+		docs := make([][]byte, 0, 2*len(specs))
+		for _, spec := range specs {
+			docs = append(docs, resp.EncodeBulkString(spec.fullName()), encodeCommandDocs(spec))
+		}
+		return resp.EncodeArray(docs), nil
+	case "list":
+		return commandList(args), nil
+	case "getkeys":
+		return commandGetKeys(args), nil
+	default:
+		return encodeHelp(commandHelp), nil
+	}
+}
+
+// COMMAND LIST [FILTERBY MODULE name | ACLCAT category | PATTERN pattern]
+func commandList(args [][]byte) []byte {
+	match := func(*commandSpec) bool { return true }
+	switch {
+	case len(args) == 0:
+	case len(args) == 3 && ToLowerString(args[0]) == "filterby":
+		arg := string(args[2])
+		switch ToLowerString(args[1]) {
+		case "module":
+			// There are no modules
+			return resp.EncodeArray(nil)
+		case "aclcat":
+			i := slices.Index(aclCategoryNames, strings.ToLower(arg))
+			if i < 0 {
+				return resp.EncodeArray(nil)
+			}
+			match = func(spec *commandSpec) bool { return spec.acl&(1<<i) != 0 }
+		case "pattern":
+			match = func(spec *commandSpec) bool { return internal.GlobMatch(arg, spec.fullName(), true) }
+		default:
+			return resp.EncodeError("syntax error")
+		}
+	default:
+		return resp.EncodeError("syntax error")
+	}
+
+	var names []string
+	for _, spec := range sortedCommandSpecs() {
+		for _, spec := range append([]*commandSpec{spec}, spec.subcommands...) {
+			if match(spec) {
+				names = append(names, spec.fullName())
+			}
+		}
+	}
+	return resp.EncodeArrayBulkStrings(names)
+}
+
+// COMMAND GETKEYS command [arg ...]
+func commandGetKeys(args [][]byte) []byte {
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		argv[i] = string(arg)
+	}
+	spec := commandTable[CommandType(strings.ToLower(argv[0]))]
+	if spec != nil && len(spec.subcommands) > 0 && len(argv) > 1 {
+		spec = spec.subcommand(argv[1])
+	}
+	switch {
+	case spec == nil:
+		return resp.EncodeError("Invalid command specified")
+	case !spec.arityOK(len(argv)):
+		return resp.EncodeError("Invalid number of arguments specified for command")
+	case len(spec.keySpecs) == 0:
+		return resp.EncodeError("The command has no key arguments")
+	}
+
+	indexes, ok := spec.keys(argv)
+	if !ok || len(indexes) == 0 {
+		return resp.EncodeError("Invalid arguments specified for command")
+	}
+	keys := make([]string, len(indexes))
+	for i, index := range indexes {
+		keys[i] = argv[index]
+	}
+	return resp.EncodeArrayBulkStrings(keys)
+}
+
+func encodeCommandInfos(specs []*commandSpec) []byte {
+	infos := make([][]byte, len(specs))
+	for i, spec := range specs {
+		infos[i] = encodeCommandInfo(spec)
+	}
+	return resp.EncodeArray(infos)
+}
+
+// Reply of COMMAND INFO for spec: name, arity, flags, first key, last key,
+// key step, ACL categories, tips, key specs and subcommands
+func encodeCommandInfo(spec *commandSpec) []byte {
+	var flags, acl [][]byte
+	for i, name := range commandFlagNames {
+		if spec.flags&(1<<i) != 0 {
+			flags = append(flags, resp.EncodeSimpleString(name))
+		}
+	}
+	for i, name := range aclCategoryNames {
+		if spec.acl&(1<<i) != 0 {
+			acl = append(acl, resp.EncodeSimpleString("@"+name))
+		}
+	}
+	keySpecs := make([][]byte, len(spec.keySpecs))
+	for i, ks := range spec.keySpecs {
+		keySpecs[i] = encodeKeySpec(ks)
+	}
+	subcommands := make([][]byte, len(spec.subcommands))
+	for i, sub := range spec.subcommands {
+		subcommands[i] = encodeCommandInfo(sub)
+	}
+
+	first, last, step := spec.legacyKeyRange()
+	return resp.EncodeArray([][]byte{
+		resp.EncodeBulkString(spec.fullName()),
+		resp.EncodeInterger(int64(spec.arity)),
+		resp.EncodeArray(flags),
+		resp.EncodeInterger(int64(first)),
+		resp.EncodeInterger(int64(last)),
+		resp.EncodeInterger(int64(step)),
+		resp.EncodeArray(acl),
+		resp.EncodeArrayBulkStrings(spec.tips),
+		resp.EncodeArray(keySpecs),
+		resp.EncodeArray(subcommands),
+	})
+}
+
+func encodeKeySpec(ks keySpec) []byte {
+	var flags [][]byte
+	for _, flag := range strings.Fields(ks.flags) {
+		flags = append(flags, resp.EncodeSimpleString(flag))
+	}
+	var beginSearch []byte
+	if ks.keyword != "" {
+		beginSearch = resp.EncodeArray([][]byte{
+			resp.EncodeBulkString("type"), resp.EncodeBulkString("keyword"),
+			resp.EncodeBulkString("spec"), resp.EncodeArray([][]byte{
+				resp.EncodeBulkString("keyword"), resp.EncodeBulkString(ks.keyword),
+				resp.EncodeBulkString("startfrom"), resp.EncodeInterger(int64(ks.startFrom)),
+			}),
+		})
+	} else {
+		beginSearch = resp.EncodeArray([][]byte{
+			resp.EncodeBulkString("type"), resp.EncodeBulkString("index"),
+			resp.EncodeBulkString("spec"), resp.EncodeArray([][]byte{
+				resp.EncodeBulkString("index"), resp.EncodeInterger(int64(ks.index)),
+			}),
+		})
+	}
+	findKeys := resp.EncodeArray([][]byte{
+		resp.EncodeBulkString("type"), resp.EncodeBulkString("range"),
+		resp.EncodeBulkString("spec"), resp.EncodeArray([][]byte{
+			resp.EncodeBulkString("lastkey"), resp.EncodeInterger(int64(ks.lastKey)),
+			resp.EncodeBulkString("keystep"), resp.EncodeInterger(int64(ks.keyStep)),
+			resp.EncodeBulkString("limit"), resp.EncodeInterger(int64(ks.limit)),
+		}),
+	})
+	return resp.EncodeArray([][]byte{
+		resp.EncodeBulkString("flags"), resp.EncodeArray(flags),
+		resp.EncodeBulkString("begin_search"), beginSearch,
+		resp.EncodeBulkString("find_keys"), findKeys,
+	})
+}
+
+// Reply of COMMAND DOCS for spec, a map flattened to an array
+func encodeCommandDocs(spec *commandSpec) []byte {
+	docs := [][]byte{
+		resp.EncodeBulkString("summary"), resp.EncodeBulkString(spec.summary),
+		resp.EncodeBulkString("since"), resp.EncodeBulkString(spec.since),
+		resp.EncodeBulkString("group"), resp.EncodeBulkString(spec.group),
+	}
+	if len(spec.subcommands) > 0 {
+		subcommands := make([][]byte, 0, 2*len(spec.subcommands))
+		for _, sub := range spec.subcommands {
+			subcommands = append(subcommands, resp.EncodeBulkString(sub.fullName()), encodeCommandDocs(sub))
+		}
+		docs = append(docs, resp.EncodeBulkString("subcommands"), resp.EncodeArray(subcommands))
+	}
+	return resp.EncodeArray(docs)
+}
+
+func encodeHelp(lines []string) []byte {
+	reply := make([][]byte, len(lines))
+	for i, line := range lines {
+		reply[i] = resp.EncodeSimpleString(line)
+	}
+	return resp.EncodeArray(reply)
 }
 
 func replConf(s *Server, c *Connection, cmd *Command) ([]byte, error) {
@@ -426,64 +1093,558 @@ func psync(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 	}
 	_, err = c.conn.Write(resp.EncodeFile(buf))
 
+	// The new replica starts with db 0 selected, make sure the stream says which db comes next
+	s.mu.Lock()
+	s.asMaster.selectedDB = -1
+	s.mu.Unlock()
+
 	return nil, err
 }
 
 func keys(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) != 1 {
-		return resp.EncodeError("wrong number of arguments for 'KEYS' command"), nil
-	}
-
-	pattern := cmd.Args[0]
-	log.Println("Pattern for matching keys:", pattern)
-	filePath := filepath.Join(s.db.Options.Dir, s.db.Options.DbFilename)
-	rdbReader := internal.NewRDBReader()
+	return resp.EncodeArrayBulkStrings(c.db.Keys(string(cmd.Args[0]))), nil
+}
 
-	// TODO: implement read keys from rdbReader instead of load the whole file
-	data, err := rdbReader.LoadFile(filePath)
+func scan(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	cursor, err := strconv.ParseUint(string(cmd.Args[0]), 10, 64)
 	if err != nil {
-		return resp.EncodeError(fmt.Sprintf("can't load rdb file at %s", filePath)), nil
+		return resp.EncodeError("invalid cursor"), nil
+	}
+	opts, errReply := parseScanOptions(cmd.Args[1:])
+	if errReply != nil {
+		return errReply, nil
 	}
 
-	keys := make([]string, len(data))
-	i := 0
-	for key := range data {
-		keys[i] = key
-		i++
+	cursor, keys := c.db.Scan(cursor, opts)
+	return encodeScanReply(cursor, keys), nil
+}
+
+// Parse the MATCH, COUNT and TYPE options of the SCAN family, returning an error reply if invalid
+func parseScanOptions(args [][]byte) (internal.ScanOptions, []byte) {
+	var opts internal.ScanOptions
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return opts, resp.EncodeError("syntax error")
+		}
+		val := string(args[i+1])
+		switch ToLowerString(args[i]) {
+		case "match":
+			opts.Pattern = val
+		case "count":
+			count, err := strconv.Atoi(val)
+			if err != nil {
+				return opts, resp.EncodeError("value is not an integer or out of range")
+			}
+			if count < 1 {
+				return opts, resp.EncodeError("syntax error")
+			}
+			opts.Count = count
+		case "type":
+			if _, ok := internal.ParseValueType(val); !ok {
+				return opts, resp.EncodeError(fmt.Sprintf("unknown type name '%s'", val))
+			}
+			opts.Type = val
+		default:
+			return opts, resp.EncodeError("syntax error")
+		}
 	}
+	return opts, nil
+}
 
-	return resp.EncodeArrayBulkStrings(keys), nil
+func encodeScanReply(cursor uint64, elements []string) []byte {
+	return resp.EncodeArray([][]byte{
+		resp.EncodeBulkString(strconv.FormatUint(cursor, 10)),
+		resp.EncodeArrayBulkStrings(elements),
+	})
 }
 
 func incr(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) != 1 {
-		return resp.EncodeError("wrong number of arguments for 'incr' commands"), nil
-	}
-	key := string(cmd.Args[0])
-	val, err := s.db.StringGet(key)
-	if err != nil {
-		s.db.StringSet(key, []byte("1"), 0)
-		return resp.EncodeInterger(1), nil
-	}
+	return incrByInternal(c, string(cmd.Args[0]), 1), nil
+}
 
-	valStr := string(val.Data.ToBytes())
-	valInt, err := strconv.Atoi(valStr)
-	if err != nil {
+func decr(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return incrByInternal(c, string(cmd.Args[0]), -1), nil
+}
+
+func incrby(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	delta, ok := internal.ParseInt64(cmd.Args[1])
+	if !ok {
 		return resp.EncodeError("value is not an integer or out of range"), nil
 	}
-
-	valInt++
-	s.db.StringSet(key, []byte(strconv.Itoa(valInt)), val.ExpiredTimeMilli)
-	return resp.EncodeInterger(int64(valInt)), nil
+	return incrByInternal(c, string(cmd.Args[0]), delta), nil
 }
 
-func multi(_ *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) != 0 {
-		return resp.EncodeError("wrong number of arguments for 'multi' command"), nil
+func decrby(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	delta, ok := internal.ParseInt64(cmd.Args[1])
+	if !ok {
+		return resp.EncodeError("value is not an integer or out of range"), nil
 	}
+	if delta == math.MinInt64 {
+		return resp.EncodeError("decrement would overflow"), nil
+	}
+	return incrByInternal(c, string(cmd.Args[0]), -delta), nil
+}
 
-	if c.isBatch {
-		return resp.EncodeError("MULTI calls can not be nested"), nil
+func incrByInternal(c *Connection, key string, delta int64) []byte {
+	val, err := c.db.IncrBy(key, delta)
+	if err != nil {
+		return encodeDBError(err)
+	}
+	return resp.EncodeInterger(val)
+}
+
+func incrbyfloat(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	val, err := c.db.IncrByFloat(string(cmd.Args[0]), string(cmd.Args[1]))
+	if err != nil {
+		return encodeDBError(err), nil
+	}
+	return resp.EncodeBulkString(val), nil
+}
+
+func expire(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return expireGeneric(c, cmd, time.Now().UnixMilli(), time.Second), nil
+}
+
+func pexpire(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return expireGeneric(c, cmd, time.Now().UnixMilli(), time.Millisecond), nil
+}
+
+func expireat(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return expireGeneric(c, cmd, 0, time.Second), nil
+}
+
+func pexpireat(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return expireGeneric(c, cmd, 0, time.Millisecond), nil
+}
+
+// Shared implementation of EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT: the time
+// argument is in unit and relative to basetime (unix milliseconds).
+// The command is propagated as PEXPIREAT so replicas get the same deadline.
+func expireGeneric(c *Connection, cmd *Command, basetime int64, unit time.Duration) []byte {
+
+	key := string(cmd.Args[0])
+	when, ok := internal.ParseInt64(cmd.Args[1])
+	if !ok {
+		return resp.EncodeError("value is not an integer or out of range")
+	}
+
+	var cond internal.ExpireCondition
+	for _, arg := range cmd.Args[2:] {
+		switch ToLowerString(arg) {
+		case "nx":
+			cond |= internal.ExpireNX
+		case "xx":
+			cond |= internal.ExpireXX
+		case "gt":
+			cond |= internal.ExpireGT
+		case "lt":
+			cond |= internal.ExpireLT
+		default:
+			return resp.EncodeError(fmt.Sprintf("Unsupported option %s", arg))
+		}
+	}
+	if cond&internal.ExpireNX != 0 && cond&(internal.ExpireXX|internal.ExpireGT|internal.ExpireLT) != 0 {
+		return resp.EncodeError("NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if cond&internal.ExpireGT != 0 && cond&internal.ExpireLT != 0 {
+		return resp.EncodeError("GT and LT options at the same time are not compatible")
+	}
+
+	invalid := resp.EncodeError(fmt.Sprintf("invalid expire time in '%s' command", cmd.CommandType))
+	if unit == time.Second {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			return invalid
+		}
+		when *= 1000
+	}
+	if when > math.MaxInt64-basetime {
+		return invalid
+	}
+	when += basetime
+
+	ok, err := c.db.Expire(key, when, cond)
+	if err != nil {
+		switch err.(type) {
+		case internal.KeyError:
+			cmd.NoPropagate()
+			return resp.EncodeInterger(0)
+		default:
+			return encodeDBError(err)
+		}
+	}
+	if !ok {
+		cmd.NoPropagate()
+		return resp.EncodeInterger(0)
+	}
+
+	cmd.Rewrite(string(PExpireAt), key, strconv.FormatInt(when, 10))
+	return resp.EncodeInterger(1)
+}
+
+func ttl(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return ttlGeneric(c, cmd, false, time.Second), nil
+}
+
+func pttl(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return ttlGeneric(c, cmd, false, time.Millisecond), nil
+}
+
+func expiretime(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return ttlGeneric(c, cmd, true, time.Second), nil
+}
+
+func pexpiretime(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return ttlGeneric(c, cmd, true, time.Millisecond), nil
+}
+
+// Shared implementation of TTL, PTTL, EXPIRETIME and PEXPIRETIME:
+// -2 when the key doesn't exist, -1 when it has no expiry
+func ttlGeneric(c *Connection, cmd *Command, absolute bool, unit time.Duration) []byte {
+
+	expireAt, err := c.db.ExpireTime(string(cmd.Args[0]))
+	if err != nil {
+		switch err.(type) {
+		case internal.KeyError:
+			return resp.EncodeInterger(-2)
+		default:
+			return encodeDBError(err)
+		}
+	}
+	if expireAt == -1 {
+		return resp.EncodeInterger(-1)
+	}
+
+	if absolute {
+		if unit == time.Second {
+			return resp.EncodeInterger(expireAt / 1000)
+		}
+		return resp.EncodeInterger(expireAt)
+	}
+
+	remaining := max(expireAt-time.Now().UnixMilli(), 0)
+	if unit == time.Second {
+		return resp.EncodeInterger((remaining + 500) / 1000)
+	}
+	return resp.EncodeInterger(remaining)
+}
+
+func persist(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	ok, err := c.db.Persist(string(cmd.Args[0]))
+	if err != nil {
+		switch err.(type) {
+		case internal.KeyError:
+			cmd.NoPropagate()
+			return resp.EncodeInterger(0), nil
+		default:
+			return encodeDBError(err), nil
+		}
+	}
+	if !ok {
+		cmd.NoPropagate()
+		return resp.EncodeInterger(0), nil
+	}
+	return resp.EncodeInterger(1), nil
+}
+
+func del(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	deleted := c.db.Del(argsToStrings(cmd.Args)...)
+	if deleted == 0 {
+		cmd.NoPropagate()
+	}
+	return resp.EncodeInterger(int64(deleted)), nil
+}
+
+func unlink(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	deleted := c.db.Unlink(argsToStrings(cmd.Args)...)
+	if deleted == 0 {
+		cmd.NoPropagate()
+	}
+	return resp.EncodeInterger(int64(deleted)), nil
+}
+
+func exists(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return resp.EncodeInterger(int64(c.db.Exists(argsToStrings(cmd.Args)...))), nil
+}
+
+func touch(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return resp.EncodeInterger(int64(c.db.Touch(argsToStrings(cmd.Args)...))), nil
+}
+
+func rename(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	err := c.db.Rename(string(cmd.Args[0]), string(cmd.Args[1]))
+	if err != nil {
+		switch err.(type) {
+		case internal.KeyError:
+			return resp.EncodeError("no such key"), nil
+		default:
+			return encodeDBError(err), nil
+		}
+	}
+	return resp.EncodeSimpleString(OK), nil
+}
+
+func renamenx(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	ok, err := c.db.RenameNX(string(cmd.Args[0]), string(cmd.Args[1]))
+	if err != nil {
+		switch err.(type) {
+		case internal.KeyError:
+			return resp.EncodeError("no such key"), nil
+		default:
+			return encodeDBError(err), nil
+		}
+	}
+	if !ok {
+		cmd.NoPropagate()
+		return resp.EncodeInterger(0), nil
+	}
+	return resp.EncodeInterger(1), nil
+}
+
+// copy is a Go builtin
+func copyKey(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	replace := false
+	dstDB := c.db
+	for i := 2; i < len(cmd.Args); i++ {
+		switch ToLowerString(cmd.Args[i]) {
+		case "replace":
+			replace = true
+		case "db":
+			if i+1 >= len(cmd.Args) {
+				return resp.EncodeError("syntax error"), nil
+			}
+			i++
+			idx, errReply := parseDBIndex(s, cmd.Args[i])
+			if errReply != nil {
+				return errReply, nil
+			}
+			dstDB = s.dbs[idx]
+		default:
+			return resp.EncodeError("syntax error"), nil
+		}
+	}
+
+	ok, err := c.db.CopyTo(dstDB, string(cmd.Args[0]), string(cmd.Args[1]), replace)
+	if err != nil {
+		switch err.(type) {
+		case internal.KeyError:
+			cmd.NoPropagate()
+			return resp.EncodeInterger(0), nil
+		default:
+			return encodeDBError(err), nil
+		}
+	}
+	if !ok {
+		cmd.NoPropagate()
+		return resp.EncodeInterger(0), nil
+	}
+	return resp.EncodeInterger(1), nil
+}
+
+// DUMP key, a null reply for a missing key
+func dump(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	payload, err := c.db.Dump(string(cmd.Args[0]))
+	if err != nil {
+		if _, ok := err.(internal.KeyError); ok {
+			return resp.EncodeNullBulkString(), nil
+		}
+		return encodeDBError(err), nil
+	}
+	return resp.EncodeBulkString(string(payload)), nil
+}
+
+// RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency].
+// A relative ttl is propagated as ABSTTL so replicas get the same deadline.
+func restore(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	opts := internal.RestoreOptions{IdleSeconds: -1, Freq: -1}
+	absTTL := false
+	for i := 3; i < len(cmd.Args); i++ {
+		switch ToLowerString(cmd.Args[i]) {
+		case "replace":
+			opts.Replace = true
+		case "absttl":
+			absTTL = true
+		case "idletime":
+			if i+1 >= len(cmd.Args) || opts.Freq != -1 {
+				return resp.EncodeError("syntax error"), nil
+			}
+			i++
+			idle, ok := internal.ParseInt64(cmd.Args[i])
+			if !ok {
+				return resp.EncodeError("value is not an integer or out of range"), nil
+			}
+			if idle < 0 {
+				return resp.EncodeError("Invalid IDLETIME value, must be >= 0"), nil
+			}
+			opts.IdleSeconds = idle
+		case "freq":
+			if i+1 >= len(cmd.Args) || opts.IdleSeconds != -1 {
+				return resp.EncodeError("syntax error"), nil
+			}
+			i++
+			freq, ok := internal.ParseInt64(cmd.Args[i])
+			if !ok {
+				return resp.EncodeError("value is not an integer or out of range"), nil
+			}
+			if freq < 0 || freq > 255 {
+				return resp.EncodeError("Invalid FREQ value, must be >= 0 and <= 255"), nil
+			}
+			opts.Freq = int(freq)
+		default:
+			return resp.EncodeError("syntax error"), nil
+		}
+	}
+
+	ttl, ok := internal.ParseInt64(cmd.Args[1])
+	if !ok {
+		return resp.EncodeError("value is not an integer or out of range"), nil
+	}
+	if ttl < 0 {
+		return resp.EncodeError("Invalid TTL value, must be >= 0"), nil
+	}
+	if ttl > 0 && !absTTL {
+		ttl += time.Now().UnixMilli()
+	}
+	opts.ExpireAtMilli = ttl
+
+	key := string(cmd.Args[0])
+	stored, err := c.db.Restore(key, cmd.Args[2], opts)
+	if err != nil {
+		return encodeDBError(err), nil
+	}
+	switch {
+	case !stored && opts.Replace:
+		cmd.Rewrite("DEL", key)
+	case !stored:
+		cmd.NoPropagate()
+	case ttl > 0 && !absTTL:
+		args := append([]string{"RESTORE", key, strconv.FormatInt(ttl, 10)}, argsToStrings(cmd.Args[2:])...)
+		cmd.Rewrite(append(args, "ABSTTL")...)
+	}
+	return resp.EncodeSimpleString(OK), nil
+}
+
+// Parse a db index argument, returning the error reply if it's invalid
+func parseDBIndex(s *Server, arg []byte) (int, []byte) {
+	idx, ok := internal.ParseInt64(arg)
+	if !ok || idx < math.MinInt32 || idx > math.MaxInt32 {
+		return 0, resp.EncodeError("value is not an integer or out of range")
+	}
+	if idx < 0 || idx >= int64(len(s.dbs)) {
+		return 0, resp.EncodeError("DB index is out of range")
+	}
+	return int(idx), nil
+}
+
+// select is a Go keyword
+func selectDB(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	idx, errReply := parseDBIndex(s, cmd.Args[0])
+	if errReply != nil {
+		return errReply, nil
+	}
+	c.selectDB(s, idx)
+	return resp.EncodeSimpleString(OK), nil
+}
+
+func move(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	idx, errReply := parseDBIndex(s, cmd.Args[1])
+	if errReply != nil {
+		return errReply, nil
+	}
+
+	ok, err := c.db.Move(string(cmd.Args[0]), s.dbs[idx])
+	if err != nil {
+		switch err.(type) {
+		case internal.KeyError:
+			cmd.NoPropagate()
+			return resp.EncodeInterger(0), nil
+		case *internal.SameObjectError:
+			return resp.EncodeError("source and destination objects are the same"), nil
+		default:
+			return encodeDBError(err), nil
+		}
+	}
+	if !ok {
+		cmd.NoPropagate()
+		return resp.EncodeInterger(0), nil
+	}
+	return resp.EncodeInterger(1), nil
+}
+
+func swapdb(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	idx1, ok1 := internal.ParseInt64(cmd.Args[0])
+	if !ok1 {
+		return resp.EncodeError("invalid first DB index"), nil
+	}
+	idx2, ok2 := internal.ParseInt64(cmd.Args[1])
+	if !ok2 {
+		return resp.EncodeError("invalid second DB index"), nil
+	}
+	if idx1 < 0 || idx1 >= int64(len(s.dbs)) || idx2 < 0 || idx2 >= int64(len(s.dbs)) {
+		return resp.EncodeError("DB index is out of range"), nil
+	}
+
+	s.dbs[idx1].SwapWith(s.dbs[idx2])
+	return resp.EncodeSimpleString(OK), nil
+}
+
+// Check the optional ASYNC|SYNC argument of FLUSHDB and FLUSHALL, both
+// drop the keys right away and leave freeing them to the garbage collector
+func checkFlushMode(cmd *Command) []byte {
+	switch {
+	case len(cmd.Args) == 0:
+		return nil
+	case len(cmd.Args) > 1:
+		return resp.EncodeError("syntax error")
+	}
+	switch ToLowerString(cmd.Args[0]) {
+	case "async", "sync":
+		return nil
+	default:
+		return resp.EncodeError("syntax error")
+	}
+}
+
+func flushdb(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	if errReply := checkFlushMode(cmd); errReply != nil {
+		return errReply, nil
+	}
+	c.db.Flush()
+	return resp.EncodeSimpleString(OK), nil
+}
+
+func flushall(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	if errReply := checkFlushMode(cmd); errReply != nil {
+		return errReply, nil
+	}
+	for _, db := range s.dbs {
+		db.Flush()
+	}
+	return resp.EncodeSimpleString(OK), nil
+}
+
+func save(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	if err := internal.Save(s.rdbPath(), s.dbs); err != nil {
+		log.Println("Error saving the RDB file:", err)
+		return resp.EncodeError(err.Error()), nil
+	}
+	return resp.EncodeSimpleString(OK), nil
+}
+
+func randomkey(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	key, ok := c.db.RandomKey()
+	if !ok {
+		return resp.EncodeNullBulkString(), nil
+	}
+	return resp.EncodeBulkString(key), nil
+}
+
+func dbsize(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return resp.EncodeInterger(int64(c.db.DBSize())), nil
+}
+
+func multi(_ *Server, c *Connection, cmd *Command) ([]byte, error) {
+	if c.isBatch {
+		return resp.EncodeError("MULTI calls can not be nested"), nil
 	}
 
 	c.isBatch = true
@@ -497,58 +1658,180 @@ func multi(_ *Server, c *Connection, cmd *Command) ([]byte, error) {
 }
 
 func exec(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) != 0 {
-		return resp.EncodeError("wrong number of arguments for 'exec' command"), nil
-	}
-
 	if !c.isBatch {
 		return resp.EncodeError("EXEC without MULTI"), nil
 	}
 
 	if c.batch.isError {
-		return resp.EncodeErrorNoPrefix("EXEC aborted due to previous errors"), nil
-	}
-
-	resArray := make([][]byte, 0, len(c.batch.handlerQueue))
-	for i := 0; i < len(c.batch.handlerQueue); i++ {
-		queuedhandler := c.batch.handlerQueue[i]
-		queuedCmd := c.batch.commandQueue[i]
-		handledBytes, err := queuedhandler(s, c, queuedCmd)
-		if err != nil {
-			// Continue the execution even if a handler fails
-			c.batch.isError = true
+		c.discardBatch()
+		return resp.EncodeErrorNoPrefix("EXECABORT Transaction discarded because of previous errors."), nil
+	}
+
+	// A watched key changed, nothing runs
+	if c.watch != nil && c.watch.Dirty() {
+		c.discardBatch()
+		return resp.EncodeNullArray(), nil
+	}
+	c.unwatch()
+
+	// One reply per queued command, errors included, so they line up with the
+	// commands. The caller holds s.cmdMu so nothing runs in between, and the
+	// writes reach the replicas before any later command.
+	replies := make([][]byte, len(c.batch.handlerQueue))
+	var writes []propagatedWrite
+	c.inExec = true
+	for i, queuedHandler := range c.batch.handlerQueue {
+		queued := c.batch.commandQueue[i]
+		reply, err := queuedHandler(s, c, queued)
+		switch {
+		case err != nil:
+			reply = resp.EncodeError(err.Error())
+		case len(reply) == 0:
+			reply = resp.EncodeNullBulkString()
 		}
-		if len(handledBytes) > 0 {
-			resArray = append(resArray, handledBytes)
+		replies[i] = reply
+		if propagates(s, queued, reply) {
+			writes = append(writes, propagatedWrite{c.dbIndex, queued})
 		}
 	}
-	// reset the connection
-	c.isBatch = false
-	c.batch = nil
-	return resp.EncodeArray(resArray), nil
+	c.inExec = false
+	c.discardBatch()
+	propagateTransaction(s, cmd, writes)
+	return resp.EncodeArray(replies), nil
 }
 
 func discard(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) != 0 {
-		return resp.EncodeError("wrong number of arguments for 'discard' command"), nil
-	}
-
 	if !c.isBatch {
 		return resp.EncodeError("DISCARD without MULTI"), nil
 	}
 
-	c.isBatch = false
-	c.batch = nil
+	c.discardBatch()
 	return resp.EncodeSimpleString(OK), nil
 }
 
-func keytype(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) != 1 {
-		return resp.EncodeError("wrong number of arguments for 'type' command"), nil
+func watch(_ *Server, c *Connection, cmd *Command) ([]byte, error) {
+	if c.isBatch {
+		return resp.EncodeError("WATCH inside MULTI is not allowed"), nil
+	}
+
+	if c.watch == nil {
+		c.watch = internal.NewWatch()
+	}
+	keys := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		keys[i] = string(arg)
+	}
+	c.db.Watch(c.watch, keys...)
+	return resp.EncodeSimpleString(OK), nil
+}
+
+func unwatch(_ *Server, c *Connection, cmd *Command) ([]byte, error) {
+	c.unwatch()
+	return resp.EncodeSimpleString(OK), nil
+}
+
+func subscribe(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return s.pubsub.subscribe(s, c, subChannel, cmd.Args), nil
+}
+
+func unsubscribe(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return s.pubsub.unsubscribe(c, subChannel, cmd.Args), nil
+}
+
+func psubscribe(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return s.pubsub.subscribe(s, c, subPattern, cmd.Args), nil
+}
+
+func punsubscribe(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return s.pubsub.unsubscribe(c, subPattern, cmd.Args), nil
+}
+
+func publish(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	receivers := s.pubsub.publish(cmd.Args[0], cmd.Args[1])
+	return resp.EncodeInterger(int64(receivers)), nil
+}
+
+func ssubscribe(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return s.pubsub.subscribe(s, c, subShard, cmd.Args), nil
+}
+
+func sunsubscribe(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return s.pubsub.unsubscribe(c, subShard, cmd.Args), nil
+}
+
+func spublish(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	receivers := s.pubsub.spublish(cmd.Args[0], cmd.Args[1])
+	return resp.EncodeInterger(int64(receivers)), nil
+}
+
+var pubsubHelp = []string{
+	"PUBSUB <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"CHANNELS [<pattern>]",
+	"    Return the currently active channels matching a <pattern> (default: '*').",
+	"NUMPAT",
+	"    Return number of subscriptions to patterns.",
+	"NUMSUB [<channel> ...]",
+	"    Return the number of subscribers for the specified channels, excluding",
+	"    pattern subscriptions(default: no channels).",
+	"SHARDCHANNELS [<pattern>]",
+	"    Return the currently active shard level channels matching a <pattern> (default: '*').",
+	"SHARDNUMSUB [<shardchannel> ...]",
+	"    Return the number of subscribers for the specified shard level channel(s)",
+	"HELP",
+	"    Print this help.",
+}
+
+func pubsubCmd(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	args := cmd.Args[1:]
+	kind := subChannel
+	switch cmd.spec.name {
+	case "shardchannels":
+		kind = subShard
+		fallthrough
+	case "channels":
+		if len(args) > 1 {
+			return resp.EncodeError(fmt.Sprintf("unknown subcommand or wrong number of arguments for '%s'. Try PUBSUB HELP.", cmd.Args[0])), nil
+		}
+		pattern := ""
+		if len(args) == 1 {
+			pattern = string(args[0])
+		}
+		return resp.EncodeArrayBulkStrings(s.pubsub.channels(kind, pattern)), nil
+	case "shardnumsub":
+		kind = subShard
+		fallthrough
+	case "numsub":
+		reply := make([][]byte, 0, 2*len(args))
+		for _, channel := range args {
+			n := s.pubsub.numSubscribers(kind, string(channel))
+			reply = append(reply, resp.EncodeBulkString(string(channel)), resp.EncodeInterger(int64(n)))
+		}
+		return resp.EncodeArray(reply), nil
+	case "numpat":
+		return resp.EncodeInterger(int64(s.pubsub.count(subPattern))), nil
+	default:
+		return encodeHelp(pubsubHelp), nil
 	}
+}
+
+// The reply is written before the connection is closed
+func quit(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	c.closeAfterReply = true
+	return resp.EncodeSimpleString(OK), nil
+}
 
+// Back to the state of a new connection: no transaction, no watched keys,
+// no subscriptions and db 0 selected
+func reset(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	c.discardBatch()
+	s.pubsub.unsubscribeAll(c)
+	c.selectDB(s, 0)
+	return resp.EncodeSimpleString("RESET"), nil
+}
+
+func keytype(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 	key := string(cmd.Args[0])
-	val, err := s.db.GetVal(key)
+	val, err := c.db.GetVal(key)
 	if err != nil {
 		switch etype := err.(type) {
 		case internal.KeyError:
@@ -562,136 +1845,905 @@ func keytype(s *Server, c *Connection, cmd *Command) ([]byte, error) {
 }
 
 func xadd(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) < 4 {
-		return resp.EncodeError("wrong number of arguments for 'xadd' command"), nil
-	}
-
 	streamKey := string(cmd.Args[0])
-	entryIDRaw := string(cmd.Args[1])
-
-	//TODO: resolve expiry if exists
-
-	data := make(internal.StreamEntryData)
-	for i := 2; i < len(cmd.Args)-1; i += 2 {
-		data[string(cmd.Args[i])] = cmd.Args[i+1]
+	opts, idPos, errReply := parseStreamAddOrTrimArgs(cmd.Args[1:], true)
+	if errReply != nil {
+		return errReply, nil
+	}
+	idPos++ // index in cmd.Args
+	entryIDRaw := string(cmd.Args[idPos])
+	fields := cmd.Args[idPos+1:]
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return resp.EncodeError("wrong number of arguments for 'xadd' command"), nil
 	}
 
-	id, err := s.db.StreamAdd(streamKey, entryIDRaw, data, 0)
-
-	// log.Printf("added streamKey: %s, entryIDRaw: %s, id: %s", streamKey, entryIDRaw, id)
+	id, trim, err := c.db.StreamAdd(streamKey, entryIDRaw, internal.StreamEntryData(fields), opts)
 	if err != nil {
 		switch etype := err.(type) {
+		case internal.KeyError:
+			// NOMKSTREAM and no stream
+			cmd.NoPropagate()
+			return resp.EncodeNullBulkString(), nil
 		case *internal.StreamKeyInvalid:
 			return resp.EncodeError(etype.Error()), nil
 		case *internal.StreamKeyTooSmall:
 			return resp.EncodeError("The ID specified in XADD is equal or smaller than the target stream top item"), nil
 		}
+		return encodeDBError(err), nil
+	}
 
-		return nil, err
+	// Replicas add the entry with the same ID and trim exactly as much
+	args := []string{"XADD", streamKey}
+	if opts.NoMkStream {
+		args = append(args, "NOMKSTREAM")
 	}
+	args = append(args, streamTrimArgs(trim)...)
+	args = append(args, id)
+	cmd.Rewrite(append(args, argsToStrings(fields)...)...)
 	return resp.EncodeBulkString(id), nil
 }
 
+func xlen(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	n, err := c.db.StreamLen(string(cmd.Args[0]))
+	if err != nil {
+		return encodeDBError(err), nil
+	}
+	return resp.EncodeInterger(int64(n)), nil
+}
+
+func xdel(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	// Every ID must be valid before anything is deleted
+	ids := make([]internal.StreamEntryID, len(cmd.Args)-1)
+	for i, arg := range cmd.Args[1:] {
+		id, err := internal.ParseStreamEntryID(string(arg))
+		if err != nil {
+			return resp.EncodeError(invalidStreamID), nil
+		}
+		ids[i] = id
+	}
+
+	n, err := c.db.StreamDelete(string(cmd.Args[0]), ids)
+	if err != nil {
+		return encodeDBError(err), nil
+	}
+	if n == 0 {
+		cmd.NoPropagate()
+	}
+	return resp.EncodeInterger(int64(n)), nil
+}
+
+func xtrim(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	opts, _, errReply := parseStreamAddOrTrimArgs(cmd.Args[1:], false)
+	if errReply != nil {
+		return errReply, nil
+	}
+	n, trim, err := c.db.StreamTrim(string(cmd.Args[0]), opts.Trim)
+	if err != nil {
+		return encodeDBError(err), nil
+	}
+	if n == 0 {
+		cmd.NoPropagate()
+	} else {
+		cmd.Rewrite(append([]string{"XTRIM", string(cmd.Args[0])}, streamTrimArgs(trim)...)...)
+	}
+	return resp.EncodeInterger(int64(n)), nil
+}
+
+// The arguments of an exact trim, what replicas get for MAXLEN or MINID as
+// "~" removes a number of entries that depends on the nodes
+func streamTrimArgs(trim internal.StreamTrimOptions) []string {
+	switch trim.Strategy {
+	case internal.StreamTrimMaxLen:
+		return []string{"MAXLEN", "=", strconv.FormatInt(trim.MaxLen, 10)}
+	case internal.StreamTrimMinID:
+		return []string{"MINID", "=", trim.MinID.String()}
+	}
+	return nil
+}
+
+const invalidStreamID = "Invalid stream ID specified as stream command argument"
+
+// Parse [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] like
+// Redis' streamParseAddOrTrimArgsOrReply. For XADD parsing stops at the
+// entry ID and its index in args is returned.
+func parseStreamAddOrTrimArgs(args [][]byte, xadd bool) (internal.StreamAddOptions, int, []byte) {
+	var opts internal.StreamAddOptions
+	trim := &opts.Trim
+	limitGiven := false
+	i := 0
+	for ; i < len(args); i++ {
+		moreArgs := len(args) - 1 - i
+		opt := ToLowerString(args[i])
+		switch {
+		case xadd && opt == "*":
+			// The entry ID
+		case (opt == "maxlen" || opt == "minid") && moreArgs > 0:
+			strategy := internal.StreamTrimMaxLen
+			if opt == "minid" {
+				strategy = internal.StreamTrimMinID
+			}
+			if trim.Strategy != internal.StreamTrimNone && trim.Strategy != strategy {
+				return opts, 0, resp.EncodeError("syntax error, MAXLEN and MINID options at the same time are not compatible")
+			}
+			trim.Strategy = strategy
+
+			if next := string(args[i+1]); moreArgs >= 2 && (next == "~" || next == "=") {
+				trim.Approx = next == "~"
+				i++
+			}
+			i++
+			if strategy == internal.StreamTrimMaxLen {
+				maxLen, ok := internal.ParseInt64(args[i])
+				if !ok {
+					return opts, 0, resp.EncodeError("value is not an integer or out of range")
+				}
+				if maxLen < 0 {
+					return opts, 0, resp.EncodeError("The MAXLEN argument must be >= 0.")
+				}
+				trim.MaxLen = maxLen
+			} else {
+				minID, err := internal.ParseStreamEntryID(string(args[i]))
+				if err != nil {
+					return opts, 0, resp.EncodeError(invalidStreamID)
+				}
+				trim.MinID = minID
+			}
+			continue
+		case opt == "limit" && moreArgs > 0:
+			i++
+			limit, ok := internal.ParseInt64(args[i])
+			if !ok {
+				return opts, 0, resp.EncodeError("value is not an integer or out of range")
+			}
+			if limit < 0 {
+				return opts, 0, resp.EncodeError("The LIMIT argument must be >= 0.")
+			}
+			trim.Limit = limit
+			limitGiven = true
+			continue
+		case xadd && opt == "nomkstream":
+			opts.NoMkStream = true
+			continue
+		case xadd:
+			// The entry ID, validated when it's generated
+		default:
+			return opts, 0, resp.EncodeError("syntax error")
+		}
+		break
+	}
+
+	if xadd && i >= len(args) {
+		return opts, 0, resp.EncodeError("wrong number of arguments for 'xadd' command")
+	}
+	if !xadd && trim.Strategy == internal.StreamTrimNone {
+		return opts, 0, resp.EncodeError("syntax error, XTRIM must be called with a trimming strategy")
+	}
+	if limitGiven && !trim.Approx {
+		return opts, 0, resp.EncodeError("syntax error, LIMIT cannot be used without the special ~ option")
+	}
+	if !limitGiven && trim.Approx {
+		trim.Limit = internal.DefaultStreamTrimLimit
+	}
+	return opts, i, nil
+}
+
 func xrange(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) != 3 {
-		return resp.EncodeError("wrong number of arguments for 'xrange' command"), nil
+	return xrangeGeneric(c, cmd, false), nil
+}
+
+func xrevrange(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	return xrangeGeneric(c, cmd, true), nil
+}
+
+// XRANGE key start end [COUNT count], XREVRANGE takes end before start
+func xrangeGeneric(c *Connection, cmd *Command, rev bool) []byte {
+	if len(cmd.Args) != 3 && len(cmd.Args) != 5 {
+		return resp.EncodeError("syntax error")
 	}
 
-	ids, values, err := s.db.StreamRange(string(cmd.Args[0]), string(cmd.Args[1]), string(cmd.Args[2]))
+	count := 0
+	if len(cmd.Args) == 5 {
+		if ToLowerString(cmd.Args[3]) != "count" {
+			return resp.EncodeError("syntax error")
+		}
+		n, ok := internal.ParseInt64(cmd.Args[4])
+		if !ok {
+			return resp.EncodeError("value is not an integer or out of range")
+		}
+		if n <= 0 {
+			return resp.EncodeNullArray()
+		}
+		count = int(min(n, math.MaxInt32))
+	}
+
+	start, end := string(cmd.Args[1]), string(cmd.Args[2])
+	if rev {
+		start, end = end, start
+	}
+	ids, values, err := c.db.StreamRange(string(cmd.Args[0]), start, end, count, rev)
 	if err != nil {
-		return resp.EncodeError(err.Error()), nil
+		return encodeDBError(err)
 	}
+	return encodeStreamEntries(ids, values)
+}
 
-	streamArr := make([][]byte, 0, len(ids))
+// Array of [id, [field, value, ...]] entries
+func encodeStreamEntries(ids []internal.StreamEntryID, values []internal.StreamEntryData) []byte {
+	streamArr := make([][]byte, len(ids))
 	for i := 0; i < len(ids); i++ {
-		entryArr := make([][]byte, 0, 2)
-		entryArr = append(entryArr, resp.EncodeBulkString(ids[i].String()))
+		streamArr[i] = encodeStreamEntry(ids[i], values[i])
+	}
+	return resp.EncodeArray(streamArr)
+}
+
+func encodeStreamEntry(id internal.StreamEntryID, value internal.StreamEntryData) []byte {
+	if value == nil {
+		// Pending entry deleted from the stream
+		return resp.EncodeArray([][]byte{resp.EncodeBulkString(id.String()), resp.EncodeNullArray()})
+	}
+	valueArr := make([][]byte, len(value))
+	for i, s := range value {
+		valueArr[i] = resp.EncodeBulkString(string(s))
+	}
+	return resp.EncodeArray([][]byte{resp.EncodeBulkString(id.String()), resp.EncodeArray(valueArr)})
+}
+
+// Arguments of XREAD and XREADGROUP
+type streamReadArgs struct {
+	keys        []string
+	ids         []string
+	count       int   // 0 for all
+	blockMillis int64 // -1 not to block
+	group       string
+	consumer    string
+	noAck       bool
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func xread(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	args, errReply := parseStreamReadArgs(cmd, false)
+	if errReply != nil {
+		return errReply, nil
+	}
+
+	// Transactions don't block
+	if c.inExec {
+		args.blockMillis = -1
+	}
+	streamResults, err := c.db.StreamRead(args.keys, args.ids, args.count, args.blockMillis)
+	if err != nil {
+		return encodeDBError(err), nil
+	}
+	if len(streamResults) == 0 {
+		return resp.EncodeNullArray(), nil
+	}
+	readArr := make([][]byte, len(streamResults))
+	for i, stream := range streamResults {
+		readArr[i] = encodeStreamReadResult(stream)
+	}
+	return resp.EncodeArray(readArr), nil
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK]
+// STREAMS key [key ...] id [id ...]
+func xreadgroup(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	args, errReply := parseStreamReadArgs(cmd, true)
+	if errReply != nil {
+		return errReply, nil
+	}
+
+	if c.inExec {
+		args.blockMillis = -1
+	}
+	streamResults, propagate, err := c.db.StreamReadGroup(args.group, args.consumer, args.keys, args.ids, args.count, args.noAck, args.blockMillis)
+	cmd.RewriteAll(propagate)
+	if err != nil {
+		return encodeDBError(err), nil
+	}
+	if len(streamResults) == 0 {
+		return resp.EncodeNullArray(), nil
+	}
+
+	readArr := make([][]byte, len(streamResults))
+	for i, stream := range streamResults {
+		readArr[i] = encodeStreamReadResult(stream)
+	}
+	return resp.EncodeArray(readArr), nil
+}
 
-		valueArr := make([][]byte, 0, len(values[i])*2)
-		for key, val := range values[i] {
-			valueArr = append(valueArr, resp.EncodeBulkString(key), resp.EncodeBulkString(string(val)))
+func parseStreamReadArgs(cmd *Command, xreadgroup bool) (streamReadArgs, []byte) {
+	args := streamReadArgs{blockMillis: -1}
+
+	keyStartIndex := -1
+	hasGroup := false
+	for i := 0; i < len(cmd.Args) && keyStartIndex < 0; i++ {
+		moreArgs := len(cmd.Args) - 1 - i
+		switch opt := ToLowerString(cmd.Args[i]); {
+		case opt == "block" && moreArgs > 0:
+			i++
+			parsedBlock, ok := internal.ParseInt64(cmd.Args[i])
+			if !ok {
+				return args, resp.EncodeError("timeout is not an integer or out of range")
+			}
+			if parsedBlock < 0 {
+				return args, resp.EncodeError("timeout is negative")
+			}
+			args.blockMillis = parsedBlock
+		case opt == "count" && moreArgs > 0:
+			i++
+			n, ok := internal.ParseInt64(cmd.Args[i])
+			if !ok {
+				return args, resp.EncodeError("value is not an integer or out of range")
+			}
+			args.count = int(max(min(n, math.MaxInt32), 0))
+		case opt == "streams" && moreArgs > 0:
+			keyStartIndex = i + 1
+		case opt == "group" && moreArgs > 1:
+			if !xreadgroup {
+				return args, resp.EncodeError("The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			args.group, args.consumer = string(cmd.Args[i+1]), string(cmd.Args[i+2])
+			hasGroup = true
+			i += 2
+		case opt == "noack" && xreadgroup:
+			args.noAck = true
+		default:
+			return args, resp.EncodeError("syntax error")
 		}
+	}
 
-		entryArr = append(entryArr, resp.EncodeArray(valueArr))
-		streamArr = append(streamArr, resp.EncodeArray(entryArr))
+	if keyStartIndex < 0 || (len(cmd.Args)-keyStartIndex)%2 != 0 {
+		return args, resp.EncodeError(fmt.Sprintf("Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified.", cmd.CommandType))
+	}
+	if xreadgroup && !hasGroup {
+		return args, resp.EncodeError("Missing GROUP option for XREADGROUP")
 	}
 
-	return resp.EncodeArray(streamArr), nil
+	keysLen := (len(cmd.Args) - keyStartIndex) / 2
+	args.keys = argsToStrings(cmd.Args[keyStartIndex : keyStartIndex+keysLen])
+	args.ids = argsToStrings(cmd.Args[keyStartIndex+keysLen:])
+	for _, id := range args.ids {
+		switch {
+		case id == "$" && xreadgroup:
+			return args, resp.EncodeError("The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		case id == "+" && xreadgroup:
+			return args, resp.EncodeError("The + ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The + ID would just return an empty result set.")
+		case id == ">" && !xreadgroup:
+			return args, resp.EncodeError("The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+		case id == "$" || id == "+" || id == ">":
+		default:
+			if _, err := internal.ParseStreamEntryID(id); err != nil {
+				return args, resp.EncodeError(invalidStreamID)
+			}
+		}
+	}
+	return args, nil
 }
 
-func xread(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	if len(cmd.Args) < 3 {
-		return resp.EncodeError("wrong number of arguments for 'xread' command"), nil
+// [key, entries] of XREAD and XREADGROUP
+func encodeStreamReadResult(stream internal.XReadKeyResult) []byte {
+	return resp.EncodeArray([][]byte{
+		resp.EncodeBulkString(stream.Key),
+		encodeStreamEntries(stream.EntryIDs, stream.EntryValues),
+	})
+}
+
+var xgroupHelp = []string{
+	"XGROUP <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"CREATE <key> <groupname> <id|$> [option]",
+	"    Create a new consumer group. Options are:",
+	"    * MKSTREAM",
+	"      Create the empty stream if it does not exist.",
+	"    * ENTRIESREAD entries_read",
+	"      Set the group's entries_read counter (internal use).",
+	"CREATECONSUMER <key> <groupname> <consumer>",
+	"    Create a new consumer in the specified group.",
+	"DELCONSUMER <key> <groupname> <consumer>",
+	"    Remove the specified consumer.",
+	"DESTROY <key> <groupname>",
+	"    Remove the specified group.",
+	"SETID <key> <groupname> <id|$> [ENTRIESREAD entries_read]",
+	"    Set the current group ID and entries_read counter.",
+	"HELP",
+	"    Print this help.",
+}
+
+func xgroup(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	subCmd := cmd.spec.name
+	if subCmd == "help" {
+		return encodeHelp(xgroupHelp), nil
 	}
 
-	keyStartIndex := 1
-	var blockMillis int64 = -1
-	switch string(cmd.Args[0]) {
-	case "block":
-		if len(cmd.Args) < 5 {
-			return resp.EncodeError("wrong number of arguments for 'xread block' command"), nil
+	key, group := string(cmd.Args[1]), string(cmd.Args[2])
+	switch subCmd {
+	case "create", "setid":
+		mkStream := false
+		var entriesRead int64 = internal.StreamEntriesReadInvalid
+		for i := 4; i < len(cmd.Args); i++ {
+			switch opt := ToLowerString(cmd.Args[i]); {
+			case opt == "mkstream" && subCmd == "create":
+				mkStream = true
+			case opt == "entriesread" && i+1 < len(cmd.Args):
+				i++
+				n, ok := internal.ParseInt64(cmd.Args[i])
+				if !ok {
+					return resp.EncodeError("value is not an integer or out of range"), nil
+				}
+				if n < 0 && n != internal.StreamEntriesReadInvalid {
+					return resp.EncodeError("value for ENTRIESREAD must be positive or -1"), nil
+				}
+				entriesRead = n
+			default:
+				return resp.EncodeError("syntax error"), nil
+			}
+		}
+
+		var err error
+		if subCmd == "create" {
+			err = c.db.StreamGroupCreate(key, group, string(cmd.Args[3]), mkStream, entriesRead)
+		} else {
+			err = c.db.StreamGroupSetID(key, group, string(cmd.Args[3]), entriesRead)
 		}
-		parsedBlock, err := strconv.ParseInt(string(cmd.Args[1]), 10, 64)
 		if err != nil {
-			return resp.EncodeError("invalid block time"), nil
+			return encodeDBError(err), nil
 		}
-		blockMillis = parsedBlock
-		keyStartIndex += 2
-	case "streams":
-		break
+		return resp.EncodeSimpleString("OK"), nil
+	case "destroy":
+		destroyed, err := c.db.StreamGroupDestroy(key, group)
+		if err != nil {
+			return encodeDBError(err), nil
+		}
+		if destroyed {
+			return resp.EncodeInterger(1), nil
+		}
+		cmd.NoPropagate()
+		return resp.EncodeInterger(0), nil
+	case "createconsumer":
+		created, err := c.db.StreamGroupCreateConsumer(key, group, string(cmd.Args[3]))
+		if err != nil {
+			return encodeDBError(err), nil
+		}
+		if created {
+			return resp.EncodeInterger(1), nil
+		}
+		cmd.NoPropagate()
+		return resp.EncodeInterger(0), nil
 	default:
-		return nil, fmt.Errorf("not implemented")
+		pending, err := c.db.StreamGroupDeleteConsumer(key, group, string(cmd.Args[3]))
+		if err != nil {
+			return encodeDBError(err), nil
+		}
+		return resp.EncodeInterger(int64(pending)), nil
+	}
+}
+
+// XACK key group id [id ...]
+func xack(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	// All or nothing, the IDs are checked before acknowledging any
+	ids := make([]internal.StreamEntryID, 0, len(cmd.Args)-2)
+	for _, arg := range cmd.Args[2:] {
+		id, err := internal.ParseStreamEntryID(string(arg))
+		if err != nil {
+			return resp.EncodeError(invalidStreamID), nil
+		}
+		ids = append(ids, id)
 	}
 
-	if keyStartIndex >= len(cmd.Args) || (len(cmd.Args)-keyStartIndex)%2 != 0 {
-		return resp.EncodeError("wrong number of arguments for 'xread' command"), nil
+	acked, err := c.db.StreamAck(string(cmd.Args[0]), string(cmd.Args[1]), ids)
+	if err != nil {
+		return encodeDBError(err), nil
 	}
+	if acked == 0 {
+		cmd.NoPropagate()
+	}
+	return resp.EncodeInterger(int64(acked)), nil
+}
 
-	// if blockMillis == 0 {
-	// 	// c.sendBytes(resp.EncodeNullBulkString())
-	// }
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func xpending(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	key, group := string(cmd.Args[0]), string(cmd.Args[1])
 
-	keysLen := (len(cmd.Args) - keyStartIndex) / 2
-	keys := make([]string, keysLen)
-	entryRaws := make([]string, keysLen)
-	for i := keyStartIndex; i < keyStartIndex+keysLen; i++ {
-		keys[i-keyStartIndex] = string(cmd.Args[i])
-		entryRaws[i-keyStartIndex] = string(cmd.Args[i+keysLen])
+	if len(cmd.Args) == 2 {
+		summary, err := c.db.StreamPendingSummary(key, group)
+		if err != nil {
+			return encodeDBError(err), nil
+		}
+		if summary.Count == 0 {
+			return resp.EncodeArray([][]byte{
+				resp.EncodeInterger(0), resp.EncodeNullBulkString(), resp.EncodeNullBulkString(), resp.EncodeNullArray(),
+			}), nil
+		}
+		consumers := make([][]byte, len(summary.Consumers))
+		for i, consumer := range summary.Consumers {
+			consumers[i] = resp.EncodeArrayBulkStrings([]string{consumer.Name, strconv.Itoa(consumer.Count)})
+		}
+		return resp.EncodeArray([][]byte{
+			resp.EncodeInterger(int64(summary.Count)),
+			resp.EncodeBulkString(summary.MinID.String()),
+			resp.EncodeBulkString(summary.MaxID.String()),
+			resp.EncodeArray(consumers),
+		}), nil
+	}
+
+	args := cmd.Args[2:]
+	var minIdle int64
+	if ToLowerString(args[0]) == "idle" && len(args) > 1 {
+		n, ok := internal.ParseInt64(args[1])
+		if !ok {
+			return resp.EncodeError("value is not an integer or out of range"), nil
+		}
+		minIdle = n
+		args = args[2:]
+	}
+	if len(args) != 3 && len(args) != 4 {
+		return resp.EncodeError("syntax error"), nil
+	}
+	count, ok := internal.ParseInt64(args[2])
+	if !ok {
+		return resp.EncodeError("value is not an integer or out of range"), nil
+	}
+	consumer := ""
+	if len(args) == 4 {
+		consumer = string(args[3])
 	}
 
-	streamResults := s.db.StreamRead(keys, entryRaws, blockMillis)
-	readArr := make([][]byte, 0, len(streamResults))
+	entries, err := c.db.StreamPending(key, group, string(args[0]), string(args[1]), int(max(min(count, math.MaxInt32), 0)), consumer, minIdle)
+	if err != nil {
+		return encodeDBError(err), nil
+	}
+	reply := make([][]byte, len(entries))
+	for i, entry := range entries {
+		reply[i] = resp.EncodeArray([][]byte{
+			resp.EncodeBulkString(entry.ID.String()),
+			resp.EncodeBulkString(entry.Consumer),
+			resp.EncodeInterger(entry.IdleMilli),
+			resp.EncodeInterger(int64(entry.DeliveryCount)),
+		})
+	}
+	return resp.EncodeArray(reply), nil
+}
 
-	for i := 0; i < len(streamResults); i++ {
-		stream := streamResults[i]
-		if len(stream.EntryIDs) == 0 {
-			continue
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms]
+// [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+func xclaim(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	minIdle, ok := internal.ParseInt64(cmd.Args[3])
+	if !ok {
+		return resp.EncodeError("Invalid min-idle-time argument for XCLAIM"), nil
+	}
+	opts := internal.StreamClaimOptions{MinIdleMilli: max(minIdle, 0), DeliveryTime: -1, RetryCount: -1}
+
+	// The IDs go on until the first argument that isn't one, the options follow
+	ids := make([]internal.StreamEntryID, 0)
+	i := 4
+	for ; i < len(cmd.Args); i++ {
+		id, err := internal.ParseStreamEntryID(string(cmd.Args[i]))
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	for ; i < len(cmd.Args); i++ {
+		moreArgs := len(cmd.Args) - 1 - i
+		switch opt := ToLowerString(cmd.Args[i]); {
+		case opt == "force":
+			opts.Force = true
+		case opt == "justid":
+			opts.JustID = true
+		case opt == "idle" && moreArgs > 0:
+			i++
+			idle, ok := internal.ParseInt64(cmd.Args[i])
+			if !ok {
+				return resp.EncodeError("Invalid IDLE option argument for XCLAIM"), nil
+			}
+			opts.DeliveryTime = time.Now().UnixMilli() - idle
+		case opt == "time" && moreArgs > 0:
+			i++
+			deliveryTime, ok := internal.ParseInt64(cmd.Args[i])
+			if !ok {
+				return resp.EncodeError("Invalid TIME option argument for XCLAIM"), nil
+			}
+			opts.DeliveryTime = deliveryTime
+		case opt == "retrycount" && moreArgs > 0:
+			i++
+			retryCount, ok := internal.ParseInt64(cmd.Args[i])
+			if !ok {
+				return resp.EncodeError("Invalid RETRYCOUNT option argument for XCLAIM"), nil
+			}
+			opts.RetryCount = retryCount
+		case opt == "lastid" && moreArgs > 0:
+			i++
+			lastID, err := internal.ParseStreamEntryID(string(cmd.Args[i]))
+			if err != nil {
+				return resp.EncodeError(invalidStreamID), nil
+			}
+			opts.LastID = lastID
+		default:
+			return resp.EncodeError(fmt.Sprintf("Unrecognized XCLAIM option '%s'", cmd.Args[i])), nil
+		}
+	}
+
+	claimedIDs, claimedValues, propagate, err := c.db.StreamClaim(string(cmd.Args[0]), string(cmd.Args[1]), string(cmd.Args[2]), ids, opts)
+	cmd.RewriteAll(propagate)
+	if err != nil {
+		return encodeDBError(err), nil
+	}
+	if opts.JustID {
+		return encodeStreamIDs(claimedIDs), nil
+	}
+	return encodeStreamEntries(claimedIDs, claimedValues), nil
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func xautoclaim(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	minIdle, ok := internal.ParseInt64(cmd.Args[3])
+	if !ok {
+		return resp.EncodeError("Invalid min-idle-time argument for XAUTOCLAIM"), nil
+	}
+	count := 100
+	justID := false
+	for i := 5; i < len(cmd.Args); i++ {
+		switch opt := ToLowerString(cmd.Args[i]); {
+		case opt == "count" && i+1 < len(cmd.Args):
+			i++
+			n, ok := internal.ParseInt64(cmd.Args[i])
+			if !ok || n < 1 || n > math.MaxInt32 {
+				return resp.EncodeError("COUNT must be > 0"), nil
+			}
+			count = int(n)
+		case opt == "justid":
+			justID = true
+		default:
+			return resp.EncodeError("syntax error"), nil
 		}
+	}
+
+	res, err := c.db.StreamAutoClaim(string(cmd.Args[0]), string(cmd.Args[1]), string(cmd.Args[2]), max(minIdle, 0), string(cmd.Args[4]), count, justID)
+	cmd.RewriteAll(res.Propagate)
+	if err != nil {
+		return encodeDBError(err), nil
+	}
+	claimed := encodeStreamIDs(res.IDs)
+	if !justID {
+		claimed = encodeStreamEntries(res.IDs, res.Values)
+	}
+	return resp.EncodeArray([][]byte{
+		resp.EncodeBulkString(res.Next.String()),
+		claimed,
+		encodeStreamIDs(res.Deleted),
+	}), nil
+}
+
+func encodeStreamIDs(ids []internal.StreamEntryID) []byte {
+	reply := make([][]byte, len(ids))
+	for i, id := range ids {
+		reply[i] = resp.EncodeBulkString(id.String())
+	}
+	return resp.EncodeArray(reply)
+}
+
+var xinfoHelp = []string{
+	"XINFO <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"CONSUMERS <key> <groupname>",
+	"    Show consumers of <groupname>.",
+	"GROUPS <key>",
+	"    Show the stream consumer groups.",
+	"STREAM <key> [FULL [COUNT <count>]",
+	"    Show information about the stream.",
+	"HELP",
+	"    Print this help.",
+}
+
+func xinfo(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	subCmd := cmd.spec.name
+	if subCmd == "help" {
+		return encodeHelp(xinfoHelp), nil
+	}
+
+	key := string(cmd.Args[1])
+	var reply []byte
+	var err error
+	switch subCmd {
+	case "stream":
+		reply, err = xinfoStream(c, key, cmd.Args[2:])
+	case "groups":
+		var groups []internal.StreamGroupInfo
+		if groups, err = c.db.StreamGroupsInfo(key); err == nil {
+			reply = encodeStreamGroupsInfo(groups)
+		}
+	default:
+		var consumers []internal.StreamConsumerInfo
+		if consumers, err = c.db.StreamConsumersInfo(key, string(cmd.Args[2])); err == nil {
+			reply = encodeStreamConsumersInfo(consumers)
+		}
+	}
+	if err != nil {
+		if _, ok := err.(internal.KeyError); ok {
+			return resp.EncodeError("no such key"), nil
+		}
+		return encodeDBError(err), nil
+	}
+	return reply, nil
+}
+
+// XINFO STREAM key [FULL [COUNT count]]
+func xinfoStream(c *Connection, key string, args [][]byte) ([]byte, error) {
+	full := false
+	count := 10
+	if len(args) > 0 {
+		if ToLowerString(args[0]) != "full" {
+			return resp.EncodeError("syntax error"), nil
+		}
+		full = true
+		switch {
+		case len(args) == 3 && ToLowerString(args[1]) == "count":
+			n, ok := internal.ParseInt64(args[2])
+			if !ok {
+				return resp.EncodeError("value is not an integer or out of range"), nil
+			}
+			count = int(max(min(n, math.MaxInt32), 0))
+		case len(args) != 1:
+			return resp.EncodeError("syntax error"), nil
+		}
+	}
+
+	info, err := c.db.StreamInfo(key, full, count)
+	if err != nil {
+		return nil, err
+	}
 
-		streamArr := make([][]byte, 0, len(stream.EntryIDs)+1)
-		streamArr = append(streamArr, resp.EncodeBulkString(stream.Key))
-		listEntriesArr := make([][]byte, 0, len(stream.EntryIDs))
-		for i, id := range stream.EntryIDs {
-			entryArr := make([][]byte, 0, 2)
-			entryArr = append(entryArr, resp.EncodeBulkString(id.String()))
-			valueArr := make([][]byte, 0, len(stream.EntryValues[i])*2)
-			for key, val := range stream.EntryValues[i] {
-				valueArr = append(valueArr, resp.EncodeBulkString(key), resp.EncodeBulkString(string(val)))
+	reply := [][]byte{
+		resp.EncodeBulkString("length"), resp.EncodeInterger(int64(info.Length)),
+		resp.EncodeBulkString("radix-tree-keys"), resp.EncodeInterger(int64(info.RadixTreeKeys)),
+		resp.EncodeBulkString("radix-tree-nodes"), resp.EncodeInterger(int64(info.RadixTreeNodes)),
+		resp.EncodeBulkString("last-generated-id"), resp.EncodeBulkString(info.LastGeneratedID.String()),
+		resp.EncodeBulkString("max-deleted-entry-id"), resp.EncodeBulkString(info.MaxDeletedID.String()),
+		resp.EncodeBulkString("entries-added"), resp.EncodeInterger(int64(info.EntriesAdded)),
+		resp.EncodeBulkString("recorded-first-entry-id"), resp.EncodeBulkString(info.FirstID.String()),
+	}
+	if !full {
+		first, last := resp.EncodeNullBulkString(), resp.EncodeNullBulkString()
+		if len(info.EntryIDs) == 2 {
+			first = encodeStreamEntry(info.EntryIDs[0], info.EntryValues[0])
+			last = encodeStreamEntry(info.EntryIDs[1], info.EntryValues[1])
+		}
+		reply = append(reply,
+			resp.EncodeBulkString("groups"), resp.EncodeInterger(int64(info.NumGroups)),
+			resp.EncodeBulkString("first-entry"), first,
+			resp.EncodeBulkString("last-entry"), last,
+		)
+		return resp.EncodeArray(reply), nil
+	}
+
+	groups := make([][]byte, len(info.Groups))
+	for i, group := range info.Groups {
+		pending := make([][]byte, len(group.Pending))
+		for j, entry := range group.Pending {
+			pending[j] = resp.EncodeArray([][]byte{
+				resp.EncodeBulkString(entry.ID.String()),
+				resp.EncodeBulkString(entry.Consumer),
+				resp.EncodeInterger(entry.DeliveryTime),
+				resp.EncodeInterger(int64(entry.DeliveryCount)),
+			})
+		}
+		consumers := make([][]byte, len(group.Consumers))
+		for j, consumer := range group.Consumers {
+			consumerPending := make([][]byte, len(consumer.Pending))
+			for k, entry := range consumer.Pending {
+				consumerPending[k] = resp.EncodeArray([][]byte{
+					resp.EncodeBulkString(entry.ID.String()),
+					resp.EncodeInterger(entry.DeliveryTime),
+					resp.EncodeInterger(int64(entry.DeliveryCount)),
+				})
 			}
+			consumers[j] = resp.EncodeArray([][]byte{
+				resp.EncodeBulkString("name"), resp.EncodeBulkString(consumer.Name),
+				resp.EncodeBulkString("seen-time"), resp.EncodeInterger(consumer.SeenTime),
+				resp.EncodeBulkString("active-time"), resp.EncodeInterger(consumer.ActiveTime),
+				resp.EncodeBulkString("pel-count"), resp.EncodeInterger(int64(consumer.PelCount)),
+				resp.EncodeBulkString("pending"), resp.EncodeArray(consumerPending),
+			})
+		}
+		groups[i] = resp.EncodeArray([][]byte{
+			resp.EncodeBulkString("name"), resp.EncodeBulkString(group.Name),
+			resp.EncodeBulkString("last-delivered-id"), resp.EncodeBulkString(group.LastDeliveredID.String()),
+			resp.EncodeBulkString("entries-read"), encodeStreamCounter(group.EntriesRead),
+			resp.EncodeBulkString("lag"), encodeStreamCounter(group.Lag),
+			resp.EncodeBulkString("pel-count"), resp.EncodeInterger(int64(group.PelCount)),
+			resp.EncodeBulkString("pending"), resp.EncodeArray(pending),
+			resp.EncodeBulkString("consumers"), resp.EncodeArray(consumers),
+		})
+	}
+	reply = append(reply,
+		resp.EncodeBulkString("entries"), encodeStreamEntries(info.EntryIDs, info.EntryValues),
+		resp.EncodeBulkString("groups"), resp.EncodeArray(groups),
+	)
+	return resp.EncodeArray(reply), nil
+}
+
+func encodeStreamGroupsInfo(groups []internal.StreamGroupInfo) []byte {
+	reply := make([][]byte, len(groups))
+	for i, group := range groups {
+		reply[i] = resp.EncodeArray([][]byte{
+			resp.EncodeBulkString("name"), resp.EncodeBulkString(group.Name),
+			resp.EncodeBulkString("consumers"), resp.EncodeInterger(int64(group.NumConsumers)),
+			resp.EncodeBulkString("pending"), resp.EncodeInterger(int64(group.PelCount)),
+			resp.EncodeBulkString("last-delivered-id"), resp.EncodeBulkString(group.LastDeliveredID.String()),
+			resp.EncodeBulkString("entries-read"), encodeStreamCounter(group.EntriesRead),
+			resp.EncodeBulkString("lag"), encodeStreamCounter(group.Lag),
+		})
+	}
+	return resp.EncodeArray(reply)
+}
 
-			entryArr = append(entryArr, resp.EncodeArray(valueArr))
-			listEntriesArr = append(listEntriesArr, resp.EncodeArray(entryArr))
+func encodeStreamConsumersInfo(consumers []internal.StreamConsumerInfo) []byte {
+	reply := make([][]byte, len(consumers))
+	for i, consumer := range consumers {
+		reply[i] = resp.EncodeArray([][]byte{
+			resp.EncodeBulkString("name"), resp.EncodeBulkString(consumer.Name),
+			resp.EncodeBulkString("pending"), resp.EncodeInterger(int64(consumer.PelCount)),
+			resp.EncodeBulkString("idle"), resp.EncodeInterger(consumer.IdleMilli),
+			resp.EncodeBulkString("inactive"), resp.EncodeInterger(consumer.InactiveMilli),
+		})
+	}
+	return resp.EncodeArray(reply)
+}
+
+// Entries read and lag of a group are null when unknown
+func encodeStreamCounter(n int64) []byte {
+	if n == internal.StreamEntriesReadInvalid {
+		return resp.EncodeNullBulkString()
+	}
+	return resp.EncodeInterger(n)
+}
+
+// XSETID key last-id [ENTRIESADDED entries-added] [MAXDELETEDID max-deleted-id]
+func xsetid(s *Server, c *Connection, cmd *Command) ([]byte, error) {
+	id, err := internal.ParseStreamEntryID(string(cmd.Args[1]))
+	if err != nil {
+		return resp.EncodeError(invalidStreamID), nil
+	}
+	var entriesAdded int64 = -1
+	var maxDeletedID internal.StreamEntryID
+	for i := 2; i < len(cmd.Args); i += 2 {
+		if i+1 >= len(cmd.Args) {
+			return resp.EncodeError("syntax error"), nil
+		}
+		switch ToLowerString(cmd.Args[i]) {
+		case "entriesadded":
+			n, ok := internal.ParseInt64(cmd.Args[i+1])
+			if !ok {
+				return resp.EncodeError("value is not an integer or out of range"), nil
+			}
+			if n < 0 {
+				return resp.EncodeError("entries_added must be positive"), nil
+			}
+			entriesAdded = n
+		case "maxdeletedid":
+			if maxDeletedID, err = internal.ParseStreamEntryID(string(cmd.Args[i+1])); err != nil {
+				return resp.EncodeError(invalidStreamID), nil
+			}
+		default:
+			return resp.EncodeError("syntax error"), nil
 		}
-		streamArr = append(streamArr, resp.EncodeArray(listEntriesArr))
-		readArr = append(readArr, resp.EncodeArray(streamArr))
 	}
 
-	if len(readArr) == 0 {
-		return resp.EncodeNullBulkString(), nil
+	if err := c.db.StreamSetID(string(cmd.Args[0]), id, entriesAdded, maxDeletedID); err != nil {
+		if _, ok := err.(internal.KeyError); ok {
+			return resp.EncodeError("no such key"), nil
+		}
+		return encodeDBError(err), nil
 	}
-	return resp.EncodeArray(readArr), nil
+	return resp.EncodeSimpleString(OK), nil
 }
 
-func unknown(s *Server, c *Connection, cmd *Command) ([]byte, error) {
-	return resp.EncodeError("unknown command"), nil
+// Map errors returned by internal.DB to their RESP error reply
+func encodeDBError(err error) []byte {
+	switch err.(type) {
+	case *internal.TypeMismatchError:
+		return resp.EncodeErrorNoPrefix(WRONGTYPE)
+	case *internal.BusyKeyError, *internal.BusyGroupError, *internal.NoGroupError:
+		return resp.EncodeErrorNoPrefix(err.Error())
+	default:
+		return resp.EncodeError(err.Error())
+	}
 }
@@ -0,0 +1,762 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Connection that keeps what the server writes to it
+type recordConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+	closed  bool
+}
+
+func (r *recordConn) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.written.Write(b)
+}
+
+func (r *recordConn) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+// What was written since the last call
+func (r *recordConn) take() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	written := r.written.String()
+	r.written.Reset()
+	return written
+}
+
+func newTestServer() *Server {
+	return NewServer(ServerOptions{Databases: 2})
+}
+
+func newTestConnection(t *testing.T, s *Server) *Connection {
+	c := NewConnection(getConnID(), &recordConn{})
+	if !c.selectDB(s, 0) {
+		t.Fatal("no db 0")
+	}
+	return c
+}
+
+func parseCommand(t *testing.T, args ...string) *Command {
+	raw := resp.EncodeArrayBulkStrings(args)
+	rp, err := resp.ReadNextResp(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := ParseCommandFromRESP(rp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+// Handle args as a command sent by c and return its raw reply
+func runCommand(t *testing.T, s *Server, c *Connection, args ...string) string {
+	cmd := parseCommand(t, args...)
+	conn := c.conn.(*recordConn)
+	conn.take()
+	if err := HandleCommand(s, c, cmd); err != nil {
+		t.Fatal(err)
+	}
+	return received(t, c)
+}
+
+// What was written to c since the last call, once its output buffer is
+// written out
+func received(t *testing.T, c *Connection) string {
+	if c.out != nil {
+		assert.Eventually(t, func() bool {
+			c.out.mu.Lock()
+			defer c.out.mu.Unlock()
+			return !c.out.writing
+		}, time.Second, time.Millisecond)
+	}
+	return c.conn.(*recordConn).take()
+}
+
+// Register a replica with s, what the master propagates to it is recorded
+func addTestReplica(s *Server) *recordConn {
+	conn := &recordConn{}
+	id := getConnID()
+	s.asMaster.slaves[id] = &Slave{connection: NewConnection(id, conn)}
+	return conn
+}
+
+// What the replica got since the last call, waiting for the write of the
+// previous command if needed
+func replicated(t *testing.T, replica *recordConn) string {
+	var got string
+	assert.Eventually(t, func() bool {
+		got = replica.take()
+		return got != ""
+	}, time.Second, time.Millisecond)
+	return got
+}
+
+// Run the commands of a replication stream on a replica
+func applyReplicated(t *testing.T, replica *Server, c *Connection, stream string) {
+	reader := bufio.NewReader(strings.NewReader(stream))
+	for {
+		if _, err := reader.Peek(1); err != nil {
+			break
+		}
+		rp, err := resp.ReadNextResp(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd, err := ParseCommandFromRESP(rp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := HandleCommand(replica, c, cmd); err != nil {
+			t.Fatal(err)
+		}
+		if reply := received(t, c); strings.HasPrefix(reply, "-") {
+			t.Errorf("%s: %s", cmd.Raw, reply)
+		}
+	}
+}
+
+func encodeCommand(args ...string) string {
+	return string(resp.EncodeArrayBulkStrings(args))
+}
+
+func TestIntegerArgsAreStrict(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+	notInteger := "-ERR value is not an integer or out of range\r\n"
+
+	for _, arg := range []string{"+5", "05", " 5", "5 ", ""} {
+		assert.Equal(t, notInteger, runCommand(t, s, c, "INCRBY", "n", arg), arg)
+		assert.Equal(t, notInteger, runCommand(t, s, c, "DECRBY", "n", arg), arg)
+		assert.Equal(t, notInteger, runCommand(t, s, c, "SET", "k", "v", "EX", arg), arg)
+		assert.Equal(t, notInteger, runCommand(t, s, c, "EXPIRE", "k", arg), arg)
+	}
+	assert.Equal(t, ":-5\r\n", runCommand(t, s, c, "INCRBY", "n", "-5"))
+	assert.Equal(t, "+OK\r\n", runCommand(t, s, c, "SET", "k", "v", "PX", "100000"))
+	assert.Equal(t, ":1\r\n", runCommand(t, s, c, "EXPIRE", "k", "100"))
+}
+
+// Replies as given by Redis 7.4 for the same commands
+func TestStreamRepliesKeepFieldOrder(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+
+	assert.Equal(t, "$3\r\n1-1\r\n", runCommand(t, s, c, "XADD", "s", "1-1", "b", "1", "a", "2"))
+	// Duplicate fields are kept
+	assert.Equal(t, "$3\r\n1-2\r\n", runCommand(t, s, c, "XADD", "s", "1-2", "b", "3", "a", "4", "b", "5"))
+	// Same fields as the first entry, in another order
+	assert.Equal(t, "$3\r\n1-3\r\n", runCommand(t, s, c, "XADD", "s", "1-3", "a", "6", "b", "7"))
+
+	assert.Equal(t,
+		"*3\r\n"+
+			"*2\r\n$3\r\n1-1\r\n*4\r\n$1\r\nb\r\n$1\r\n1\r\n$1\r\na\r\n$1\r\n2\r\n"+
+			"*2\r\n$3\r\n1-2\r\n*6\r\n$1\r\nb\r\n$1\r\n3\r\n$1\r\na\r\n$1\r\n4\r\n$1\r\nb\r\n$1\r\n5\r\n"+
+			"*2\r\n$3\r\n1-3\r\n*4\r\n$1\r\na\r\n$1\r\n6\r\n$1\r\nb\r\n$1\r\n7\r\n",
+		runCommand(t, s, c, "XRANGE", "s", "-", "+"))
+
+	assert.Equal(t,
+		"*1\r\n*2\r\n$1\r\ns\r\n*1\r\n"+
+			"*2\r\n$3\r\n1-2\r\n*6\r\n$1\r\nb\r\n$1\r\n3\r\n$1\r\na\r\n$1\r\n4\r\n$1\r\nb\r\n$1\r\n5\r\n",
+		runCommand(t, s, c, "XREAD", "COUNT", "1", "STREAMS", "s", "1-1"))
+
+	assert.Equal(t,
+		"*1\r\n*2\r\n$3\r\n1-3\r\n*4\r\n$1\r\na\r\n$1\r\n6\r\n$1\r\nb\r\n$1\r\n7\r\n",
+		runCommand(t, s, c, "XREVRANGE", "s", "+", "-", "COUNT", "1"))
+}
+
+func TestOnlyWritesPropagate(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+	replica := addTestReplica(s)
+	runCommand(t, s, c, "SET", "k", "v")
+	replicated(t, replica)
+
+	for _, tc := range []struct {
+		args       []string
+		propagated bool
+	}{
+		{[]string{"GET", "k"}, false},
+		{[]string{"XGROUP", "HELP"}, false},
+		{[]string{"ECHO", "x"}, false},
+		{[]string{"PUBLISH", "ch", "hi"}, true},
+		{[]string{"SPUBLISH", "ch", "hi"}, true},
+		{[]string{"XGROUP", "CREATE", "s", "g", "$", "MKSTREAM"}, true},
+		{[]string{"XINFO", "GROUPS", "s"}, false},
+	} {
+		runCommand(t, s, c, tc.args...)
+		if tc.propagated {
+			assert.Equal(t, encodeCommand(tc.args...), replicated(t, replica))
+		}
+	}
+	runCommand(t, s, c, "DEL", "k")
+	assert.Equal(t, encodeCommand("DEL", "k"), replicated(t, replica))
+}
+
+func TestStreamWritesPropagate(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+	for i := 1; i <= 250; i++ {
+		runCommand(t, s, c, "XADD", "s", strconv.Itoa(i)+"-1", "f", "v")
+	}
+	replica := addTestReplica(s)
+
+	// The generated ID is sent
+	runCommand(t, s, c, "XADD", "s", "251-*", "f", "v")
+	assert.Equal(t, encodeCommand("XADD", "s", "251-0", "f", "v"), replicated(t, replica))
+
+	// "~" only removes whole nodes, replicas remove exactly as many entries
+	assert.Equal(t, ":200\r\n", runCommand(t, s, c, "XTRIM", "s", "MAXLEN", "~", "10"))
+	assert.Equal(t, encodeCommand("XTRIM", "s", "MAXLEN", "=", "51"), replicated(t, replica))
+	runCommand(t, s, c, "XADD", "s", "MINID", "~", "249", "LIMIT", "100", "252-1", "f", "v")
+	assert.Equal(t, encodeCommand("XADD", "s", "MINID", "=", "201-1", "252-1", "f", "v"), replicated(t, replica))
+
+	// Writes that change nothing, or fail, aren't sent
+	runCommand(t, s, c, "XDEL", "s", "1-1")
+	runCommand(t, s, c, "XTRIM", "s", "MAXLEN", "100")
+	runCommand(t, s, c, "XADD", "missing", "NOMKSTREAM", "*", "f", "v")
+	runCommand(t, s, c, "XADD", "s", "1-1", "f", "v")
+	runCommand(t, s, c, "SET", "k", "v", "EX", "x")
+	runCommand(t, s, c, "XDEL", "s", "252-1")
+	assert.Equal(t, encodeCommand("XDEL", "s", "252-1"), replicated(t, replica))
+}
+
+func TestStreamGroupWritesPropagate(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+	replica := addTestReplica(s)
+
+	var stream string
+	for _, tc := range []struct {
+		args       []string
+		propagated bool
+	}{
+		{[]string{"XGROUP", "CREATE", "s", "g", "0", "MKSTREAM"}, true},
+		{[]string{"XADD", "s", "1-1", "f", "v"}, true},
+		{[]string{"XADD", "s", "2-1", "f", "v"}, true},
+		{[]string{"XADD", "s", "3-1", "f", "v"}, true},
+		{[]string{"XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">"}, true},
+		{[]string{"XREADGROUP", "GROUP", "g", "bob", "NOACK", "STREAMS", "s", ">"}, true},
+		{[]string{"XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">"}, false},
+		{[]string{"XCLAIM", "s", "g", "bob", "0", "1-1"}, true},
+		{[]string{"XCLAIM", "s", "g", "bob", "0", "3-1"}, false},
+		{[]string{"XDEL", "s", "2-1"}, true},
+		{[]string{"XAUTOCLAIM", "s", "g", "carol", "0", "0"}, true},
+		{[]string{"XACK", "s", "g", "3-1"}, false},
+		{[]string{"XCLAIM", "s", "g", "bob", "0", "3-1", "FORCE", "RETRYCOUNT", "5"}, true},
+		{[]string{"XACK", "s", "g", "1-1"}, true},
+		{[]string{"XGROUP", "CREATECONSUMER", "s", "g", "dave"}, true},
+		{[]string{"XGROUP", "CREATECONSUMER", "s", "g", "dave"}, false},
+		{[]string{"XGROUP", "DELCONSUMER", "s", "g", "dave"}, true},
+		{[]string{"XGROUP", "CREATE", "s", "other", "$"}, true},
+		{[]string{"XGROUP", "DESTROY", "s", "other"}, true},
+		{[]string{"XGROUP", "DESTROY", "s", "other"}, false},
+		{[]string{"XSETID", "s", "3-1", "ENTRIESADDED", "3", "MAXDELETEDID", "2-1"}, true},
+	} {
+		runCommand(t, s, c, tc.args...)
+		if tc.propagated {
+			stream += replicated(t, replica)
+		}
+	}
+	// Nothing more than expected was sent
+	runCommand(t, s, c, "XACK", "s", "g", "3-1")
+	assert.Equal(t, encodeCommand("XACK", "s", "g", "3-1"), replicated(t, replica))
+
+	// The replica ends up with the same groups
+	r := newTestServer()
+	rc := newTestConnection(t, r)
+	applyReplicated(t, r, rc, stream)
+	runCommand(t, r, rc, "XACK", "s", "g", "3-1")
+	for _, args := range [][]string{
+		{"XINFO", "GROUPS", "s"},
+		{"XPENDING", "s", "g"},
+		{"XLEN", "s"},
+	} {
+		assert.Equal(t, runCommand(t, s, c, args...), runCommand(t, r, rc, args...), args)
+	}
+	assert.Contains(t, runCommand(t, r, rc, "XINFO", "CONSUMERS", "s", "g"), "carol")
+}
+
+func TestWatch(t *testing.T) {
+	s := newTestServer()
+	c, other := newTestConnection(t, s), newTestConnection(t, s)
+	runCommand(t, s, c, "SET", "k", "1")
+
+	// Untouched keys, EXEC runs
+	assert.Equal(t, "+OK\r\n", runCommand(t, s, c, "WATCH", "k", "missing"))
+	runCommand(t, s, other, "SET", "unwatched", "1")
+	runCommand(t, s, c, "MULTI")
+	assert.Equal(t, "+QUEUED\r\n", runCommand(t, s, c, "INCR", "k"))
+	assert.Equal(t, "*1\r\n:2\r\n", runCommand(t, s, c, "EXEC"))
+
+	// EXEC unwatched the keys, a later change doesn't count
+	runCommand(t, s, other, "SET", "k", "10")
+	runCommand(t, s, c, "MULTI")
+	runCommand(t, s, c, "INCR", "k")
+	assert.Equal(t, "*1\r\n:11\r\n", runCommand(t, s, c, "EXEC"))
+
+	// Changed by another client, nothing runs
+	runCommand(t, s, c, "WATCH", "k")
+	runCommand(t, s, other, "SET", "k", "100")
+	runCommand(t, s, c, "MULTI")
+	assert.Equal(t, "-ERR WATCH inside MULTI is not allowed\r\n", runCommand(t, s, c, "WATCH", "x"))
+	runCommand(t, s, c, "INCR", "k")
+	assert.Equal(t, "*-1\r\n", runCommand(t, s, c, "EXEC"))
+	assert.Equal(t, "$3\r\n100\r\n", runCommand(t, s, c, "GET", "k"))
+
+	// Keys are watched in the db selected at WATCH
+	runCommand(t, s, c, "WATCH", "k")
+	runCommand(t, s, other, "SELECT", "1")
+	runCommand(t, s, other, "SET", "k", "1")
+	runCommand(t, s, c, "MULTI")
+	runCommand(t, s, c, "INCR", "k")
+	assert.Equal(t, "*1\r\n:101\r\n", runCommand(t, s, c, "EXEC"))
+
+	// Flushes and UNWATCH
+	runCommand(t, s, c, "WATCH", "k")
+	runCommand(t, s, other, "FLUSHALL")
+	runCommand(t, s, c, "MULTI")
+	assert.Equal(t, "*-1\r\n", runCommand(t, s, c, "EXEC"))
+	runCommand(t, s, c, "WATCH", "k")
+	runCommand(t, s, other, "SET", "k", "1")
+	assert.Equal(t, "+OK\r\n", runCommand(t, s, c, "UNWATCH"))
+	runCommand(t, s, c, "MULTI")
+	assert.Equal(t, "*0\r\n", runCommand(t, s, c, "EXEC"))
+}
+
+func TestExecRepliesLineUp(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+
+	runCommand(t, s, c, "SET", "str", "v")
+	runCommand(t, s, c, "MULTI")
+	assert.Equal(t, "-ERR MULTI calls can not be nested\r\n", runCommand(t, s, c, "MULTI"))
+	runCommand(t, s, c, "INCR", "n")
+	runCommand(t, s, c, "XADD", "str", "*", "f", "v")
+	runCommand(t, s, c, "GET", "missing")
+	runCommand(t, s, c, "INCR", "n")
+	assert.Equal(t,
+		"*4\r\n:1\r\n-"+WRONGTYPE+"\r\n$-1\r\n:2\r\n",
+		runCommand(t, s, c, "EXEC"))
+	assert.Equal(t, "-ERR EXEC without MULTI\r\n", runCommand(t, s, c, "EXEC"))
+}
+
+func TestExecAbort(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+
+	for _, bad := range [][]string{{"GET"}, {"NOSUCHCOMMAND", "x"}} {
+		runCommand(t, s, c, "MULTI")
+		runCommand(t, s, c, "INCR", "n")
+		reply := runCommand(t, s, c, bad...)
+		assert.True(t, strings.HasPrefix(reply, "-ERR "), reply)
+		assert.Equal(t, "+QUEUED\r\n", runCommand(t, s, c, "INCR", "n"))
+		assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", runCommand(t, s, c, "EXEC"))
+	}
+	assert.Equal(t, "$-1\r\n", runCommand(t, s, c, "GET", "n"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command\r\n", runCommand(t, s, c, "GET"))
+}
+
+func TestExecRejectsNoMultiCommands(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+
+	for _, args := range [][]string{{"SAVE"}, {"PSYNC", "?", "-1"}} {
+		runCommand(t, s, c, "MULTI")
+		runCommand(t, s, c, "INCR", "n")
+		assert.Equal(t, "-ERR Command not allowed inside a transaction\r\n", runCommand(t, s, c, args...))
+		assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", runCommand(t, s, c, "EXEC"))
+	}
+	assert.Equal(t, "$-1\r\n", runCommand(t, s, c, "GET", "n"))
+}
+
+func TestExecDoesntBlock(t *testing.T) {
+	s := newTestServer()
+	c, blocked := newTestConnection(t, s), newTestConnection(t, s)
+
+	// A transaction doesn't block, and runs while another client blocks
+	done := make(chan string)
+	go func() {
+		done <- runCommand(t, s, blocked, "XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	runCommand(t, s, c, "MULTI")
+	runCommand(t, s, c, "XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+	runCommand(t, s, c, "XADD", "s", "1-1", "f", "v")
+	assert.Equal(t, "*2\r\n*-1\r\n$3\r\n1-1\r\n", runCommand(t, s, c, "EXEC"))
+	select {
+	case reply := <-done:
+		assert.Contains(t, reply, "1-1")
+	case <-time.After(time.Second):
+		t.Fatal("XREAD wasn't woken up")
+	}
+}
+
+func TestExecIsolated(t *testing.T) {
+	s := newTestServer()
+	c, other := newTestConnection(t, s), newTestConnection(t, s)
+	runCommand(t, s, c, "SET", "n", "0")
+
+	// Other clients never see the transaction half done
+	var wg sync.WaitGroup
+	started, stop := make(chan struct{}), make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		close(started)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if reply := runCommand(t, s, other, "GET", "n"); reply != "$1\r\n0\r\n" {
+				t.Errorf("GET n in the middle of a transaction: %q", reply)
+				return
+			}
+		}
+	}()
+	<-started
+	for i := 0; i < 200; i++ {
+		runCommand(t, s, c, "MULTI")
+		for j := 0; j < 100; j++ {
+			runCommand(t, s, c, "INCR", "n")
+		}
+		runCommand(t, s, c, "DECRBY", "n", "100")
+		runCommand(t, s, c, "EXEC")
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestSlowReaderDoesntBlock(t *testing.T) {
+	s := newTestServer()
+	stuck := &stuckConn{closed: make(chan struct{})}
+	slow, c, other := NewConnection(getConnID(), stuck), newTestConnection(t, s), newTestConnection(t, s)
+	slow.selectDB(s, 0)
+
+	// A client that doesn't read its replies holds up neither transactions
+	// nor the commands queued behind them
+	done := make(chan error)
+	go func() {
+		done <- HandleCommand(s, slow, parseCommand(t, "GET", "k"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		runCommand(t, s, c, "MULTI")
+		runCommand(t, s, c, "SET", "k", "v")
+		assert.Equal(t, "*1\r\n+OK\r\n", runCommand(t, s, c, "EXEC"))
+		assert.Equal(t, "$1\r\nv\r\n", runCommand(t, s, other, "GET", "k"))
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("blocked by a client that doesn't read")
+	}
+
+	stuck.Close()
+	assert.ErrorIs(t, <-done, net.ErrClosed)
+}
+
+func TestExecPropagates(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+	replica := addTestReplica(s)
+	runCommand(t, s, c, "SET", "str", "v")
+	replicated(t, replica)
+
+	// The writes that ran go out at once, with the db they ran against
+	runCommand(t, s, c, "MULTI")
+	runCommand(t, s, c, "INCR", "n")
+	runCommand(t, s, c, "GET", "n")
+	runCommand(t, s, c, "INCR", "str")
+	runCommand(t, s, c, "SELECT", "1")
+	runCommand(t, s, c, "SET", "k", "v")
+	runCommand(t, s, c, "EXEC")
+	stream := replicated(t, replica)
+	assert.Equal(t,
+		encodeCommand("MULTI")+
+			encodeCommand("INCR", "n")+
+			encodeCommand("SELECT", "1")+
+			encodeCommand("SET", "k", "v")+
+			encodeCommand("EXEC"),
+		stream)
+
+	// A transaction that writes nothing sends nothing
+	runCommand(t, s, c, "MULTI")
+	runCommand(t, s, c, "GET", "k")
+	runCommand(t, s, c, "DEL", "missing")
+	runCommand(t, s, c, "EXEC")
+	runCommand(t, s, c, "SET", "k", "w")
+	assert.Equal(t, encodeCommand("SET", "k", "w"), replicated(t, replica))
+
+	// The replica runs the transaction
+	r := newTestServer()
+	rc := newTestConnection(t, r)
+	applyReplicated(t, r, rc, stream)
+	assert.Equal(t, "$1\r\nv\r\n", runCommand(t, r, rc, "GET", "k"))
+	runCommand(t, r, rc, "SELECT", "0")
+	assert.Equal(t, "$1\r\n1\r\n", runCommand(t, r, rc, "GET", "n"))
+}
+
+// Replies as given by Redis 7.4 for the same commands
+func TestCommandInfo(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+
+	assert.Equal(t, ":"+strconv.Itoa(len(commandTable))+"\r\n", runCommand(t, s, c, "COMMAND", "COUNT"))
+	assert.Equal(t,
+		"*2\r\n"+
+			"*10\r\n$3\r\nget\r\n:2\r\n*2\r\n+readonly\r\n+fast\r\n:1\r\n:1\r\n:1\r\n"+
+			"*3\r\n+@read\r\n+@string\r\n+@fast\r\n*0\r\n"+
+			"*1\r\n*6\r\n"+
+			"$5\r\nflags\r\n*2\r\n+RO\r\n+access\r\n"+
+			"$12\r\nbegin_search\r\n*4\r\n$4\r\ntype\r\n$5\r\nindex\r\n$4\r\nspec\r\n*2\r\n$5\r\nindex\r\n:1\r\n"+
+			"$9\r\nfind_keys\r\n*4\r\n$4\r\ntype\r\n$5\r\nrange\r\n$4\r\nspec\r\n*6\r\n$7\r\nlastkey\r\n:0\r\n$7\r\nkeystep\r\n:1\r\n$5\r\nlimit\r\n:0\r\n"+
+			"*0\r\n"+
+			"$-1\r\n",
+		runCommand(t, s, c, "COMMAND", "INFO", "GET", "nosuchcommand"))
+
+	// Keys after a keyword are movable, and not in the legacy key range
+	reply := runCommand(t, s, c, "COMMAND", "INFO", "xread")
+	assert.Contains(t, reply, "*3\r\n+readonly\r\n+blocking\r\n+movablekeys\r\n:0\r\n:0\r\n:0\r\n")
+	assert.Contains(t, reply, "*4\r\n$7\r\nkeyword\r\n$7\r\nSTREAMS\r\n$9\r\nstartfrom\r\n:1\r\n")
+
+	assert.Contains(t, runCommand(t, s, c, "COMMAND", "INFO", "object|encoding"), "$15\r\nobject|encoding\r\n:3\r\n")
+	assert.Equal(t,
+		"*2\r\n$3\r\nget\r\n*6\r\n"+
+			"$7\r\nsummary\r\n$34\r\nReturns the string value of a key.\r\n"+
+			"$5\r\nsince\r\n$5\r\n1.0.0\r\n"+
+			"$5\r\ngroup\r\n$6\r\nstring\r\n",
+		runCommand(t, s, c, "COMMAND", "DOCS", "get", "nosuchcommand"))
+}
+
+func TestCommandList(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+
+	assert.Equal(t,
+		"*5\r\n$7\r\ndiscard\r\n$4\r\nexec\r\n$5\r\nmulti\r\n$7\r\nunwatch\r\n$5\r\nwatch\r\n",
+		runCommand(t, s, c, "COMMAND", "LIST", "FILTERBY", "ACLCAT", "transaction"))
+	assert.Equal(t,
+		"*5\r\n$5\r\nxinfo\r\n$15\r\nxinfo|consumers\r\n$12\r\nxinfo|groups\r\n$12\r\nxinfo|stream\r\n$10\r\nxinfo|help\r\n",
+		runCommand(t, s, c, "COMMAND", "LIST", "FILTERBY", "PATTERN", "xinfo*"))
+	assert.Equal(t, "*0\r\n", runCommand(t, s, c, "COMMAND", "LIST", "FILTERBY", "MODULE", "json"))
+	assert.Equal(t, "*0\r\n", runCommand(t, s, c, "COMMAND", "LIST", "FILTERBY", "ACLCAT", "nosuchcategory"))
+	assert.Equal(t, "-ERR syntax error\r\n", runCommand(t, s, c, "COMMAND", "LIST", "FILTERBY", "NAME", "get"))
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+
+	for _, tc := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"get", "k"}, "*1\r\n$1\r\nk\r\n"},
+		{[]string{"xread", "COUNT", "1", "STREAMS", "a", "b", "0", "0"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"xreadgroup", "GROUP", "g", "c", "STREAMS", "a", ">"}, "*1\r\n$1\r\na\r\n"},
+		{[]string{"object", "encoding", "k"}, "*1\r\n$1\r\nk\r\n"},
+		{[]string{"watch", "a", "b", "c"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"ping"}, "-ERR The command has no key arguments\r\n"},
+		{[]string{"nosuchcommand", "k"}, "-ERR Invalid command specified\r\n"},
+		{[]string{"get"}, "-ERR Invalid number of arguments specified for command\r\n"},
+		{[]string{"xread", "COUNT", "1"}, "-ERR Invalid number of arguments specified for command\r\n"},
+		{[]string{"xread", "COUNT", "1", "BLOCK", "0"}, "-ERR Invalid arguments specified for command\r\n"},
+	} {
+		args := append([]string{"COMMAND", "GETKEYS"}, tc.args...)
+		assert.Equal(t, tc.reply, runCommand(t, s, c, args...), tc.args)
+	}
+}
+
+// Unknown commands and wrong arities are rejected before any handler runs
+func TestCommandTableErrors(t *testing.T) {
+	s := newTestServer()
+	c := newTestConnection(t, s)
+
+	assert.Equal(t,
+		"-ERR unknown command 'nosuchcommand', with args beginning with: 'a' 'b' \r\n",
+		runCommand(t, s, c, "NOSUCHCOMMAND", "a", "b"))
+	assert.Equal(t,
+		"-ERR unknown subcommand 'NOPE'. Try OBJECT HELP.\r\n",
+		runCommand(t, s, c, "OBJECT", "NOPE", "k"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'object' command\r\n", runCommand(t, s, c, "OBJECT"))
+	assert.Equal(t,
+		"-ERR wrong number of arguments for 'object|encoding' command\r\n",
+		runCommand(t, s, c, "OBJECT", "ENCODING"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'xadd' command\r\n", runCommand(t, s, c, "XADD", "s", "*"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'ttl' command\r\n", runCommand(t, s, c, "TTL", "a", "b"))
+
+	// Option counts past the arity are syntax errors
+	assert.Equal(t, "-ERR syntax error\r\n", runCommand(t, s, c, "SET", "k", "v", "EX"))
+	assert.Equal(t, "-ERR syntax error\r\n", runCommand(t, s, c, "XRANGE", "s", "-", "+", "COUNT"))
+}
+
+// Replies as given by Redis 7.4 for the same commands
+func TestPubSub(t *testing.T) {
+	s := newTestServer()
+	sub, other := newTestConnection(t, s), newTestConnection(t, s)
+
+	// Subscribing again still gets a reply
+	assert.Equal(t,
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n"+
+			"*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n"+
+			"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:2\r\n",
+		runCommand(t, s, sub, "SUBSCRIBE", "a", "b", "a"))
+	assert.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$5\r\nh?llo\r\n:3\r\n", runCommand(t, s, sub, "PSUBSCRIBE", "h?llo"))
+
+	// Only the pubsub commands run while subscribed
+	assert.Equal(t,
+		"-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n",
+		runCommand(t, s, sub, "GET", "k"))
+	assert.Equal(t, "*2\r\n$4\r\npong\r\n$0\r\n\r\n", runCommand(t, s, sub, "PING"))
+	assert.Equal(t, "*2\r\n$4\r\npong\r\n$2\r\nhi\r\n", runCommand(t, s, sub, "PING", "hi"))
+
+	assert.Equal(t, ":1\r\n", runCommand(t, s, other, "PUBLISH", "a", "hi"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$2\r\nhi\r\n", received(t, sub))
+	assert.Equal(t, ":1\r\n", runCommand(t, s, other, "PUBLISH", "hello", "x"))
+	assert.Equal(t, "*4\r\n$8\r\npmessage\r\n$5\r\nh?llo\r\n$5\r\nhello\r\n$1\r\nx\r\n", received(t, sub))
+	assert.Equal(t, ":0\r\n", runCommand(t, s, other, "PUBLISH", "c", "x"))
+
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", runCommand(t, s, other, "PUBSUB", "CHANNELS"))
+	assert.Equal(t, "*1\r\n$1\r\na\r\n", runCommand(t, s, other, "PUBSUB", "CHANNELS", "[ac]"))
+	assert.Equal(t, "*4\r\n$1\r\na\r\n:1\r\n$1\r\nc\r\n:0\r\n", runCommand(t, s, other, "PUBSUB", "NUMSUB", "a", "c"))
+	assert.Equal(t, ":1\r\n", runCommand(t, s, other, "PUBSUB", "NUMPAT"))
+	assert.Contains(t, runCommand(t, s, other, "INFO", "stats"), "pubsub_channels:2\npubsub_patterns:1\n")
+
+	// Everything, with a reply per channel
+	assert.Equal(t,
+		"*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:2\r\n*3\r\n$11\r\nunsubscribe\r\n$1\r\nb\r\n:1\r\n",
+		runCommand(t, s, sub, "UNSUBSCRIBE"))
+	assert.Equal(t, "*3\r\n$12\r\npunsubscribe\r\n$5\r\nh?llo\r\n:0\r\n", runCommand(t, s, sub, "PUNSUBSCRIBE"))
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n", runCommand(t, s, sub, "UNSUBSCRIBE"))
+	assert.Equal(t, "$-1\r\n", runCommand(t, s, sub, "GET", "k"))
+	assert.Equal(t, ":0\r\n", runCommand(t, s, other, "PUBLISH", "a", "hi"))
+	assert.Equal(t, "*0\r\n", runCommand(t, s, other, "PUBSUB", "CHANNELS"))
+}
+
+func TestPubSubReset(t *testing.T) {
+	s := newTestServer()
+	sub, other := newTestConnection(t, s), newTestConnection(t, s)
+
+	runCommand(t, s, sub, "SELECT", "1")
+	runCommand(t, s, sub, "SUBSCRIBE", "a")
+	runCommand(t, s, sub, "PSUBSCRIBE", "*")
+	assert.Equal(t, ":2\r\n", runCommand(t, s, other, "PUBLISH", "a", "hi"))
+	received(t, sub)
+
+	// No more subscriptions, nor unsubscribe replies
+	assert.Equal(t, "+RESET\r\n", runCommand(t, s, sub, "RESET"))
+	assert.Equal(t, ":0\r\n", runCommand(t, s, other, "PUBLISH", "a", "hi"))
+	assert.Equal(t, "", received(t, sub))
+	assert.Equal(t, 0, sub.dbIndex)
+
+	assert.Equal(t, "+OK\r\n", runCommand(t, s, sub, "QUIT"))
+	assert.True(t, sub.closeAfterReply)
+}
+
+// Connection that never gets written to, like a client that stopped reading
+type stuckConn struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *stuckConn) Write(b []byte) (int, error) {
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+func (c *stuckConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestPubSubSlowSubscriber(t *testing.T) {
+	s := NewServer(ServerOptions{Databases: 1, PubSubOutputLimit: 1000})
+	stuck := &stuckConn{closed: make(chan struct{})}
+	sub, other := NewConnection(getConnID(), stuck), newTestConnection(t, s)
+	sub.selectDB(s, 0)
+	if err := HandleCommand(s, sub, parseCommand(t, "SUBSCRIBE", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// PUBLISH doesn't wait, the subscriber is disconnected past the limit
+	message := strings.Repeat("x", 100)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, ":1\r\n", runCommand(t, s, other, "PUBLISH", "a", message))
+	}
+	select {
+	case <-stuck.closed:
+	default:
+		t.Fatal("subscriber over the limit wasn't disconnected")
+	}
+	assert.Equal(t, int64(1), s.stats.outputLimitDisconnections.Load())
+	assert.Contains(t, runCommand(t, s, other, "INFO", "stats"), "client_output_buffer_limit_disconnections:1")
+}
+
+func TestShardPubSub(t *testing.T) {
+	s := newTestServer()
+	sub, other := newTestConnection(t, s), newTestConnection(t, s)
+
+	assert.Equal(t,
+		"*3\r\n$10\r\nssubscribe\r\n$4\r\n{u}a\r\n:1\r\n*3\r\n$10\r\nssubscribe\r\n$4\r\n{u}b\r\n:2\r\n",
+		runCommand(t, s, sub, "SSUBSCRIBE", "{u}a", "{u}b"))
+	// There's no cluster, the channels of a command can be in any slot
+	assert.Equal(t,
+		"*3\r\n$10\r\nssubscribe\r\n$1\r\na\r\n:3\r\n*3\r\n$10\r\nssubscribe\r\n$1\r\nb\r\n:4\r\n",
+		runCommand(t, s, sub, "SSUBSCRIBE", "a", "b"))
+	assert.Equal(t,
+		"*3\r\n$12\r\nsunsubscribe\r\n$1\r\na\r\n:3\r\n*3\r\n$12\r\nsunsubscribe\r\n$1\r\nb\r\n:2\r\n",
+		runCommand(t, s, sub, "SUNSUBSCRIBE", "a", "b"))
+	// Shard channels are counted apart
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$4\r\n{u}a\r\n:1\r\n", runCommand(t, s, sub, "SUBSCRIBE", "{u}a"))
+
+	assert.Equal(t, ":1\r\n", runCommand(t, s, other, "SPUBLISH", "{u}a", "hi"))
+	assert.Equal(t, "*3\r\n$8\r\nsmessage\r\n$4\r\n{u}a\r\n$2\r\nhi\r\n", received(t, sub))
+	assert.Equal(t, ":0\r\n", runCommand(t, s, other, "SPUBLISH", "{u}c", "hi"))
+	assert.Equal(t, ":1\r\n", runCommand(t, s, other, "PUBLISH", "{u}a", "hi"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$4\r\n{u}a\r\n$2\r\nhi\r\n", received(t, sub))
+
+	assert.Equal(t, "*2\r\n$4\r\n{u}a\r\n$4\r\n{u}b\r\n", runCommand(t, s, other, "PUBSUB", "SHARDCHANNELS"))
+	assert.Equal(t, "*1\r\n$4\r\n{u}b\r\n", runCommand(t, s, other, "PUBSUB", "SHARDCHANNELS", "*b"))
+	assert.Equal(t, "*4\r\n$4\r\n{u}a\r\n:1\r\n$4\r\n{u}c\r\n:0\r\n", runCommand(t, s, other, "PUBSUB", "SHARDNUMSUB", "{u}a", "{u}c"))
+	assert.Contains(t, runCommand(t, s, other, "INFO", "stats"), "pubsub_channels:1\npubsub_patterns:0\npubsubshard_channels:2\n")
+
+	// Still subscribed to shard channels
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$4\r\n{u}a\r\n:0\r\n", runCommand(t, s, sub, "UNSUBSCRIBE"))
+	assert.Contains(t, runCommand(t, s, sub, "GET", "k"), "-ERR Can't execute 'get'")
+	assert.Equal(t,
+		"*3\r\n$12\r\nsunsubscribe\r\n$4\r\n{u}a\r\n:1\r\n*3\r\n$12\r\nsunsubscribe\r\n$4\r\n{u}b\r\n:0\r\n",
+		runCommand(t, s, sub, "SUNSUBSCRIBE"))
+	assert.Equal(t, "*3\r\n$12\r\nsunsubscribe\r\n$-1\r\n:0\r\n", runCommand(t, s, sub, "SUNSUBSCRIBE"))
+	assert.Equal(t, "$-1\r\n", runCommand(t, s, sub, "GET", "k"))
+
+	// Shard channels are declared as keys that aren't
+	assert.Contains(t, runCommand(t, s, other, "COMMAND", "INFO", "ssubscribe"), "$10\r\nssubscribe\r\n:-2\r\n*4\r\n+pubsub\r\n+noscript\r\n+loading\r\n+stale\r\n:1\r\n:-1\r\n:1\r\n")
+	assert.Equal(t, "-ERR Invalid arguments specified for command\r\n", runCommand(t, s, other, "COMMAND", "GETKEYS", "spublish", "ch", "hi"))
+}
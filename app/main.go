@@ -2,6 +2,9 @@ package main
 
 import (
 	"flag"
+	"log"
+
+	"github.com/codecrafters-io/redis-starter-go/internal"
 )
 
 func main() {
@@ -9,14 +12,51 @@ func main() {
 	dir := flag.String("dir", "/tmp/redis-files", "Directory to store RDB files")
 	replicaof := flag.String("replicaof", "", "Replica of host:port")
 	dbFileName := flag.String("dbfilename", "dump.rdb", "Name of the RDB file")
+	databases := flag.Int("databases", 16, "Number of logical databases")
+	maxMemory := flag.String("maxmemory", "0", "Memory limit of the dataset, e.g. 100mb, 0 for no limit")
+	maxMemoryPolicy := flag.String("maxmemory-policy", "noeviction", "How to pick the keys to evict when over maxmemory")
+	maxMemorySamples := flag.Int("maxmemory-samples", 5, "Keys sampled to approximate the LRU, LFU and TTL policies")
+	defaultTTL := flag.Int64("default-ttl-ms", 0, "Non-standard: expire keys SET without EX/PX after this many milliseconds (0 = never)")
+	pubsubOutputLimit := flag.String("client-output-buffer-limit-pubsub", "32mb", "Messages queued for a subscriber before it's disconnected, e.g. 32mb, 0 for no limit")
 
 	flag.Parse()
 
+	if *databases < 1 {
+		log.Fatalln("databases must be at least 1")
+	}
+	maxMemoryBytes, ok := ParseMemory(*maxMemory)
+	if !ok {
+		log.Fatalln("invalid maxmemory:", *maxMemory)
+	}
+	policy, ok := internal.ParseEvictionPolicy(*maxMemoryPolicy)
+	if !ok {
+		log.Fatalln("invalid maxmemory-policy:", *maxMemoryPolicy)
+	}
+	if *maxMemorySamples < 1 {
+		log.Fatalln("maxmemory-samples must be at least 1")
+	}
+	if *defaultTTL < 0 {
+		log.Fatalln("default-ttl-ms must not be negative")
+	}
+	pubsubOutputLimitBytes, ok := ParseMemory(*pubsubOutputLimit)
+	if !ok {
+		log.Fatalln("invalid client-output-buffer-limit-pubsub:", *pubsubOutputLimit)
+	}
+
 	server := NewServer(ServerOptions{
 		Port:       *port,
 		DbFilename: *dbFileName,
 		Dir:        *dir,
 		Replicaof:  *replicaof,
+		Databases:  *databases,
+
+		MaxMemory:        maxMemoryBytes,
+		MaxMemoryPolicy:  policy,
+		MaxMemorySamples: *maxMemorySamples,
+
+		DefaultTTLMilli: *defaultTTL,
+
+		PubSubOutputLimit: pubsubOutputLimitBytes,
 	})
 
 	server.Run()
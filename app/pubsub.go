@@ -0,0 +1,260 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/internal"
+	"github.com/codecrafters-io/redis-starter-go/resp"
+)
+
+/*
+Publish/Subscribe: clients subscribe to channels, or to glob-style patterns
+of channels, and get the messages PUBLISHed to them. A client with
+subscriptions is in the subscribed mode, where only the pubsub commands run.
+
+Shard channels are the same but for SPUBLISH, and hash to cluster slots like
+keys, see KeyHashSlot. Without a cluster a single shard serves every slot, so
+the channels of a command don't have to share one.
+
+Messages are queued to the output buffer of each subscriber, see
+outputBuffer, so PUBLISH never waits on a slow subscriber.
+*/
+
+// What a client subscribes to
+type subKind int
+
+const (
+	subChannel subKind = iota
+	subPattern
+	subShard
+	numSubKinds
+)
+
+// Names in the replies, per kind
+var subKindNames = [numSubKinds]struct{ subscribe, unsubscribe, message string }{
+	subChannel: {"subscribe", "unsubscribe", "message"},
+	subPattern: {"psubscribe", "punsubscribe", "pmessage"},
+	subShard:   {"ssubscribe", "sunsubscribe", "smessage"},
+}
+
+// The subscribers of every channel, pattern and shard channel, like Redis'
+// server.pubsub_channels, server.pubsub_patterns and server.pubsubshard_channels
+type pubSub struct {
+	mu          sync.RWMutex
+	subscribers [numSubKinds]map[string]map[*Connection]struct{}
+}
+
+func newPubSub() *pubSub {
+	ps := &pubSub{}
+	for kind := range ps.subscribers {
+		ps.subscribers[kind] = make(map[string]map[*Connection]struct{})
+	}
+	return ps
+}
+
+// The count given in the replies of the (un)subscribe commands of kind:
+// channels and patterns are counted together, shard channels apart
+func (c *Connection) subscriptionCount(kind subKind) int {
+	if kind == subShard {
+		return len(c.subs[subShard])
+	}
+	return len(c.subs[subChannel]) + len(c.subs[subPattern])
+}
+
+// In the subscribed mode, only the pubsub commands can run
+func (c *Connection) subscribed() bool {
+	return c.subscriptionCount(subChannel) > 0 || c.subscriptionCount(subShard) > 0
+}
+
+// Subscribe c to names, replying with one confirmation per name
+func (ps *pubSub) subscribe(s *Server, c *Connection, kind subKind, names [][]byte) []byte {
+	if c.out == nil {
+		c.out = newOutputBuffer(c.conn, s.options.PubSubOutputLimit, func() {
+			s.stats.outputLimitDisconnections.Add(1)
+		})
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var replies []byte
+	for _, name := range names {
+		name := string(name)
+		if _, ok := c.subs[kind][name]; !ok {
+			if c.subs[kind] == nil {
+				c.subs[kind] = make(map[string]struct{})
+			}
+			c.subs[kind][name] = struct{}{}
+			ps.addLocked(c, kind, name)
+		}
+		replies = append(replies, encodeSubscription(subKindNames[kind].subscribe, &name, c.subscriptionCount(kind))...)
+	}
+	return ps.confirmLocked(c, replies)
+}
+
+// Unsubscribe c from names, or from everything of kind when there are none,
+// replying with one confirmation per name
+func (ps *pubSub) unsubscribe(c *Connection, kind subKind, names [][]byte) []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var replies []byte
+	if len(names) == 0 {
+		if len(c.subs[kind]) == 0 {
+			// Still a reply, saying there's nothing left
+			replies = encodeSubscription(subKindNames[kind].unsubscribe, nil, c.subscriptionCount(kind))
+		}
+		for _, name := range sortedSubscriptions(c.subs[kind]) {
+			delete(c.subs[kind], name)
+			ps.removeLocked(c, kind, name)
+			replies = append(replies, encodeSubscription(subKindNames[kind].unsubscribe, &name, c.subscriptionCount(kind))...)
+		}
+		return ps.confirmLocked(c, replies)
+	}
+
+	for _, name := range names {
+		name := string(name)
+		if _, ok := c.subs[kind][name]; ok {
+			delete(c.subs[kind], name)
+			ps.removeLocked(c, kind, name)
+		}
+		replies = append(replies, encodeSubscription(subKindNames[kind].unsubscribe, &name, c.subscriptionCount(kind))...)
+	}
+	return ps.confirmLocked(c, replies)
+}
+
+// Forget all the subscriptions of c without replying, when it's closed or RESET
+func (ps *pubSub) unsubscribeAll(c *Connection) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for kind := range c.subs {
+		for name := range c.subs[kind] {
+			ps.removeLocked(c, subKind(kind), name)
+		}
+		c.subs[kind] = nil
+	}
+}
+
+// The confirmations are queued while ps.mu is held so they come before any
+// message on the new subscriptions. In EXEC nothing else runs, they're the
+// reply to the command, same for a client that never subscribed.
+func (ps *pubSub) confirmLocked(c *Connection, replies []byte) []byte {
+	if c.inExec || c.out == nil {
+		return replies
+	}
+	c.out.push(replies)
+	return nil
+}
+
+func (ps *pubSub) addLocked(c *Connection, kind subKind, name string) {
+	conns, ok := ps.subscribers[kind][name]
+	if !ok {
+		conns = make(map[*Connection]struct{})
+		ps.subscribers[kind][name] = conns
+	}
+	conns[c] = struct{}{}
+}
+
+func (ps *pubSub) removeLocked(c *Connection, kind subKind, name string) {
+	conns := ps.subscribers[kind][name]
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(ps.subscribers[kind], name)
+	}
+}
+
+// Send message to the subscribers of channel and of the patterns matching
+// it, returning how many got it. A client subscribed to both gets it twice.
+func (ps *pubSub) publish(channel, message []byte) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	receivers := ps.publishLocked(subChannel, channel, message)
+	for pattern, conns := range ps.subscribers[subPattern] {
+		if !internal.GlobMatch(pattern, string(channel), false) {
+			continue
+		}
+		reply := resp.EncodeArray([][]byte{
+			resp.EncodeBulkString(subKindNames[subPattern].message),
+			resp.EncodeBulkString(pattern),
+			resp.EncodeBulkString(string(channel)),
+			resp.EncodeBulkString(string(message)),
+		})
+		for c := range conns {
+			c.out.push(reply)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// Send message to the subscribers of the shard channel, returning how many got it
+func (ps *pubSub) spublish(channel, message []byte) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.publishLocked(subShard, channel, message)
+}
+
+func (ps *pubSub) publishLocked(kind subKind, channel, message []byte) int {
+	conns, ok := ps.subscribers[kind][string(channel)]
+	if !ok {
+		return 0
+	}
+	reply := resp.EncodeArray([][]byte{
+		resp.EncodeBulkString(subKindNames[kind].message),
+		resp.EncodeBulkString(string(channel)),
+		resp.EncodeBulkString(string(message)),
+	})
+	for c := range conns {
+		c.out.push(reply)
+	}
+	return len(conns)
+}
+
+// Channels, or shard channels, with subscribers matching pattern, all of
+// them if it's empty
+func (ps *pubSub) channels(kind subKind, pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	names := make([]string, 0)
+	for name := range ps.subscribers[kind] {
+		if pattern == "" || internal.GlobMatch(pattern, name, false) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ps *pubSub) numSubscribers(kind subKind, name string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.subscribers[kind][name])
+}
+
+// Number of channels, patterns or shard channels with subscribers
+func (ps *pubSub) count(kind subKind) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.subscribers[kind])
+}
+
+// [kind, name, count], name is null when there's none
+func encodeSubscription(kind string, name *string, count int) []byte {
+	encodedName := resp.EncodeNullBulkString()
+	if name != nil {
+		encodedName = resp.EncodeBulkString(*name)
+	}
+	return resp.EncodeArray([][]byte{
+		resp.EncodeBulkString(kind),
+		encodedName,
+		resp.EncodeInterger(int64(count)),
+	})
+}
+
+func sortedSubscriptions(subs map[string]struct{}) []string {
+	names := make([]string, 0, len(subs))
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime/metrics"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,26 +20,54 @@ import (
 	"github.com/codecrafters-io/redis-starter-go/resp"
 )
 
+const (
+	serverCronInterval      = 100 * time.Millisecond // how often serverCron runs its background jobs, Redis' default hz is 10
+	activeExpireCycleBudget = 25 * time.Millisecond  // max time spent expiring keys per cron run, over all dbs
+)
+
 type ServerOptions struct {
 	Replicaof  string
 	DbFilename string
 	Dir        string
 	Port       int
+	Databases  int
+
+	MaxMemory        int64 // bytes, 0 for no limit
+	MaxMemoryPolicy  internal.EvictionPolicy
+	MaxMemorySamples int
+
+	DefaultTTLMilli int64
+
+	PubSubOutputLimit int64 // bytes of messages queued for a subscriber before it's disconnected, 0 for no limit
 }
 
 type Server struct {
-	db       *internal.DB
+	dbs      []*internal.DB // logical databases, picked with SELECT
+	evictor  *internal.Evictor
+	options  ServerOptions
 	port     int
 	isMaster bool
 	asMaster AsMasterInfo
 	asSlave  AsSlaveInfo
+	stats    serverStats
+	pubsub   *pubSub
 	mu       *sync.Mutex
+	cmdMu    *sync.RWMutex // held for reading by every command, for writing by EXEC so transactions run alone
+}
+
+type serverStats struct {
+	expiredStalePerc atomic.Uint64 // float64 bits, running estimate of expired keys still in memory
+	expireDB         int           // db the next active expire cycle starts with, only used by serverCron
+	peakAllocated    atomic.Int64  // highest heap size seen, for MEMORY STATS
+
+	outputLimitDisconnections atomic.Int64 // subscribers closed for going over PubSubOutputLimit
 }
 
 type AsMasterInfo struct {
 	repl_id     string
 	repl_offset int64
 	slaves      map[ConnectionID]*Slave
+	selectedDB  int // db of the last command sent to the replicas, -1 to send a SELECT first
 }
 
 type Slave struct {
@@ -56,8 +87,11 @@ type AsSlaveInfo struct {
 
 func NewServer(options ServerOptions) *Server {
 	server := &Server{
-		port: options.Port,
-		mu:   &sync.Mutex{},
+		options: options,
+		port:    options.Port,
+		pubsub:  newPubSub(),
+		mu:      &sync.Mutex{},
+		cmdMu:   &sync.RWMutex{},
 	}
 
 	if options.Replicaof == "" {
@@ -65,6 +99,7 @@ func NewServer(options ServerOptions) *Server {
 		server.asMaster.repl_id = generateReplId()
 		server.asMaster.repl_offset = 0
 		server.asMaster.slaves = make(map[ConnectionID]*Slave)
+		server.asMaster.selectedDB = -1
 	} else {
 		server.isMaster = false
 		splitted := strings.Split(options.Replicaof, " ")
@@ -81,13 +116,24 @@ func NewServer(options ServerOptions) *Server {
 		server.asSlave.masterPort = port
 	}
 
-	server.db = internal.NewDB(internal.DBOptions{Dir: options.Dir, DbFilename: options.DbFilename})
+	server.dbs = make([]*internal.DB, options.Databases)
+	for i := range server.dbs {
+		server.dbs[i] = internal.NewDB(internal.DBOptions{
+			Dir:             options.Dir,
+			DbFilename:      options.DbFilename,
+			DefaultTTLMilli: options.DefaultTTLMilli,
+			MaxMemoryPolicy: options.MaxMemoryPolicy,
+			CommandLock:     server.cmdMu.RLocker(),
+		})
+	}
+	server.evictor = internal.NewEvictor(server.dbs, options.MaxMemory, options.MaxMemoryPolicy, options.MaxMemorySamples)
 	return server
 }
 
 func (s *Server) Run() {
 	// Load the RDB file -> has to be executed first
 	s.loadRDB()
+	go s.serverCron()
 
 	if !s.isMaster {
 		// sync with master after the server is up the running
@@ -128,6 +174,8 @@ func (s *Server) Run() {
 func (s *Server) handleConnection(c *Connection) {
 	defer func() {
 		c.conn.Close()
+		c.unwatch()
+		s.pubsub.unsubscribeAll(c)
 		// TODO: move this logic to be handled by the master struct
 		if s.isMaster {
 			s.mu.Lock()
@@ -137,6 +185,7 @@ func (s *Server) handleConnection(c *Connection) {
 	}()
 
 	log.Println("Handling connection from:", c.conn.RemoteAddr())
+	c.selectDB(s, 0)
 
 	for {
 		rp, err := resp.ReadNextResp(c.reader)
@@ -145,8 +194,19 @@ func (s *Server) handleConnection(c *Connection) {
 				log.Println("Client closed connection")
 				break
 			}
-			log.Fatalln("Error reading RESP", err)
-			continue
+			if errors.Is(err, net.ErrClosed) {
+				// QUIT, or a subscriber over its output buffer limit
+				log.Println("Connection closed")
+				break
+			}
+			// A reset by a subscriber gone with messages unread, or garbage:
+			// only this connection ends
+			log.Println("Error reading RESP", err)
+			var protoErr *resp.ProtocolError
+			if errors.As(err, &protoErr) {
+				c.sendBytes(resp.EncodeError(protoErr.Error()))
+			}
+			break
 		}
 
 		command, err := ParseCommandFromRESP(rp)
@@ -161,28 +221,87 @@ func (s *Server) handleConnection(c *Connection) {
 			log.Fatalf("Error handling command %v: %v", command, err)
 			continue
 		}
+		if c.closeAfterReply {
+			break
+		}
+	}
+}
+
+// Background jobs that run periodically for the lifetime of the server
+func (s *Server) serverCron() {
+	ticker := time.NewTicker(serverCronInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Keys don't expire in the middle of a transaction
+		s.cmdMu.RLock()
+		s.activeExpireCycle()
+		s.cmdMu.RUnlock()
+		s.allocatedMemory()
+	}
+}
+
+// Run the active expire cycle of the dbs in turn within activeExpireCycleBudget,
+// resuming with the db where the previous run ran out of time
+func (s *Server) activeExpireCycle() {
+	deadline := time.Now().Add(activeExpireCycleBudget)
+	var sampled, expired int
+	for i := 0; i < len(s.dbs) && time.Now().Before(deadline); i++ {
+		db := s.dbs[s.stats.expireDB]
+		s.stats.expireDB = (s.stats.expireDB + 1) % len(s.dbs)
+		n, e := db.ActiveExpireCycle(deadline)
+		sampled += n
+		expired += e
+	}
+
+	var stalePerc float64
+	if sampled > 0 {
+		stalePerc = float64(expired) / float64(sampled)
+	}
+	prev := math.Float64frombits(s.stats.expiredStalePerc.Load())
+	s.stats.expiredStalePerc.Store(math.Float64bits(stalePerc*0.05 + prev*0.95))
+}
+
+// Bytes of heap in use, recording the peak
+func (s *Server) allocatedMemory() int64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	allocated := int64(sample[0].Value.Uint64())
+	for {
+		peak := s.stats.peakAllocated.Load()
+		if allocated <= peak || s.stats.peakAllocated.CompareAndSwap(peak, allocated) {
+			return allocated
+		}
 	}
 }
 
 func (s *Server) loadRDB() {
-	if IsEmptyOrWhitespace(s.db.Options.Dir) || IsEmptyOrWhitespace(s.db.Options.DbFilename) {
+	if IsEmptyOrWhitespace(s.options.Dir) || IsEmptyOrWhitespace(s.options.DbFilename) {
 		return
 	}
 
-	rdbPath := filepath.Join(s.db.Options.Dir, s.db.Options.DbFilename)
 	rdbReader := internal.NewRDBReader()
-	data, err := rdbReader.LoadFile(rdbPath)
+	rdbReader.EvictionPolicy = s.options.MaxMemoryPolicy
+	dbs, err := rdbReader.LoadFile(s.rdbPath())
 	if err != nil {
 		log.Fatal("Can't load the provided RDB file:", err)
 		panic(err)
 	}
-	if data == nil {
+	if dbs == nil {
 		log.Println("Starting a clean DB")
 		return
 	}
 
-	log.Printf("Initing db with %d keys\n", len(data))
-	s.db.InitStorage(data)
+	for idx, data := range dbs {
+		if idx >= len(s.dbs) {
+			log.Fatalf("FATAL: Data file was created with a Redis server configured to handle more than %d databases", len(s.dbs))
+		}
+		log.Printf("Initing db %d with %d keys\n", idx, len(data))
+		s.dbs[idx].InitStorage(data)
+	}
+}
+
+func (s *Server) rdbPath() string {
+	return filepath.Join(s.options.Dir, s.options.DbFilename)
 }
 
 func generateReplId() string {
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// Clients blocked on keys, like Redis' blocking_keys. A blocked client
+// registers a waiter on all its keys before checking them, then sleeps until
+// one of them is signaled or its timeout expires, and checks them again.
+
+type keyWaiter struct {
+	ch   chan struct{} // buffered, so a signal while checking the keys isn't lost
+	lock sync.Locker   // released while waiting, may be nil
+}
+
+type keyWaiters struct {
+	keys map[string]map[*keyWaiter]struct{}
+	lock sync.Locker // DBOptions.CommandLock
+	mu   sync.Mutex
+}
+
+func newKeyWaiters(lock sync.Locker) *keyWaiters {
+	return &keyWaiters{keys: make(map[string]map[*keyWaiter]struct{}), lock: lock}
+}
+
+// Register a waiter on keys, it must be removed once done
+func (w *keyWaiters) add(keys []string) *keyWaiter {
+	waiter := &keyWaiter{ch: make(chan struct{}, 1), lock: w.lock}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		waiters, ok := w.keys[key]
+		if !ok {
+			waiters = make(map[*keyWaiter]struct{})
+			w.keys[key] = waiters
+		}
+		waiters[waiter] = struct{}{}
+	}
+	return waiter
+}
+
+func (w *keyWaiters) remove(waiter *keyWaiter, keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		waiters := w.keys[key]
+		delete(waiters, waiter)
+		if len(waiters) == 0 {
+			delete(w.keys, key)
+		}
+	}
+}
+
+// Wake up all the waiters on key
+func (w *keyWaiters) signal(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for waiter := range w.keys[key] {
+		select {
+		case waiter.ch <- struct{}{}:
+		default: // already signaled
+		}
+	}
+}
+
+// Block until the waiter is signaled or the deadline passes, return false on timeout
+func (waiter *keyWaiter) wait(deadline <-chan time.Time) bool {
+	if waiter.lock != nil {
+		waiter.lock.Unlock()
+		defer waiter.lock.Lock()
+	}
+	select {
+	case <-waiter.ch:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+// Timer channel for a timeout in milliseconds, nil to wait forever for 0
+func blockDeadline(blockMilli int64) (<-chan time.Time, func()) {
+	if blockMilli <= 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Duration(blockMilli) * time.Millisecond)
+	return timer.C, func() { timer.Stop() }
+}
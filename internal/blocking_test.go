@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Run StreamRead in the background
+func streamReadAsync(db *DB, keys, starts []string, blockMilli int64) <-chan []XReadKeyResult {
+	done := make(chan []XReadKeyResult, 1)
+	go func() {
+		res, _ := db.StreamRead(keys, starts, 0, blockMilli)
+		done <- res
+	}()
+	return done
+}
+
+// Wait until n clients are blocked on key
+func waitBlocked(t *testing.T, db *DB, key string, n int) {
+	assert.Eventually(t, func() bool {
+		db.waiters.mu.Lock()
+		defer db.waiters.mu.Unlock()
+		return len(db.waiters.keys[key]) == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestStreamReadBlockWakesOnAdd(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 1)
+
+	// Many clients on the same key, one on a key that doesn't exist yet
+	first := streamReadAsync(db, []string{"s"}, []string{"$"}, 0)
+	second := streamReadAsync(db, []string{"other", "s"}, []string{"$", "$"}, 10000)
+	missing := streamReadAsync(db, []string{"missing"}, []string{"$"}, 0)
+	waitBlocked(t, db, "s", 2)
+	waitBlocked(t, db, "missing", 1)
+
+	start := time.Now()
+	fillStream(t, db, "s", 2, 2)
+	for _, done := range []<-chan []XReadKeyResult{first, second} {
+		res := <-done
+		assert.Len(t, res, 1)
+		assert.Equal(t, "s", res[0].Key)
+		assert.Equal(t, []StreamEntryID{{2, 1}}, res[0].EntryIDs)
+	}
+	assert.Less(t, time.Since(start), time.Second)
+
+	fillStream(t, db, "missing", 1, 1)
+	res := <-missing
+	assert.Equal(t, []StreamEntryID{{1, 1}}, res[0].EntryIDs)
+
+	// Nobody is left waiting
+	db.waiters.mu.Lock()
+	assert.Empty(t, db.waiters.keys)
+	db.waiters.mu.Unlock()
+}
+
+func TestStreamReadBlockTimeout(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 1)
+
+	start := time.Now()
+	res, err := db.StreamRead([]string{"s"}, []string{"$"}, 0, 50)
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// Entries already there are returned without waiting
+	res, _ = db.StreamRead([]string{"s"}, []string{"0"}, 0, 10000)
+	assert.Len(t, res, 1)
+}
+
+func TestStreamReadGroupBlock(t *testing.T) {
+	db := NewDB(DBOptions{})
+	assert.NoError(t, db.StreamGroupCreate("s", "g", "$", true, StreamEntriesReadInvalid))
+
+	done := make(chan error, 1)
+	go func() {
+		res, _, err := db.StreamReadGroup("g", "c", []string{"s"}, []string{">"}, 0, false, 0)
+		if err == nil {
+			assert.Equal(t, []StreamEntryID{{1, 1}}, res[0].EntryIDs)
+		}
+		done <- err
+	}()
+	waitBlocked(t, db, "s", 1)
+	fillStream(t, db, "s", 1, 1)
+	assert.NoError(t, <-done)
+
+	// Destroying the group wakes its readers up
+	go func() {
+		_, _, err := db.StreamReadGroup("g", "c", []string{"s"}, []string{">"}, 0, false, 0)
+		done <- err
+	}()
+	waitBlocked(t, db, "s", 1)
+	_, err := db.StreamGroupDestroy("s", "g")
+	assert.NoError(t, err)
+	assert.IsType(t, &NoGroupError{}, <-done)
+}
@@ -0,0 +1,45 @@
+package internal
+
+import "strings"
+
+// Redis Cluster hashes keys, and shard channels, to slots with CRC-16 XMODEM:
+// polynomial 0x1021, no initial or final inversion
+var crc16Table = makeCrc16Table(0x1021)
+
+func makeCrc16Table(poly uint16) *[256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return &table
+}
+
+func crc16(p []byte) uint16 {
+	var crc uint16
+	for _, b := range p {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+const ClusterSlots = 16384
+
+// KeyHashSlot is the cluster slot of key. When key has a non empty hash tag,
+// the part between the first '{' and the next '}', only the tag is hashed so
+// keys sharing it end up in the same slot.
+func KeyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16([]byte(key))) & (ClusterSlots - 1)
+}
@@ -0,0 +1,25 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrc16(t *testing.T) {
+	// Check value from Redis' crc16.c
+	assert.EqualValues(t, uint16(0x31c3), crc16([]byte("123456789")))
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	// Slots as given by CLUSTER KEYSLOT
+	assert.Equal(t, 12182, KeyHashSlot("foo"))
+	assert.Equal(t, 866, KeyHashSlot("hello"))
+	assert.Equal(t, KeyHashSlot("user1000"), KeyHashSlot("{user1000}.following"))
+	assert.Equal(t, KeyHashSlot("user1000"), KeyHashSlot("a{user1000}b{other}"))
+
+	// Empty or unclosed tags, the whole key is hashed
+	assert.Equal(t, int(crc16([]byte("{}foo"))&16383), KeyHashSlot("{}foo"))
+	assert.Equal(t, int(crc16([]byte("foo{bar"))&16383), KeyHashSlot("foo{bar"))
+	assert.NotEqual(t, KeyHashSlot("{}foo"), KeyHashSlot("{}bar"))
+}
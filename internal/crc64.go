@@ -0,0 +1,13 @@
+package internal
+
+import "hash/crc64"
+
+// Redis checksums RDB files and DUMP payloads with the CRC-64 Jones variant:
+// reflected polynomial 0xad93d23594c935a9, no initial or final inversion
+var crc64JonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// Continue the checksum crc with p, start with 0
+func crc64Jones(crc uint64, p []byte) uint64 {
+	// hash/crc64 inverts the crc before and after, undo both
+	return ^crc64.Update(^crc, crc64JonesTable, p)
+}
@@ -0,0 +1,15 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrc64Jones(t *testing.T) {
+	// Check value from Redis' crc64.c
+	assert.EqualValues(t, uint64(0xe9c6d914c4b8d9ca), crc64Jones(0, []byte("123456789")))
+
+	crc := crc64Jones(0, []byte("1234"))
+	assert.EqualValues(t, uint64(0xe9c6d914c4b8d9ca), crc64Jones(crc, []byte("56789")))
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -9,74 +10,179 @@ type Value struct {
 	Data             ValueData
 	Type             ValueType
 	ExpiredTimeMilli int64
+
+	access *accessInfo // LRU/LFU bookkeeping for eviction, set when stored
+	memory int64       // bytes accounted in db.usedMemory when stored
 }
 
-type storage map[string]Value
+func (v Value) isExpired(nowMilli int64) bool {
+	return v.ExpiredTimeMilli > 0 && v.ExpiredTimeMilli < nowMilli
+}
 
 type DB struct {
-	Options *DBOptions
-	storage storage
-	mu      *sync.RWMutex
+	Options      *DBOptions
+	id           uint64 // orders the locks of operations spanning two dbs
+	storage      *dict[Value]
+	expires      *dict[int64] // keys with an expiry -> ExpiredTimeMilli, scanned by the active expire cycle
+	expireCursor uint64       // where the next active expire cycle resumes scanning expires
+	usedMemory   atomic.Int64 // approximate bytes of the keys and values
+	stats        dbStats
+	waiters      *keyWaiters  // clients blocked on keys of this db
+	watchers     *keyWatchers // WATCHes on keys of this db
+	mu           *sync.RWMutex
 }
 
-func NewDB(options DBOptions) *DB {
-	if options.ExpiryTime == 0 {
-		options.ExpiryTime = 60_000 // 1 minute
-	}
+var nextDBID atomic.Uint64
 
+func NewDB(options DBOptions) *DB {
 	return &DB{
-		Options: &options,
-		storage: make(map[string]Value),
-		mu:      &sync.RWMutex{},
+		Options:  &options,
+		id:       nextDBID.Add(1),
+		storage:  newDict[Value](),
+		expires:  newDict[int64](),
+		waiters:  newKeyWaiters(options.CommandLock),
+		watchers: newKeyWatchers(),
+		mu:       &sync.RWMutex{},
 	}
 }
 
-func (db *DB) Snapshot() storage {
+// Snapshot returns a copy of the keys and values
+func (db *DB) Snapshot() map[string]Value {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	data := make(map[string]Value, db.storage.Len())
+	db.storage.Range(func(key string, v Value) bool {
+		data[key] = v
+		return true
+	})
+	return data
+}
+
+func (db *DB) InitStorage(data map[string]Value) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.storage
+	db.watchers.touchExisting(db.hasKeyLocked)
+	db.storage.Clear()
+	db.expires.Clear()
+	db.usedMemory.Store(0)
+	for key, v := range data {
+		// Keep the access bookkeeping loaded with the value, if any
+		if v.access == nil {
+			v.access = newAccessInfo(db.Options.MaxMemoryPolicy)
+		}
+		db.storeLocked(key, v)
+	}
+}
+
+// Lock db and other, always in the same order so two goroutines locking the
+// same pair in opposite roles can't deadlock. Returns the unlock function.
+func (db *DB) lockPair(other *DB) func() {
+	if db == other {
+		db.mu.Lock()
+		return db.mu.Unlock
+	}
+	first, second := db, other
+	if first.id > second.id {
+		first, second = second, first
+	}
+	first.mu.Lock()
+	second.mu.Lock()
+	return func() {
+		second.mu.Unlock()
+		first.mu.Unlock()
+	}
+}
+
+// Store v at key as a write access: an overwritten key passes its access
+// bookkeeping on, like Redis does for LFU counters. Must be called with db.mu held.
+func (db *DB) setLocked(key string, v Value) {
+	if v.access == nil {
+		if old, ok := db.storage.Get(key); ok && old.access != nil {
+			v.access = old.access
+		} else {
+			v.access = newAccessInfo(db.Options.MaxMemoryPolicy)
+		}
+	}
+	v.access.touch(db.Options.MaxMemoryPolicy)
+	db.storeLocked(key, v)
+}
+
+// Store v at key keeping the expires index, the memory accounting and the
+// watches in sync. Must be called with db.mu held.
+func (db *DB) storeLocked(key string, v Value) {
+	// Values changed in place, like streams, were accounted with their size
+	// from the last time they were stored
+	v.memory = valueMemory(key, v)
+	if old, ok := db.storage.Get(key); ok {
+		db.usedMemory.Add(-old.memory)
+	}
+	db.usedMemory.Add(v.memory)
+
+	db.storage.Set(key, v)
+	if v.ExpiredTimeMilli > 0 {
+		db.expires.Set(key, v.ExpiredTimeMilli)
+	} else {
+		db.expires.Delete(key)
+	}
+	db.watchers.touch(key)
 }
 
-func (db *DB) InitStorage(data storage) {
-	db.storage = data
+// Remove key from the storage and the expires index. Must be called with db.mu held.
+func (db *DB) deleteLocked(key string) {
+	if old, ok := db.storage.Delete(key); ok {
+		db.usedMemory.Add(-old.memory)
+		db.watchers.touch(key)
+	}
+	db.expires.Delete(key)
 }
 
+// Whether key is in the storage, expired or not. Must be called with db.mu held.
+func (db *DB) hasKeyLocked(key string) bool {
+	_, ok := db.storage.Get(key)
+	return ok
+}
+
+// Delete key if it's still expired once we hold the write lock
 func (db *DB) tryDelete(key string) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	// Check again
-	if v, ok := db.storage[key]; ok {
-		if v.ExpiredTimeMilli < time.Now().UnixMilli() {
-			delete(db.storage, key)
+	if v, ok := db.storage.Get(key); ok {
+		if v.isExpired(time.Now().UnixMilli()) {
+			db.deleteLocked(key)
+			db.stats.expiredKeys.Add(1)
 		}
 	}
 }
 
-func (db *DB) checkKey(key string, valType ValueType) (Value, error) {
+// Return the value at key, lazily deleting it if it's expired. Doesn't count
+// as an access for eviction, like Redis' LOOKUP_NOTOUCH.
+func (db *DB) lookup(key string) (Value, error) {
 	db.mu.RLock()
-	defer db.mu.RUnlock()
-	if v, ok := db.storage[key]; ok {
-		if v.ExpiredTimeMilli > 0 && v.ExpiredTimeMilli < time.Now().UnixMilli() {
-			go db.tryDelete(key)
-			return Value{}, &KeyExpiredError{}
-		}
-		if v.Type != valType {
-			return Value{}, &TypeMismatchError{}
-		}
-		return v, nil
+	v, ok := db.storage.Get(key)
+	db.mu.RUnlock()
+	if !ok {
+		return Value{}, &KeyNotFoundError{}
 	}
-	return Value{}, &KeyNotFoundError{}
+	if v.isExpired(time.Now().UnixMilli()) {
+		db.tryDelete(key)
+		return Value{}, &KeyExpiredError{}
+	}
+	return v, nil
 }
 
-func (db *DB) GetVal(key string) (Value, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	if v, ok := db.storage[key]; ok {
-		if v.ExpiredTimeMilli > 0 && v.ExpiredTimeMilli < time.Now().UnixMilli() {
-			go db.tryDelete(key)
-			return Value{}, &KeyExpiredError{}
-		}
-		return v, nil
+func (db *DB) checkKey(key string, valType ValueType) (Value, error) {
+	v, err := db.lookup(key)
+	if err != nil {
+		return Value{}, err
+	}
+	if v.Type != valType {
+		return Value{}, &TypeMismatchError{}
 	}
-	return Value{}, &KeyNotFoundError{}
+	v.access.touch(db.Options.MaxMemoryPolicy)
+	return v, nil
+}
+
+func (db *DB) GetVal(key string) (Value, error) {
+	return db.lookup(key)
 }
@@ -1,8 +1,10 @@
 package internal
 
 import (
+	"bytes"
 	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 type ValueType byte
@@ -18,6 +20,9 @@ const (
 
 type ValueData interface {
 	ToBytes() []byte
+	Copy() ValueData    // deep copy for COPY
+	MemoryUsage() int64 // approximate bytes, for maxmemory
+	Encoding() string   // internal representation Redis would pick, for OBJECT ENCODING
 }
 
 // String type
@@ -27,8 +32,39 @@ func (v ValueString) ToBytes() []byte {
 	return v
 }
 
+func (v ValueString) Copy() ValueData {
+	return append(ValueString(nil), v...)
+}
+
+func (v ValueString) MemoryUsage() int64 {
+	switch v.Encoding() {
+	case "int":
+		// The integer is stored in the object header
+		return objectOverhead
+	case "embstr":
+		return int64(mallocSize(objectOverhead + sdsHeaderOverhead + len(v)))
+	default:
+		return int64(objectOverhead + mallocSize(sdsHeaderOverhead+len(v)))
+	}
+}
+
+// Integers that fit a long are "int", short strings are "embstr", allocated
+// with their object header, and the others "raw"
+func (v ValueString) Encoding() string {
+	if _, ok := ParseInt64(v); ok && len(v) <= 20 {
+		return "int"
+	}
+	if len(v) <= embstrMaxLen {
+		return "embstr"
+	}
+	return "raw"
+}
+
 // Stream type
-type StreamEntryData map[string][]byte
+
+// Fields and values of a stream entry, alternating, in the order they were
+// given to XADD. A field may appear more than once.
+type StreamEntryData [][]byte
 
 type StreamEntryID struct {
 	Timestamp uint64
@@ -39,41 +75,122 @@ func (e StreamEntryID) String() string {
 	return strconv.FormatUint(e.Timestamp, 10) + "-" + strconv.FormatUint(e.Sequence, 10)
 }
 
-type StreamChannelEntry struct {
-	key  string
-	id   StreamEntryID
-	data StreamEntryData
-}
-
 type ValueStream struct {
-	keys   []StreamEntryID
-	values map[StreamEntryID]StreamEntryData
+	nodes  *rax[*streamNode] // keyed by the big endian ID of their master entry
+	length int               // live entries
+
+	lastID       StreamEntryID // greatest ID ever added, new IDs must be greater even once it's deleted
+	maxDeletedID StreamEntryID // greatest ID removed by XDEL
+	entriesAdded uint64        // entries added over the lifetime of the stream
+	groups       map[string]*streamGroup
+
+	memory atomic.Int64 // MemoryUsage, kept up to date by the writers
 	mu     *sync.RWMutex
-	ch     chan *StreamChannelEntry
 }
 
-func (v *ValueStream) InjectChannelSafe(ch chan *StreamChannelEntry) {
-	v.mu.Lock()
-	defer v.mu.Unlock()
-	v.ch = ch
+const streamOverhead = 64 // the stream itself
+
+// Consumer group of a stream
+type streamGroup struct {
+	lastID      StreamEntryID // last entry delivered to the group
+	entriesRead int64         // entries delivered to the group, StreamEntriesReadInvalid when unknown
+	pel         map[StreamEntryID]*streamNACK
+	consumers   map[string]*streamConsumer
+}
+
+type streamConsumer struct {
+	name       string
+	seenTime   int64 // unix ms of the last read attempt
+	activeTime int64 // unix ms of the last delivery, -1 for never
+	pel        map[StreamEntryID]*streamNACK
 }
 
-func (v *ValueStream) RejectChannelSafe() {
-	v.mu.Lock()
-	defer v.mu.Unlock()
-	if v.ch != nil {
-		close(v.ch)
-		v.ch = nil
+// Pending entry, delivered but not acknowledged yet. Shared by the PEL of the
+// group and the one of its consumer.
+type streamNACK struct {
+	deliveryTime  int64 // unix ms
+	deliveryCount uint64
+	consumer      *streamConsumer
+}
+
+const (
+	streamGroupOverhead    = 64
+	streamConsumerOverhead = 48
+	streamNACKOverhead     = 48 // in the group and consumer PELs
+)
+
+// MemoryUsage doesn't take the lock, it's called by writers holding it
+func (v *ValueStream) MemoryUsage() int64 {
+	return streamOverhead + v.memory.Load()
+}
+
+func (v *ValueStream) Encoding() string {
+	return "stream"
+}
+
+func newValueStream() *ValueStream {
+	return &ValueStream{
+		nodes: newRax[*streamNode](),
+		mu:    &sync.RWMutex{},
 	}
 }
 
-func (v ValueStream) ToBytes() []byte {
+func (v *ValueStream) ToBytes() []byte {
 	bytes := make([]byte, 0)
 	return bytes
 }
 
+// Copy clones the nodes and the consumer groups
+func (v *ValueStream) Copy() ValueData {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	cp := &ValueStream{
+		nodes:        newRax[*streamNode](),
+		length:       v.length,
+		lastID:       v.lastID,
+		maxDeletedID: v.maxDeletedID,
+		entriesAdded: v.entriesAdded,
+		mu:           &sync.RWMutex{},
+	}
+	v.nodes.Ascend(nil, func(key []byte, n *streamNode) bool {
+		cp.nodes.Insert(key, &streamNode{master: n.master, lp: bytes.Clone(n.lp)})
+		return true
+	})
+	if len(v.groups) > 0 {
+		cp.groups = make(map[string]*streamGroup, len(v.groups))
+		for name, group := range v.groups {
+			cp.groups[name] = group.copy()
+		}
+	}
+	cp.memory.Store(v.memory.Load())
+	return cp
+}
+
+func (g *streamGroup) copy() *streamGroup {
+	cp := newStreamGroup(g.lastID, g.entriesRead)
+	for name, consumer := range g.consumers {
+		cp.consumers[name] = &streamConsumer{
+			name:       name,
+			seenTime:   consumer.seenTime,
+			activeTime: consumer.activeTime,
+			pel:        make(map[StreamEntryID]*streamNACK, len(consumer.pel)),
+		}
+	}
+	for id, nack := range g.pel {
+		nackCp := &streamNACK{
+			deliveryTime:  nack.deliveryTime,
+			deliveryCount: nack.deliveryCount,
+			consumer:      cp.consumers[nack.consumer.name],
+		}
+		cp.pel[id] = nackCp
+		nackCp.consumer.pel[id] = nackCp
+	}
+	return cp
+}
+
 type XReadKeyResult struct {
 	Key         string
 	EntryIDs    []StreamEntryID
-	EntryValues []StreamEntryData
+	EntryValues []StreamEntryData // nil for pending entries that were deleted
 }
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	activeExpireKeysPerLoop     = 20 // keys with an expiry sampled per iteration
+	activeExpireAcceptableStale = 25 // keep going while more than this % of a sample was expired
+)
+
+// Condition flags of EXPIRE and friends (Redis 7), XX can be combined with GT or LT
+type ExpireCondition byte
+
+const (
+	ExpireNX ExpireCondition = 1 << iota // only when the key has no expiry
+	ExpireXX                             // only when the key has an expiry
+	ExpireGT                             // only when the new expiry is greater than the current one
+	ExpireLT                             // only when the new expiry is less than the current one
+)
+
+type dbStats struct {
+	expiredKeys atomic.Int64
+}
+
+// ExpiredKeys returns how many keys were deleted because they expired
+func (db *DB) ExpiredKeys() int64 {
+	return db.stats.expiredKeys.Load()
+}
+
+/*
+Functions for key expiration
+*/
+
+// Expire sets the absolute expiry time of key in unix milliseconds and reports
+// whether it was set. A time that already passed deletes the key right away.
+func (db *DB) Expire(key string, expireAtMilli int64, cond ExpireCondition) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	v, ok := db.storage.Get(key)
+	if !ok {
+		return false, &KeyNotFoundError{}
+	}
+	if v.isExpired(now) {
+		db.deleteLocked(key)
+		db.stats.expiredKeys.Add(1)
+		return false, &KeyNotFoundError{}
+	}
+
+	// A key without expiry has an infinite TTL for GT/LT
+	cur := v.ExpiredTimeMilli
+	if cond&ExpireNX != 0 && cur != 0 {
+		return false, nil
+	}
+	if cond&ExpireXX != 0 && cur == 0 {
+		return false, nil
+	}
+	if cond&ExpireGT != 0 && (cur == 0 || expireAtMilli <= cur) {
+		return false, nil
+	}
+	if cond&ExpireLT != 0 && cur != 0 && expireAtMilli >= cur {
+		return false, nil
+	}
+
+	if expireAtMilli <= now {
+		db.deleteLocked(key)
+		return true, nil
+	}
+
+	v.ExpiredTimeMilli = expireAtMilli
+	db.setLocked(key, v)
+	return true, nil
+}
+
+// Persist removes the expiry of key and reports whether there was one
+func (db *DB) Persist(key string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	v, ok := db.storage.Get(key)
+	if !ok {
+		return false, &KeyNotFoundError{}
+	}
+	if v.isExpired(time.Now().UnixMilli()) {
+		db.deleteLocked(key)
+		db.stats.expiredKeys.Add(1)
+		return false, &KeyNotFoundError{}
+	}
+	if v.ExpiredTimeMilli == 0 {
+		return false, nil
+	}
+
+	v.ExpiredTimeMilli = 0
+	db.setLocked(key, v)
+	return true, nil
+}
+
+// ExpireTime returns the absolute expiry time of key in unix milliseconds,
+// or -1 if the key never expires
+func (db *DB) ExpireTime(key string) (int64, error) {
+	v, err := db.GetVal(key)
+	if err != nil {
+		return 0, err
+	}
+	if v.ExpiredTimeMilli == 0 {
+		return -1, nil
+	}
+	return v.ExpiredTimeMilli, nil
+}
+
+// ActiveExpireCycle deletes expired keys nobody reads anymore. It samples keys
+// from the expires index with a scan cursor and repeats while more than activeExpireAcceptableStale
+// percent of a sample was expired, until deadline. It returns how many keys
+// were sampled and how many of them were expired.
+func (db *DB) ActiveExpireCycle(deadline time.Time) (sampled, expired int) {
+	for {
+		db.mu.Lock()
+		if db.expires.Len() == 0 {
+			db.mu.Unlock()
+			break
+		}
+
+		// Resume scanning the expires index where the last iteration stopped so
+		// every key with an expiry gets checked over time
+		now := time.Now().UnixMilli()
+		n := 0
+		expiredKeys := make([]string, 0)
+		for buckets := 0; n < activeExpireKeysPerLoop && buckets < activeExpireKeysPerLoop*20; buckets++ {
+			db.expireCursor = db.expires.Scan(db.expireCursor, func(key string, expireAt int64) {
+				n++
+				if expireAt < now {
+					expiredKeys = append(expiredKeys, key)
+				}
+			})
+			if db.expireCursor == 0 {
+				break
+			}
+		}
+		for _, key := range expiredKeys {
+			db.deleteLocked(key)
+		}
+		e := len(expiredKeys)
+		db.mu.Unlock()
+
+		sampled += n
+		expired += e
+		db.stats.expiredKeys.Add(int64(e))
+
+		if e*100 <= n*activeExpireAcceptableStale || time.Now().After(deadline) {
+			break
+		}
+	}
+	return sampled, expired
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpireConditions(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("k", []byte("v"), 0)
+	now := time.Now().UnixMilli()
+
+	ok, _ := db.Expire("k", now+10_000, ExpireXX)
+	assert.False(t, ok)
+	ok, _ = db.Expire("k", now+10_000, ExpireGT)
+	assert.False(t, ok, "no expiry counts as infinite for GT")
+	ok, _ = db.Expire("k", now+10_000, ExpireNX)
+	assert.True(t, ok)
+	ok, _ = db.Expire("k", now+20_000, ExpireNX)
+	assert.False(t, ok)
+	ok, _ = db.Expire("k", now+5_000, ExpireGT)
+	assert.False(t, ok)
+	ok, _ = db.Expire("k", now+5_000, ExpireXX|ExpireLT)
+	assert.True(t, ok)
+
+	at, err := db.ExpireTime("k")
+	assert.NoError(t, err)
+	assert.Equal(t, now+5_000, at)
+
+	db.StringSet("persistent", []byte("v"), 0)
+	ok, _ = db.Expire("persistent", now+5_000, ExpireXX|ExpireLT)
+	assert.False(t, ok)
+	ok, _ = db.Expire("persistent", now+5_000, ExpireLT)
+	assert.True(t, ok)
+}
+
+func TestExpireInThePastDeletes(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("k", []byte("v"), 0)
+
+	ok, err := db.Expire("k", -1, 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = db.GetVal("k")
+	assert.IsType(t, &KeyNotFoundError{}, err)
+	_, err = db.Expire("k", time.Now().UnixMilli()+1000, 0)
+	assert.IsType(t, &KeyNotFoundError{}, err)
+}
+
+func TestPersist(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("k", []byte("v"), 10_000)
+
+	ok, err := db.Persist("k")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, _ = db.Persist("k")
+	assert.False(t, ok)
+
+	at, _ := db.ExpireTime("k")
+	assert.EqualValues(t, -1, at)
+}
+
+func TestActiveExpireCycle(t *testing.T) {
+	db := NewDB(DBOptions{})
+	for i := 0; i < 1000; i++ {
+		db.StringSet(fmt.Sprintf("volatile:%d", i), []byte("v"), 1)
+	}
+	db.StringSet("persistent", []byte("v"), 0)
+	db.StringSet("later", []byte("v"), 60_000)
+	time.Sleep(5 * time.Millisecond)
+
+	// A mostly stale sample keeps the cycle going until the index is clean
+	sampled, expired := db.ActiveExpireCycle(time.Now().Add(time.Second))
+
+	assert.Equal(t, 2, db.storage.Len())
+	assert.Equal(t, 1, db.expires.Len())
+	assert.Equal(t, 1000, expired)
+	assert.GreaterOrEqual(t, sampled, expired)
+	assert.EqualValues(t, 1000, db.ExpiredKeys())
+}
@@ -0,0 +1,339 @@
+package internal
+
+import (
+	"time"
+)
+
+/*
+Generic functions working on keys of any type
+*/
+
+// Del removes keys and returns how many of them existed
+func (db *DB) Del(keys ...string) int {
+	return db.removeKeys(keys)
+}
+
+// Unlink removes keys like Del. Values are only dropped, never torn down:
+// a reader may still hold one, the garbage collector frees it afterwards.
+func (db *DB) Unlink(keys ...string) int {
+	return db.removeKeys(keys)
+}
+
+func (db *DB) removeKeys(keys []string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	deleted := 0
+	for _, key := range keys {
+		v, ok := db.storage.Get(key)
+		if !ok {
+			continue
+		}
+		db.deleteLocked(key)
+		if v.isExpired(now) {
+			db.stats.expiredKeys.Add(1)
+			continue
+		}
+		deleted++
+	}
+	return deleted
+}
+
+// Exists returns how many of keys exist, counting a key as many times as it's mentioned
+func (db *DB) Exists(keys ...string) int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+	count := 0
+	for _, key := range keys {
+		if v, ok := db.storage.Get(key); ok && !v.isExpired(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// Touch records an access to keys for the eviction policies and returns how many exist
+func (db *DB) Touch(keys ...string) int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+	count := 0
+	for _, key := range keys {
+		if v, ok := db.storage.Get(key); ok && !v.isExpired(now) {
+			v.access.touch(db.Options.MaxMemoryPolicy)
+			count++
+		}
+	}
+	return count
+}
+
+// Rename moves the value at src to dst together with its expiry, overwriting dst
+func (db *DB) Rename(src, dst string) error {
+	_, err := db.rename(src, dst, false)
+	return err
+}
+
+// RenameNX is Rename that reports false instead of overwriting an existing dst
+func (db *DB) RenameNX(src, dst string) (bool, error) {
+	return db.rename(src, dst, true)
+}
+
+func (db *DB) rename(src, dst string, nx bool) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	v, ok := db.storage.Get(src)
+	if !ok || v.isExpired(now) {
+		return false, &KeyNotFoundError{}
+	}
+	if src == dst {
+		return !nx, nil
+	}
+	if nx {
+		if dv, ok := db.storage.Get(dst); ok && !dv.isExpired(now) {
+			return false, nil
+		}
+	}
+
+	db.deleteLocked(src)
+	db.setLocked(dst, v)
+	return true, nil
+}
+
+// Copy stores a deep copy of the value at src, expiry included, at dst.
+// It reports false when dst exists and replace isn't set.
+func (db *DB) Copy(src, dst string, replace bool) (bool, error) {
+	return db.CopyTo(db, src, dst, replace)
+}
+
+// CopyTo is Copy with the destination key in dstDB
+func (db *DB) CopyTo(dstDB *DB, src, dst string, replace bool) (bool, error) {
+	if db == dstDB && src == dst {
+		return false, &SameObjectError{}
+	}
+
+	unlock := db.lockPair(dstDB)
+	defer unlock()
+
+	now := time.Now().UnixMilli()
+	v, ok := db.storage.Get(src)
+	if !ok || v.isExpired(now) {
+		return false, &KeyNotFoundError{}
+	}
+	if dv, ok := dstDB.storage.Get(dst); ok && !dv.isExpired(now) && !replace {
+		return false, nil
+	}
+
+	v.Data = v.Data.Copy()
+	v.access = nil
+	dstDB.setLocked(dst, v)
+	return true, nil
+}
+
+// Move transfers key with its expiry to dstDB. It reports false when key
+// already exists in dstDB.
+func (db *DB) Move(key string, dstDB *DB) (bool, error) {
+	if db == dstDB {
+		return false, &SameObjectError{}
+	}
+
+	unlock := db.lockPair(dstDB)
+	defer unlock()
+
+	now := time.Now().UnixMilli()
+	v, ok := db.storage.Get(key)
+	if !ok || v.isExpired(now) {
+		return false, &KeyNotFoundError{}
+	}
+	if dv, ok := dstDB.storage.Get(key); ok && !dv.isExpired(now) {
+		return false, nil
+	}
+
+	db.deleteLocked(key)
+	dstDB.setLocked(key, v)
+	return true, nil
+}
+
+// Dump serializes the value at key in the DUMP payload format
+func (db *DB) Dump(key string) ([]byte, error) {
+	v, err := db.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	v.access.touch(db.Options.MaxMemoryPolicy)
+	return dumpValue(v)
+}
+
+type RestoreOptions struct {
+	ExpireAtMilli int64 // unix time, 0 for no expiry
+	Replace       bool
+	IdleSeconds   int64 // LRU idle time to restore, -1 if not given
+	Freq          int   // LFU counter to restore, -1 if not given
+}
+
+// Restore creates key from a DUMP payload. It reports false when nothing was
+// stored because the expiry is already in the past, in which case an
+// existing key is still deleted with Replace.
+func (db *DB) Restore(key string, payload []byte, opts RestoreOptions) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	if old, ok := db.storage.Get(key); ok && !old.isExpired(now) && !opts.Replace {
+		return false, &BusyKeyError{}
+	}
+	data, valType, err := loadDumpPayload(payload)
+	if err != nil {
+		return false, err
+	}
+
+	db.deleteLocked(key)
+	if opts.ExpireAtMilli > 0 && opts.ExpireAtMilli <= now {
+		return false, nil
+	}
+
+	policy := db.Options.MaxMemoryPolicy
+	v := Value{Type: valType, Data: data, ExpiredTimeMilli: opts.ExpireAtMilli}
+	v.access = loadedAccessInfo(policy, opts.IdleSeconds, opts.Freq)
+	if v.access == nil {
+		v.access = newAccessInfo(policy)
+	}
+	db.storeLocked(key, v)
+	return true, nil
+}
+
+// SwapWith exchanges the whole content of db and other, clients connected to
+// one of them see the other's keys right away
+func (db *DB) SwapWith(other *DB) {
+	if db == other {
+		return
+	}
+	unlock := db.lockPair(other)
+	defer unlock()
+
+	// A key of either db changes in both
+	exists := func(key string) bool {
+		return db.hasKeyLocked(key) || other.hasKeyLocked(key)
+	}
+	db.watchers.touchExisting(exists)
+	other.watchers.touchExisting(exists)
+
+	db.storage, other.storage = other.storage, db.storage
+	db.expires, other.expires = other.expires, db.expires
+	db.expireCursor, other.expireCursor = other.expireCursor, db.expireCursor
+	used := db.usedMemory.Load()
+	db.usedMemory.Store(other.usedMemory.Load())
+	other.usedMemory.Store(used)
+}
+
+// Flush removes every key. The values are only dropped, like UNLINK does, so
+// FLUSHDB ASYNC and SYNC do the same here.
+func (db *DB) Flush() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.watchers.touchExisting(db.hasKeyLocked)
+	db.storage = newDict[Value]()
+	db.expires = newDict[int64]()
+	db.expireCursor = 0
+	db.usedMemory.Store(0)
+}
+
+// Keys returns the live keys matching the glob pattern
+func (db *DB) Keys(pattern string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	allKeys := pattern == "*"
+	now := time.Now().UnixMilli()
+	keys := make([]string, 0)
+	db.storage.Range(func(key string, v Value) bool {
+		if !v.isExpired(now) && (allKeys || GlobMatch(pattern, key, false)) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// Options of SCAN
+type ScanOptions struct {
+	Count   int    // hint of how many elements to return, defaults to 10
+	Pattern string // glob the elements must match, "" for any
+	Type    string // type name the keys must have, "" for any
+}
+
+const scanDefaultCount = 10
+
+// Scan returns the next cursor and the keys found from cursor, see dict.Scan
+// for the guarantees. Filters apply after fetching, so fewer than Count keys
+// can be returned before the iteration is complete.
+func (db *DB) Scan(cursor uint64, opts ScanOptions) (uint64, []string) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	count := opts.Count
+	if count <= 0 {
+		count = scanDefaultCount
+	}
+	matchAll := opts.Pattern == "" || opts.Pattern == "*"
+	now := time.Now().UnixMilli()
+
+	keys := make([]string, 0, count)
+	for maxIterations := count * 10; maxIterations > 0 && len(keys) < count; maxIterations-- {
+		cursor = db.storage.Scan(cursor, func(key string, v Value) {
+			if v.isExpired(now) {
+				return
+			}
+			if !matchAll && !GlobMatch(opts.Pattern, key, false) {
+				return
+			}
+			if opts.Type != "" && DecodeValueType(v.Type) != opts.Type {
+				return
+			}
+			keys = append(keys, key)
+		})
+		if cursor == 0 {
+			break
+		}
+	}
+	return cursor, keys
+}
+
+// RandomKey returns a random key that isn't expired, false if the db is empty
+func (db *DB) RandomKey() (string, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// Give up after a few expired keys in a row instead of looping on a mostly expired db
+	now := time.Now().UnixMilli()
+	for tries := 0; tries < 100; tries++ {
+		key, v, ok := db.storage.RandomEntry()
+		if !ok {
+			return "", false
+		}
+		if !v.isExpired(now) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// KeyspaceStats returns the number of keys and of keys with an expiry, as
+// shown by INFO keyspace
+func (db *DB) KeyspaceStats() (keys, expires int) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.storage.Len(), db.expires.Len()
+}
+
+// DBSize returns the number of keys, including expired ones not deleted yet like Redis does
+func (db *DB) DBSize() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.storage.Len()
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameKeepsExpiry(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("src", []byte("v"), 60_000)
+	before, _ := db.ExpireTime("src")
+
+	assert.NoError(t, db.Rename("src", "dst"))
+	after, err := db.ExpireTime("dst")
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+	assert.Equal(t, 0, db.Exists("src"))
+	assert.IsType(t, &KeyNotFoundError{}, db.Rename("src", "dst"))
+
+	db.StringSet("other", []byte("v"), 0)
+	ok, err := db.RenameNX("dst", "other")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCopyStreamIsDeep(t *testing.T) {
+	db := NewDB(DBOptions{})
+	_, _, err := db.StreamAdd("s", "1-1", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+	assert.NoError(t, err)
+
+	ok, err := db.Copy("s", "s2", false)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, _, err = db.StreamAdd("s2", "2-1", StreamEntryData{[]byte("f"), []byte("v2")}, StreamAddOptions{})
+	assert.NoError(t, err)
+
+	ids, _, _ := db.StreamRange("s", "-", "+", 0, false)
+	assert.Len(t, ids, 1)
+	ids, _, _ = db.StreamRange("s2", "-", "+", 0, false)
+	assert.Len(t, ids, 2)
+
+	ok, _ = db.Copy("s", "s2", false)
+	assert.False(t, ok)
+	ok, _ = db.Copy("s", "s2", true)
+	assert.True(t, ok)
+	ids, _, _ = db.StreamRange("s2", "-", "+", 0, false)
+	assert.Len(t, ids, 1)
+}
+
+func TestUnlinkLargeStream(t *testing.T) {
+	db := NewDB(DBOptions{})
+	for i := 1; i <= 1000; i++ {
+		_, _, err := db.StreamAdd("s", fmt.Sprintf("%d-0", i), StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+		assert.NoError(t, err)
+	}
+	db.StringSet("k", []byte("v"), 0)
+	v, _ := db.storage.Get("s")
+
+	assert.Equal(t, 2, db.Unlink("s", "k", "missing"))
+	assert.Equal(t, 0, db.DBSize())
+	_, ok := db.RandomKey()
+	assert.False(t, ok)
+
+	// Whoever still holds the stream keeps reading all of it
+	assert.EqualValues(t, 1000, v.Data.(*ValueStream).length)
+}
+
+func TestKeysMatchesLiveKeys(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("user:1", []byte("v"), 0)
+	db.StringSet("user:2", []byte("v"), 0)
+	db.StringSet("session:1", []byte("v"), 0)
+	db.StringSet("user:expired", []byte("v"), 60_000)
+	db.Expire("user:expired", 1, 0)
+
+	assert.ElementsMatch(t, []string{"user:1", "user:2"}, db.Keys("user:*"))
+	assert.ElementsMatch(t, []string{"user:1", "session:1"}, db.Keys("*:1"))
+	assert.Len(t, db.Keys("*"), 3)
+	assert.Empty(t, db.Keys("nope*"))
+}
+
+func TestScanFilters(t *testing.T) {
+	db := NewDB(DBOptions{})
+	for i := 0; i < 100; i++ {
+		db.StringSet(fmt.Sprintf("user:%d", i), []byte("v"), 0)
+	}
+	_, _, err := db.StreamAdd("user:stream", "1-1", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+	assert.NoError(t, err)
+
+	scanAllKeys := func(opts ScanOptions) []string {
+		var cursor uint64
+		all := make([]string, 0)
+		for {
+			var keys []string
+			cursor, keys = db.Scan(cursor, opts)
+			all = append(all, keys...)
+			if cursor == 0 {
+				return all
+			}
+		}
+	}
+
+	assert.Len(t, scanAllKeys(ScanOptions{Count: 7, Pattern: "user:*"}), 101)
+	assert.Len(t, scanAllKeys(ScanOptions{Pattern: "user:1?"}), 10)
+	assert.Equal(t, []string{"user:stream"}, scanAllKeys(ScanOptions{Type: "stream"}))
+}
+
+func TestDumpRestore(t *testing.T) {
+	src := NewDB(DBOptions{})
+	src.StringSet("str", []byte("hello"), 0)
+	src.StringSet("num", []byte("-1234"), 0)
+	_, _, err := src.StreamAdd("s", "1-1", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+	assert.NoError(t, err)
+	_, _, err = src.StreamAdd("s", "2-1", StreamEntryData{[]byte("a"), []byte("1"), []byte("b"), []byte("2")}, StreamAddOptions{})
+	assert.NoError(t, err)
+
+	dst := NewDB(DBOptions{})
+	for _, key := range []string{"str", "num", "s"} {
+		payload, err := src.Dump(key)
+		assert.NoError(t, err)
+		stored, err := dst.Restore(key, payload, RestoreOptions{IdleSeconds: -1, Freq: -1})
+		assert.NoError(t, err)
+		assert.True(t, stored)
+	}
+
+	v, err := dst.StringGet("num")
+	assert.NoError(t, err)
+	assert.Equal(t, "-1234", string(v.Data.ToBytes()))
+	ids, entries, err := dst.StreamRange("s", "-", "+", 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []StreamEntryID{{1, 1}, {2, 1}}, ids)
+	assert.Equal(t, StreamEntryData{[]byte("a"), []byte("1"), []byte("b"), []byte("2")}, entries[1])
+	assert.Equal(t, src.UsedMemory(), dst.UsedMemory())
+
+	_, err = src.Dump("missing")
+	assert.IsType(t, &KeyNotFoundError{}, err)
+}
+
+func TestDumpPayloadFormat(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("k", []byte("bar"), 0)
+	payload, err := db.Dump("k")
+	assert.NoError(t, err)
+	// Type, length prefixed value, RDB version 11, CRC64
+	assert.Equal(t, []byte{0x00, 0x03, 'b', 'a', 'r', 0x0b, 0x00}, payload[:7])
+	assert.Len(t, payload, 15)
+}
+
+func TestRestoreOptions(t *testing.T) {
+	db := NewDB(DBOptions{MaxMemoryPolicy: AllKeysLRU})
+	db.StringSet("k", []byte("v"), 0)
+	payload, _ := db.Dump("k")
+
+	_, err := db.Restore("k", payload, RestoreOptions{IdleSeconds: -1, Freq: -1})
+	assert.IsType(t, &BusyKeyError{}, err)
+
+	expireAt := time.Now().UnixMilli() + 60_000
+	stored, err := db.Restore("k", payload, RestoreOptions{Replace: true, ExpireAtMilli: expireAt, IdleSeconds: 100, Freq: -1})
+	assert.NoError(t, err)
+	assert.True(t, stored)
+	when, err := db.ExpireTime("k")
+	assert.NoError(t, err)
+	assert.Equal(t, expireAt, when)
+	assert.EqualValues(t, 100, mustObject(t, db, "k").IdleSeconds)
+
+	// Already expired: nothing is stored but REPLACE still deletes the key
+	stored, err = db.Restore("k", payload, RestoreOptions{Replace: true, ExpireAtMilli: 1, IdleSeconds: -1, Freq: -1})
+	assert.NoError(t, err)
+	assert.False(t, stored)
+	assert.Equal(t, 0, db.Exists("k"))
+}
+
+func TestRestoreBadPayload(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("k", []byte("value"), 0)
+	payload, _ := db.Dump("k")
+
+	corrupted := append([]byte(nil), payload...)
+	corrupted[2] ^= 0xFF
+	_, err := db.Restore("other", corrupted, RestoreOptions{IdleSeconds: -1, Freq: -1})
+	assert.IsType(t, &DumpPayloadError{}, err)
+
+	newer := append([]byte(nil), payload[:len(payload)-10]...)
+	newer = binary.LittleEndian.AppendUint16(newer, rdbVersion+1)
+	newer = binary.LittleEndian.AppendUint64(newer, crc64Jones(0, newer))
+	_, err = db.Restore("other", newer, RestoreOptions{IdleSeconds: -1, Freq: -1})
+	assert.IsType(t, &DumpPayloadError{}, err)
+
+	// Valid footer around a value type that isn't supported
+	bad := []byte{0x42, 0x01, 'x', 0x0b, 0x00}
+	bad = binary.LittleEndian.AppendUint64(bad, crc64Jones(0, bad))
+	_, err = db.Restore("other", bad, RestoreOptions{IdleSeconds: -1, Freq: -1})
+	assert.IsType(t, &BadDataFormatError{}, err)
+	assert.Equal(t, 0, db.Exists("other"))
+}
@@ -4,242 +4,356 @@ import (
 	"math"
 	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
 )
 
 /*
 Functions for stream type
 */
-func (db *DB) StreamAdd(key string, entryIDRaw string, data StreamEntryData, expireAfterMilli int64) (string, error) {
-	// Check if key exists
-	v, err := db.checkKey(key, ValTypeStream)
-	if err != nil || v.Type != ValTypeStream {
-		v = Value{
-			Data: &ValueStream{
-				keys:   make([]StreamEntryID, 0),
-				values: make(map[StreamEntryID]StreamEntryData),
-				mu:     &sync.RWMutex{},
-			},
-			Type: ValTypeStream,
+
+type StreamTrimStrategy byte
+
+const (
+	StreamTrimNone StreamTrimStrategy = iota
+	StreamTrimMaxLen
+	StreamTrimMinID
+)
+
+// Entries removed at most by an approximate trim without LIMIT, like Redis
+const DefaultStreamTrimLimit = 100 * streamNodeMaxEntries
+
+type StreamTrimOptions struct {
+	Strategy StreamTrimStrategy
+	MaxLen   int64
+	MinID    StreamEntryID
+	Approx   bool  // only remove whole nodes, which is cheaper, like Redis' "~"
+	Limit    int64 // max entries removed when Approx, 0 for no limit
+}
+
+type StreamAddOptions struct {
+	NoMkStream bool // don't create a missing stream
+	Trim       StreamTrimOptions
+}
+
+// StreamAdd appends an entry and trims the stream per opts.Trim, returning
+// the ID of the entry and the exact trim that was done, see exactTrim. It
+// returns a KeyNotFoundError for a missing key with NoMkStream.
+func (db *DB) StreamAdd(key string, entryIDRaw string, data StreamEntryData, opts StreamAddOptions) (string, StreamTrimOptions, error) {
+	db.mu.Lock()
+	v, err := db.streamForUpdate(key, !opts.NoMkStream)
+	if err != nil {
+		db.mu.Unlock()
+		return "", StreamTrimOptions{}, err
+	}
+	entryID, trim, err := v.Data.(*ValueStream).add(entryIDRaw, data, opts.Trim)
+	if err != nil {
+		db.mu.Unlock()
+		return "", StreamTrimOptions{}, err
+	}
+	db.setLocked(key, v)
+	db.mu.Unlock()
+
+	db.waiters.signal(key)
+	return entryID.String(), trim, nil
+}
+
+// Return the live stream at key for an update, or a new empty stream if the
+// key doesn't exist and create is set. Must be called with db.mu held.
+func (db *DB) streamForUpdate(key string, create bool) (Value, error) {
+	if v, ok := db.storage.Get(key); ok && !v.isExpired(time.Now().UnixMilli()) {
+		if v.Type != ValTypeStream {
+			return Value{}, &TypeMismatchError{}
 		}
+		return v, nil
 	}
+	if !create {
+		return Value{}, &KeyNotFoundError{}
+	}
+	return Value{
+		Data: newValueStream(),
+		Type: ValTypeStream,
+	}, nil
+}
 
+// Append an entry with an ID generated from entryIDRaw, then trim
+func (v *ValueStream) add(entryIDRaw string, data StreamEntryData, trim StreamTrimOptions) (StreamEntryID, StreamTrimOptions, error) {
 	var entryID StreamEntryID
-	stream := v.Data.(*ValueStream)
-	stream.mu.Lock()
-	defer stream.mu.Unlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
 
-	// timestamp-sequence
+	// timestamp-sequence, new IDs must be greater than the last one ever added
 	parts := strings.Split(entryIDRaw, "-")
-	var lastKey *StreamEntryID
-	if len(stream.keys) > 0 {
-		lastKey = &stream.keys[len(stream.keys)-1]
-	}
+	lastKey := v.lastID
 
 	switch len(parts) {
 	case 1:
 		if parts[0] != "*" {
-			return "", &StreamKeyInvalid{}
+			return entryID, trim, &StreamKeyInvalid{}
 		}
 		curTS := uint64(time.Now().UnixMilli())
-		if lastKey != nil {
-			if curTS > lastKey.Timestamp {
-				entryID.Timestamp = curTS
-			} else {
-				entryID.Timestamp = lastKey.Timestamp + 1
-				entryID.Sequence = lastKey.Sequence + 1
-			}
-		} else {
+		if curTS > lastKey.Timestamp {
 			entryID.Timestamp = curTS
+		} else {
+			entryID.Timestamp = lastKey.Timestamp
+			entryID.Sequence = lastKey.Sequence + 1
 		}
 	case 2:
 		ts, err := strconv.ParseUint(parts[0], 10, 0)
 		if err != nil {
-			return "", &StreamKeyInvalid{}
+			return entryID, trim, &StreamKeyInvalid{}
 		}
 
 		var seq uint64
 		if parts[1] == "*" { // Generate sequence
-			if lastKey != nil {
-				if ts < lastKey.Timestamp {
-					return "", &StreamKeyTooSmall{}
-				} else if ts == lastKey.Timestamp {
-					seq = lastKey.Sequence + 1
-				}
-			} else if ts == 0 {
-				// Default sequence is 0 except for timestamp == 0 then default sequence is 1
-				seq = 1
+			if ts < lastKey.Timestamp {
+				return entryID, trim, &StreamKeyTooSmall{}
+			} else if ts == lastKey.Timestamp {
+				// Also makes 0-* start at 0-1
+				seq = lastKey.Sequence + 1
 			}
 		} else { // Fully provided stream id
 			seq, err = strconv.ParseUint(parts[1], 10, 0)
 			if err != nil {
-				return "", &StreamKeyInvalid{}
+				return entryID, trim, &StreamKeyInvalid{}
 			}
 		}
 
 		entryID.Timestamp = ts
 		entryID.Sequence = seq
 	default:
-		return "", &StreamKeyInvalid{}
+		return entryID, trim, &StreamKeyInvalid{}
 	}
 
 	// Validate the key
 	if entryID.Timestamp == 0 && entryID.Sequence == 0 {
-		return "", &StreamKeyInvalid{message: "The ID specified in XADD must be greater than 0-0"}
+		return entryID, trim, &StreamKeyInvalid{message: "The ID specified in XADD must be greater than 0-0"}
 	}
-	if lastKey != nil {
-		if lastKey.Timestamp > entryID.Timestamp || (lastKey.Timestamp == entryID.Timestamp && lastKey.Sequence >= entryID.Sequence) {
-			return "", &StreamKeyTooSmall{}
-		}
+	if compareEntryIds(entryID, lastKey) <= 0 {
+		return entryID, trim, &StreamKeyTooSmall{}
 	}
 
 	// Add an entry to the stream
-	stream.keys = append(stream.keys, entryID)
-	stream.values[entryID] = data
-
-	if stream.ch != nil {
-		channelEntry := StreamChannelEntry{
-			key:  key,
-			id:   entryID,
-			data: data,
-		}
-		select {
-		case stream.ch <- &channelEntry: // send entryID to the stream's channel
-		default: // stream's channel is full or closed
-			stream.ch = nil
-		}
+	v.appendEntry(entryID, data)
+	v.trim(trim)
+	return entryID, v.exactTrim(trim), nil
+}
+
+// StreamLen returns the number of entries, 0 for a missing key
+func (db *DB) StreamLen(key string) (int, error) {
+	stream, err := db.streamAt(key)
+	if err != nil || stream == nil {
+		return 0, err
 	}
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+	return stream.length, nil
+}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	db.storage[key] = v
-	return entryID.String(), nil
+// StreamDelete removes the entries with the given IDs and returns how many existed
+func (db *DB) StreamDelete(key string, ids []StreamEntryID) (int, error) {
+	return db.streamUpdate(key, func(stream *ValueStream) int {
+		deleted := 0
+		for _, id := range ids {
+			if stream.deleteID(id) {
+				deleted++
+			}
+		}
+		return deleted
+	})
 }
 
-func (db *DB) StreamRange(key, start, end string) ([]StreamEntryID, []StreamEntryData, error) {
-	var ids []StreamEntryID
-	var values []StreamEntryData
+// StreamTrim removes the oldest entries per opts and returns how many were
+// removed, with the exact trim that was done, see exactTrim
+func (db *DB) StreamTrim(key string, opts StreamTrimOptions) (int, StreamTrimOptions, error) {
+	exact := opts
+	n, err := db.streamUpdate(key, func(stream *ValueStream) int {
+		removed := stream.trim(opts)
+		exact = stream.exactTrim(opts)
+		return removed
+	})
+	return n, exact, err
+}
 
+// Apply fn to the stream at key under its lock, then store it back so the
+// memory accounting sees the change. A missing key changes nothing.
+func (db *DB) streamUpdate(key string, fn func(stream *ValueStream) int) (int, error) {
 	v, err := db.checkKey(key, ValTypeStream)
-	if err != nil || v.Type != ValTypeStream {
-		return nil, nil, &KeyNotFoundError{}
+	if err != nil {
+		if _, ok := err.(KeyError); ok {
+			return 0, nil
+		}
+		return 0, err
 	}
 
 	stream := v.Data.(*ValueStream)
-	stream.mu.RLock()
-	defer stream.mu.RUnlock()
+	stream.mu.Lock()
+	n := fn(stream)
+	stream.mu.Unlock()
+	if n == 0 {
+		return 0, nil
+	}
 
-	startIndex, err := streamFindStartIndex(stream, start, false)
+	db.streamStored(key, v)
+	return n, nil
+}
+
+// The stream at key, nil for a missing key
+func (db *DB) streamAt(key string) (*ValueStream, error) {
+	v, err := db.checkKey(key, ValTypeStream)
 	if err != nil {
-		return nil, nil, err
+		if _, ok := err.(KeyError); ok {
+			return nil, nil
+		}
+		return nil, err
 	}
-	endIndex, err := streamFindEndIndex(stream, end)
+	return v.Data.(*ValueStream), nil
+}
+
+// StreamRange returns up to count entries (0 for all) between start and end,
+// or from end down to start with rev. The bounds are "-", "+", or IDs that
+// are excluded when prefixed with "(". A missing key is an empty stream.
+func (db *DB) StreamRange(key, start, end string, count int, rev bool) ([]StreamEntryID, []StreamEntryData, error) {
+	startID, endID, err := streamParseInterval(start, end)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	for i := startIndex; i <= endIndex; i++ {
-		ids = append(ids, stream.keys[i])
-		values = append(values, stream.values[stream.keys[i]])
+	v, err := db.checkKey(key, ValTypeStream)
+	if err != nil {
+		if _, ok := err.(KeyError); ok {
+			return nil, nil, nil
+		}
+		return nil, nil, err
 	}
 
+	stream := v.Data.(*ValueStream)
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+	ids, values := stream.read(startID, endID, count, rev)
 	return ids, values, nil
 }
 
-func (db *DB) StreamRead(keys, starts []string, blockMilli int64) []XReadKeyResult {
-	blockCh := time.After(time.Duration(blockMilli) * time.Millisecond)
-	// Prepare streams and start times
-	streams := make([]*ValueStream, len(keys))
-	for i := 0; i < len(keys); i++ {
-		v, err := db.checkKey(keys[i], ValTypeStream)
+// StreamRead returns up to count entries (0 for all) of the streams with
+// entries after their start ID, "$" being the last ID and "+" the ID before
+// the last entry. A missing key reads as an empty stream. When no stream has
+// entries it waits up to blockMilli for some to be added, 0 being forever
+// and -1 not to wait, and returns nil on timeout.
+func (db *DB) StreamRead(keys, starts []string, count int, blockMilli int64) ([]XReadKeyResult, error) {
+	// Resolve the start IDs once, so waiting on "$" returns what's added later
+	ids := make([]StreamEntryID, len(keys))
+	for i, key := range keys {
+		stream, err := db.streamAt(key)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		stream := v.Data.(*ValueStream)
-		streams[i] = stream
-		if starts[i] == "$" {
-			if len(stream.keys) > 0 {
-				starts[i] = stream.keys[len(stream.keys)-1].String()
-			} else {
-				starts[i] = "0-0"
+		switch {
+		case stream == nil && (starts[i] == "$" || starts[i] == "+"):
+			// Anything added to the key later is new
+		case stream == nil:
+			if ids[i], err = streamParseEntryID(starts[i], false); err != nil {
+				return nil, err
+			}
+		default:
+			if ids[i], err = stream.readStart(starts[i]); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	var itemsCnt int32
-	res := make([]XReadKeyResult, len(keys))
-	wg := sync.WaitGroup{}
-
-	// wait for blocked time
-	<-blockCh
+	if blockMilli < 0 {
+		return db.streamRead(keys, ids, count)
+	}
 
-	// Lock all streams after waiting
-	for _, stream := range streams {
-		if stream != nil {
-			stream.mu.Lock()
+	// Registered before reading, so entries added meanwhile aren't missed
+	waiter := db.waiters.add(keys)
+	defer db.waiters.remove(waiter, keys)
+	deadline, stop := blockDeadline(blockMilli)
+	defer stop()
+	for {
+		res, err := db.streamRead(keys, ids, count)
+		if err != nil || len(res) > 0 {
+			return res, err
+		}
+		if !waiter.wait(deadline) {
+			return nil, nil
 		}
 	}
+}
 
-	// Get entries from streams
-	for i := 0; i < len(keys); i++ {
-		if streams[i] != nil {
-			wg.Add(1)
-			// Simultaneously read from multiple streams
-			go func() {
-				defer wg.Done()
-				entryIDs, entryVals, err := streamReadNoLock(streams[i], starts[i])
-				if err == nil {
-					res[i] = XReadKeyResult{Key: keys[i], EntryIDs: entryIDs, EntryValues: entryVals}
-					atomic.AddInt32(&itemsCnt, int32(len(entryIDs)))
-				}
-			}()
+// The ID to read a stream after for start
+func (v *ValueStream) readStart(start string) (StreamEntryID, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	switch start {
+	case "$":
+		return v.lastID, nil
+	case "+":
+		if last, ok := v.lastEntryID(); ok {
+			return streamDecrID(last), nil
 		}
+		return v.lastID, nil
 	}
-	wg.Wait()
-
-	// If block time is 0 and no entry found, keep waiting for the first available entry
-	if itemsCnt == 0 && blockMilli == 0 {
-		// log.Println("Block time is", blockMilli, "ms, waiting to get the first entry from", len(keys), "streams")
-		ch := make(chan *StreamChannelEntry, 1)
-		for _, stream := range streams {
-			// Release all streams and inject the channel
-			if streams != nil {
-				stream.mu.Unlock()
-				stream.InjectChannelSafe(ch)
-				defer stream.RejectChannelSafe()
-			}
+	return streamParseEntryID(start, false)
+}
+
+// Read each stream once, returning the ones with entries after their ID
+func (db *DB) streamRead(keys []string, ids []StreamEntryID, count int) ([]XReadKeyResult, error) {
+	var res []XReadKeyResult
+	for i, key := range keys {
+		stream, err := db.streamAt(key)
+		if err != nil {
+			return nil, err
 		}
-		channelEntry := <-ch // block until the first item
-		return []XReadKeyResult{{
-			Key: channelEntry.key, EntryIDs: []StreamEntryID{channelEntry.id}, EntryValues: []StreamEntryData{channelEntry.data},
-		}}
-	} else {
-		// Release all streams for further access
-		for _, stream := range streams {
-			if stream != nil {
-				stream.mu.Unlock()
-			}
+		if stream == nil {
+			continue
+		}
+		stream.mu.RLock()
+		var entryIDs []StreamEntryID
+		var entryVals []StreamEntryData
+		if ids[i] != maxStreamEntryID {
+			entryIDs, entryVals = stream.read(streamIncrID(ids[i]), maxStreamEntryID, count, false)
+		}
+		stream.mu.RUnlock()
+		if len(entryIDs) > 0 {
+			res = append(res, XReadKeyResult{Key: key, EntryIDs: entryIDs, EntryValues: entryVals})
 		}
 	}
-
-	return res
+	return res, nil
 }
 
-func streamReadNoLock(stream *ValueStream, start string) ([]StreamEntryID, []StreamEntryData, error) {
-	startIndex, err := streamFindStartIndex(stream, start, true)
-	if err != nil {
-		return nil, nil, err
+// StreamSetID sets the last ID of the stream at key, and its entries added
+// and max deleted ID unless they're -1 and 0-0
+func (db *DB) StreamSetID(key string, id StreamEntryID, entriesAdded int64, maxDeletedID StreamEntryID) error {
+	if compareEntryIds(id, maxDeletedID) < 0 {
+		return &StreamKeyInvalid{message: "The ID specified in XSETID is smaller than the provided max_deleted_entry_id"}
 	}
+	return db.streamWrite(key, func(stream *ValueStream) error {
+		if compareEntryIds(id, stream.maxDeletedID) < 0 {
+			return &StreamKeyInvalid{message: "The ID specified in XSETID is smaller than current max_deleted_entry_id"}
+		}
+		if last, ok := stream.lastEntryID(); ok {
+			if compareEntryIds(id, last) < 0 {
+				return &StreamKeyInvalid{message: "The ID specified in XSETID is smaller than the target stream top item"}
+			}
+			if entriesAdded != -1 && int64(stream.length) > entriesAdded {
+				return &StreamKeyInvalid{message: "The entries_added specified in XSETID is smaller than the target stream length"}
+			}
+		}
 
-	endIndex := len(stream.keys) - 1
-	entryIDs := stream.keys[startIndex : endIndex+1]
-	entryVals := make([]StreamEntryData, len(entryIDs))
-	for i, id := range entryIDs {
-		entryVals[i] = stream.values[id]
-	}
-	return entryIDs, entryVals, nil
+		stream.lastID = id
+		if entriesAdded != -1 {
+			stream.entriesAdded = uint64(entriesAdded)
+		}
+		if maxDeletedID != (StreamEntryID{}) {
+			stream.maxDeletedID = maxDeletedID
+		}
+		return nil
+	})
+}
+
+// ParseStreamEntryID parses an entry ID argument, "<ms>-<seq>" or "<ms>" for "<ms>-0"
+func ParseStreamEntryID(idRaw string) (StreamEntryID, error) {
+	return streamParseEntryID(idRaw, false)
 }
 
 func streamParseEntryID(idRaw string, isEnd bool) (StreamEntryID, error) {
@@ -276,49 +390,65 @@ func streamParseEntryID(idRaw string, isEnd bool) (StreamEntryID, error) {
 	}
 }
 
-func streamFindStartIndex(stream *ValueStream, idRaw string, strict bool) (int, error) {
-	if idRaw == "-" {
-		return 0, nil
+var maxStreamEntryID = StreamEntryID{Timestamp: math.MaxUint64, Sequence: math.MaxUint64}
+
+// Parse "-", "+", or an ID prefixed with "(" to exclude it. A missing
+// sequence is 0 for a start and the max for an end, like Redis.
+func streamParseIntervalID(idRaw string, isEnd bool) (StreamEntryID, bool, error) {
+	switch idRaw {
+	case "-":
+		return StreamEntryID{}, false, nil
+	case "+":
+		return maxStreamEntryID, false, nil
+	}
+	exclusive := false
+	if len(idRaw) > 1 && idRaw[0] == '(' {
+		exclusive = true
+		idRaw = idRaw[1:]
+	}
+	id, err := streamParseEntryID(idRaw, isEnd)
+	return id, exclusive, err
+}
+
+// Inclusive bounds of the interval between start and end
+func streamParseInterval(start, end string) (StreamEntryID, StreamEntryID, error) {
+	startID, startExclusive, err := streamParseIntervalID(start, false)
+	if err != nil {
+		return startID, startID, err
 	}
-	id, err := streamParseEntryID(idRaw, false)
+	endID, endExclusive, err := streamParseIntervalID(end, true)
 	if err != nil {
-		return 0, err
+		return startID, endID, err
 	}
-	// lower bound binary search
-	l, r := 0, len(stream.keys)
-	for l < r {
-		m := (l + r) / 2
-		if compareEntryIds(stream.keys[m], id) < 0 {
-			l = m + 1
-		} else {
-			r = m
+	if startExclusive {
+		if startID == maxStreamEntryID {
+			return startID, endID, &StreamKeyInvalid{message: "invalid start ID for the interval"}
 		}
+		startID = streamIncrID(startID)
 	}
-	if strict && compareEntryIds(stream.keys[l], id) == 0 {
-		return l + 1, nil
+	if endExclusive {
+		if endID == (StreamEntryID{}) {
+			return startID, endID, &StreamKeyInvalid{message: "invalid end ID for the interval"}
+		}
+		endID = streamDecrID(endID)
 	}
-	return l, nil
+	return startID, endID, nil
 }
 
-func streamFindEndIndex(stream *ValueStream, idRaw string) (int, error) {
-	if idRaw == "+" {
-		return len(stream.keys) - 1, nil
+// The next ID, id must not be the max
+func streamIncrID(id StreamEntryID) StreamEntryID {
+	if id.Sequence == math.MaxUint64 {
+		return StreamEntryID{Timestamp: id.Timestamp + 1}
 	}
-	id, err := streamParseEntryID(idRaw, true)
-	if err != nil {
-		return 0, err
-	}
-	// upper bound binary search
-	l, r := 0, len(stream.keys)
-	for l < r {
-		m := (l + r) / 2
-		if compareEntryIds(stream.keys[m], id) > 0 {
-			r = m
-		} else {
-			l = m + 1
-		}
+	return StreamEntryID{Timestamp: id.Timestamp, Sequence: id.Sequence + 1}
+}
+
+// The previous ID, id must not be 0-0
+func streamDecrID(id StreamEntryID) StreamEntryID {
+	if id.Sequence == 0 {
+		return StreamEntryID{Timestamp: id.Timestamp - 1, Sequence: math.MaxUint64}
 	}
-	return l - 1, nil
+	return StreamEntryID{Timestamp: id.Timestamp, Sequence: id.Sequence - 1}
 }
 
 func compareEntryIds(first, second StreamEntryID) int {
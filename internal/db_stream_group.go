@@ -0,0 +1,797 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+Consumer groups of streams, ported from Redis' t_stream.c
+*/
+
+// Entries read by a group when it can't be told, e.g. after deletions
+const StreamEntriesReadInvalid = -1
+
+func newStreamGroup(lastID StreamEntryID, entriesRead int64) *streamGroup {
+	return &streamGroup{
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		pel:         make(map[StreamEntryID]*streamNACK),
+		consumers:   make(map[string]*streamConsumer),
+	}
+}
+
+// Add a consumer group, return nil if it already exists. Must be called with v.mu held.
+func (v *ValueStream) createGroup(name string, lastID StreamEntryID, entriesRead int64) *streamGroup {
+	if _, ok := v.groups[name]; ok {
+		return nil
+	}
+	if v.groups == nil {
+		v.groups = make(map[string]*streamGroup)
+	}
+	group := newStreamGroup(lastID, entriesRead)
+	v.groups[name] = group
+	v.memory.Add(streamGroupOverhead + int64(len(name)))
+	return group
+}
+
+// Must be called with v.mu held
+func (v *ValueStream) destroyGroup(name string) bool {
+	group, ok := v.groups[name]
+	if !ok {
+		return false
+	}
+	for _, consumer := range group.consumers {
+		v.deleteConsumer(group, consumer)
+	}
+	delete(v.groups, name)
+	v.memory.Add(-streamGroupOverhead - int64(len(name)))
+	return true
+}
+
+// Return the consumer called name, creating it if needed and flagging with
+// created. Must be called with v.mu held.
+func (v *ValueStream) lookupConsumer(group *streamGroup, name string, now int64) (consumer *streamConsumer, created bool) {
+	if consumer, ok := group.consumers[name]; ok {
+		return consumer, false
+	}
+	consumer = &streamConsumer{
+		name:       name,
+		seenTime:   now,
+		activeTime: -1,
+		pel:        make(map[StreamEntryID]*streamNACK),
+	}
+	group.consumers[name] = consumer
+	v.memory.Add(streamConsumerOverhead + int64(len(name)))
+	return consumer, true
+}
+
+// Remove a consumer and its pending entries, return how many it had. Must be
+// called with v.mu held.
+func (v *ValueStream) deleteConsumer(group *streamGroup, consumer *streamConsumer) int {
+	pending := len(consumer.pel)
+	for id := range consumer.pel {
+		delete(group.pel, id)
+	}
+	v.memory.Add(-int64(pending) * streamNACKOverhead)
+	delete(group.consumers, consumer.name)
+	v.memory.Add(-streamConsumerOverhead - int64(len(consumer.name)))
+	return pending
+}
+
+// Add id to the PEL of consumer, taking it over from the consumer that had
+// it pending if any. Must be called with v.mu held.
+func (v *ValueStream) addPending(group *streamGroup, consumer *streamConsumer, id StreamEntryID, now int64) {
+	nack, ok := group.pel[id]
+	if ok {
+		delete(nack.consumer.pel, id)
+	} else {
+		nack = &streamNACK{}
+		group.pel[id] = nack
+		v.memory.Add(streamNACKOverhead)
+	}
+	nack.consumer = consumer
+	nack.deliveryTime = now
+	nack.deliveryCount = 1
+	consumer.pel[id] = nack
+}
+
+// Must be called with v.mu held
+func (v *ValueStream) ackPending(group *streamGroup, id StreamEntryID) bool {
+	nack, ok := group.pel[id]
+	if !ok {
+		return false
+	}
+	delete(group.pel, id)
+	delete(nack.consumer.pel, id)
+	v.memory.Add(-streamNACKOverhead)
+	return true
+}
+
+// IDs of a PEL in ascending order
+func sortedPendingIDs(pel map[StreamEntryID]*streamNACK) []StreamEntryID {
+	ids := make([]StreamEntryID, 0, len(pel))
+	for id := range pel {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return compareEntryIds(ids[i], ids[j]) < 0
+	})
+	return ids
+}
+
+// Estimate how many entries were added up to id, Redis'
+// streamEstimateDistanceFromFirstEverEntry. Must be called with v.mu held.
+func (v *ValueStream) entriesUpTo(id StreamEntryID) int64 {
+	if v.entriesAdded == 0 {
+		return 0
+	}
+	cmpLast := compareEntryIds(id, v.lastID)
+	first, ok := v.firstID()
+	if !ok && cmpLast <= 0 {
+		return int64(v.entriesAdded)
+	}
+	if cmpLast == 0 {
+		return int64(v.entriesAdded)
+	} else if cmpLast > 0 {
+		// The counter of a future ID is unknown
+		return StreamEntriesReadInvalid
+	}
+
+	cmpFirst := compareEntryIds(id, first)
+	if v.maxDeletedID == (StreamEntryID{}) || compareEntryIds(v.maxDeletedID, first) < 0 {
+		// No deleted entry in the way
+		if cmpFirst < 0 {
+			return int64(v.entriesAdded) - int64(v.length)
+		} else if cmpFirst == 0 {
+			return int64(v.entriesAdded) - int64(v.length) + 1
+		}
+	}
+	return StreamEntriesReadInvalid
+}
+
+// Whether entries after start may have been deleted by XDEL. Must be called
+// with v.mu held.
+func (v *ValueStream) hasTombstonesAfter(start StreamEntryID) bool {
+	if v.length == 0 || v.maxDeletedID == (StreamEntryID{}) {
+		return false
+	}
+	if first, _ := v.firstID(); compareEntryIds(first, v.maxDeletedID) > 0 {
+		// The last deletion was before the first entry
+		return false
+	}
+	return compareEntryIds(start, v.maxDeletedID) <= 0
+}
+
+// Resolve the ID of XGROUP CREATE or SETID, "$" being the last ID. Must be
+// called with v.mu held.
+func (v *ValueStream) groupID(idRaw string) (StreamEntryID, error) {
+	if idRaw == "$" {
+		return v.lastID, nil
+	}
+	return streamParseEntryID(idRaw, false)
+}
+
+/*
+Replicas get what a command did to a consumer group as the commands that do
+exactly that, like Redis' streamPropagateXCLAIM, streamPropagateGroupID and
+streamPropagateConsumerCreation: what gets delivered or claimed depends on
+the time and on the PEL, replicas can't work it out from the command.
+*/
+
+// XCLAIM of id as it's now pending, FORCE adds it to the PEL if needed and
+// JUSTID keeps the delivery count as given. An entry deleted from the stream
+// is removed from the PEL by it.
+func xclaimArgs(key, group, consumer string, g *streamGroup, id StreamEntryID, nack *streamNACK) []string {
+	return []string{"XCLAIM", key, group, consumer, "0", id.String(),
+		"TIME", strconv.FormatInt(nack.deliveryTime, 10),
+		"RETRYCOUNT", strconv.FormatUint(nack.deliveryCount, 10),
+		"FORCE", "JUSTID", "LASTID", g.lastID.String()}
+}
+
+func xgroupSetIDArgs(key, group string, g *streamGroup) []string {
+	return []string{"XGROUP", "SETID", key, group, g.lastID.String(), "ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10)}
+}
+
+func xgroupCreateConsumerArgs(key, group, consumer string) []string {
+	return []string{"XGROUP", "CREATECONSUMER", key, group, consumer}
+}
+
+/*
+XGROUP
+*/
+
+// StreamGroupCreate adds the consumer group to the stream at key, starting
+// after idRaw or "$" for the last entry. With mkStream a missing key is
+// created as an empty stream.
+func (db *DB) StreamGroupCreate(key, group, idRaw string, mkStream bool, entriesRead int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	v, err := db.streamForUpdate(key, mkStream)
+	if err != nil {
+		if _, ok := err.(KeyError); ok {
+			return &StreamGroupKeyMissingError{}
+		}
+		return err
+	}
+
+	stream := v.Data.(*ValueStream)
+	stream.mu.Lock()
+	id, err := stream.groupID(idRaw)
+	if err == nil && stream.createGroup(group, id, entriesRead) == nil {
+		err = &BusyGroupError{}
+	}
+	stream.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	db.setLocked(key, v)
+	return nil
+}
+
+// StreamGroupSetID sets the last delivered ID of a consumer group
+func (db *DB) StreamGroupSetID(key, group, idRaw string, entriesRead int64) error {
+	return db.streamGroupUpdate(key, group, func(stream *ValueStream, g *streamGroup) error {
+		id, err := stream.groupID(idRaw)
+		if err != nil {
+			return err
+		}
+		g.lastID = id
+		g.entriesRead = entriesRead
+		return nil
+	})
+}
+
+// StreamGroupDestroy removes a consumer group and returns whether it existed
+func (db *DB) StreamGroupDestroy(key, group string) (bool, error) {
+	destroyed := false
+	err := db.streamWrite(key, func(stream *ValueStream) error {
+		destroyed = stream.destroyGroup(group)
+		return nil
+	})
+	if _, ok := err.(KeyError); ok {
+		return false, &StreamGroupKeyMissingError{}
+	}
+	if destroyed {
+		// Clients blocked reading the group get NOGROUP
+		db.waiters.signal(key)
+	}
+	return destroyed, err
+}
+
+// StreamGroupCreateConsumer adds a consumer to a group and returns whether it
+// didn't exist
+func (db *DB) StreamGroupCreateConsumer(key, group, consumer string) (bool, error) {
+	created := false
+	err := db.streamGroupUpdate(key, group, func(stream *ValueStream, g *streamGroup) error {
+		_, created = stream.lookupConsumer(g, consumer, time.Now().UnixMilli())
+		return nil
+	})
+	return created, err
+}
+
+// StreamGroupDeleteConsumer removes a consumer from a group and returns how
+// many entries it had pending
+func (db *DB) StreamGroupDeleteConsumer(key, group, consumer string) (int, error) {
+	pending := 0
+	err := db.streamGroupUpdate(key, group, func(stream *ValueStream, g *streamGroup) error {
+		if c, ok := g.consumers[consumer]; ok {
+			pending = stream.deleteConsumer(g, c)
+		}
+		return nil
+	})
+	return pending, err
+}
+
+// Apply fn to a consumer group for the XGROUP subcommands
+func (db *DB) streamGroupUpdate(key, group string, fn func(stream *ValueStream, g *streamGroup) error) error {
+	err := db.streamWrite(key, func(stream *ValueStream) error {
+		g, ok := stream.groups[group]
+		if !ok {
+			return &NoGroupError{message: fmt.Sprintf("No such consumer group '%s' for key name '%s'", group, key)}
+		}
+		return fn(stream, g)
+	})
+	if _, ok := err.(KeyError); ok {
+		return &StreamGroupKeyMissingError{}
+	}
+	return err
+}
+
+// Apply fn to the stream at key under its lock, then store it back so the
+// memory accounting sees the change. Returns a KeyError for a missing key.
+func (db *DB) streamWrite(key string, fn func(stream *ValueStream) error) error {
+	v, err := db.checkKey(key, ValTypeStream)
+	if err != nil {
+		return err
+	}
+
+	stream := v.Data.(*ValueStream)
+	stream.mu.Lock()
+	err = fn(stream)
+	stream.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	db.streamStored(key, v)
+	return nil
+}
+
+// Store back the stream v changed in place, unless the key was deleted or
+// replaced meanwhile
+func (db *DB) streamStored(key string, v Value) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if cur, ok := db.storage.Get(key); ok && cur.Data == v.Data {
+		db.setLocked(key, cur)
+	}
+}
+
+/*
+XREADGROUP, XACK and XPENDING
+*/
+
+// StreamReadGroup reads entries of each stream for consumer, creating it if
+// needed. The ID ">" reads entries never delivered to the group, up to count
+// (0 for all), adding them to the PEL of consumer unless noAck. Other IDs
+// read the history of consumer, its pending entries after them. When only
+// ">" is asked for and nothing was delivered, it waits up to blockMilli for
+// a new entry, 0 being forever and -1 not to wait. It also returns the
+// commands replicas run for the deliveries.
+func (db *DB) StreamReadGroup(group, consumer string, keys, ids []string, count int, noAck bool, blockMilli int64) ([]XReadKeyResult, [][]string, error) {
+	canBlock := blockMilli >= 0
+	for _, id := range ids {
+		if id != ">" {
+			canBlock = false
+		}
+	}
+	var propagate [][]string
+	if !canBlock {
+		res, _, err := db.streamReadGroup(group, consumer, keys, ids, count, noAck, &propagate)
+		return res, propagate, err
+	}
+
+	// Registered before reading, so entries added meanwhile aren't missed
+	waiter := db.waiters.add(keys)
+	defer db.waiters.remove(waiter, keys)
+	deadline, stop := blockDeadline(blockMilli)
+	defer stop()
+	for {
+		// The keys are looked up again, the group may be gone by now
+		res, delivered, err := db.streamReadGroup(group, consumer, keys, ids, count, noAck, &propagate)
+		if err != nil || delivered > 0 {
+			return res, propagate, err
+		}
+		if !waiter.wait(deadline) {
+			return nil, propagate, nil
+		}
+	}
+}
+
+func streamReadGroupMissing(key, group string) error {
+	return &NoGroupError{message: fmt.Sprintf("No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, group)}
+}
+
+// Serve XREADGROUP once, return the results of the streams with entries, or
+// all of them when reading history, and how many entries were delivered.
+// The commands for the replicas are appended to propagate.
+func (db *DB) streamReadGroup(group, consumerName string, keys, ids []string, count int, noAck bool, propagate *[][]string) ([]XReadKeyResult, int, error) {
+	values := make([]Value, len(keys))
+	for i, key := range keys {
+		v, err := db.checkKey(key, ValTypeStream)
+		if err != nil {
+			if _, ok := err.(KeyError); !ok {
+				return nil, 0, err
+			}
+			return nil, 0, streamReadGroupMissing(key, group)
+		}
+		values[i] = v
+	}
+
+	now := time.Now().UnixMilli()
+	res := make([]XReadKeyResult, 0, len(keys))
+	delivered := 0
+	for i, v := range values {
+		stream := v.Data.(*ValueStream)
+		stream.mu.Lock()
+		g, ok := stream.groups[group]
+		if !ok {
+			stream.mu.Unlock()
+			return nil, 0, streamReadGroupMissing(keys[i], group)
+		}
+		consumer, created := stream.lookupConsumer(g, consumerName, now)
+		consumer.seenTime = now
+		if created {
+			*propagate = append(*propagate, xgroupCreateConsumerArgs(keys[i], group, consumerName))
+		}
+
+		var result XReadKeyResult
+		if ids[i] == ">" {
+			result = stream.readNew(g, consumer, count, noAck, now)
+			// Like Redis, history reads aren't propagated
+			for _, id := range result.EntryIDs {
+				if nack, ok := g.pel[id]; ok && !noAck {
+					*propagate = append(*propagate, xclaimArgs(keys[i], group, consumerName, g, id, nack))
+				}
+			}
+			if len(result.EntryIDs) > 0 {
+				*propagate = append(*propagate, xgroupSetIDArgs(keys[i], group, g))
+			}
+		} else {
+			result = stream.readHistory(consumer, ids[i], count, now)
+		}
+		stream.mu.Unlock()
+		db.streamStored(keys[i], v)
+
+		result.Key = keys[i]
+		if len(result.EntryIDs) > 0 || ids[i] != ">" {
+			res = append(res, result)
+		}
+		delivered += len(result.EntryIDs)
+	}
+	return res, delivered, nil
+}
+
+// Deliver the entries after the last delivered one. Must be called with v.mu held.
+func (v *ValueStream) readNew(group *streamGroup, consumer *streamConsumer, count int, noAck bool, now int64) XReadKeyResult {
+	var result XReadKeyResult
+	if group.lastID == maxStreamEntryID {
+		return result
+	}
+	ids, values := v.read(streamIncrID(group.lastID), maxStreamEntryID, count, false)
+	for i, id := range ids {
+		if group.entriesRead != StreamEntriesReadInvalid && !v.hasTombstonesAfter(id) {
+			// Still tracking the progress of the group
+			group.entriesRead++
+		} else if v.entriesAdded > 0 {
+			group.entriesRead = v.entriesUpTo(id)
+		}
+		group.lastID = id
+		consumer.activeTime = now
+		if !noAck {
+			v.addPending(group, consumer, id, now)
+		}
+		result.EntryIDs = append(result.EntryIDs, id)
+		result.EntryValues = append(result.EntryValues, values[i])
+	}
+	return result
+}
+
+// Deliver again the pending entries of consumer after start. Entries deleted
+// meanwhile have nil values. Must be called with v.mu held.
+func (v *ValueStream) readHistory(consumer *streamConsumer, start string, count int, now int64) XReadKeyResult {
+	startID, _ := streamParseEntryID(start, false)
+	result := XReadKeyResult{EntryIDs: []StreamEntryID{}, EntryValues: []StreamEntryData{}}
+	for _, id := range sortedPendingIDs(consumer.pel) {
+		if count > 0 && len(result.EntryIDs) == count {
+			break
+		}
+		if compareEntryIds(id, startID) <= 0 {
+			continue
+		}
+		var data StreamEntryData
+		e, ok := v.lookup(id)
+		if ok {
+			data = e.data()
+			nack := consumer.pel[id]
+			nack.deliveryTime = now
+			nack.deliveryCount++
+		}
+		result.EntryIDs = append(result.EntryIDs, id)
+		result.EntryValues = append(result.EntryValues, data)
+	}
+	return result
+}
+
+// StreamAck removes the IDs from the PEL of a consumer group and returns how
+// many were pending. A missing key or group has nothing pending.
+func (db *DB) StreamAck(key, group string, ids []StreamEntryID) (int, error) {
+	acked := 0
+	err := db.streamWrite(key, func(stream *ValueStream) error {
+		g, ok := stream.groups[group]
+		if !ok {
+			return nil
+		}
+		for _, id := range ids {
+			if stream.ackPending(g, id) {
+				acked++
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(KeyError); ok {
+		return 0, nil
+	}
+	return acked, err
+}
+
+type StreamPendingSummary struct {
+	Count     int
+	MinID     StreamEntryID
+	MaxID     StreamEntryID
+	Consumers []StreamConsumerPending // consumers with pending entries, by name
+}
+
+type StreamConsumerPending struct {
+	Name  string
+	Count int
+}
+
+type StreamPendingEntry struct {
+	ID            StreamEntryID
+	Consumer      string
+	DeliveryTime  int64 // unix ms of the last delivery
+	IdleMilli     int64 // since the last delivery
+	DeliveryCount uint64
+}
+
+// StreamPendingSummary describes the PEL of a consumer group
+func (db *DB) StreamPendingSummary(key, group string) (StreamPendingSummary, error) {
+	var summary StreamPendingSummary
+	err := db.streamPendingRead(key, group, func(stream *ValueStream, g *streamGroup) {
+		ids := sortedPendingIDs(g.pel)
+		summary.Count = len(ids)
+		if len(ids) == 0 {
+			return
+		}
+		summary.MinID, summary.MaxID = ids[0], ids[len(ids)-1]
+		for _, consumer := range g.consumers {
+			if len(consumer.pel) > 0 {
+				summary.Consumers = append(summary.Consumers, StreamConsumerPending{Name: consumer.name, Count: len(consumer.pel)})
+			}
+		}
+		sort.Slice(summary.Consumers, func(i, j int) bool {
+			return summary.Consumers[i].Name < summary.Consumers[j].Name
+		})
+	})
+	return summary, err
+}
+
+// StreamPending returns up to count pending entries of a consumer group
+// between start and end, as parsed by StreamRange, idle for at least
+// minIdleMilli. A non empty consumer only returns its entries.
+func (db *DB) StreamPending(key, group, start, end string, count int, consumer string, minIdleMilli int64) ([]StreamPendingEntry, error) {
+	startID, endID, err := streamParseInterval(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	entries := make([]StreamPendingEntry, 0)
+	err = db.streamPendingRead(key, group, func(stream *ValueStream, g *streamGroup) {
+		pel := g.pel
+		if consumer != "" {
+			c, ok := g.consumers[consumer]
+			if !ok {
+				return
+			}
+			pel = c.pel
+		}
+		for _, id := range sortedPendingIDs(pel) {
+			if len(entries) >= count || compareEntryIds(id, endID) > 0 {
+				break
+			}
+			if compareEntryIds(id, startID) < 0 {
+				continue
+			}
+			nack := pel[id]
+			if max(now-nack.deliveryTime, 0) < minIdleMilli {
+				continue
+			}
+			entries = append(entries, nack.info(id, now))
+		}
+	})
+	return entries, err
+}
+
+func (nack *streamNACK) info(id StreamEntryID, now int64) StreamPendingEntry {
+	return StreamPendingEntry{
+		ID:            id,
+		Consumer:      nack.consumer.name,
+		DeliveryTime:  nack.deliveryTime,
+		IdleMilli:     max(now-nack.deliveryTime, 0),
+		DeliveryCount: nack.deliveryCount,
+	}
+}
+
+// Apply fn to a consumer group under the read lock of its stream, for XPENDING
+func (db *DB) streamPendingRead(key, group string, fn func(stream *ValueStream, g *streamGroup)) error {
+	missing := streamNoGroup(key, group)
+	v, err := db.checkKey(key, ValTypeStream)
+	if err != nil {
+		if _, ok := err.(KeyError); ok {
+			return missing
+		}
+		return err
+	}
+
+	stream := v.Data.(*ValueStream)
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+	g, ok := stream.groups[group]
+	if !ok {
+		return missing
+	}
+	fn(stream, g)
+	return nil
+}
+
+func streamNoGroup(key, group string) error {
+	return &NoGroupError{message: fmt.Sprintf("No such key '%s' or consumer group '%s'", key, group)}
+}
+
+/*
+XCLAIM and XAUTOCLAIM
+*/
+
+type StreamClaimOptions struct {
+	MinIdleMilli int64         // only claim entries idle for at least this long
+	DeliveryTime int64         // unix ms set as the last delivery, -1 for now
+	RetryCount   int64         // delivery count to set, -1 to increment it
+	Force        bool          // add IDs missing from the PEL if they're in the stream
+	JustID       bool          // don't increment the delivery counts, nor return the values
+	LastID       StreamEntryID // new last delivered ID of the group, if greater
+}
+
+// StreamClaim transfers the pending entries with the given IDs to consumer
+// and returns them, with their values unless opts.JustID, and the commands
+// replicas run for it. Entries deleted from the stream are removed from the
+// PEL instead.
+func (db *DB) StreamClaim(key, group, consumer string, ids []StreamEntryID, opts StreamClaimOptions) ([]StreamEntryID, []StreamEntryData, [][]string, error) {
+	var claimedIDs []StreamEntryID
+	var claimedValues []StreamEntryData
+	var propagate [][]string
+	err := db.streamClaimWrite(key, group, func(stream *ValueStream, g *streamGroup) {
+		now := time.Now().UnixMilli()
+		deliveryTime := opts.DeliveryTime
+		if deliveryTime < 0 || deliveryTime > now {
+			deliveryTime = now
+		}
+		// Sent with each XCLAIM, on its own when there's none
+		lastIDChanged := false
+		if compareEntryIds(opts.LastID, g.lastID) > 0 {
+			g.lastID = opts.LastID
+			lastIDChanged = true
+		}
+
+		var c *streamConsumer
+		for _, id := range ids {
+			e, exists := stream.lookup(id)
+			if !exists {
+				if nack, ok := g.pel[id]; ok {
+					propagate = append(propagate, xclaimArgs(key, group, consumer, g, id, nack))
+					stream.ackPending(g, id)
+				}
+				continue
+			}
+			nack, ok := g.pel[id]
+			if !ok {
+				if !opts.Force {
+					continue
+				}
+				nack = &streamNACK{deliveryCount: 1}
+				g.pel[id] = nack
+				stream.memory.Add(streamNACKOverhead)
+			}
+			// An entry just added by FORCE has never been delivered
+			if nack.consumer != nil && opts.MinIdleMilli > 0 && now-nack.deliveryTime < opts.MinIdleMilli {
+				continue
+			}
+
+			if c == nil {
+				c, _ = stream.lookupConsumer(g, consumer, now)
+			}
+			stream.claimPending(c, id, nack, deliveryTime, opts.RetryCount, opts.JustID)
+			c.seenTime, c.activeTime = now, now
+			propagate = append(propagate, xclaimArgs(key, group, consumer, g, id, nack))
+			claimedIDs = append(claimedIDs, id)
+			if !opts.JustID {
+				claimedValues = append(claimedValues, e.data())
+			}
+		}
+		if lastIDChanged && len(propagate) == 0 {
+			propagate = append(propagate, xgroupSetIDArgs(key, group, g))
+		}
+	})
+	return claimedIDs, claimedValues, propagate, err
+}
+
+type StreamAutoClaimResult struct {
+	Next    StreamEntryID // cursor for the next call, 0-0 once the PEL was scanned
+	IDs     []StreamEntryID
+	Values  []StreamEntryData // nil with JustID
+	Deleted []StreamEntryID   // pending entries no longer in the stream, removed from the PEL
+
+	Propagate [][]string // commands replicas run for the claims and removals
+}
+
+// Pending entries examined per entry to claim by XAUTOCLAIM
+const streamAutoClaimAttemptsFactor = 10
+
+// StreamAutoClaim scans the PEL from start, as parsed by StreamRange, and
+// transfers to consumer up to count entries idle for at least minIdleMilli,
+// like StreamClaim does
+func (db *DB) StreamAutoClaim(key, group, consumer string, minIdleMilli int64, start string, count int, justID bool) (StreamAutoClaimResult, error) {
+	var res StreamAutoClaimResult
+	startID, _, err := streamParseInterval(start, "+")
+	if err != nil {
+		return res, err
+	}
+
+	err = db.streamClaimWrite(key, group, func(stream *ValueStream, g *streamGroup) {
+		now := time.Now().UnixMilli()
+		ids := sortedPendingIDs(g.pel)
+		i, _ := slices.BinarySearchFunc(ids, startID, compareEntryIds)
+
+		var c *streamConsumer
+		attempts := count * streamAutoClaimAttemptsFactor
+		for ; attempts > 0 && count > 0 && i < len(ids); i++ {
+			attempts--
+			id := ids[i]
+			nack := g.pel[id]
+			e, exists := stream.lookup(id)
+			if !exists {
+				res.Propagate = append(res.Propagate, xclaimArgs(key, group, consumer, g, id, nack))
+				stream.ackPending(g, id)
+				res.Deleted = append(res.Deleted, id)
+				count--
+				continue
+			}
+			if minIdleMilli > 0 && now-nack.deliveryTime < minIdleMilli {
+				continue
+			}
+
+			if c == nil {
+				c, _ = stream.lookupConsumer(g, consumer, now)
+			}
+			stream.claimPending(c, id, nack, now, -1, justID)
+			c.seenTime, c.activeTime = now, now
+			res.Propagate = append(res.Propagate, xclaimArgs(key, group, consumer, g, id, nack))
+			res.IDs = append(res.IDs, id)
+			if !justID {
+				res.Values = append(res.Values, e.data())
+			}
+			count--
+		}
+		if i < len(ids) {
+			res.Next = ids[i]
+		}
+	})
+	return res, err
+}
+
+// Make nack, pending for id, owned by consumer. Must be called with v.mu held.
+func (v *ValueStream) claimPending(consumer *streamConsumer, id StreamEntryID, nack *streamNACK, deliveryTime, retryCount int64, justID bool) {
+	if nack.consumer != consumer {
+		if nack.consumer != nil {
+			delete(nack.consumer.pel, id)
+		}
+		nack.consumer = consumer
+		consumer.pel[id] = nack
+	}
+	nack.deliveryTime = deliveryTime
+	if retryCount >= 0 {
+		nack.deliveryCount = uint64(retryCount)
+	} else if !justID {
+		nack.deliveryCount++
+	}
+}
+
+// Apply fn to a consumer group for XCLAIM and XAUTOCLAIM
+func (db *DB) streamClaimWrite(key, group string, fn func(stream *ValueStream, g *streamGroup)) error {
+	err := db.streamWrite(key, func(stream *ValueStream) error {
+		g, ok := stream.groups[group]
+		if !ok {
+			return streamNoGroup(key, group)
+		}
+		fn(stream, g)
+		return nil
+	})
+	if _, ok := err.(KeyError); ok {
+		return streamNoGroup(key, group)
+	}
+	return err
+}
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamGroupCreate(t *testing.T) {
+	db := NewDB(DBOptions{})
+
+	err := db.StreamGroupCreate("s", "g", "$", false, StreamEntriesReadInvalid)
+	assert.IsType(t, &StreamGroupKeyMissingError{}, err)
+	assert.NoError(t, db.StreamGroupCreate("s", "g", "$", true, StreamEntriesReadInvalid))
+	err = db.StreamGroupCreate("s", "g", "0", false, StreamEntriesReadInvalid)
+	assert.IsType(t, &BusyGroupError{}, err)
+	err = db.StreamGroupCreate("s", "g2", "x", false, StreamEntriesReadInvalid)
+	assert.IsType(t, &StreamKeyInvalid{}, err)
+
+	err = db.StreamGroupSetID("s", "nope", "0", StreamEntriesReadInvalid)
+	assert.IsType(t, &NoGroupError{}, err)
+
+	destroyed, err := db.StreamGroupDestroy("s", "g")
+	assert.NoError(t, err)
+	assert.True(t, destroyed)
+	destroyed, _ = db.StreamGroupDestroy("s", "g")
+	assert.False(t, destroyed)
+}
+
+func TestStreamGroupCreateConcurrent(t *testing.T) {
+	db := NewDB(DBOptions{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.StreamGroupCreate("s", "g"+strconv.Itoa(i), "$", true, StreamEntriesReadInvalid); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	groups, err := db.StreamGroupsInfo("s")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 50)
+
+	db.StringSet("str", []byte("v"), 0)
+	err = db.StreamGroupCreate("str", "g", "$", true, StreamEntriesReadInvalid)
+	assert.IsType(t, &TypeMismatchError{}, err)
+}
+
+func TestStreamReadGroupAndAck(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 3)
+	assert.NoError(t, db.StreamGroupCreate("s", "g", "0", false, StreamEntriesReadInvalid))
+
+	res, _, err := db.StreamReadGroup("g", "alice", []string{"s"}, []string{">"}, 2, false, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []StreamEntryID{{1, 1}, {2, 1}}, res[0].EntryIDs)
+	res, _, _ = db.StreamReadGroup("g", "bob", []string{"s"}, []string{">"}, 0, false, -1)
+	assert.Equal(t, []StreamEntryID{{3, 1}}, res[0].EntryIDs)
+	res, _, _ = db.StreamReadGroup("g", "bob", []string{"s"}, []string{">"}, 0, false, -1)
+	assert.Empty(t, res)
+
+	stream := mustStream(t, db, "s")
+	assert.EqualValues(t, 3, stream.groups["g"].entriesRead)
+	assert.Equal(t, StreamEntryID{3, 1}, stream.groups["g"].lastID)
+
+	// The history of alice, a deleted entry has no values
+	_, err = db.StreamDelete("s", []StreamEntryID{{1, 1}})
+	assert.NoError(t, err)
+	res, _, _ = db.StreamReadGroup("g", "alice", []string{"s"}, []string{"0"}, 0, false, -1)
+	assert.Equal(t, []StreamEntryID{{1, 1}, {2, 1}}, res[0].EntryIDs)
+	assert.Nil(t, res[0].EntryValues[0])
+	assert.NotNil(t, res[0].EntryValues[1])
+
+	summary, err := db.StreamPendingSummary("s", "g")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, summary.Count)
+	assert.Equal(t, StreamEntryID{1, 1}, summary.MinID)
+	assert.Equal(t, StreamEntryID{3, 1}, summary.MaxID)
+	assert.Equal(t, []StreamConsumerPending{{"alice", 2}, {"bob", 1}}, summary.Consumers)
+
+	acked, err := db.StreamAck("s", "g", []StreamEntryID{{1, 1}, {9, 9}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, acked)
+	acked, _ = db.StreamAck("s", "nope", []StreamEntryID{{2, 1}})
+	assert.Equal(t, 0, acked)
+
+	entries, err := db.StreamPending("s", "g", "-", "+", 10, "", 0)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "alice", entries[0].Consumer)
+	assert.EqualValues(t, 2, entries[0].DeliveryCount)
+	entries, _ = db.StreamPending("s", "g", "(2-1", "+", 10, "", 0)
+	assert.Equal(t, []StreamEntryID{{3, 1}}, []StreamEntryID{entries[0].ID})
+	entries, _ = db.StreamPending("s", "g", "-", "+", 10, "bob", 0)
+	assert.Len(t, entries, 1)
+	entries, _ = db.StreamPending("s", "g", "-", "+", 10, "", 60000)
+	assert.Empty(t, entries)
+
+	pending, err := db.StreamGroupDeleteConsumer("s", "g", "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pending)
+	summary, _ = db.StreamPendingSummary("s", "g")
+	assert.Equal(t, 1, summary.Count)
+}
+
+func TestStreamReadGroupNoAckAndMissing(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 2)
+	assert.NoError(t, db.StreamGroupCreate("s", "g", "0", false, StreamEntriesReadInvalid))
+
+	res, _, err := db.StreamReadGroup("g", "c", []string{"s"}, []string{">"}, 0, true, -1)
+	assert.NoError(t, err)
+	assert.Len(t, res[0].EntryIDs, 2)
+	summary, _ := db.StreamPendingSummary("s", "g")
+	assert.Equal(t, 0, summary.Count)
+
+	_, _, err = db.StreamReadGroup("nope", "c", []string{"s"}, []string{">"}, 0, false, -1)
+	assert.IsType(t, &NoGroupError{}, err)
+	_, _, err = db.StreamReadGroup("g", "c", []string{"missing"}, []string{">"}, 0, false, -1)
+	assert.IsType(t, &NoGroupError{}, err)
+	_, err = db.StreamPendingSummary("missing", "g")
+	assert.IsType(t, &NoGroupError{}, err)
+}
+
+func TestStreamGroupsSurviveDumpAndCopy(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 3)
+	assert.NoError(t, db.StreamGroupCreate("s", "g", "0", false, StreamEntriesReadInvalid))
+	_, _, err := db.StreamReadGroup("g", "alice", []string{"s"}, []string{">"}, 2, false, -1)
+	assert.NoError(t, err)
+	_, err = db.StreamGroupCreateConsumer("s", "g", "idle")
+	assert.NoError(t, err)
+
+	payload, err := db.Dump("s")
+	assert.NoError(t, err)
+	_, err = db.Restore("restored", payload, RestoreOptions{IdleSeconds: -1, Freq: -1})
+	assert.NoError(t, err)
+	_, err = db.Copy("s", "copied", false)
+	assert.NoError(t, err)
+
+	for _, key := range []string{"restored", "copied"} {
+		group := mustStream(t, db, key).groups["g"]
+		assert.Equal(t, StreamEntryID{2, 1}, group.lastID)
+		assert.EqualValues(t, 2, group.entriesRead)
+		assert.Len(t, group.consumers, 2)
+		assert.Len(t, group.pel, 2)
+		alice := group.consumers["alice"]
+		assert.Len(t, alice.pel, 2)
+		assert.Same(t, alice, group.pel[StreamEntryID{1, 1}].consumer)
+	}
+
+	// The copy has its own PEL
+	_, err = db.StreamAck("copied", "g", []StreamEntryID{{1, 1}})
+	assert.NoError(t, err)
+	assert.Len(t, mustStream(t, db, "s").groups["g"].pel, 2)
+}
+
+func TestStreamClaim(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 4)
+	assert.NoError(t, db.StreamGroupCreate("s", "g", "0", false, StreamEntriesReadInvalid))
+	_, _, err := db.StreamReadGroup("g", "alice", []string{"s"}, []string{">"}, 3, false, -1)
+	assert.NoError(t, err)
+
+	noOpts := StreamClaimOptions{DeliveryTime: -1, RetryCount: -1}
+	ids, values, _, err := db.StreamClaim("s", "g", "bob", []StreamEntryID{{1, 1}, {4, 1}}, noOpts)
+	assert.NoError(t, err)
+	assert.Equal(t, []StreamEntryID{{1, 1}}, ids)
+	assert.Len(t, values, 1)
+
+	// Not idle for long enough
+	ids, _, _, _ = db.StreamClaim("s", "g", "bob", []StreamEntryID{{2, 1}}, StreamClaimOptions{MinIdleMilli: 60000, DeliveryTime: -1, RetryCount: -1})
+	assert.Empty(t, ids)
+
+	opts := StreamClaimOptions{DeliveryTime: 0, RetryCount: 5, JustID: true, LastID: StreamEntryID{9, 9}}
+	ids, values, _, _ = db.StreamClaim("s", "g", "bob", []StreamEntryID{{2, 1}}, opts)
+	assert.Equal(t, []StreamEntryID{{2, 1}}, ids)
+	assert.Nil(t, values)
+	group := mustStream(t, db, "s").groups["g"]
+	assert.EqualValues(t, 5, group.pel[StreamEntryID{2, 1}].deliveryCount)
+	assert.EqualValues(t, 0, group.pel[StreamEntryID{2, 1}].deliveryTime)
+	assert.Equal(t, StreamEntryID{9, 9}, group.lastID)
+	assert.Len(t, group.consumers["alice"].pel, 1)
+	assert.Len(t, group.consumers["bob"].pel, 2)
+
+	// FORCE adds entries of the stream missing from the PEL
+	ids, _, _, _ = db.StreamClaim("s", "g", "bob", []StreamEntryID{{4, 1}, {8, 1}}, StreamClaimOptions{DeliveryTime: -1, RetryCount: -1, Force: true})
+	assert.Equal(t, []StreamEntryID{{4, 1}}, ids)
+
+	// Deleted entries leave the PEL
+	_, err = db.StreamDelete("s", []StreamEntryID{{3, 1}})
+	assert.NoError(t, err)
+	ids, _, _, _ = db.StreamClaim("s", "g", "bob", []StreamEntryID{{3, 1}}, noOpts)
+	assert.Empty(t, ids)
+	assert.NotContains(t, group.pel, StreamEntryID{3, 1})
+
+	_, _, _, err = db.StreamClaim("s", "nope", "bob", nil, noOpts)
+	assert.IsType(t, &NoGroupError{}, err)
+}
+
+func TestStreamAutoClaim(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 5)
+	assert.NoError(t, db.StreamGroupCreate("s", "g", "0", false, StreamEntriesReadInvalid))
+	_, _, err := db.StreamReadGroup("g", "alice", []string{"s"}, []string{">"}, 0, false, -1)
+	assert.NoError(t, err)
+	_, err = db.StreamDelete("s", []StreamEntryID{{2, 1}})
+	assert.NoError(t, err)
+
+	res, err := db.StreamAutoClaim("s", "g", "bob", 0, "-", 2, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []StreamEntryID{{1, 1}}, res.IDs)
+	assert.Equal(t, []StreamEntryID{{2, 1}}, res.Deleted)
+	assert.Equal(t, StreamEntryID{3, 1}, res.Next)
+
+	res, _ = db.StreamAutoClaim("s", "g", "bob", 0, res.Next.String(), 10, true)
+	assert.Equal(t, []StreamEntryID{{3, 1}, {4, 1}, {5, 1}}, res.IDs)
+	assert.Nil(t, res.Values)
+	assert.Equal(t, StreamEntryID{}, res.Next)
+
+	group := mustStream(t, db, "s").groups["g"]
+	assert.Empty(t, group.consumers["alice"].pel)
+	assert.Len(t, group.consumers["bob"].pel, 4)
+	// JUSTID doesn't count as a delivery
+	assert.EqualValues(t, 1, group.pel[StreamEntryID{3, 1}].deliveryCount)
+	assert.EqualValues(t, 2, group.pel[StreamEntryID{1, 1}].deliveryCount)
+
+	res, _ = db.StreamAutoClaim("s", "g", "carol", 60000, "0", 10, false)
+	assert.Empty(t, res.IDs)
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+XINFO, describing streams, their consumer groups and consumers
+*/
+
+type StreamInfo struct {
+	Length          int
+	RadixTreeKeys   int
+	RadixTreeNodes  int
+	LastGeneratedID StreamEntryID
+	MaxDeletedID    StreamEntryID
+	EntriesAdded    uint64
+	FirstID         StreamEntryID // recorded first entry ID, 0-0 when empty
+	NumGroups       int
+
+	// The first and last entries, or with full the first count entries
+	EntryIDs    []StreamEntryID
+	EntryValues []StreamEntryData
+	// With full only, the PELs truncated to count entries
+	Groups []StreamGroupInfo
+}
+
+type StreamGroupInfo struct {
+	Name            string
+	Consumers       []StreamConsumerInfo // with XINFO GROUPS only the length is known
+	NumConsumers    int
+	Pending         []StreamPendingEntry
+	PelCount        int
+	LastDeliveredID StreamEntryID
+	EntriesRead     int64 // StreamEntriesReadInvalid when unknown
+	Lag             int64 // StreamEntriesReadInvalid when unknown
+}
+
+type StreamConsumerInfo struct {
+	Name          string
+	Pending       []StreamPendingEntry
+	PelCount      int
+	SeenTime      int64 // unix ms
+	ActiveTime    int64 // unix ms, -1 for never
+	IdleMilli     int64 // since the last read attempt
+	InactiveMilli int64 // since the last delivery, -1 for never
+}
+
+// StreamInfo describes the stream at key. With full it returns up to count
+// entries (0 for all) and the consumer groups with up to count pending
+// entries each.
+func (db *DB) StreamInfo(key string, full bool, count int) (StreamInfo, error) {
+	var info StreamInfo
+	v, err := db.checkKey(key, ValTypeStream)
+	if err != nil {
+		return info, err
+	}
+
+	stream := v.Data.(*ValueStream)
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+
+	info.Length = stream.length
+	info.RadixTreeKeys, info.RadixTreeNodes = stream.radixTreeSize()
+	info.LastGeneratedID = stream.lastID
+	info.MaxDeletedID = stream.maxDeletedID
+	info.EntriesAdded = stream.entriesAdded
+	info.FirstID, _ = stream.firstID()
+	info.NumGroups = len(stream.groups)
+
+	if !full {
+		if stream.length > 0 {
+			firstIDs, firstValues := stream.read(StreamEntryID{}, maxStreamEntryID, 1, false)
+			lastIDs, lastValues := stream.read(StreamEntryID{}, maxStreamEntryID, 1, true)
+			info.EntryIDs = append(firstIDs, lastIDs...)
+			info.EntryValues = append(firstValues, lastValues...)
+		}
+		return info, nil
+	}
+
+	info.EntryIDs, info.EntryValues = stream.read(StreamEntryID{}, maxStreamEntryID, count, false)
+
+	now := time.Now().UnixMilli()
+	info.Groups = make([]StreamGroupInfo, 0, len(stream.groups))
+	for _, name := range sortedGroupNames(stream.groups) {
+		g := stream.groups[name]
+		groupInfo := stream.groupInfo(name, g)
+		groupInfo.Pending = pendingInfo(g.pel, count, now)
+		for _, consumer := range sortedConsumers(g) {
+			consumerInfo := consumer.info(now)
+			consumerInfo.Pending = pendingInfo(consumer.pel, count, now)
+			groupInfo.Consumers = append(groupInfo.Consumers, consumerInfo)
+		}
+		info.Groups = append(info.Groups, groupInfo)
+	}
+	return info, nil
+}
+
+// StreamGroupsInfo describes the consumer groups of the stream at key
+func (db *DB) StreamGroupsInfo(key string) ([]StreamGroupInfo, error) {
+	v, err := db.checkKey(key, ValTypeStream)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := v.Data.(*ValueStream)
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+
+	groups := make([]StreamGroupInfo, 0, len(stream.groups))
+	for _, name := range sortedGroupNames(stream.groups) {
+		groups = append(groups, stream.groupInfo(name, stream.groups[name]))
+	}
+	return groups, nil
+}
+
+// StreamConsumersInfo describes the consumers of a consumer group
+func (db *DB) StreamConsumersInfo(key, group string) ([]StreamConsumerInfo, error) {
+	v, err := db.checkKey(key, ValTypeStream)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := v.Data.(*ValueStream)
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+
+	g, ok := stream.groups[group]
+	if !ok {
+		return nil, &NoGroupError{message: fmt.Sprintf("No such consumer group '%s' for key name '%s'", group, key)}
+	}
+	now := time.Now().UnixMilli()
+	consumers := make([]StreamConsumerInfo, 0, len(g.consumers))
+	for _, consumer := range sortedConsumers(g) {
+		consumers = append(consumers, consumer.info(now))
+	}
+	return consumers, nil
+}
+
+// Must be called with v.mu held
+func (v *ValueStream) groupInfo(name string, g *streamGroup) StreamGroupInfo {
+	return StreamGroupInfo{
+		Name:            name,
+		NumConsumers:    len(g.consumers),
+		PelCount:        len(g.pel),
+		LastDeliveredID: g.lastID,
+		EntriesRead:     g.entriesRead,
+		Lag:             v.groupLag(g),
+	}
+}
+
+// Entries added to the stream but not delivered to the group yet, or
+// StreamEntriesReadInvalid when it can't be told. Must be called with v.mu held.
+func (v *ValueStream) groupLag(g *streamGroup) int64 {
+	if v.entriesAdded == 0 {
+		return 0
+	}
+	if g.entriesRead != StreamEntriesReadInvalid && !v.hasTombstonesAfter(g.lastID) {
+		return int64(v.entriesAdded) - g.entriesRead
+	}
+	entriesRead := v.entriesUpTo(g.lastID)
+	if entriesRead == StreamEntriesReadInvalid {
+		return StreamEntriesReadInvalid
+	}
+	return int64(v.entriesAdded) - entriesRead
+}
+
+func (c *streamConsumer) info(now int64) StreamConsumerInfo {
+	info := StreamConsumerInfo{
+		Name:          c.name,
+		PelCount:      len(c.pel),
+		SeenTime:      c.seenTime,
+		ActiveTime:    c.activeTime,
+		IdleMilli:     max(now-c.seenTime, 0),
+		InactiveMilli: -1,
+	}
+	if c.activeTime >= 0 {
+		info.InactiveMilli = max(now-c.activeTime, 0)
+	}
+	return info
+}
+
+// Up to count (0 for all) entries of a PEL in ID order
+func pendingInfo(pel map[StreamEntryID]*streamNACK, count int, now int64) []StreamPendingEntry {
+	ids := sortedPendingIDs(pel)
+	if count > 0 && count < len(ids) {
+		ids = ids[:count]
+	}
+	entries := make([]StreamPendingEntry, len(ids))
+	for i, id := range ids {
+		entries[i] = pel[id].info(id, now)
+	}
+	return entries
+}
+
+func sortedGroupNames(groups map[string]*streamGroup) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedConsumers(g *streamGroup) []*streamConsumer {
+	consumers := make([]*streamConsumer, 0, len(g.consumers))
+	for _, consumer := range g.consumers {
+		consumers = append(consumers, consumer)
+	}
+	sort.Slice(consumers, func(i, j int) bool {
+		return consumers[i].name < consumers[j].name
+	})
+	return consumers
+}
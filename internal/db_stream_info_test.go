@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamInfo(t *testing.T) {
+	db := NewDB(DBOptions{})
+	_, err := db.StreamInfo("s", false, 0)
+	assert.IsType(t, &KeyNotFoundError{}, err)
+
+	fillStream(t, db, "s", 1, 150)
+	assert.NoError(t, db.StreamGroupCreate("s", "g", "0", false, StreamEntriesReadInvalid))
+	_, _, err = db.StreamReadGroup("g", "alice", []string{"s"}, []string{">"}, 3, false, -1)
+	assert.NoError(t, err)
+
+	info, err := db.StreamInfo("s", false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 150, info.Length)
+	assert.Equal(t, 2, info.RadixTreeKeys)
+	assert.Equal(t, StreamEntryID{150, 1}, info.LastGeneratedID)
+	assert.Equal(t, StreamEntryID{1, 1}, info.FirstID)
+	assert.Equal(t, 1, info.NumGroups)
+	assert.Equal(t, []StreamEntryID{{1, 1}, {150, 1}}, info.EntryIDs)
+	assert.Nil(t, info.Groups)
+
+	info, err = db.StreamInfo("s", true, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []StreamEntryID{{1, 1}, {2, 1}}, info.EntryIDs)
+	assert.Len(t, info.Groups, 1)
+	group := info.Groups[0]
+	assert.Equal(t, 3, group.PelCount)
+	assert.Len(t, group.Pending, 2)
+	assert.Equal(t, "alice", group.Consumers[0].Name)
+	assert.Len(t, group.Consumers[0].Pending, 2)
+}
+
+func TestStreamGroupLag(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 5)
+	assert.NoError(t, db.StreamGroupCreate("s", "g", "0", false, StreamEntriesReadInvalid))
+	assert.NoError(t, db.StreamGroupCreate("s", "h", "$", false, StreamEntriesReadInvalid))
+
+	groups, err := db.StreamGroupsInfo("s")
+	assert.NoError(t, err)
+	assert.Equal(t, "g", groups[0].Name)
+	assert.EqualValues(t, StreamEntriesReadInvalid, groups[0].EntriesRead)
+	assert.EqualValues(t, 5, groups[0].Lag)
+	assert.EqualValues(t, 0, groups[1].Lag)
+
+	_, _, err = db.StreamReadGroup("g", "c", []string{"s"}, []string{">"}, 2, false, -1)
+	assert.NoError(t, err)
+	groups, _ = db.StreamGroupsInfo("s")
+	assert.EqualValues(t, 2, groups[0].EntriesRead)
+	assert.EqualValues(t, 3, groups[0].Lag)
+
+	// A deletion after the last delivered entry makes the lag unknown
+	_, err = db.StreamDelete("s", []StreamEntryID{{4, 1}})
+	assert.NoError(t, err)
+	groups, _ = db.StreamGroupsInfo("s")
+	assert.EqualValues(t, StreamEntriesReadInvalid, groups[0].Lag)
+
+	consumers, err := db.StreamConsumersInfo("s", "g")
+	assert.NoError(t, err)
+	assert.Equal(t, "c", consumers[0].Name)
+	assert.Equal(t, 2, consumers[0].PelCount)
+	_, err = db.StreamConsumersInfo("s", "nope")
+	assert.IsType(t, &NoGroupError{}, err)
+}
+
+func TestStreamSetID(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 3)
+
+	err := db.StreamSetID("s", StreamEntryID{2, 1}, -1, StreamEntryID{})
+	assert.IsType(t, &StreamKeyInvalid{}, err)
+	err = db.StreamSetID("s", StreamEntryID{5, 0}, 2, StreamEntryID{})
+	assert.IsType(t, &StreamKeyInvalid{}, err)
+	err = db.StreamSetID("s", StreamEntryID{5, 0}, 10, StreamEntryID{6, 0})
+	assert.IsType(t, &StreamKeyInvalid{}, err)
+	err = db.StreamSetID("missing", StreamEntryID{5, 0}, -1, StreamEntryID{})
+	assert.IsType(t, &KeyNotFoundError{}, err)
+
+	assert.NoError(t, db.StreamSetID("s", StreamEntryID{5, 0}, 10, StreamEntryID{4, 0}))
+	stream := mustStream(t, db, "s")
+	assert.Equal(t, StreamEntryID{5, 0}, stream.lastID)
+	assert.EqualValues(t, 10, stream.entriesAdded)
+	assert.Equal(t, StreamEntryID{4, 0}, stream.maxDeletedID)
+
+	// New IDs must be greater than the one set
+	_, _, err = db.StreamAdd("s", "4-1", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+	assert.IsType(t, &StreamKeyTooSmall{}, err)
+}
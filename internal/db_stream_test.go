@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Add the entries <from>-1 to <to>-1
+func fillStream(t *testing.T, db *DB, key string, from, to int) {
+	for i := from; i <= to; i++ {
+		_, _, err := db.StreamAdd(key, fmt.Sprintf("%d-1", i), StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+		assert.NoError(t, err)
+	}
+}
+
+func TestStreamDeleteKeepsLastID(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 3)
+
+	n, err := db.StreamDelete("s", []StreamEntryID{{3, 1}, {2, 1}, {9, 9}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	length, _ := db.StreamLen("s")
+	assert.Equal(t, 1, length)
+
+	stream := mustStream(t, db, "s")
+	assert.Equal(t, StreamEntryID{3, 1}, stream.lastID)
+	assert.Equal(t, StreamEntryID{3, 1}, stream.maxDeletedID)
+	assert.EqualValues(t, 3, stream.entriesAdded)
+
+	// IDs can't go back to the deleted ones
+	_, _, err = db.StreamAdd("s", "3-1", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+	assert.IsType(t, &StreamKeyTooSmall{}, err)
+	id, _, err := db.StreamAdd("s", "3-*", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "3-2", id)
+}
+
+func TestStreamTrim(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 250)
+	before := db.UsedMemory()
+
+	// Approximate trimming only removes whole nodes
+	n, _, err := db.StreamTrim("s", StreamTrimOptions{Strategy: StreamTrimMaxLen, MaxLen: 120, Approx: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 100, n)
+	assert.Less(t, db.UsedMemory(), before)
+
+	n, _, _ = db.StreamTrim("s", StreamTrimOptions{Strategy: StreamTrimMaxLen, MaxLen: 120})
+	assert.Equal(t, 30, n)
+
+	n, _, _ = db.StreamTrim("s", StreamTrimOptions{Strategy: StreamTrimMinID, MinID: StreamEntryID{200, 0}})
+	assert.Equal(t, 69, n)
+	ids, _, _ := db.StreamRange("s", "-", "+", 0, false)
+	assert.Equal(t, StreamEntryID{200, 1}, ids[0])
+
+	// The limit rounds down to whole nodes too: the node left with 200-1,
+	// then the one 201-1 to 300-1
+	fillStream(t, db, "s", 251, 500)
+	n, _, _ = db.StreamTrim("s", StreamTrimOptions{Strategy: StreamTrimMaxLen, MaxLen: 0, Approx: true, Limit: 150})
+	assert.Equal(t, 101, n)
+
+	n, _, err = db.StreamTrim("missing", StreamTrimOptions{Strategy: StreamTrimMaxLen})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestStreamAddOptions(t *testing.T) {
+	db := NewDB(DBOptions{})
+	_, _, err := db.StreamAdd("s", "*", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{NoMkStream: true})
+	assert.IsType(t, &KeyNotFoundError{}, err)
+	assert.Equal(t, 0, db.Exists("s"))
+
+	fillStream(t, db, "s", 1, 5)
+	_, _, err = db.StreamAdd("s", "6-1", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{
+		NoMkStream: true,
+		Trim:       StreamTrimOptions{Strategy: StreamTrimMaxLen, MaxLen: 2},
+	})
+	assert.NoError(t, err)
+	length, _ := db.StreamLen("s")
+	assert.Equal(t, 2, length)
+
+	db.StringSet("str", []byte("v"), 0)
+	_, _, err = db.StreamAdd("str", "*", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+	assert.IsType(t, &TypeMismatchError{}, err)
+}
+
+func TestStreamAddConcurrent(t *testing.T) {
+	db := NewDB(DBOptions{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, _, err := db.StreamAdd("s", "*", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	length, _ := db.StreamLen("s")
+	assert.Equal(t, 1000, length)
+}
+
+func TestStreamAddKeepsExpiry(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 1)
+	expireAt := time.Now().Add(time.Minute).UnixMilli()
+	_, err := db.Expire("s", expireAt, 0)
+	assert.NoError(t, err)
+
+	fillStream(t, db, "s", 2, 2)
+	expireTime, err := db.ExpireTime("s")
+	assert.NoError(t, err)
+	assert.Equal(t, expireAt, expireTime)
+}
+
+func TestStreamMetadataSurvivesDump(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 3)
+	_, err := db.StreamDelete("s", []StreamEntryID{{3, 1}})
+	assert.NoError(t, err)
+
+	payload, err := db.Dump("s")
+	assert.NoError(t, err)
+	_, err = db.Restore("copy", payload, RestoreOptions{IdleSeconds: -1, Freq: -1})
+	assert.NoError(t, err)
+
+	stream := mustStream(t, db, "copy")
+	assert.Equal(t, StreamEntryID{3, 1}, stream.lastID)
+	assert.Equal(t, StreamEntryID{3, 1}, stream.maxDeletedID)
+	assert.EqualValues(t, 3, stream.entriesAdded)
+}
+
+func mustStream(t *testing.T, db *DB, key string) *ValueStream {
+	v, err := db.checkKey(key, ValTypeStream)
+	assert.NoError(t, err)
+	return v.Data.(*ValueStream)
+}
+
+func TestStreamRangeCountAndExclusive(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 5)
+
+	ids, _, err := db.StreamRange("s", "(2-1", "+", 2, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []StreamEntryID{{3, 1}, {4, 1}}, ids)
+
+	ids, _, err = db.StreamRange("s", "-", "(4-1", 0, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []StreamEntryID{{3, 1}, {2, 1}, {1, 1}}, ids)
+
+	ids, _, err = db.StreamRange("s", "(5-1", "+", 0, false)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	_, _, err = db.StreamRange("s", "(-", "+", 0, false)
+	_, _, err = db.StreamRange("s", "(18446744073709551615-18446744073709551615", "+", 0, false)
+	_, _, err = db.StreamRange("s", "-", "(18446744073709551615-18446744073709551615", 0, false)
+	_, _, err = db.StreamRange("s", "-", "(0-0", 0, false)
+	assert.Error(t, err)
+	assert.Error(t, err)
+
+	ids, _, err = db.StreamRange("missing", "-", "+", 0, false)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestStreamReadLastEntryAndCount(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 5)
+
+	res, err := db.StreamRead([]string{"s"}, []string{"+"}, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []StreamEntryID{{5, 1}}, res[0].EntryIDs)
+
+	res, _ = db.StreamRead([]string{"s"}, []string{"0-0"}, 2, -1)
+	assert.Equal(t, []StreamEntryID{{1, 1}, {2, 1}}, res[0].EntryIDs)
+
+	// Only the streams with entries are returned
+	res, _ = db.StreamRead([]string{"s", "missing"}, []string{"$", "0-0"}, 0, -1)
+	assert.Empty(t, res)
+
+	db.StringSet("str", []byte("v"), 0)
+	_, err = db.StreamRead([]string{"str"}, []string{"0-0"}, 0, -1)
+	assert.IsType(t, &TypeMismatchError{}, err)
+}
@@ -1,6 +1,15 @@
 package internal
 
-import "time"
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Precision of the C long double Redis uses for INCRBYFLOAT (x87 extended)
+const longDoublePrec = 64
 
 /*
 Functions for strings type
@@ -24,5 +33,107 @@ func (db *DB) StringSet(key string, val []byte, expireAfterMilli int64) {
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	db.storage[key] = value
+	db.setLocked(key, value)
+}
+
+// IncrBy adds delta to the integer stored at key as a single atomic step.
+// A missing key counts as 0, an existing key keeps its expiry time.
+func (db *DB) IncrBy(key string, delta int64) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	value, err := db.stringForUpdate(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var cur int64
+	if value.Data != nil {
+		parsed, ok := ParseInt64(value.Data.ToBytes())
+		if !ok {
+			return 0, &NotIntegerError{}
+		}
+		cur = parsed
+	}
+
+	if (delta < 0 && cur < math.MinInt64-delta) || (delta > 0 && cur > math.MaxInt64-delta) {
+		return 0, &OverflowError{}
+	}
+	cur += delta
+
+	value.Data = ValueString(strconv.FormatInt(cur, 10))
+	db.setLocked(key, value)
+	return cur, nil
+}
+
+// IncrByFloat adds incr to the number stored at key with long double
+// precision and returns the new value formatted the way Redis does.
+func (db *DB) IncrByFloat(key string, incr string) (string, error) {
+	delta, ok := parseLongDouble(incr)
+	if !ok {
+		return "", &NotFloatError{}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	value, err := db.stringForUpdate(key)
+	if err != nil {
+		return "", err
+	}
+
+	cur := new(big.Float).SetPrec(longDoublePrec)
+	if value.Data != nil {
+		parsed, ok := parseLongDouble(string(value.Data.ToBytes()))
+		if !ok {
+			return "", &NotFloatError{}
+		}
+		cur = parsed
+	}
+
+	if cur.IsInf() || delta.IsInf() {
+		return "", &NaNOrInfinityError{}
+	}
+	cur.Add(cur, delta)
+
+	res := formatLongDouble(cur)
+	value.Data = ValueString(res)
+	db.setLocked(key, value)
+	return res, nil
+}
+
+// Return the live string value at key for a read-modify-write, or an empty
+// string value if the key doesn't exist. Must be called with db.mu held.
+func (db *DB) stringForUpdate(key string) (Value, error) {
+	if v, ok := db.storage.Get(key); ok && !v.isExpired(time.Now().UnixMilli()) {
+		if v.Type != ValTypeString {
+			return Value{}, &TypeMismatchError{}
+		}
+		return v, nil
+	}
+	return Value{Type: ValTypeString}, nil
+}
+
+func parseLongDouble(s string) (*big.Float, bool) {
+	if len(s) == 0 || strings.TrimSpace(s) != s {
+		return nil, false
+	}
+	f, _, err := new(big.Float).SetPrec(longDoublePrec).Parse(s, 10)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// Same as Redis' ld2string with LD_STR_HUMAN: "%.17Lf" without trailing zeros
+func formatLongDouble(f *big.Float) string {
+	s := f.Text('f', 17)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(s, "0")
+		s = strings.TrimSuffix(s, ".")
+	}
+	if s == "-0" {
+		s = "0"
+	}
+	return s
 }
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncrByConcurrent(t *testing.T) {
+	db := NewDB(DBOptions{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := db.IncrBy("counter", 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := db.StringGet("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "5000", string(v.Data.ToBytes()))
+}
+
+func TestIncrByKeepsExpiry(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("counter", []byte("10"), 60_000)
+	before, _ := db.StringGet("counter")
+
+	res, err := db.IncrBy("counter", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := db.StringGet("counter")
+
+	assert.EqualValues(t, 15, res)
+	assert.Equal(t, before.ExpiredTimeMilli, after.ExpiredTimeMilli)
+	assert.LessOrEqual(t, after.ExpiredTimeMilli, time.Now().Add(time.Minute).UnixMilli())
+}
+
+func TestIncrByErrors(t *testing.T) {
+	db := NewDB(DBOptions{})
+
+	db.StringSet("max", []byte("9223372036854775807"), 0)
+	_, err := db.IncrBy("max", 1)
+	assert.IsType(t, &OverflowError{}, err)
+
+	db.StringSet("min", []byte("-9223372036854775808"), 0)
+	_, err = db.IncrBy("min", -1)
+	assert.IsType(t, &OverflowError{}, err)
+	_, err = db.IncrBy("min", math.MaxInt64)
+	assert.NoError(t, err)
+
+	for _, raw := range []string{"abc", "", " 1", "+1", "01", "1.5", "9223372036854775808"} {
+		db.StringSet("bad", []byte(raw), 0)
+		_, err = db.IncrBy("bad", 1)
+		assert.IsType(t, &NotIntegerError{}, err, raw)
+	}
+}
+
+func TestIncrByFloat(t *testing.T) {
+	db := NewDB(DBOptions{})
+
+	db.StringSet("f", []byte("10.50"), 0)
+	res, err := db.IncrByFloat("f", "0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.6", res)
+
+	res, err = db.IncrByFloat("f", "-5")
+	assert.NoError(t, err)
+	assert.Equal(t, "5.6", res)
+
+	db.StringSet("f", []byte("5.0e3"), 0)
+	res, err = db.IncrByFloat("f", "2.0e2")
+	assert.NoError(t, err)
+	assert.Equal(t, "5200", res)
+
+	res, err = db.IncrByFloat("new", "0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.1", res)
+	res, err = db.IncrByFloat("new", "0.2")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.3", res)
+
+	res, err = db.IncrByFloat("new", "-0.3")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", res)
+
+	_, err = db.IncrByFloat("new", "abc")
+	assert.IsType(t, &NotFloatError{}, err)
+	_, err = db.IncrByFloat("new", "inf")
+	assert.IsType(t, &NaNOrInfinityError{}, err)
+}
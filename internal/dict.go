@@ -0,0 +1,367 @@
+package internal
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+)
+
+const (
+	dictInitialSize      = 4
+	dictRehashStep       = 1  // buckets moved to the new table by every write
+	dictMaxEmptyVisits   = 10 // per bucket of a rehash step
+	dictShrinkFillFactor = 8  // shrink when less than 1/8 of the buckets are used
+)
+
+// dict is a hash table with chained, power-of-two sized bucket tables, ported
+// from Redis' dict.c. Resizing is incremental: while rehashing both tables are
+// live and every write moves a few buckets from table 0 to table 1.
+// The bucket layout allows a stateless Scan cursor that survives resizes.
+// dict isn't safe for concurrent use, the owner holds the lock.
+type dict[V any] struct {
+	tables    [2][]*dictEntry[V]
+	used      [2]int
+	rehashIdx int // next bucket of table 0 to move, -1 when not rehashing
+	seed      maphash.Seed
+}
+
+type dictEntry[V any] struct {
+	key  string
+	val  V
+	next *dictEntry[V]
+}
+
+func newDict[V any]() *dict[V] {
+	return &dict[V]{
+		rehashIdx: -1,
+		seed:      maphash.MakeSeed(),
+	}
+}
+
+func (d *dict[V]) Len() int {
+	return d.used[0] + d.used[1]
+}
+
+// Buckets returns the size of the bucket tables
+func (d *dict[V]) Buckets() int {
+	return len(d.tables[0]) + len(d.tables[1])
+}
+
+func (d *dict[V]) isRehashing() bool {
+	return d.rehashIdx != -1
+}
+
+func (d *dict[V]) hash(key string) uint64 {
+	return maphash.String(d.seed, key)
+}
+
+func (d *dict[V]) find(key string) *dictEntry[V] {
+	if d.Len() == 0 {
+		return nil
+	}
+	h := d.hash(key)
+	for t := 0; t <= 1; t++ {
+		table := d.tables[t]
+		if len(table) == 0 {
+			continue
+		}
+		for e := table[h&uint64(len(table)-1)]; e != nil; e = e.next {
+			if e.key == key {
+				return e
+			}
+		}
+		if !d.isRehashing() {
+			break
+		}
+	}
+	return nil
+}
+
+func (d *dict[V]) Get(key string) (V, bool) {
+	if e := d.find(key); e != nil {
+		return e.val, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Set inserts or replaces the value of key and reports whether key is new
+func (d *dict[V]) Set(key string, val V) bool {
+	d.rehashStep()
+	if e := d.find(key); e != nil {
+		e.val = val
+		return false
+	}
+
+	d.expandIfNeeded()
+	// New entries go to the new table while rehashing
+	t := 0
+	if d.isRehashing() {
+		t = 1
+	}
+	table := d.tables[t]
+	idx := d.hash(key) & uint64(len(table)-1)
+	table[idx] = &dictEntry[V]{key: key, val: val, next: table[idx]}
+	d.used[t]++
+	return true
+}
+
+// Delete removes key and returns its value, if it was there
+func (d *dict[V]) Delete(key string) (V, bool) {
+	var zero V
+	if d.Len() == 0 {
+		return zero, false
+	}
+	d.rehashStep()
+
+	h := d.hash(key)
+	for t := 0; t <= 1; t++ {
+		table := d.tables[t]
+		if len(table) == 0 {
+			continue
+		}
+		idx := h & uint64(len(table)-1)
+		var prev *dictEntry[V]
+		for e := table[idx]; e != nil; e = e.next {
+			if e.key == key {
+				if prev == nil {
+					table[idx] = e.next
+				} else {
+					prev.next = e.next
+				}
+				d.used[t]--
+				d.shrinkIfNeeded()
+				return e.val, true
+			}
+			prev = e
+		}
+		if !d.isRehashing() {
+			break
+		}
+	}
+	return zero, false
+}
+
+// Clear drops every entry and the tables
+func (d *dict[V]) Clear() {
+	d.tables = [2][]*dictEntry[V]{}
+	d.used = [2]int{}
+	d.rehashIdx = -1
+}
+
+// Range calls fn for every entry until it returns false. fn must not modify the dict.
+func (d *dict[V]) Range(fn func(key string, val V) bool) {
+	for t := 0; t <= 1; t++ {
+		for _, e := range d.tables[t] {
+			for ; e != nil; e = e.next {
+				if !fn(e.key, e.val) {
+					return
+				}
+			}
+		}
+		if !d.isRehashing() {
+			break
+		}
+	}
+}
+
+// Scan calls fn for the entries of the buckets at cursor and returns the next
+// cursor, 0 once the iteration is complete. The cursor is incremented with its
+// bits reversed so every entry present for the whole iteration is returned at
+// least once even if the table grows or shrinks between calls, see dictScan in
+// Redis' dict.c. fn must not modify the dict.
+func (d *dict[V]) Scan(cursor uint64, fn func(key string, val V)) uint64 {
+	if d.Len() == 0 {
+		return 0
+	}
+
+	emit := func(e *dictEntry[V]) {
+		for ; e != nil; e = e.next {
+			fn(e.key, e.val)
+		}
+	}
+
+	if !d.isRehashing() {
+		table := d.tables[0]
+		m0 := uint64(len(table) - 1)
+		emit(table[cursor&m0])
+
+		// Set the unmasked bits so incrementing the reversed cursor only touches the masked ones
+		cursor |= ^m0
+		return bits.Reverse64(bits.Reverse64(cursor) + 1)
+	}
+
+	// Visit the bucket of the smaller table, then all the buckets of the
+	// larger table that expand from it
+	small, large := d.tables[0], d.tables[1]
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+	m0, m1 := uint64(len(small)-1), uint64(len(large)-1)
+	emit(small[cursor&m0])
+	for {
+		emit(large[cursor&m1])
+		cursor |= ^m1
+		cursor = bits.Reverse64(bits.Reverse64(cursor) + 1)
+		if cursor&(m0^m1) == 0 {
+			break
+		}
+	}
+	return cursor
+}
+
+// RandomEntry returns a random entry, false if the dict is empty
+func (d *dict[V]) RandomEntry() (string, V, bool) {
+	var zero V
+	if d.Len() == 0 {
+		return "", zero, false
+	}
+
+	var head *dictEntry[V]
+	for head == nil {
+		if d.isRehashing() {
+			// Buckets of table 0 below rehashIdx are empty
+			size0, size1 := len(d.tables[0]), len(d.tables[1])
+			idx := d.rehashIdx + rand.Intn(size0+size1-d.rehashIdx)
+			if idx >= size0 {
+				head = d.tables[1][idx-size0]
+			} else {
+				head = d.tables[0][idx]
+			}
+		} else {
+			head = d.tables[0][rand.Intn(len(d.tables[0]))]
+		}
+	}
+
+	// Pick a random element of the chain
+	n := 0
+	for e := head; e != nil; e = e.next {
+		n++
+	}
+	e := head
+	for i := rand.Intn(n); i > 0; i-- {
+		e = e.next
+	}
+	return e.key, e.val, true
+}
+
+// SampleEntries calls fn for up to count entries picked from a random spot of
+// the table, cheaper than count calls to RandomEntry. Like dictGetSomeKeys.
+func (d *dict[V]) SampleEntries(count int, fn func(key string, val V)) {
+	if d.Len() == 0 || count <= 0 {
+		return
+	}
+	count = min(count, d.Len())
+
+	maxMask := uint64(len(d.tables[0]) - 1)
+	if d.isRehashing() {
+		maxMask = max(maxMask, uint64(len(d.tables[1])-1))
+	}
+
+	idx := rand.Uint64() & maxMask
+	sampled, emptyVisits := 0, 0
+	for steps := count * 10; sampled < count && steps > 0; steps-- {
+		for t := 0; t <= 1; t++ {
+			if t == 1 && !d.isRehashing() {
+				break
+			}
+			table := d.tables[t]
+			if idx >= uint64(len(table)) {
+				continue
+			}
+			e := table[idx]
+			if e == nil {
+				// Jump somewhere else after a run of empty buckets
+				emptyVisits++
+				if emptyVisits >= 5 && emptyVisits > count {
+					idx = rand.Uint64() & maxMask
+					emptyVisits = 0
+				}
+				continue
+			}
+			emptyVisits = 0
+			for ; e != nil && sampled < count; e = e.next {
+				fn(e.key, e.val)
+				sampled++
+			}
+		}
+		idx = (idx + 1) & maxMask
+	}
+}
+
+func (d *dict[V]) expandIfNeeded() {
+	if d.isRehashing() {
+		return
+	}
+	if len(d.tables[0]) == 0 {
+		d.tables[0] = make([]*dictEntry[V], dictInitialSize)
+		return
+	}
+	if d.used[0] >= len(d.tables[0]) {
+		d.resize(d.used[0] + 1)
+	}
+}
+
+func (d *dict[V]) shrinkIfNeeded() {
+	if d.isRehashing() || len(d.tables[0]) <= dictInitialSize {
+		return
+	}
+	if d.used[0]*dictShrinkFillFactor < len(d.tables[0]) {
+		d.resize(d.used[0])
+	}
+}
+
+// Start rehashing into a table of the next power of two >= size
+func (d *dict[V]) resize(size int) {
+	newSize := dictInitialSize
+	for newSize < size {
+		newSize *= 2
+	}
+	if newSize == len(d.tables[0]) {
+		return
+	}
+	d.tables[1] = make([]*dictEntry[V], newSize)
+	d.used[1] = 0
+	d.rehashIdx = 0
+}
+
+// Move a few buckets of table 0 to table 1, finishing the rehash when table 0 is empty
+func (d *dict[V]) rehashStep() {
+	if !d.isRehashing() {
+		return
+	}
+
+	emptyVisits := dictRehashStep * dictMaxEmptyVisits
+	for n := dictRehashStep; n > 0 && d.used[0] > 0; n-- {
+		for d.tables[0][d.rehashIdx] == nil {
+			d.rehashIdx++
+			emptyVisits--
+			if emptyVisits == 0 {
+				return
+			}
+		}
+
+		mask := uint64(len(d.tables[1]) - 1)
+		for e := d.tables[0][d.rehashIdx]; e != nil; {
+			next := e.next
+			idx := d.hash(e.key) & mask
+			e.next = d.tables[1][idx]
+			d.tables[1][idx] = e
+			d.used[0]--
+			d.used[1]++
+			e = next
+		}
+		d.tables[0][d.rehashIdx] = nil
+		d.rehashIdx++
+	}
+
+	if d.used[0] == 0 {
+		d.tables[0] = d.tables[1]
+		d.used[0] = d.used[1]
+		d.tables[1] = nil
+		d.used[1] = 0
+		d.rehashIdx = -1
+		// Entries deleted during the rehash may call for another shrink
+		d.shrinkIfNeeded()
+	}
+}
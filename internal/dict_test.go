@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDictSetGetDelete(t *testing.T) {
+	d := newDict[int]()
+	for i := 0; i < 10_000; i++ {
+		assert.True(t, d.Set(strconv.Itoa(i), i))
+	}
+	assert.False(t, d.Set("42", -42))
+	assert.Equal(t, 10_000, d.Len())
+
+	v, ok := d.Get("42")
+	assert.True(t, ok)
+	assert.Equal(t, -42, v)
+
+	for i := 0; i < 9_990; i++ {
+		_, ok := d.Delete(strconv.Itoa(i))
+		assert.True(t, ok)
+	}
+	_, ok = d.Delete("0")
+	assert.False(t, ok)
+	assert.Equal(t, 10, d.Len())
+	for i := 9_990; i < 10_000; i++ {
+		v, ok := d.Get(strconv.Itoa(i))
+		assert.True(t, ok)
+		assert.Equal(t, i, v)
+	}
+
+	// Finish the rehash triggered by the deletes and check it shrank
+	for d.isRehashing() {
+		d.rehashStep()
+	}
+	assert.Less(t, len(d.tables[0]), 1024)
+}
+
+func scanAll[V any](d *dict[V], between func()) map[string]int {
+	seen := make(map[string]int)
+	var cursor uint64
+	for {
+		cursor = d.Scan(cursor, func(key string, _ V) {
+			seen[key]++
+		})
+		if cursor == 0 {
+			return seen
+		}
+		between()
+	}
+}
+
+func TestDictScanWhileGrowing(t *testing.T) {
+	d := newDict[int]()
+	for i := 0; i < 1000; i++ {
+		d.Set(strconv.Itoa(i), i)
+	}
+
+	// Grow the table a lot in between the first calls
+	next := 1000
+	seen := scanAll(d, func() {
+		for i := 0; i < 50 && next < 20_000; i++ {
+			d.Set(strconv.Itoa(next), next)
+			next++
+		}
+	})
+
+	for i := 0; i < 1000; i++ {
+		assert.GreaterOrEqual(t, seen[strconv.Itoa(i)], 1, "missing key %d", i)
+	}
+}
+
+func TestDictScanWhileShrinking(t *testing.T) {
+	d := newDict[int]()
+	for i := 0; i < 5000; i++ {
+		d.Set(strconv.Itoa(i), i)
+	}
+
+	// Keys below 100 stay for the whole iteration, the rest get deleted
+	next := 100
+	seen := scanAll(d, func() {
+		for i := 0; i < 50 && next < 5000; i++ {
+			d.Delete(strconv.Itoa(next))
+			next++
+		}
+	})
+
+	for i := 0; i < 100; i++ {
+		assert.GreaterOrEqual(t, seen[strconv.Itoa(i)], 1, "missing key %d", i)
+	}
+}
+
+func TestDictRandomAndSample(t *testing.T) {
+	d := newDict[int]()
+	_, _, ok := d.RandomEntry()
+	assert.False(t, ok)
+
+	for i := 0; i < 100; i++ {
+		d.Set(strconv.Itoa(i), i)
+	}
+	key, val, ok := d.RandomEntry()
+	assert.True(t, ok)
+	assert.Equal(t, strconv.Itoa(val), key)
+
+	sampled := 0
+	d.SampleEntries(20, func(key string, val int) {
+		assert.Equal(t, strconv.Itoa(val), key)
+		sampled++
+	})
+	assert.Equal(t, 20, sampled)
+}
@@ -36,7 +36,7 @@ type StreamKeyInvalid struct {
 
 func (e *StreamKeyInvalid) Error() string {
 	if e.message == "" {
-		return "Stream key invalid"
+		return "Invalid stream ID specified as stream command argument"
 	}
 	return e.message
 }
@@ -46,3 +46,79 @@ type StreamKeyTooSmall struct{}
 func (e *StreamKeyTooSmall) Error() string {
 	return "The ID specified in XADD is equal or smaller than the target stream top item"
 }
+
+type NotIntegerError struct{}
+
+func (e *NotIntegerError) Error() string {
+	return "value is not an integer or out of range"
+}
+
+type NotFloatError struct{}
+
+func (e *NotFloatError) Error() string {
+	return "value is not a valid float"
+}
+
+type OverflowError struct{}
+
+func (e *OverflowError) Error() string {
+	return "increment or decrement would overflow"
+}
+
+type NaNOrInfinityError struct{}
+
+func (e *NaNOrInfinityError) Error() string {
+	return "increment would produce NaN or Infinity"
+}
+
+type SameObjectError struct{}
+
+func (e *SameObjectError) Error() string {
+	return "source and destination objects are the same"
+}
+
+type BusyKeyError struct{}
+
+func (e *BusyKeyError) Error() string {
+	return "BUSYKEY Target key name already exists."
+}
+
+type DumpPayloadError struct{}
+
+func (e *DumpPayloadError) Error() string {
+	return "DUMP payload version or checksum are wrong"
+}
+
+// A DUMP payload with a valid checksum that can't be decoded
+type BadDataFormatError struct {
+	err error
+}
+
+func (e *BadDataFormatError) Error() string {
+	return "Bad data format"
+}
+
+func (e *BadDataFormatError) Unwrap() error {
+	return e.err
+}
+
+type StreamGroupKeyMissingError struct{}
+
+func (e *StreamGroupKeyMissingError) Error() string {
+	return "The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."
+}
+
+type BusyGroupError struct{}
+
+func (e *BusyGroupError) Error() string {
+	return "BUSYGROUP Consumer Group name already exists"
+}
+
+// A missing stream or consumer group, the message depends on the command
+type NoGroupError struct {
+	message string
+}
+
+func (e *NoGroupError) Error() string {
+	return "NOGROUP " + e.message
+}
@@ -0,0 +1,390 @@
+package internal
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Eviction of keys when the dataset grows over maxmemory, ported from Redis'
+// evict.c. Keys are picked by approximated LRU, LFU or TTL: a few keys are
+// sampled per db and the best candidates kept in a small pool across calls.
+
+type EvictionPolicy byte
+
+const (
+	NoEviction EvictionPolicy = iota
+	AllKeysLRU
+	VolatileLRU
+	AllKeysLFU
+	VolatileLFU
+	AllKeysRandom
+	VolatileRandom
+	VolatileTTL
+)
+
+var evictionPolicyNames = [...]string{
+	NoEviction:     "noeviction",
+	AllKeysLRU:     "allkeys-lru",
+	VolatileLRU:    "volatile-lru",
+	AllKeysLFU:     "allkeys-lfu",
+	VolatileLFU:    "volatile-lfu",
+	AllKeysRandom:  "allkeys-random",
+	VolatileRandom: "volatile-random",
+	VolatileTTL:    "volatile-ttl",
+}
+
+func ParseEvictionPolicy(name string) (EvictionPolicy, bool) {
+	for p, n := range evictionPolicyNames {
+		if n == name {
+			return EvictionPolicy(p), true
+		}
+	}
+	return NoEviction, false
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+func (p EvictionPolicy) isLRU() bool {
+	return p == AllKeysLRU || p == VolatileLRU
+}
+
+func (p EvictionPolicy) IsLFU() bool {
+	return p == AllKeysLFU || p == VolatileLFU
+}
+
+// Volatile policies only evict keys with an expiry
+func (p EvictionPolicy) isVolatile() bool {
+	return p == VolatileLRU || p == VolatileLFU || p == VolatileRandom || p == VolatileTTL
+}
+
+const (
+	lruClockMax        = 1<<24 - 1 // the LRU clock takes 24 bits
+	lruClockResolution = 1000      // milliseconds per LRU clock tick
+	lfuInitVal         = 5         // counter of new keys, so they aren't evicted right away
+	lfuLogFactor       = 10        // how slowly the counter grows, Redis' lfu-log-factor
+	lfuDecayTime       = 1         // minutes for the counter to decrement by one, Redis' lfu-decay-time
+	evictionPoolSize   = 16
+)
+
+// Access bookkeeping of a key, like the lru field of Redis objects. For LRU
+// policies it holds the LRU clock of the last access. For LFU policies the
+// top 16 bits are the minute of the last decrement and the low 8 bits a
+// logarithmic access counter. Shared by the copies of a Value, updated
+// atomically so readers can touch keys under the read lock.
+type accessInfo struct {
+	lru atomic.Uint32
+}
+
+func newAccessInfo(policy EvictionPolicy) *accessInfo {
+	a := &accessInfo{}
+	if policy.IsLFU() {
+		a.lru.Store(lfuTimeInMinutes()<<8 | lfuInitVal)
+	} else {
+		a.lru.Store(lruClock())
+	}
+	return a
+}
+
+// Record an access
+func (a *accessInfo) touch(policy EvictionPolicy) {
+	if policy.IsLFU() {
+		counter := lfuLogIncr(a.lfuCounter())
+		a.lru.Store(lfuTimeInMinutes()<<8 | uint32(counter))
+	} else {
+		a.lru.Store(lruClock())
+	}
+}
+
+// Milliseconds since the last access, with LRU bookkeeping
+func (a *accessInfo) idleMilli() int64 {
+	clock, lru := lruClock(), a.lru.Load()
+	if clock >= lru {
+		return int64(clock-lru) * lruClockResolution
+	}
+	// The clock wrapped around
+	return int64(clock+(lruClockMax-lru)) * lruClockResolution
+}
+
+// Access counter decremented for the time elapsed since the last decrement,
+// with LFU bookkeeping
+func (a *accessInfo) lfuCounter() uint8 {
+	lru := a.lru.Load()
+	ldt, counter := lru>>8, uint8(lru&255)
+	periods := lfuTimeElapsed(ldt) / lfuDecayTime
+	if periods > uint32(counter) {
+		return 0
+	}
+	return counter - uint8(periods)
+}
+
+func lruClock() uint32 {
+	return uint32(time.Now().UnixMilli()/lruClockResolution) & lruClockMax
+}
+
+func lfuTimeInMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 65535
+}
+
+// Minutes elapsed since ldt, handling the 16 bit wrap around
+func lfuTimeElapsed(ldt uint32) uint32 {
+	now := lfuTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 65535 - ldt + now
+}
+
+// Increment the counter with a probability that shrinks as it grows, so 255
+// stands for about a million accesses
+func lfuLogIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return counter
+	}
+	baseval := max(float64(counter)-lfuInitVal, 0)
+	p := 1.0 / (baseval*lfuLogFactor + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+// Restore the access bookkeeping saved in an RDB file or a DUMP payload,
+// idle seconds for LRU policies and the counter for LFU ones. Returns nil
+// when nothing applies to policy.
+func loadedAccessInfo(policy EvictionPolicy, idleSeconds int64, freq int) *accessInfo {
+	switch {
+	case policy.isLRU() && idleSeconds >= 0:
+		a := &accessInfo{}
+		clock := int64(lruClock())
+		lru := clock - idleSeconds
+		if lru < 0 {
+			lru += lruClockMax
+		}
+		a.lru.Store(uint32(lru))
+		return a
+	case policy.IsLFU() && freq >= 0:
+		a := &accessInfo{}
+		a.lru.Store(lfuTimeInMinutes()<<8 | uint32(min(freq, 255)))
+		return a
+	default:
+		return nil
+	}
+}
+
+/*
+Eviction
+*/
+
+type evictionCandidate struct {
+	score uint64 // the higher, the better to evict
+	db    int
+	key   string
+}
+
+// A key removed by the evictor
+type EvictedKey struct {
+	DB  int
+	Key string
+}
+
+// Evictor frees memory from a set of dbs according to an eviction policy
+type Evictor struct {
+	MaxMemory int64 // bytes, 0 for no limit
+	Policy    EvictionPolicy
+	Samples   int // keys sampled per db, Redis' maxmemory-samples
+
+	dbs         []*DB
+	pool        []evictionCandidate // sorted by ascending score
+	nextDB      int                 // next db to pick a random key from
+	evictedKeys atomic.Int64
+	mu          sync.Mutex
+}
+
+func NewEvictor(dbs []*DB, maxMemory int64, policy EvictionPolicy, samples int) *Evictor {
+	return &Evictor{
+		MaxMemory: maxMemory,
+		Policy:    policy,
+		Samples:   samples,
+		dbs:       dbs,
+		pool:      make([]evictionCandidate, 0, evictionPoolSize),
+	}
+}
+
+// UsedMemory returns the approximate bytes used by all the dbs
+func (e *Evictor) UsedMemory() int64 {
+	var used int64
+	for _, db := range e.dbs {
+		used += db.UsedMemory()
+	}
+	return used
+}
+
+// EvictedKeys returns how many keys were evicted so far
+func (e *Evictor) EvictedKeys() int64 {
+	return e.evictedKeys.Load()
+}
+
+// PerformEvictions deletes keys picked by the policy until the used memory is
+// within MaxMemory. It returns the evicted keys, and false if the memory is
+// still over the limit because nothing (more) can be evicted.
+func (e *Evictor) PerformEvictions() ([]EvictedKey, bool) {
+	if e.MaxMemory <= 0 || e.UsedMemory() <= e.MaxMemory {
+		return nil, true
+	}
+	if e.Policy == NoEviction {
+		return nil, false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	evicted := make([]EvictedKey, 0)
+	for e.UsedMemory() > e.MaxMemory {
+		var dbIdx int
+		var key string
+		var ok bool
+		if e.Policy == AllKeysRandom || e.Policy == VolatileRandom {
+			dbIdx, key, ok = e.randomKey()
+		} else {
+			dbIdx, key, ok = e.bestKey()
+		}
+		if !ok {
+			return evicted, false
+		}
+
+		if e.dbs[dbIdx].evictKey(key, e.Policy.isVolatile()) {
+			e.evictedKeys.Add(1)
+			evicted = append(evicted, EvictedKey{DB: dbIdx, Key: key})
+		}
+	}
+	return evicted, true
+}
+
+// Pick a random key visiting the dbs round robin
+func (e *Evictor) randomKey() (int, string, bool) {
+	for i := 0; i < len(e.dbs); i++ {
+		idx := e.nextDB
+		e.nextDB = (e.nextDB + 1) % len(e.dbs)
+		db := e.dbs[idx]
+
+		db.mu.RLock()
+		var key string
+		var ok bool
+		if e.Policy.isVolatile() {
+			key, _, ok = db.expires.RandomEntry()
+		} else {
+			key, _, ok = db.storage.RandomEntry()
+		}
+		db.mu.RUnlock()
+		if ok {
+			return idx, key, true
+		}
+	}
+	return 0, "", false
+}
+
+// Refill the pool with samples of every db and pop the best candidate that still exists
+func (e *Evictor) bestKey() (int, string, bool) {
+	for {
+		totalKeys := 0
+		for idx, db := range e.dbs {
+			totalKeys += e.populatePool(idx, db)
+		}
+		if totalKeys == 0 {
+			return 0, "", false
+		}
+
+		for len(e.pool) > 0 {
+			best := e.pool[len(e.pool)-1]
+			e.pool = e.pool[:len(e.pool)-1]
+			if e.dbs[best.db].hasEvictionCandidate(best.key, e.Policy.isVolatile()) {
+				return best.db, best.key, true
+			}
+		}
+	}
+}
+
+// Sample keys of db into the pool, return how many keys the sampled dict holds
+func (e *Evictor) populatePool(idx int, db *DB) int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if e.Policy.isVolatile() {
+		db.expires.SampleEntries(e.Samples, func(key string, expireAt int64) {
+			if v, ok := db.storage.Get(key); ok {
+				e.insertCandidate(idx, key, e.score(v, expireAt))
+			}
+		})
+		return db.expires.Len()
+	}
+	db.storage.SampleEntries(e.Samples, func(key string, v Value) {
+		e.insertCandidate(idx, key, e.score(v, v.ExpiredTimeMilli))
+	})
+	return db.storage.Len()
+}
+
+func (e *Evictor) score(v Value, expireAt int64) uint64 {
+	switch {
+	case e.Policy == VolatileTTL:
+		// Sooner expiry, better candidate
+		return math.MaxUint64 - uint64(expireAt)
+	case v.access == nil:
+		return 0
+	case e.Policy.IsLFU():
+		return 255 - uint64(v.access.lfuCounter())
+	default:
+		return uint64(v.access.idleMilli())
+	}
+}
+
+// Insert into the pool kept sorted by score, dropping the worst candidate when full
+func (e *Evictor) insertCandidate(db int, key string, score uint64) {
+	for i, c := range e.pool {
+		if c.db == db && c.key == key {
+			e.pool = append(e.pool[:i], e.pool[i+1:]...)
+			break
+		}
+	}
+
+	k := 0
+	for k < len(e.pool) && e.pool[k].score < score {
+		k++
+	}
+	candidate := evictionCandidate{score: score, db: db, key: key}
+	if len(e.pool) < evictionPoolSize {
+		e.pool = append(e.pool, evictionCandidate{})
+		copy(e.pool[k+1:], e.pool[k:])
+		e.pool[k] = candidate
+		return
+	}
+	if k == 0 {
+		// Worse than everything in a full pool
+		return
+	}
+	// Shift the worse candidates left, dropping the first one
+	copy(e.pool[:k-1], e.pool[1:k])
+	e.pool[k-1] = candidate
+}
+
+func (db *DB) hasEvictionCandidate(key string, volatile bool) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	v, ok := db.storage.Get(key)
+	return ok && (!volatile || v.ExpiredTimeMilli > 0)
+}
+
+func (db *DB) evictKey(key string, volatile bool) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	v, ok := db.storage.Get(key)
+	if !ok || (volatile && v.ExpiredTimeMilli == 0) {
+		return false
+	}
+	db.deleteLocked(key)
+	return true
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsedMemory(t *testing.T) {
+	db := NewDB(DBOptions{})
+	assert.EqualValues(t, 0, db.UsedMemory())
+
+	db.StringSet("k", []byte("value"), 0)
+	withValue := db.UsedMemory()
+	assert.Greater(t, withValue, int64(0))
+
+	db.StringSet("k", []byte("a much longer value"), 0)
+	assert.Greater(t, db.UsedMemory(), withValue)
+
+	db.StreamAdd("s", "1-1", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+	withStream := db.UsedMemory()
+	db.StreamAdd("s", "1-2", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+	assert.Greater(t, db.UsedMemory(), withStream)
+
+	db.Del("k", "s")
+	assert.EqualValues(t, 0, db.UsedMemory())
+}
+
+func fillDB(db *DB, n int, expireAfterMilli int64) {
+	for i := 0; i < n; i++ {
+		db.StringSet(fmt.Sprintf("key:%d", i), []byte("value"), expireAfterMilli)
+	}
+}
+
+func TestEvictNoEviction(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillDB(db, 10, 0)
+	e := NewEvictor([]*DB{db}, 1, NoEviction, 5)
+
+	evicted, ok := e.PerformEvictions()
+	assert.False(t, ok)
+	assert.Empty(t, evicted)
+	assert.Equal(t, 10, db.DBSize())
+}
+
+func TestEvictAllKeys(t *testing.T) {
+	for _, policy := range []EvictionPolicy{AllKeysLRU, AllKeysLFU, AllKeysRandom} {
+		db0, db1 := NewDB(DBOptions{MaxMemoryPolicy: policy}), NewDB(DBOptions{MaxMemoryPolicy: policy})
+		fillDB(db0, 100, 0)
+		fillDB(db1, 100, 0)
+		limit := (db0.UsedMemory() + db1.UsedMemory()) / 2
+		e := NewEvictor([]*DB{db0, db1}, limit, policy, 5)
+
+		evicted, ok := e.PerformEvictions()
+		assert.True(t, ok, policy.String())
+		assert.LessOrEqual(t, e.UsedMemory(), limit, policy.String())
+		assert.Equal(t, 200-len(evicted), db0.DBSize()+db1.DBSize(), policy.String())
+		assert.EqualValues(t, len(evicted), e.EvictedKeys(), policy.String())
+	}
+}
+
+func TestEvictVolatile(t *testing.T) {
+	for _, policy := range []EvictionPolicy{VolatileLRU, VolatileLFU, VolatileRandom, VolatileTTL} {
+		db := NewDB(DBOptions{MaxMemoryPolicy: policy})
+		fillDB(db, 50, 0)
+		db.StringSet("volatile:1", []byte("v"), 60_000)
+		db.StringSet("volatile:2", []byte("v"), 60_000)
+		e := NewEvictor([]*DB{db}, 1, policy, 5)
+
+		// Only the keys with an expiry can go, that's not enough
+		evicted, ok := e.PerformEvictions()
+		assert.False(t, ok, policy.String())
+		assert.Len(t, evicted, 2, policy.String())
+		assert.Equal(t, 50, db.DBSize(), policy.String())
+	}
+}
+
+func TestEvictVolatileTTLPicksSoonestExpiry(t *testing.T) {
+	db := NewDB(DBOptions{MaxMemoryPolicy: VolatileTTL})
+	db.StringSet("later", []byte("v"), 60_000)
+	db.StringSet("sooner", []byte("v"), 10_000)
+	e := NewEvictor([]*DB{db}, db.UsedMemory()-1, VolatileTTL, 5)
+
+	evicted, ok := e.PerformEvictions()
+	assert.True(t, ok)
+	assert.Equal(t, []EvictedKey{{DB: 0, Key: "sooner"}}, evicted)
+}
+
+func TestEvictLRUPicksIdleKey(t *testing.T) {
+	db := NewDB(DBOptions{MaxMemoryPolicy: AllKeysLRU})
+	db.StringSet("idle", []byte("v"), 0)
+	db.StringSet("used", []byte("v"), 0)
+
+	// Pretend idle wasn't accessed for a minute
+	v, _ := db.storage.Get("idle")
+	v.access.lru.Store(lruClock() - 60)
+
+	e := NewEvictor([]*DB{db}, db.UsedMemory()-1, AllKeysLRU, 5)
+	evicted, ok := e.PerformEvictions()
+	assert.True(t, ok)
+	assert.Equal(t, []EvictedKey{{DB: 0, Key: "idle"}}, evicted)
+}
+
+func TestLFUCounter(t *testing.T) {
+	a := newAccessInfo(AllKeysLFU)
+	assert.EqualValues(t, lfuInitVal, a.lfuCounter())
+
+	for i := 0; i < 1000; i++ {
+		a.touch(AllKeysLFU)
+	}
+	counter := a.lfuCounter()
+	assert.Greater(t, counter, uint8(lfuInitVal))
+	// Logarithmic: far from one increment per access
+	assert.Less(t, counter, uint8(100))
+}
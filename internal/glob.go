@@ -0,0 +1,128 @@
+package internal
+
+import "strings"
+
+// Patterns nesting deeper than this never match, protects against abusive patterns
+const globMaxNesting = 1000
+
+// GlobMatch reports whether str matches the Redis glob-style pattern:
+// '*' any sequence, '?' any single byte, '[abc]', '[^a]' and '[a-z]'
+// classes, and '\' escaping the next byte. Works on bytes like Redis' stringmatchlen.
+func GlobMatch(pattern, str string, nocase bool) bool {
+	// Redis never gets here with an empty string, KEYS and SCAN special case "*"
+	if len(str) == 0 {
+		return strings.Trim(pattern, "*") == ""
+	}
+	skipLongerMatches := false
+	return globMatch(pattern, str, nocase, &skipLongerMatches, 0)
+}
+
+func globMatch(pattern, str string, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	if nesting > globMaxNesting {
+		return false
+	}
+
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p == len(pattern)-1 {
+				return true
+			}
+			for s < len(str) {
+				if globMatch(pattern[p+1:], str[s:], nocase, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+				s++
+			}
+			// The rest of the pattern matches nowhere in the rest of the string, so
+			// no earlier '*' can help by consuming more
+			*skipLongerMatches = true
+			return false
+		case '?':
+			s++
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if p < len(pattern)-1 && pattern[p] == '\\' {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if p < len(pattern) && pattern[p] == ']' {
+					break
+				} else if p >= len(pattern) {
+					// Unterminated class
+					p--
+					break
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					start, end, c := pattern[p], pattern[p+2], str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLowerByte(start), toLowerByte(end), toLowerByte(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(pattern[p], str[s], nocase) {
+					match = true
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if p < len(pattern)-1 {
+				p++
+			}
+			fallthrough
+		default:
+			if !equalByte(pattern[p], str[s], nocase) {
+				return false
+			}
+			s++
+		}
+		p++
+		if s == len(str) {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			break
+		}
+	}
+
+	return p == len(pattern) && s == len(str)
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLowerByte(a) == toLowerByte(b)
+	}
+	return a == b
+}
+
+func toLowerByte(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + ('a' - 'A')
+	}
+	return b
+}
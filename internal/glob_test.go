@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		str     string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"", "", true},
+		{"", "a", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello world", false},
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h[b-a]llo", "hallo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"user:*:name", "user:42:name", true},
+		{"user:*:name", "user:42:email", false},
+		{"*a*b*c", "xaybzc", true},
+		{"*a*b*c", "xaybzcd", false},
+		{"a*", "a", true},
+		{"a**", "a", true},
+		{"[abc", "a", true},
+		{"[abc", "d", false},
+		{"abc\\", "abc\\", true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.match, GlobMatch(c.pattern, c.str, false), "pattern %q string %q", c.pattern, c.str)
+	}
+}
+
+func TestGlobMatchNocase(t *testing.T) {
+	assert.True(t, GlobMatch("HeLLo", "hello", true))
+	assert.True(t, GlobMatch("h[A-Z]llo", "hello", true))
+	assert.False(t, GlobMatch("HeLLo", "hello", false))
+}
+
+func TestGlobMatchPathological(t *testing.T) {
+	// Would take ages without giving up on longer matches early
+	pattern := strings.Repeat("a*", 40) + "b"
+	assert.False(t, GlobMatch(pattern, strings.Repeat("a", 100), false))
+}
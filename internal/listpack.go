@@ -0,0 +1,309 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Listpacks are Redis' compact serialization of a list of strings and
+// integers, used by the RDB format for stream nodes. Layout:
+// <total-bytes u32><num-elements u16><element>...<0xFF>, each element being
+// <encoding><data><backlen>. See listpack.md in the Redis repository.
+const (
+	lpHeaderSize  = 6
+	lpEOF         = 0xFF
+	lpNumUnknown  = 0xFFFF // element count too large for the header
+	lpEnc7BitUint = 0x00
+	lpEnc6BitStr  = 0x80
+	lpEnc13BitInt = 0xC0
+	lpEnc12BitStr = 0xE0
+	lpEnc16BitInt = 0xF1
+	lpEnc24BitInt = 0xF2
+	lpEnc32BitInt = 0xF3
+	lpEnc64BitInt = 0xF4
+	lpEnc32BitStr = 0xF0
+)
+
+type listpackWriter struct {
+	buf []byte
+	num int
+}
+
+func newListpackWriter() *listpackWriter {
+	return &listpackWriter{buf: make([]byte, lpHeaderSize, 256)}
+}
+
+// Append s, encoded as an integer when it's the canonical form of one
+func (lp *listpackWriter) AppendString(s []byte) {
+	if v, ok := ParseInt64(s); ok && len(s) <= 20 {
+		lp.AppendInt(v)
+		return
+	}
+
+	start := len(lp.buf)
+	switch n := len(s); {
+	case n < 64:
+		lp.buf = append(lp.buf, lpEnc6BitStr|byte(n))
+	case n < 4096:
+		lp.buf = append(lp.buf, lpEnc12BitStr|byte(n>>8), byte(n))
+	default:
+		lp.buf = append(lp.buf, lpEnc32BitStr)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(n))
+	}
+	lp.buf = append(lp.buf, s...)
+	lp.appendBacklen(len(lp.buf) - start)
+}
+
+func (lp *listpackWriter) AppendInt(v int64) {
+	start := len(lp.buf)
+	switch {
+	case v >= 0 && v <= 127:
+		lp.buf = append(lp.buf, byte(v))
+	case v >= -4096 && v <= 4095:
+		uv := uint64(v) & 0x1FFF
+		lp.buf = append(lp.buf, lpEnc13BitInt|byte(uv>>8), byte(uv))
+	case v >= math16Min && v <= math16Max:
+		lp.buf = append(lp.buf, lpEnc16BitInt)
+		lp.buf = binary.LittleEndian.AppendUint16(lp.buf, uint16(v))
+	case v >= -(1<<23) && v < 1<<23:
+		uv := uint32(v)
+		lp.buf = append(lp.buf, lpEnc24BitInt, byte(uv), byte(uv>>8), byte(uv>>16))
+	case v >= math32Min && v <= math32Max:
+		lp.buf = append(lp.buf, lpEnc32BitInt)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(v))
+	default:
+		lp.buf = append(lp.buf, lpEnc64BitInt)
+		lp.buf = binary.LittleEndian.AppendUint64(lp.buf, uint64(v))
+	}
+	lp.appendBacklen(len(lp.buf) - start)
+}
+
+const (
+	math16Min = -1 << 15
+	math16Max = 1<<15 - 1
+	math32Min = -1 << 31
+	math32Max = 1<<31 - 1
+)
+
+// The backlen stores the element size in 7 bit groups, most significant
+// first, so the list can be walked from the tail
+func (lp *listpackWriter) appendBacklen(n int) {
+	switch {
+	case n <= 127:
+		lp.buf = append(lp.buf, byte(n))
+	case n < 16383:
+		lp.buf = append(lp.buf, byte(n>>7), byte(n&127)|128)
+	case n < 2097151:
+		lp.buf = append(lp.buf, byte(n>>14), byte((n>>7)&127)|128, byte(n&127)|128)
+	case n < 268435455:
+		lp.buf = append(lp.buf, byte(n>>21), byte((n>>14)&127)|128, byte((n>>7)&127)|128, byte(n&127)|128)
+	default:
+		lp.buf = append(lp.buf, byte(n>>28), byte((n>>21)&127)|128, byte((n>>14)&127)|128, byte((n>>7)&127)|128, byte(n&127)|128)
+	}
+	lp.num++
+}
+
+func (lp *listpackWriter) Len() int {
+	return len(lp.buf) + 1
+}
+
+// Bytes terminates the listpack and returns it, the writer can't be used afterwards
+func (lp *listpackWriter) Bytes() []byte {
+	lp.buf = append(lp.buf, lpEOF)
+	binary.LittleEndian.PutUint32(lp.buf, uint32(len(lp.buf)))
+	binary.LittleEndian.PutUint16(lp.buf[4:], uint16(min(lp.num, lpNumUnknown)))
+	return lp.buf
+}
+
+// Decode the elements of a listpack, integers are returned in decimal
+func listpackElements(lp []byte) ([][]byte, error) {
+	r, err := newListpackReader(lp)
+	if err != nil {
+		return nil, err
+	}
+	elements := make([][]byte, 0, binary.LittleEndian.Uint16(lp[4:]))
+	for !r.Done() {
+		elements = append(elements, r.Next())
+	}
+	return elements, r.err
+}
+
+// Reads the elements of a listpack in order. The first error is kept, the
+// reads after it return zero values.
+type listpackReader struct {
+	lp  []byte
+	p   int // offset of the next element
+	err error
+}
+
+func newListpackReader(lp []byte) (*listpackReader, error) {
+	if len(lp) < lpHeaderSize+1 || int(binary.LittleEndian.Uint32(lp)) != len(lp) || lp[len(lp)-1] != lpEOF {
+		return nil, fmt.Errorf("invalid listpack header")
+	}
+	return &listpackReader{lp: lp, p: lpHeaderSize}, nil
+}
+
+// Done reports whether all the elements were read, or reading failed
+func (r *listpackReader) Done() bool {
+	return r.err != nil || r.p >= len(r.lp)-1
+}
+
+// Next returns the next element, integers in decimal
+func (r *listpackReader) Next() []byte {
+	s, v, isInt := r.next()
+	if isInt {
+		return strconv.AppendInt(nil, v, 10)
+	}
+	return s
+}
+
+// NextInt returns the next element, which must be an integer
+func (r *listpackReader) NextInt() int64 {
+	s, v, isInt := r.next()
+	if !isInt && r.err == nil {
+		if v, ok := ParseInt64(s); ok {
+			return v
+		}
+		r.err = fmt.Errorf("listpack element %q isn't an integer", s)
+	}
+	return v
+}
+
+// Decode the element at r.p, either a string or an integer
+func (r *listpackReader) next() ([]byte, int64, bool) {
+	if r.Done() {
+		if r.err == nil {
+			r.err = fmt.Errorf("listpack element out of range")
+		}
+		return nil, 0, false
+	}
+
+	lp, p := r.lp, r.p
+	b := lp[p]
+	var s []byte
+	var v int64
+	isInt := true
+	size := 0 // encoding + data
+	need := func(n int) bool {
+		if p+n >= len(lp) {
+			r.err = fmt.Errorf("listpack element out of range")
+			return false
+		}
+		return true
+	}
+	switch {
+	case b&0x80 == lpEnc7BitUint:
+		v, size = int64(b), 1
+	case b&0xC0 == lpEnc6BitStr:
+		n := int(b & 0x3F)
+		if !need(1 + n) {
+			return nil, 0, false
+		}
+		s, size, isInt = lp[p+1:p+1+n], 1+n, false
+	case b&0xE0 == lpEnc13BitInt:
+		if !need(2) {
+			return nil, 0, false
+		}
+		v = int64(b&0x1F)<<8 | int64(lp[p+1])
+		if v >= 1<<12 {
+			v -= 1 << 13
+		}
+		size = 2
+	case b&0xF0 == lpEnc12BitStr:
+		if !need(2) {
+			return nil, 0, false
+		}
+		n := int(b&0x0F)<<8 | int(lp[p+1])
+		if !need(2 + n) {
+			return nil, 0, false
+		}
+		s, size, isInt = lp[p+2:p+2+n], 2+n, false
+	case b == lpEnc16BitInt:
+		if !need(3) {
+			return nil, 0, false
+		}
+		v, size = int64(int16(binary.LittleEndian.Uint16(lp[p+1:]))), 3
+	case b == lpEnc24BitInt:
+		if !need(4) {
+			return nil, 0, false
+		}
+		uv := uint32(lp[p+1]) | uint32(lp[p+2])<<8 | uint32(lp[p+3])<<16
+		v, size = int64(int32(uv<<8)>>8), 4 // sign extend
+	case b == lpEnc32BitInt:
+		if !need(5) {
+			return nil, 0, false
+		}
+		v, size = int64(int32(binary.LittleEndian.Uint32(lp[p+1:]))), 5
+	case b == lpEnc64BitInt:
+		if !need(9) {
+			return nil, 0, false
+		}
+		v, size = int64(binary.LittleEndian.Uint64(lp[p+1:])), 9
+	case b == lpEnc32BitStr:
+		if !need(5) {
+			return nil, 0, false
+		}
+		n := int(binary.LittleEndian.Uint32(lp[p+1:]))
+		if n < 0 || !need(5+n) {
+			return nil, 0, false
+		}
+		s, size, isInt = lp[p+5:p+5+n], 5+n, false
+	default:
+		r.err = fmt.Errorf("invalid listpack encoding %#x", b)
+		return nil, 0, false
+	}
+
+	if !need(size + lpBacklenSize(size)) {
+		return nil, 0, false
+	}
+	r.p += size + lpBacklenSize(size)
+	return s, v, isInt
+}
+
+// Append the elements written to w at the end of lp, which may be reallocated
+func listpackAppend(lp []byte, w *listpackWriter) []byte {
+	num := int(binary.LittleEndian.Uint16(lp[4:]))
+	lp = append(lp[:len(lp)-1], w.buf[lpHeaderSize:]...)
+	lp = append(lp, lpEOF)
+	binary.LittleEndian.PutUint32(lp, uint32(len(lp)))
+	if num != lpNumUnknown {
+		binary.LittleEndian.PutUint16(lp[4:], uint16(min(num+w.num, lpNumUnknown)))
+	}
+	return lp
+}
+
+// Replace the integer element at offset p by v, lp may be reallocated
+func listpackReplaceInt(lp []byte, p int, v int64) []byte {
+	r := &listpackReader{lp: lp, p: p}
+	r.next()
+	old := lp[p:r.p]
+
+	w := &listpackWriter{}
+	w.AppendInt(v)
+	if len(w.buf) == len(old) {
+		copy(old, w.buf)
+		return lp
+	}
+	out := make([]byte, 0, len(lp)-len(old)+len(w.buf))
+	out = append(out, lp[:p]...)
+	out = append(out, w.buf...)
+	out = append(out, lp[r.p:]...)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)))
+	return out
+}
+
+func lpBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
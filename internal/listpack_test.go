@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListpackRoundTrip(t *testing.T) {
+	values := []string{
+		"0", "127", "128", "-1", "4095", "-4096", "4096", "32767", "-32768",
+		"8388607", "-8388608", "2147483647", "-2147483648", "9223372036854775807",
+		"", "field", "007", strings.Repeat("m", 100), strings.Repeat("l", 5000),
+	}
+
+	lp := newListpackWriter()
+	for _, v := range values {
+		lp.AppendString([]byte(v))
+	}
+	elements, err := listpackElements(lp.Bytes())
+	assert.NoError(t, err)
+	assert.Len(t, elements, len(values))
+	for i, v := range values {
+		assert.Equal(t, v, string(elements[i]))
+	}
+}
+
+func TestListpackEncoding(t *testing.T) {
+	// A listpack holding "hello" and 10: 16 bytes, 2 elements
+	lp := newListpackWriter()
+	lp.AppendString([]byte("hello"))
+	lp.AppendInt(10)
+	assert.Equal(t, []byte{
+		0x10, 0x00, 0x00, 0x00, 0x02, 0x00,
+		0x85, 'h', 'e', 'l', 'l', 'o', 0x06,
+		0x0A, 0x01,
+		0xFF,
+	}, lp.Bytes())
+}
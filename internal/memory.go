@@ -0,0 +1,91 @@
+package internal
+
+/*
+Memory accounting, the sizes are estimates of what Redis would allocate
+*/
+
+const (
+	dictEntryOverhead = 24 // dict entry of the key, and of the expires index
+	objectOverhead    = 16 // header of a Redis object
+	sdsHeaderOverhead = 4  // sds header and terminator of a short string
+	embstrMaxLen      = 44 // longest string stored with its object header in one allocation
+)
+
+// Round n up to the size class jemalloc would allocate: 8, multiples of 16
+// up to 128, then four classes per power of two
+func mallocSize(n int) int {
+	switch {
+	case n <= 8:
+		return 8
+	case n <= 128:
+		return (n + 15) &^ 15
+	}
+	// Classes between 2^k and 2^(k+1) are 2^(k-2) apart
+	spacing := 1
+	for spacing*8 < n {
+		spacing *= 2
+	}
+	return (n + spacing - 1) / spacing * spacing
+}
+
+// Approximate bytes used by key and v in the db
+func valueMemory(key string, v Value) int64 {
+	size := int64(dictEntryOverhead + mallocSize(len(key)+sdsHeaderOverhead))
+	if v.ExpiredTimeMilli > 0 {
+		size += dictEntryOverhead
+	}
+	if v.Data != nil {
+		size += v.Data.MemoryUsage()
+	}
+	return size
+}
+
+// UsedMemory returns the approximate bytes used by the keys and values of the db
+func (db *DB) UsedMemory() int64 {
+	return db.usedMemory.Load()
+}
+
+// Internals of a key for OBJECT and MEMORY USAGE
+type ObjectInfo struct {
+	Encoding    string
+	IdleSeconds int64 // since the last access, with an LRU policy
+	Freq        int   // logarithmic access counter, with an LFU policy
+	MemoryUsage int64 // bytes of the key and value
+}
+
+// Object returns the internals of key without counting as an access
+func (db *DB) Object(key string) (ObjectInfo, error) {
+	v, err := db.lookup(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info := ObjectInfo{
+		Encoding:    v.Data.Encoding(),
+		MemoryUsage: valueMemory(key, v),
+	}
+	if v.access != nil {
+		if db.Options.MaxMemoryPolicy.IsLFU() {
+			info.Freq = int(v.access.lfuCounter())
+		} else {
+			info.IdleSeconds = v.access.idleMilli() / 1000
+		}
+	}
+	return info, nil
+}
+
+// Memory of the hash tables themselves, for MEMORY STATS
+type HashtableOverhead struct {
+	Main    int64
+	Expires int64
+}
+
+func (db *DB) HashtableOverhead() HashtableOverhead {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	// A bucket is a pointer
+	return HashtableOverhead{
+		Main:    int64(db.storage.Buckets() * 8),
+		Expires: int64(db.expires.Buckets() * 8),
+	}
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMallocSize(t *testing.T) {
+	assert.Equal(t, 8, mallocSize(1))
+	assert.Equal(t, 16, mallocSize(9))
+	assert.Equal(t, 48, mallocSize(40))
+	assert.Equal(t, 128, mallocSize(128))
+	assert.Equal(t, 160, mallocSize(129))
+	assert.Equal(t, 1280, mallocSize(1025))
+}
+
+func TestStringEncoding(t *testing.T) {
+	assert.Equal(t, "int", ValueString("12345").Encoding())
+	assert.Equal(t, "int", ValueString("-9223372036854775808").Encoding())
+	assert.Equal(t, "embstr", ValueString("012").Encoding())
+	assert.Equal(t, "embstr", ValueString("9223372036854775808").Encoding())
+	assert.Equal(t, "embstr", ValueString(strings.Repeat("a", 44)).Encoding())
+	assert.Equal(t, "raw", ValueString(strings.Repeat("a", 45)).Encoding())
+
+	assert.EqualValues(t, 16, ValueString("12345").MemoryUsage())
+	assert.EqualValues(t, 32, ValueString("hello").MemoryUsage())
+	assert.EqualValues(t, 80, ValueString(strings.Repeat("a", 45)).MemoryUsage())
+}
+
+func TestObject(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("str", []byte("hello"), 0)
+	db.StreamAdd("s", "1-1", StreamEntryData{[]byte("f"), []byte("v")}, StreamAddOptions{})
+
+	info, err := db.Object("str")
+	assert.NoError(t, err)
+	assert.Equal(t, "embstr", info.Encoding)
+	assert.EqualValues(t, 0, info.IdleSeconds)
+	assert.Equal(t, db.UsedMemory()-mustObject(t, db, "s").MemoryUsage, info.MemoryUsage)
+
+	assert.Equal(t, "stream", mustObject(t, db, "s").Encoding)
+
+	_, err = db.Object("missing")
+	assert.IsType(t, &KeyNotFoundError{}, err)
+}
+
+func TestObjectDoesNotTouch(t *testing.T) {
+	db := NewDB(DBOptions{MaxMemoryPolicy: AllKeysLRU})
+	db.StringSet("k", []byte("v"), 0)
+	v, _ := db.storage.Get("k")
+	v.access.lru.Store(lruClock() - 60)
+
+	assert.EqualValues(t, 60, mustObject(t, db, "k").IdleSeconds)
+	assert.EqualValues(t, 60, mustObject(t, db, "k").IdleSeconds)
+}
+
+func TestObjectFreq(t *testing.T) {
+	db := NewDB(DBOptions{MaxMemoryPolicy: AllKeysLFU})
+	db.StringSet("k", []byte("v"), 0)
+	assert.GreaterOrEqual(t, mustObject(t, db, "k").Freq, lfuInitVal)
+}
+
+func mustObject(t *testing.T, db *DB, key string) ObjectInfo {
+	info, err := db.Object(key)
+	assert.NoError(t, err)
+	return info
+}
@@ -1,7 +1,14 @@
 package internal
 
+import "sync"
+
 type DBOptions struct {
-	ExpiryTime int64  // default expiry time in milisecond
-	Dir        string // default directory to store RDB files
-	DbFilename string // default name of the RDB file
+	// Non-standard: TTL in milisecond applied to SET without EX/PX, 0 keeps keys forever like Redis
+	DefaultTTLMilli int64
+	Dir             string         // default directory to store RDB files
+	DbFilename      string         // default name of the RDB file
+	MaxMemoryPolicy EvictionPolicy // decides whether key accesses feed the LRU clock or the LFU counter
+	// Held by the caller while it runs a command, released while the command
+	// blocks on keys so others can run. nil if there's none.
+	CommandLock sync.Locker
 }
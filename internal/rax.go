@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"bytes"
+	"sort"
+)
+
+// rax is a radix tree with compressed paths, after Redis' rax.c: every node
+// holds the part of the key leading to it from its parent, so keys sharing a
+// prefix share its nodes. Keys are iterated in byte order, which for the big
+// endian stream IDs is the ID order.
+// rax isn't safe for concurrent use, the owner holds the lock.
+type rax[V any] struct {
+	root  *raxNode[V]
+	size  int // keys
+	nodes int
+}
+
+type raxNode[V any] struct {
+	prefix   []byte        // the part of the key between the parent and this node
+	children []*raxNode[V] // sorted by the first byte of their prefix
+	isKey    bool
+	val      V
+}
+
+func newRax[V any]() *rax[V] {
+	return &rax[V]{root: &raxNode[V]{}, nodes: 1}
+}
+
+func (r *rax[V]) Len() int {
+	return r.size
+}
+
+// Nodes returns how many nodes the tree is made of
+func (r *rax[V]) Nodes() int {
+	return r.nodes
+}
+
+// Index of the child whose prefix starts with b, or where it would be inserted
+func (n *raxNode[V]) childIndex(b byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].prefix[0] >= b
+	})
+	return i, i < len(n.children) && n.children[i].prefix[0] == b
+}
+
+func commonPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// Insert sets the value of key and returns whether it's a new key
+func (r *rax[V]) Insert(key []byte, val V) bool {
+	n := r.root
+	for len(key) > 0 {
+		i, ok := n.childIndex(key[0])
+		if !ok {
+			leaf := &raxNode[V]{prefix: bytes.Clone(key), isKey: true, val: val}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = leaf
+			r.nodes++
+			r.size++
+			return true
+		}
+
+		child := n.children[i]
+		l := commonPrefixLen(child.prefix, key)
+		if l < len(child.prefix) {
+			// Split the child where key diverges from it
+			mid := &raxNode[V]{prefix: child.prefix[:l:l], children: []*raxNode[V]{child}}
+			child.prefix = child.prefix[l:]
+			n.children[i] = mid
+			r.nodes++
+			child = mid
+		}
+		n, key = child, key[l:]
+	}
+
+	isNew := !n.isKey
+	n.isKey, n.val = true, val
+	if isNew {
+		r.size++
+	}
+	return isNew
+}
+
+// Find returns the value of key
+func (r *rax[V]) Find(key []byte) (V, bool) {
+	n := r.root
+	for len(key) > 0 {
+		i, ok := n.childIndex(key[0])
+		if !ok || !bytes.HasPrefix(key, n.children[i].prefix) {
+			var zero V
+			return zero, false
+		}
+		n, key = n.children[i], key[len(n.children[i].prefix):]
+	}
+	return n.val, n.isKey
+}
+
+// Remove deletes key and returns whether it existed
+func (r *rax[V]) Remove(key []byte) bool {
+	var parent *raxNode[V]
+	n := r.root
+	for len(key) > 0 {
+		i, ok := n.childIndex(key[0])
+		if !ok || !bytes.HasPrefix(key, n.children[i].prefix) {
+			return false
+		}
+		parent, n, key = n, n.children[i], key[len(n.children[i].prefix):]
+	}
+	if !n.isKey {
+		return false
+	}
+
+	var zero V
+	n.isKey, n.val = false, zero
+	r.size--
+	if n == r.root {
+		return true
+	}
+	switch len(n.children) {
+	case 0:
+		i, _ := parent.childIndex(n.prefix[0])
+		parent.children = append(parent.children[:i], parent.children[i+1:]...)
+		r.nodes--
+		// The parent may now be a plain link to its last child
+		if parent != r.root && !parent.isKey && len(parent.children) == 1 {
+			r.merge(parent)
+		}
+	case 1:
+		r.merge(n)
+	}
+	return true
+}
+
+// Merge n, which isn't a key, with its only child
+func (r *rax[V]) merge(n *raxNode[V]) {
+	child := n.children[0]
+	n.prefix = append(n.prefix[:len(n.prefix):len(n.prefix)], child.prefix...)
+	n.children, n.isKey, n.val = child.children, child.isKey, child.val
+	r.nodes--
+}
+
+// Ascend calls fn with the keys >= from in ascending order, all of them for a
+// nil from, until fn returns false. key is only valid during the call.
+func (r *rax[V]) Ascend(from []byte, fn func(key []byte, val V) bool) {
+	r.root.ascend(make([]byte, 0, 32), from, fn)
+}
+
+func (n *raxNode[V]) ascend(path, from []byte, fn func(key []byte, val V) bool) bool {
+	path = append(path, n.prefix...)
+	if from != nil {
+		m := min(len(path), len(from))
+		switch bytes.Compare(path[:m], from[:m]) {
+		case -1:
+			return true // the whole subtree is before from
+		case 1:
+			from = nil
+		default:
+			if len(path) >= len(from) {
+				from = nil
+			}
+		}
+	}
+
+	// With from still set path is a strict prefix of it, so it's before from
+	if n.isKey && from == nil && !fn(path, n.val) {
+		return false
+	}
+	for _, child := range n.children {
+		if !child.ascend(path, from, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// Descend calls fn with the keys <= from in descending order, all of them for
+// a nil from, until fn returns false. key is only valid during the call.
+func (r *rax[V]) Descend(from []byte, fn func(key []byte, val V) bool) {
+	r.root.descend(make([]byte, 0, 32), from, fn)
+}
+
+func (n *raxNode[V]) descend(path, from []byte, fn func(key []byte, val V) bool) bool {
+	path = append(path, n.prefix...)
+	children := n.children
+	if from != nil {
+		m := min(len(path), len(from))
+		switch bytes.Compare(path[:m], from[:m]) {
+		case 1:
+			return true // the whole subtree is after from
+		case -1:
+			from = nil
+		default:
+			if len(path) > len(from) {
+				return true
+			}
+			if len(path) == len(from) {
+				// path is from, the children are after it
+				children, from = nil, nil
+			}
+		}
+	}
+
+	for i := len(children) - 1; i >= 0; i-- {
+		if !children[i].descend(path, from, fn) {
+			return false
+		}
+	}
+	return !n.isKey || fn(path, n.val)
+}
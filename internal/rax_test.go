@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func raxKey(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func raxKeys(r *rax[int], from []byte, descend bool) []int {
+	var vals []int
+	fn := func(_ []byte, v int) bool {
+		vals = append(vals, v)
+		return true
+	}
+	if descend {
+		r.Descend(from, fn)
+	} else {
+		r.Ascend(from, fn)
+	}
+	return vals
+}
+
+func TestRaxInsertFindRemove(t *testing.T) {
+	r := newRax[int]()
+	vals := rand.Perm(5000)
+	for _, v := range vals {
+		assert.True(t, r.Insert(raxKey(uint64(v)*7), v))
+	}
+	assert.False(t, r.Insert(raxKey(42*7), -42))
+	assert.Equal(t, 5000, r.Len())
+
+	v, ok := r.Find(raxKey(42 * 7))
+	assert.True(t, ok)
+	assert.Equal(t, -42, v)
+	_, ok = r.Find(raxKey(43))
+	assert.False(t, ok)
+	_, ok = r.Find(raxKey(42 * 7)[:4])
+	assert.False(t, ok)
+
+	for _, v := range vals[:4990] {
+		assert.True(t, r.Remove(raxKey(uint64(v)*7)))
+	}
+	assert.False(t, r.Remove(raxKey(uint64(vals[0])*7)))
+	assert.Equal(t, 10, r.Len())
+
+	left := append([]int(nil), vals[4990:]...)
+	sort.Ints(left)
+	for i := range left {
+		if left[i] == 42 {
+			left[i] = -42
+		}
+	}
+	got := raxKeys(r, nil, false)
+	sort.Ints(got)
+	assert.Equal(t, left, got)
+
+	for _, v := range vals[4990:] {
+		assert.True(t, r.Remove(raxKey(uint64(v)*7)))
+	}
+	assert.Equal(t, 0, r.Len())
+	assert.Equal(t, 1, r.Nodes())
+}
+
+func TestRaxAscendDescend(t *testing.T) {
+	r := newRax[int]()
+	for _, v := range rand.Perm(100) {
+		r.Insert(raxKey(uint64(v)*10), v*10)
+	}
+
+	got := raxKeys(r, nil, false)
+	assert.Len(t, got, 100)
+	assert.True(t, sort.IntsAreSorted(got))
+	assert.Equal(t, []int{990, 980}, raxKeys(r, nil, true)[:2])
+
+	// Bounds that are keys, or between them
+	assert.Equal(t, []int{500, 510}, raxKeys(r, raxKey(500), false)[:2])
+	assert.Equal(t, []int{510, 520}, raxKeys(r, raxKey(501), false)[:2])
+	assert.Equal(t, []int{500, 490}, raxKeys(r, raxKey(500), true)[:2])
+	assert.Equal(t, []int{500, 490}, raxKeys(r, raxKey(509), true)[:2])
+	assert.Empty(t, raxKeys(r, raxKey(991), false))
+	assert.Equal(t, []int{0}, raxKeys(r, raxKey(9), true))
+
+	// Stopping early
+	n := 0
+	r.Ascend(nil, func(_ []byte, _ int) bool {
+		n++
+		return n < 3
+	})
+	assert.Equal(t, 3, n)
+}
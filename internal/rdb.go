@@ -2,25 +2,59 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"time"
 )
 
 const (
+	rdbVersion = 11
+
+	rdbOpcodeFunction2                   byte = 0xF5
+	rdbOpcodeModuleAux                   byte = 0xF7
+	rdbOpcodeIdle                        byte = 0xF8
+	rdbOpcodeFreq                        byte = 0xF9
 	rdbMetadataIndicator                 byte = 0xFA
 	rdbDatabaseIndicator                 byte = 0xFE
 	rdbHashtableSizeInformationIndicator byte = 0xFB
-	rdbStringEncoding                    byte = 0x00
 	rdbExpiryMilis                       byte = 0xFC
 	rdbExpirySeconds                     byte = 0xFD
 	rdbEndOfFile                         byte = 0xFF
+
+	// Value types
+	rdbStringEncoding       byte = 0x00
+	rdbTypeStreamListpacks  byte = 0x0F
+	rdbTypeStreamListpacks2 byte = 0x13 // + first id, max deleted id, entries added and entries read
+	rdbTypeStreamListpacks3 byte = 0x15 // + consumers active time
+
+	// Special string encodings, flagged by 0b11 in the size byte
+	rdbEncInt8  = 0xC0
+	rdbEncInt16 = 0xC1
+	rdbEncInt32 = 0xC2
+	rdbEncLZF   = 0xC3
+
+	// Limits of a stream node, Redis' stream-node-max-bytes and stream-node-max-entries
+	streamNodeMaxBytes   = 4096
+	streamNodeMaxEntries = 100
+
+	// Flags of the entries of a stream node
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
 )
 
 type RDBReader struct {
 	reader *bufio.Reader
+
+	// Keys get the LRU idle time or LFU counter saved in the file when the
+	// policy uses it, like Redis does
+	EvictionPolicy EvictionPolicy
 }
 
 type Metadata struct {
@@ -32,19 +66,22 @@ func NewRDBReader() *RDBReader {
 	return &RDBReader{}
 }
 
-func (r *RDBReader) LoadFile(filepath string) (storage, error) {
+// LoadFile reads the RDB file at filepath and returns the keys of each db by index
+func (r *RDBReader) LoadFile(filepath string) (map[int]map[string]Value, error) {
 	if _, err := os.Stat(filepath); os.IsNotExist(err) {
 		log.Println("No RDB file exists -> starting new DB")
 		return nil, nil
 	}
 
-	file, err := os.Open(filepath)
+	content, err := os.ReadFile(filepath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	if err := verifyRDBChecksum(content); err != nil {
+		return nil, err
+	}
 
-	r.reader = bufio.NewReader(file)
+	r.reader = bufio.NewReader(bytes.NewReader(content))
 
 	header, err := r.readHeader()
 	if err != nil {
@@ -58,12 +95,29 @@ func (r *RDBReader) LoadFile(filepath string) (storage, error) {
 	}
 	log.Println("Read metadatas:", metas)
 
-	// TODO: implement read multiple dbs
-	dbIdx, data, err := r.readDatabase()
-	if err != nil {
-		return nil, fmt.Errorf("error reading database: %w", err)
+	dbs := make(map[int]map[string]Value)
+	for {
+		b, err := r.reader.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("error reading database: %w", err)
+		}
+		if b[0] == rdbEndOfFile {
+			break
+		}
+
+		dbIdx, data, err := r.readDatabase()
+		if err != nil {
+			return nil, fmt.Errorf("error reading database: %w", err)
+		}
+		log.Println("Keys loaded for db", dbIdx, ":", len(data))
+		if dbs[dbIdx] == nil {
+			dbs[dbIdx] = data
+		} else {
+			for key, val := range data {
+				dbs[dbIdx][key] = val
+			}
+		}
 	}
-	log.Println("Keys loaded for db", dbIdx, ":", len(data))
 
 	checksum, err := r.readEndOfFile()
 	if err != nil {
@@ -71,16 +125,42 @@ func (r *RDBReader) LoadFile(filepath string) (storage, error) {
 	}
 	log.Println("RDB checksum:", checksum)
 
-	return data, nil
+	return dbs, nil
 }
 
+// The last 8 bytes of the file are the CRC64 of the rest, 0 when the
+// checksum was disabled when saving. Versions before 5 had no checksum.
+func verifyRDBChecksum(content []byte) error {
+	if len(content) < 9+8 {
+		return fmt.Errorf("RDB file too short")
+	}
+	if version, err := strconv.Atoi(string(content[5:9])); err == nil && version < 5 {
+		return nil
+	}
+	expected := binary.LittleEndian.Uint64(content[len(content)-8:])
+	if expected == 0 {
+		return nil
+	}
+	if actual := crc64Jones(0, content[:len(content)-8]); actual != expected {
+		return fmt.Errorf("wrong RDB checksum expected: (%x) got: (%x)", expected, actual)
+	}
+	return nil
+}
+
+// Read the magic string and the version, e.g. REDIS0011
 func (r *RDBReader) readHeader() ([]byte, error) {
-	buf, err := r.reader.ReadBytes(rdbMetadataIndicator)
-	if err != nil {
+	buf := make([]byte, 9)
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
 		return buf, err
 	}
-	r.reader.UnreadByte()
-	return buf[:len(buf)-1], nil
+	if string(buf[:5]) != "REDIS" {
+		return buf, fmt.Errorf("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(buf[5:]))
+	if err != nil || version < 1 || version > rdbVersion {
+		return buf, fmt.Errorf("can't handle RDB format version %s", buf[5:])
+	}
+	return buf, nil
 }
 
 func (r *RDBReader) readMetadata() ([]Metadata, error) {
@@ -88,9 +168,6 @@ func (r *RDBReader) readMetadata() ([]Metadata, error) {
 	for {
 		b, err := r.reader.ReadByte()
 		if err != nil {
-			// if err == io.EOF {
-			// 	break
-			// }
 			return nil, err
 		}
 		if b != rdbMetadataIndicator {
@@ -111,43 +188,40 @@ func (r *RDBReader) readMetadata() ([]Metadata, error) {
 	return metadatas, nil
 }
 
-// Read the actual data -> db index, storage, expired storage, error if any
-func (r *RDBReader) readDatabase() (int, storage, error) {
-	var data storage
+// Read one database section -> db index, storage, error if any
+func (r *RDBReader) readDatabase() (int, map[string]Value, error) {
 	b, err := r.reader.ReadByte()
 	if err != nil {
-		return -1, data, nil
+		return -1, nil, err
 	}
 	if b != rdbDatabaseIndicator {
 		r.reader.UnreadByte()
-		return -1, data, fmt.Errorf("expect rdbDatabaseIndicator but got %v", b)
+		return -1, nil, fmt.Errorf("expect rdbDatabaseIndicator but got %v", b)
 	}
 
 	// Read the index of the database
 	_, idx, err := decodeSize(r.reader)
 	if err != nil {
-		return idx, data, err
+		return idx, nil, err
 	}
 	log.Println("DB index:", idx)
 
-	b, err = r.reader.ReadByte()
-	if err != nil {
-		return idx, data, err
-	}
-	if b != rdbHashtableSizeInformationIndicator {
-		return idx, data, fmt.Errorf("expect hash table size indicator but got %v", b)
-	}
-
-	_, dataHTSSize, err := decodeSize(r.reader)
-	if err != nil {
-		return idx, data, fmt.Errorf("error reading hash table size information:: %w", err)
-	}
-	_, _, err = decodeSize(r.reader)
-	if err != nil {
-		return idx, data, fmt.Errorf("error reading hash table size information:: %w", err)
+	// The hash table sizes are an optional hint
+	dataHTSSize := 0
+	if b, err := r.reader.Peek(1); err == nil && b[0] == rdbHashtableSizeInformationIndicator {
+		r.reader.ReadByte()
+		_, dataHTSSize, err = decodeSize(r.reader)
+		if err != nil {
+			return idx, nil, fmt.Errorf("error reading hash table size information:: %w", err)
+		}
+		_, _, err = decodeSize(r.reader)
+		if err != nil {
+			return idx, nil, fmt.Errorf("error reading hash table size information:: %w", err)
+		}
 	}
-	data = make(storage, dataHTSSize)
+	data := make(map[string]Value, dataHTSSize)
 
+	now := time.Now().UnixMilli()
 Loop:
 	// Read key, value pairs
 	for {
@@ -159,13 +233,27 @@ Loop:
 		case rdbEndOfFile, rdbDatabaseIndicator:
 			r.reader.UnreadByte() // Unread the format byte
 			break Loop            // Meet end of file or another db
+		case rdbMetadataIndicator:
+			// Aux fields can show up between databases too
+			if _, err := decodeString(r.reader); err != nil {
+				return idx, data, err
+			}
+			if _, err := decodeString(r.reader); err != nil {
+				return idx, data, err
+			}
+		case rdbOpcodeModuleAux, rdbOpcodeFunction2:
+			return idx, data, fmt.Errorf("modules and functions aren't supported")
 		default:
 			r.reader.UnreadByte() // Unread the format byte
-			key, val, err := tryDecodeKeyValue(r.reader)
+			key, val, err := tryDecodeKeyValue(r.reader, r.EvictionPolicy)
 			if err != nil {
 				return idx, data, err
 			}
 
+			// Like a master, don't load keys that expired while the server was down
+			if val.isExpired(now) {
+				continue
+			}
 			data[key] = val
 		}
 	}
@@ -184,62 +272,94 @@ func (r *RDBReader) readEndOfFile() ([]byte, error) {
 	}
 
 	buf := make([]byte, 8)
-	_, err = r.reader.Read(buf)
+	_, err = io.ReadFull(r.reader, buf)
 	if err != nil {
 		return nil, fmt.Errorf("error reading end of file: %w", err)
 	}
 	return buf, nil
 }
 
-func tryDecodeKeyValue(reader *bufio.Reader) (string, Value, error) {
+func tryDecodeKeyValue(reader *bufio.Reader, policy EvictionPolicy) (string, Value, error) {
 	var key string
 	var val Value
-	b, err := reader.ReadByte()
-	if err != nil {
-		return key, val, fmt.Errorf("Error reading key/value:: %w", err)
-	}
+	idleSeconds, freq := int64(-1), -1
 
-	// Decode expiry time
-	switch b {
-	case rdbExpiryMilis:
-		expiry, err := decodeExpiryMilis(reader)
+	// Opcodes that qualify the next key
+	var b byte
+	for {
+		var err error
+		b, err = reader.ReadByte()
 		if err != nil {
-			return key, val, fmt.Errorf("Error decoding expiry: %w", err)
+			return key, val, fmt.Errorf("Error reading key/value:: %w", err)
 		}
-		val.ExpiredTimeMilli = int64(expiry)
-	case rdbExpirySeconds:
-		expiry, err := decodeExpirySeconds(reader)
-		if err != nil {
-			return key, val, fmt.Errorf("Error decoding expiry: %w", err)
+
+		switch b {
+		case rdbExpiryMilis:
+			expiry, err := decodeExpiryMilis(reader)
+			if err != nil {
+				return key, val, fmt.Errorf("Error decoding expiry: %w", err)
+			}
+			val.ExpiredTimeMilli = int64(expiry)
+			continue
+		case rdbExpirySeconds:
+			expiry, err := decodeExpirySeconds(reader)
+			if err != nil {
+				return key, val, fmt.Errorf("Error decoding expiry: %w", err)
+			}
+			val.ExpiredTimeMilli = int64(expiry) * 1000
+			continue
+		case rdbOpcodeIdle:
+			_, idle, err := decodeSize(reader)
+			if err != nil {
+				return key, val, fmt.Errorf("Error decoding idle time: %w", err)
+			}
+			idleSeconds = int64(idle)
+			continue
+		case rdbOpcodeFreq:
+			b, err := reader.ReadByte()
+			if err != nil {
+				return key, val, fmt.Errorf("Error decoding frequency: %w", err)
+			}
+			freq = int(b)
+			continue
 		}
-		val.ExpiredTimeMilli = int64(expiry) * 1000
-	default:
-		reader.UnreadByte() // Unread the format byte in case of no expiry time byte indicator
+		break
 	}
 
 	// Read the actual key-value pair
-	b, err = reader.ReadByte()
+	key, err := decodeString(reader)
+	if err != nil {
+		return key, val, err
+	}
+	data, valType, err := decodeValue(reader, b)
 	if err != nil {
-		return key, val, fmt.Errorf("Error reading key/value:: %w", err)
+		return key, val, fmt.Errorf("error decoding value of key %q: %w", key, err)
 	}
+	val.Data = data
+	val.Type = valType
+	val.access = loadedAccessInfo(policy, idleSeconds, freq)
+
+	return key, val, nil
+}
 
-	// Decode key/value
-	switch b {
-	case rdbStringEncoding: // rdbStringEncoding
-		key, err = decodeString(reader)
+// Decode a value serialized as rdbType
+func decodeValue(reader *bufio.Reader, rdbType byte) (ValueData, ValueType, error) {
+	switch rdbType {
+	case rdbStringEncoding:
+		str, err := decodeString(reader)
 		if err != nil {
-			return key, val, err
+			return nil, 0, err
 		}
-		valStr, err := decodeString(reader)
+		return ValueString(str), ValTypeString, nil
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		stream, err := decodeStream(reader, rdbType)
 		if err != nil {
-			return key, val, err
+			return nil, 0, err
 		}
-		val.Data = ValueString(valStr)
+		return stream, ValTypeStream, nil
 	default:
-		panic(fmt.Sprintf("Not implemented for format: %v\n", b))
+		return nil, 0, fmt.Errorf("value type %v isn't supported", rdbType)
 	}
-
-	return key, val, nil
 }
 
 // Return the first 2 bits of the next byte, the parsed size, and the error if any
@@ -265,12 +385,21 @@ func decodeSize(reader *bufio.Reader) (byte, int, error) {
 		size <<= 8
 		size |= int(nxtByte)
 	case 0b10:
-		var size32 int32
-		err = binary.Read(reader, binary.BigEndian, &size32)
+		switch curByte {
+		case 0x80:
+			var size32 uint32
+			err = binary.Read(reader, binary.BigEndian, &size32)
+			size = int(size32)
+		case 0x81:
+			var size64 uint64
+			err = binary.Read(reader, binary.BigEndian, &size64)
+			size = int(size64)
+		default:
+			err = fmt.Errorf("unknown length encoding %#x", curByte)
+		}
 		if err != nil {
 			return flag, -1, err
 		}
-		size = int(size32)
 	}
 
 	return flag, size, nil
@@ -288,37 +417,54 @@ func decodeString(reader *bufio.Reader) (string, error) {
 	case 0b11:
 		// size now detemines the format of the string
 		switch size {
-		case 0xC0:
+		case rdbEncInt8:
 			// String is an 8-bit integer
 			b, err := reader.ReadByte()
 			if err != nil {
 				return "", err
 			}
-			str = strconv.Itoa(int(b))
-		case 0xC1:
+			str = strconv.Itoa(int(int8(b)))
+		case rdbEncInt16:
 			// string is a 16-bit integer
 			buf := make([]byte, 2)
-			_, err = reader.Read(buf)
+			_, err = io.ReadFull(reader, buf)
 			if err != nil {
 				return "", err
 			}
-			str = strconv.FormatUint(uint64(binary.LittleEndian.Uint16(buf)), 10)
-		case 0xC2:
+			str = strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf))))
+		case rdbEncInt32:
 			// string is a 32-bit integer
 			buf := make([]byte, 4)
-			_, err = reader.Read(buf)
+			_, err = io.ReadFull(reader, buf)
+			if err != nil {
+				return "", err
+			}
+			str = strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf))))
+		case rdbEncLZF:
+			_, compressedLen, err := decodeSize(reader)
 			if err != nil {
 				return "", err
 			}
-			str = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(buf)), 10)
+			_, length, err := decodeSize(reader)
+			if err != nil {
+				return "", err
+			}
+			compressed := make([]byte, compressedLen)
+			if _, err := io.ReadFull(reader, compressed); err != nil {
+				return "", err
+			}
+			buf, err := lzfDecompress(compressed, length)
+			if err != nil {
+				return "", err
+			}
+			str = string(buf)
 		default:
-			// LZF compression algorithm
-			panic("LZF: Not implemented")
+			return "", fmt.Errorf("unknown string encoding %#x", size)
 		}
 
 	default:
 		buf := make([]byte, size)
-		_, err := reader.Read(buf)
+		_, err := io.ReadFull(reader, buf)
 		if err != nil {
 			return "", err
 		}
@@ -328,10 +474,56 @@ func decodeString(reader *bufio.Reader) (string, error) {
 	return str, nil
 }
 
+// Decompress the output of Redis' lzf_compress, the original length is known
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 32 {
+			// Literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if ip+n > len(in) {
+				return nil, fmt.Errorf("invalid LZF data")
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+
+		// Back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(in) {
+				return nil, fmt.Errorf("invalid LZF data")
+			}
+			n += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, fmt.Errorf("invalid LZF data")
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - 1 - int(in[ip])
+		ip++
+		if ref < 0 {
+			return nil, fmt.Errorf("invalid LZF data")
+		}
+		// Copy byte by byte, the reference may overlap what's being written
+		for n += 2; n > 0; n-- {
+			out = append(out, out[ref])
+			ref++
+		}
+	}
+	if len(out) != length {
+		return nil, fmt.Errorf("invalid LZF compressed string")
+	}
+	return out, nil
+}
+
 func decodeExpirySeconds(reader *bufio.Reader) (uint32, error) {
 	var expirySeconds uint32
 	buf := make([]byte, 4)
-	_, err := reader.Read(buf)
+	_, err := io.ReadFull(reader, buf)
 	if err != nil {
 		return expirySeconds, fmt.Errorf("error reading expiry in seconds: %w", err)
 	}
@@ -342,7 +534,7 @@ func decodeExpirySeconds(reader *bufio.Reader) (uint32, error) {
 func decodeExpiryMilis(reader *bufio.Reader) (uint64, error) {
 	var expiry uint64
 	buf := make([]byte, 8)
-	_, err := reader.Read(buf)
+	_, err := io.ReadFull(reader, buf)
 	if err != nil {
 		return expiry, fmt.Errorf("error reading expiry in miliseconds: %w", err)
 	}
@@ -350,6 +542,510 @@ func decodeExpiryMilis(reader *bufio.Reader) (uint64, error) {
 	return expiry, nil
 }
 
-func Save(filepath string, db *DB) error {
-	panic("Not implemented")
+// Stream IDs are stored as 128 bit big endian numbers, so node keys sort like IDs
+func decodeStreamID(b []byte) (StreamEntryID, error) {
+	if len(b) != 16 {
+		return StreamEntryID{}, fmt.Errorf("invalid stream ID length %d", len(b))
+	}
+	return StreamEntryID{
+		Timestamp: binary.BigEndian.Uint64(b),
+		Sequence:  binary.BigEndian.Uint64(b[8:]),
+	}, nil
+}
+
+func encodeStreamID(id StreamEntryID) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, id.Timestamp)
+	binary.BigEndian.PutUint64(b[8:], id.Sequence)
+	return b
+}
+
+func decodeStreamIDSizes(reader *bufio.Reader) (StreamEntryID, error) {
+	_, ms, err := decodeSize(reader)
+	if err != nil {
+		return StreamEntryID{}, err
+	}
+	_, seq, err := decodeSize(reader)
+	if err != nil {
+		return StreamEntryID{}, err
+	}
+	return StreamEntryID{Timestamp: uint64(ms), Sequence: uint64(seq)}, nil
+}
+
+// Decode a stream stored as a list of listpack nodes, see rdbLoadObject in Redis' rdb.c
+func decodeStream(reader *bufio.Reader, rdbType byte) (*ValueStream, error) {
+	stream := newValueStream()
+
+	_, numNodes, err := decodeSize(reader)
+	if err != nil {
+		return nil, err
+	}
+	for n := 0; n < numNodes; n++ {
+		nodeKey, err := decodeString(reader)
+		if err != nil {
+			return nil, err
+		}
+		master, err := decodeStreamID([]byte(nodeKey))
+		if err != nil {
+			return nil, err
+		}
+		lp, err := decodeString(reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := stream.loadNode(master, []byte(lp)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Metadata
+	_, length, err := decodeSize(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length != stream.length {
+		return nil, fmt.Errorf("stream length %d doesn't match its %d entries", length, stream.length)
+	}
+	if stream.lastID, err = decodeStreamIDSizes(reader); err != nil {
+		return nil, err
+	}
+	if rdbType >= rdbTypeStreamListpacks2 {
+		if _, err := decodeStreamIDSizes(reader); err != nil { // first id
+			return nil, err
+		}
+		if stream.maxDeletedID, err = decodeStreamIDSizes(reader); err != nil {
+			return nil, err
+		}
+		_, entriesAdded, err := decodeSize(reader)
+		if err != nil {
+			return nil, err
+		}
+		stream.entriesAdded = uint64(entriesAdded)
+	}
+	// Older files don't know about the deleted entries, the entries added
+	// are then the entries left, as counted by loadNode
+
+	if err := decodeStreamGroups(reader, rdbType, stream); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Decode the consumer groups of a stream: name, last delivered ID, entries
+// read, the PEL of the group and then the consumers with the IDs of their
+// pending entries
+func decodeStreamGroups(reader *bufio.Reader, rdbType byte, stream *ValueStream) error {
+	_, numGroups, err := decodeSize(reader)
+	if err != nil {
+		return err
+	}
+	for g := 0; g < numGroups; g++ {
+		name, err := decodeString(reader)
+		if err != nil {
+			return err
+		}
+		lastID, err := decodeStreamIDSizes(reader)
+		if err != nil {
+			return err
+		}
+		var entriesRead int64
+		if rdbType >= rdbTypeStreamListpacks2 {
+			_, n, err := decodeSize(reader)
+			if err != nil {
+				return err
+			}
+			entriesRead = int64(n)
+		} else {
+			entriesRead = stream.entriesUpTo(lastID)
+		}
+		group := stream.createGroup(name, lastID, entriesRead)
+		if group == nil {
+			return fmt.Errorf("duplicated consumer group %q", name)
+		}
+
+		// Group PEL: ID, delivery time, delivery count
+		_, pelSize, err := decodeSize(reader)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < pelSize; i++ {
+			rawID := make([]byte, 16)
+			if _, err := io.ReadFull(reader, rawID); err != nil {
+				return err
+			}
+			id, _ := decodeStreamID(rawID)
+			deliveryTime, err := decodeExpiryMilis(reader)
+			if err != nil {
+				return err
+			}
+			_, deliveryCount, err := decodeSize(reader)
+			if err != nil {
+				return err
+			}
+			group.pel[id] = &streamNACK{deliveryTime: int64(deliveryTime), deliveryCount: uint64(deliveryCount)}
+			stream.memory.Add(streamNACKOverhead)
+		}
+
+		// Consumers: name, seen time, active time, IDs of their pending entries
+		_, numConsumers, err := decodeSize(reader)
+		if err != nil {
+			return err
+		}
+		for c := 0; c < numConsumers; c++ {
+			name, err := decodeString(reader)
+			if err != nil {
+				return err
+			}
+			seenTime, err := decodeExpiryMilis(reader)
+			if err != nil {
+				return err
+			}
+			activeTime := seenTime
+			if rdbType >= rdbTypeStreamListpacks3 {
+				if activeTime, err = decodeExpiryMilis(reader); err != nil {
+					return err
+				}
+			}
+			consumer, _ := stream.lookupConsumer(group, name, int64(seenTime))
+			consumer.activeTime = int64(activeTime)
+
+			_, pelSize, err := decodeSize(reader)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < pelSize; i++ {
+				rawID := make([]byte, 16)
+				if _, err := io.ReadFull(reader, rawID); err != nil {
+					return err
+				}
+				id, _ := decodeStreamID(rawID)
+				nack, ok := group.pel[id]
+				if !ok {
+					return fmt.Errorf("consumer %q has entry %s pending which isn't in the group PEL", name, id)
+				}
+				nack.consumer = consumer
+				consumer.pel[id] = nack
+			}
+		}
+
+		for id, nack := range group.pel {
+			if nack.consumer == nil {
+				return fmt.Errorf("pending entry %s of group %q has no consumer", id, name)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Writing RDB files
+*/
+
+// Save writes the live keys of dbs, indexed by their db number, to an RDB file
+// at filepath. The file is written under a temporary name and renamed once
+// complete so a crash never leaves a truncated dump behind.
+func Save(filepath string, dbs []*DB) error {
+	tmpPath := tempRDBPath(filepath)
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed opening the temp RDB file %s: %w", tmpPath, err)
+	}
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	w := &rdbWriter{w: bufio.NewWriter(file)}
+	writeErr := w.writeRDB(dbs)
+	if writeErr == nil {
+		writeErr = w.w.Flush()
+	}
+	if writeErr == nil {
+		writeErr = file.Sync()
+	}
+	if err := file.Close(); writeErr == nil {
+		writeErr = err
+	}
+	if writeErr != nil {
+		return fmt.Errorf("error writing the RDB file: %w", writeErr)
+	}
+	return os.Rename(tmpPath, filepath)
+}
+
+func tempRDBPath(path string) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+}
+
+// Writes to w while keeping the checksum of everything written
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	buf bytes.Buffer
+}
+
+func (w *rdbWriter) write(p []byte) error {
+	w.crc = crc64Jones(w.crc, p)
+	_, err := w.w.Write(p)
+	return err
+}
+
+// Write the content of the scratch buffer
+func (w *rdbWriter) flushBuf() error {
+	err := w.write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+func (w *rdbWriter) writeRDB(dbs []*DB) error {
+	w.buf.WriteString(fmt.Sprintf("REDIS%04d", rdbVersion))
+	aux := [][2]string{
+		{"redis-ver", "7.2.0"},
+		{"redis-bits", strconv.Itoa(strconv.IntSize)},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+		{"aof-base", "0"},
+	}
+	for _, kv := range aux {
+		w.buf.WriteByte(rdbMetadataIndicator)
+		encodeString(&w.buf, []byte(kv[0]))
+		encodeString(&w.buf, []byte(kv[1]))
+	}
+	if err := w.flushBuf(); err != nil {
+		return err
+	}
+
+	for idx, db := range dbs {
+		if err := w.writeDatabase(idx, db); err != nil {
+			return err
+		}
+	}
+
+	w.buf.WriteByte(rdbEndOfFile)
+	if err := w.flushBuf(); err != nil {
+		return err
+	}
+	checksum := binary.LittleEndian.AppendUint64(nil, w.crc)
+	_, err := w.w.Write(checksum)
+	return err
+}
+
+func (w *rdbWriter) writeDatabase(idx int, db *DB) error {
+	now := time.Now().UnixMilli()
+	data := db.Snapshot()
+	keys := make([]string, 0, len(data))
+	numExpires := 0
+	for key, val := range data {
+		if val.isExpired(now) {
+			continue
+		}
+		keys = append(keys, key)
+		if val.ExpiredTimeMilli > 0 {
+			numExpires++
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	w.buf.WriteByte(rdbDatabaseIndicator)
+	encodeSize(&w.buf, uint64(idx))
+	w.buf.WriteByte(rdbHashtableSizeInformationIndicator)
+	encodeSize(&w.buf, uint64(len(keys)))
+	encodeSize(&w.buf, uint64(numExpires))
+
+	policy := db.Options.MaxMemoryPolicy
+	for _, key := range keys {
+		val := data[key]
+		if val.ExpiredTimeMilli > 0 {
+			w.buf.WriteByte(rdbExpiryMilis)
+			w.buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(val.ExpiredTimeMilli)))
+		}
+		if val.access != nil && policy.isLRU() {
+			w.buf.WriteByte(rdbOpcodeIdle)
+			encodeSize(&w.buf, uint64(val.access.idleMilli()/1000))
+		}
+		if val.access != nil && policy.IsLFU() {
+			w.buf.WriteByte(rdbOpcodeFreq)
+			w.buf.WriteByte(val.access.lfuCounter())
+		}
+		if err := encodeKeyValue(&w.buf, key, val); err != nil {
+			return err
+		}
+		if err := w.flushBuf(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serialize the type, key and value of val
+func encodeKeyValue(buf *bytes.Buffer, key string, val Value) error {
+	rdbType, err := rdbValueType(val)
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(rdbType)
+	encodeString(buf, []byte(key))
+	return encodeValue(buf, val)
+}
+
+func rdbValueType(val Value) (byte, error) {
+	switch val.Data.(type) {
+	case ValueString:
+		return rdbStringEncoding, nil
+	case *ValueStream:
+		return rdbTypeStreamListpacks3, nil
+	default:
+		return 0, fmt.Errorf("can't serialize values of type %s", DecodeValueType(val.Type))
+	}
+}
+
+func encodeValue(buf *bytes.Buffer, val Value) error {
+	switch data := val.Data.(type) {
+	case ValueString:
+		encodeString(buf, data)
+	case *ValueStream:
+		encodeStream(buf, data)
+	default:
+		return fmt.Errorf("can't serialize values of type %s", DecodeValueType(val.Type))
+	}
+	return nil
+}
+
+func encodeSize(buf *bytes.Buffer, size uint64) {
+	switch {
+	case size < 1<<6:
+		buf.WriteByte(byte(size))
+	case size < 1<<14:
+		buf.WriteByte(0b01<<6 | byte(size>>8))
+		buf.WriteByte(byte(size))
+	case size <= 1<<32-1:
+		buf.WriteByte(0x80)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(size)))
+	default:
+		buf.WriteByte(0x81)
+		buf.Write(binary.BigEndian.AppendUint64(nil, size))
+	}
+}
+
+// Strings that are small integers are stored as such, like rdbTryIntegerEncoding
+func encodeString(buf *bytes.Buffer, s []byte) {
+	if len(s) <= 11 {
+		if v, ok := ParseInt64(s); ok {
+			switch {
+			case v >= -1<<7 && v < 1<<7:
+				buf.WriteByte(rdbEncInt8)
+				buf.WriteByte(byte(v))
+				return
+			case v >= -1<<15 && v < 1<<15:
+				buf.WriteByte(rdbEncInt16)
+				buf.Write(binary.LittleEndian.AppendUint16(nil, uint16(v)))
+				return
+			case v >= -1<<31 && v < 1<<31:
+				buf.WriteByte(rdbEncInt32)
+				buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(v)))
+				return
+			}
+		}
+	}
+	encodeRawString(buf, s)
+}
+
+func encodeRawString(buf *bytes.Buffer, s []byte) {
+	encodeSize(buf, uint64(len(s)))
+	buf.Write(s)
+}
+
+// Serialize a stream as its listpack nodes, followed by its metadata
+func encodeStream(buf *bytes.Buffer, stream *ValueStream) {
+	stream.mu.RLock()
+	defer stream.mu.RUnlock()
+
+	encodeSize(buf, uint64(stream.nodes.Len()))
+	stream.nodes.Ascend(nil, func(key []byte, n *streamNode) bool {
+		encodeRawString(buf, key) // the big endian master ID
+		encodeRawString(buf, n.lp)
+		return true
+	})
+
+	first, _ := stream.firstID()
+	encodeSize(buf, uint64(stream.length))
+	encodeSize(buf, stream.lastID.Timestamp)
+	encodeSize(buf, stream.lastID.Sequence)
+	encodeSize(buf, first.Timestamp)
+	encodeSize(buf, first.Sequence)
+	encodeSize(buf, stream.maxDeletedID.Timestamp)
+	encodeSize(buf, stream.maxDeletedID.Sequence)
+	encodeSize(buf, stream.entriesAdded)
+	encodeStreamGroups(buf, stream)
+}
+
+// Groups by name, their PELs and consumers in the order Redis' radix trees have
+func encodeStreamGroups(buf *bytes.Buffer, stream *ValueStream) {
+	names := sortedGroupNames(stream.groups)
+	encodeSize(buf, uint64(len(names)))
+	for _, name := range names {
+		group := stream.groups[name]
+		encodeString(buf, []byte(name))
+		encodeSize(buf, group.lastID.Timestamp)
+		encodeSize(buf, group.lastID.Sequence)
+		encodeSize(buf, uint64(group.entriesRead))
+
+		encodeSize(buf, uint64(len(group.pel)))
+		for _, id := range sortedPendingIDs(group.pel) {
+			nack := group.pel[id]
+			buf.Write(encodeStreamID(id))
+			buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(nack.deliveryTime)))
+			encodeSize(buf, nack.deliveryCount)
+		}
+
+		encodeSize(buf, uint64(len(group.consumers)))
+		for _, consumer := range sortedConsumers(group) {
+			encodeString(buf, []byte(consumer.name))
+			buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(consumer.seenTime)))
+			buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(consumer.activeTime)))
+			encodeSize(buf, uint64(len(consumer.pel)))
+			for _, id := range sortedPendingIDs(consumer.pel) {
+				buf.Write(encodeStreamID(id))
+			}
+		}
+	}
+}
+
+/*
+DUMP payloads: a single value in the RDB format, followed by the RDB version
+(2 bytes) and the CRC64 of everything before (8 bytes), little endian
+*/
+
+func dumpValue(val Value) ([]byte, error) {
+	var buf bytes.Buffer
+	rdbType, err := rdbValueType(val)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte(rdbType)
+	if err := encodeValue(&buf, val); err != nil {
+		return nil, err
+	}
+	buf.Write(binary.LittleEndian.AppendUint16(nil, rdbVersion))
+	buf.Write(binary.LittleEndian.AppendUint64(nil, crc64Jones(0, buf.Bytes())))
+	return buf.Bytes(), nil
+}
+
+// Check the footer of payload and decode its value
+func loadDumpPayload(payload []byte) (ValueData, ValueType, error) {
+	if len(payload) < 1+10 {
+		return nil, 0, &DumpPayloadError{}
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > rdbVersion {
+		return nil, 0, &DumpPayloadError{}
+	}
+	if crc64Jones(0, payload[:len(payload)-8]) != binary.LittleEndian.Uint64(footer[2:]) {
+		return nil, 0, &DumpPayloadError{}
+	}
+
+	body := bytes.NewReader(payload[1 : len(payload)-10])
+	data, valType, err := decodeValue(bufio.NewReader(body), payload[0])
+	if err != nil {
+		return nil, 0, &BadDataFormatError{err: err}
+	}
+	return data, valType, nil
 }
@@ -3,6 +3,11 @@ package internal
 import (
 	"bufio"
 	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -126,5 +131,82 @@ func TestLoadFile(t *testing.T) {
 		t.Fatal("Error:", err)
 	}
 	t.Log("Data:", data)
-	assert.Equal(t, 3, len(data))
+	assert.Equal(t, 3, len(data[0]))
+}
+
+func TestDecodeStringAsInt_Negative(t *testing.T) {
+	input := []byte{0xC0, 0xFF}
+	reader := bufio.NewReader(bytes.NewReader(input))
+	str, err := decodeString(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "-1", str)
+}
+
+func TestDecodeStringLZF(t *testing.T) {
+	// A literal "a" followed by a back reference repeating it 39 times
+	input := []byte{0xC3, 0x05, 0x28, 0x00, 0x61, 0xE0, 0x1E, 0x00}
+	reader := bufio.NewReader(bytes.NewReader(input))
+	str, err := decodeString(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, strings.Repeat("a", 40), str)
+}
+
+func TestSaveAndLoadFile(t *testing.T) {
+	db0 := NewDB(DBOptions{})
+	db0.StringSet("str", []byte("hello"), 0)
+	db0.StringSet("int", []byte("-12345"), 0)
+	db0.StringSet("volatile", []byte("v"), 60_000)
+	for i := 0; i < 250; i++ {
+		fields := StreamEntryData{[]byte("temperature"), []byte(strconv.Itoa(i))}
+		if i%7 == 0 {
+			fields = append(fields, []byte("humidity"), []byte("high"))
+		}
+		_, _, err := db0.StreamAdd("stream", fmt.Sprintf("%d-%d", 1000+i/3, i%3), fields, StreamAddOptions{})
+		assert.NoError(t, err)
+	}
+	db1 := NewDB(DBOptions{})
+	db1.StringSet("other", []byte(strings.Repeat("x", 5000)), 0)
+	empty := NewDB(DBOptions{})
+
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	assert.NoError(t, Save(path, []*DB{db0, empty, db1}))
+
+	data, err := NewRDBReader().LoadFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, data, 2)
+	assert.Len(t, data[0], 4)
+	assert.Len(t, data[2], 1)
+
+	assert.Equal(t, ValueString("hello"), data[0]["str"].Data)
+	assert.Equal(t, ValueString("-12345"), data[0]["int"].Data)
+	assert.Greater(t, data[0]["volatile"].ExpiredTimeMilli, int64(0))
+	assert.Equal(t, 5000, len(data[2]["other"].Data.ToBytes()))
+
+	stream := data[0]["stream"].Data.(*ValueStream)
+	original, _ := db0.GetVal("stream")
+	originalIDs, originalValues := original.Data.(*ValueStream).read(StreamEntryID{}, maxStreamEntryID, 0, false)
+	ids, values := stream.read(StreamEntryID{}, maxStreamEntryID, 0, false)
+	assert.Equal(t, originalIDs, ids)
+	assert.Equal(t, originalValues, values)
+	assert.Equal(t, original.Data.(*ValueStream).nodes.Len(), stream.nodes.Len())
+}
+
+func TestLoadFileBadChecksum(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("k", []byte("v"), 0)
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	assert.NoError(t, Save(path, []*DB{db}))
+
+	content, _ := os.ReadFile(path)
+	content[len(content)-10] ^= 0xFF
+	assert.NoError(t, os.WriteFile(path, content, 0o644))
+
+	_, err := NewRDBReader().LoadFile(path)
+	assert.ErrorContains(t, err, "checksum")
 }
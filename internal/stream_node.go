@@ -0,0 +1,516 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// Stream entries are stored the way Redis does: a radix tree maps the ID of
+// the first entry of each node, big endian, to a listpack holding up to
+// streamNodeMaxEntries entries or about streamNodeMaxBytes. A node starts
+// with its master entry, whose fields the following entries usually share:
+//
+//	count, deleted, number of master fields, master fields..., 0
+//
+// Then come the entries, their IDs being deltas from the master ID:
+//
+//	flags, ms-diff, seq-diff, values...                   with SAMEFIELDS
+//	flags, ms-diff, seq-diff, num-fields, field, value... otherwise
+//
+// each followed by lp-count, the number of elements it took before it.
+// Deleted entries stay in their node, flagged, until the node is freed with
+// its last live entry. RDB files store the nodes as they are.
+
+type streamNode struct {
+	master StreamEntryID
+	lp     []byte
+}
+
+const streamNodeOverhead = 64 // the node and its key in the radix tree
+
+// An entry of a node, its fields and values are decoded on demand
+type streamEntry struct {
+	ID           StreamEntryID
+	node         *streamNode
+	pos          int // offset of the flags element
+	flags        int64
+	dataPos      int      // offset of the values, or of num-fields without SAMEFIELDS
+	masterFields [][]byte // of the node
+}
+
+func newStreamNode(master StreamEntryID, fields [][]byte) *streamNode {
+	lp := newListpackWriter()
+	lp.AppendInt(0) // count
+	lp.AppendInt(0) // deleted
+	lp.AppendInt(int64(len(fields)))
+	for _, field := range fields {
+		lp.AppendString(field)
+	}
+	lp.AppendInt(0)
+	return &streamNode{master: master, lp: lp.Bytes()}
+}
+
+// The master entry: the live and deleted entries, the master fields and
+// where the entries start
+func (n *streamNode) header() (int, int, [][]byte, int) {
+	r := &listpackReader{lp: n.lp, p: lpHeaderSize}
+	count, deleted := r.NextInt(), r.NextInt()
+	fields := make([][]byte, r.NextInt())
+	for i := range fields {
+		fields[i] = r.Next()
+	}
+	r.next() // master entry terminator
+	return int(count), int(deleted), fields, r.p
+}
+
+// Rewrite the counts of the master entry
+func (n *streamNode) setCounts(count, deleted int) {
+	n.lp = listpackReplaceInt(n.lp, lpHeaderSize, int64(count))
+	r := &listpackReader{lp: n.lp, p: lpHeaderSize}
+	r.next()
+	n.lp = listpackReplaceInt(n.lp, r.p, int64(deleted))
+}
+
+// Call fn with the entries of the node in ID order, the deleted ones
+// included, until it returns false
+func (n *streamNode) forEach(fn func(e *streamEntry) bool) {
+	_, _, fields, p := n.header()
+	r := &listpackReader{lp: n.lp, p: p}
+	for !r.Done() {
+		e := streamEntry{node: n, pos: r.p, masterFields: fields}
+		e.flags = r.NextInt()
+		e.ID.Timestamp = n.master.Timestamp + uint64(r.NextInt())
+		e.ID.Sequence = n.master.Sequence + uint64(r.NextInt())
+		e.dataPos = r.p
+
+		elements := len(fields)
+		if e.flags&streamItemFlagSameFields == 0 {
+			elements = 2 * int(r.NextInt())
+		}
+		for i := 0; i < elements; i++ {
+			r.next()
+		}
+		r.next() // lp-count
+		if !fn(&e) {
+			return
+		}
+	}
+}
+
+// The entries of the node in ID order, the deleted ones included
+func (n *streamNode) entries() []streamEntry {
+	var entries []streamEntry
+	n.forEach(func(e *streamEntry) bool {
+		entries = append(entries, *e)
+		return true
+	})
+	return entries
+}
+
+func (e *streamEntry) deleted() bool {
+	return e.flags&streamItemFlagDeleted != 0
+}
+
+// The fields and values of the entry, copied out of the node
+func (e *streamEntry) data() StreamEntryData {
+	r := &listpackReader{lp: e.node.lp, p: e.dataPos}
+	sameFields := e.flags&streamItemFlagSameFields != 0
+	numFields := len(e.masterFields)
+	if !sameFields {
+		numFields = int(r.NextInt())
+	}
+
+	// The fields and values share a single allocation
+	var buf []byte
+	ends := make([]int, 2*numFields)
+	for i := range ends {
+		if sameFields && i%2 == 0 {
+			buf = append(buf, e.masterFields[i/2]...)
+		} else if s, v, isInt := r.next(); isInt {
+			buf = strconv.AppendInt(buf, v, 10)
+		} else {
+			buf = append(buf, s...)
+		}
+		ends[i] = len(buf)
+	}
+
+	data := make(StreamEntryData, len(ends))
+	start := 0
+	for i, end := range ends {
+		data[i] = buf[start:end:end]
+		start = end
+	}
+	return data
+}
+
+/*
+Entries of a ValueStream, all the methods must be called with v.mu held
+*/
+
+// Append an entry with an ID greater than the last one, to the last node
+// unless it's full
+func (v *ValueStream) appendEntry(id StreamEntryID, data StreamEntryData) {
+	size := 0
+	for _, s := range data {
+		size += len(s)
+	}
+	numFields := len(data) / 2
+
+	node := v.lastNode()
+	var count, deleted int
+	var masterFields [][]byte
+	if node != nil {
+		count, deleted, masterFields, _ = node.header()
+		if count+deleted >= streamNodeMaxEntries || len(node.lp)+size >= streamNodeMaxBytes {
+			node = nil
+		}
+	}
+	if node == nil {
+		masterFields = make([][]byte, numFields)
+		for i := range masterFields {
+			masterFields[i] = data[2*i]
+		}
+		node = newStreamNode(id, masterFields)
+		v.nodes.Insert(encodeStreamID(id), node)
+		v.memory.Add(int64(streamNodeOverhead + len(node.lp)))
+		count, deleted = 0, 0
+	}
+
+	// The same fields in the same order as the master entry
+	sameFields := numFields == len(masterFields)
+	for i := 0; sameFields && i < numFields; i++ {
+		sameFields = bytes.Equal(data[2*i], masterFields[i])
+	}
+
+	entry := newListpackWriter()
+	if sameFields {
+		entry.AppendInt(streamItemFlagSameFields)
+	} else {
+		entry.AppendInt(0)
+	}
+	entry.AppendInt(int64(id.Timestamp - node.master.Timestamp))
+	entry.AppendInt(int64(id.Sequence - node.master.Sequence))
+	if sameFields {
+		for i := 1; i < len(data); i += 2 {
+			entry.AppendString(data[i])
+		}
+	} else {
+		entry.AppendInt(int64(numFields))
+		for _, s := range data {
+			entry.AppendString(s)
+		}
+	}
+	entry.AppendInt(int64(entry.num))
+
+	before := len(node.lp)
+	node.lp = listpackAppend(node.lp, entry)
+	node.setCounts(count+1, deleted)
+	v.memory.Add(int64(len(node.lp) - before))
+
+	v.length++
+	v.lastID = id
+	v.entriesAdded++
+}
+
+// Flag entries of node n deleted, or free n with its last live entry
+func (v *ValueStream) deleteEntries(n *streamNode, entries []*streamEntry) {
+	count, deleted, _, _ := n.header()
+	v.length -= len(entries)
+	if count == len(entries) {
+		v.removeNode(n)
+		return
+	}
+
+	before := len(n.lp)
+	for _, e := range entries {
+		// The flags are small enough to always take a single byte
+		n.lp[e.pos] = byte(e.flags | streamItemFlagDeleted)
+	}
+	n.setCounts(count-len(entries), deleted+len(entries))
+	v.memory.Add(int64(len(n.lp) - before))
+}
+
+// Remove the entry with the given ID, as XDEL does
+func (v *ValueStream) deleteID(id StreamEntryID) bool {
+	e, ok := v.lookup(id)
+	if !ok {
+		return false
+	}
+	v.deleteEntries(e.node, []*streamEntry{e})
+	if compareEntryIds(id, v.maxDeletedID) > 0 {
+		v.maxDeletedID = id
+	}
+	return true
+}
+
+func (v *ValueStream) removeNode(n *streamNode) {
+	v.nodes.Remove(encodeStreamID(n.master))
+	v.memory.Add(-int64(streamNodeOverhead + len(n.lp)))
+}
+
+func (v *ValueStream) firstNode() *streamNode {
+	var first *streamNode
+	v.nodes.Ascend(nil, func(_ []byte, n *streamNode) bool {
+		first = n
+		return false
+	})
+	return first
+}
+
+func (v *ValueStream) lastNode() *streamNode {
+	var last *streamNode
+	v.nodes.Descend(nil, func(_ []byte, n *streamNode) bool {
+		last = n
+		return false
+	})
+	return last
+}
+
+// Call fn with the live entries between start and end in ID order, or from
+// end down to start with rev, until it returns false. fn must not change
+// the stream.
+func (v *ValueStream) scan(start, end StreamEntryID, rev bool, fn func(e *streamEntry) bool) {
+	if compareEntryIds(start, end) > 0 {
+		return
+	}
+
+	if rev {
+		v.nodes.Descend(encodeStreamID(end), func(_ []byte, n *streamNode) bool {
+			entries := n.entries()
+			for i := len(entries) - 1; i >= 0; i-- {
+				e := &entries[i]
+				if compareEntryIds(e.ID, start) < 0 {
+					return false
+				}
+				if !e.deleted() && compareEntryIds(e.ID, end) <= 0 && !fn(e) {
+					return false
+				}
+			}
+			return true
+		})
+		return
+	}
+
+	// The node holding start begins before it
+	from := encodeStreamID(start)
+	v.nodes.Descend(from, func(key []byte, _ *streamNode) bool {
+		from = bytes.Clone(key)
+		return false
+	})
+	v.nodes.Ascend(from, func(_ []byte, n *streamNode) bool {
+		if compareEntryIds(n.master, end) > 0 {
+			return false
+		}
+		more := true
+		n.forEach(func(e *streamEntry) bool {
+			if compareEntryIds(e.ID, end) > 0 {
+				more = false
+			} else if !e.deleted() && compareEntryIds(e.ID, start) >= 0 {
+				more = fn(e)
+			}
+			return more
+		})
+		return more
+	})
+}
+
+// Up to count entries (0 for all) between start and end, or from end down to
+// start with rev
+func (v *ValueStream) read(start, end StreamEntryID, count int, rev bool) ([]StreamEntryID, []StreamEntryData) {
+	ids := []StreamEntryID{}
+	values := []StreamEntryData{}
+	v.scan(start, end, rev, func(e *streamEntry) bool {
+		ids = append(ids, e.ID)
+		values = append(values, e.data())
+		return count <= 0 || len(ids) < count
+	})
+	return ids, values
+}
+
+// The live entry with the given ID
+func (v *ValueStream) lookup(id StreamEntryID) (*streamEntry, bool) {
+	var found *streamEntry
+	v.scan(id, id, false, func(e *streamEntry) bool {
+		found = e
+		return false
+	})
+	return found, found != nil
+}
+
+// The ID of the first live entry
+func (v *ValueStream) firstID() (StreamEntryID, bool) {
+	var id StreamEntryID
+	found := false
+	v.scan(StreamEntryID{}, maxStreamEntryID, false, func(e *streamEntry) bool {
+		id, found = e.ID, true
+		return false
+	})
+	return id, found
+}
+
+// The ID of the last live entry, unlike lastID it's never a deleted one
+func (v *ValueStream) lastEntryID() (StreamEntryID, bool) {
+	var id StreamEntryID
+	found := false
+	v.scan(StreamEntryID{}, maxStreamEntryID, true, func(e *streamEntry) bool {
+		id, found = e.ID, true
+		return false
+	})
+	return id, found
+}
+
+// Remove the oldest entries per opts, return how many were removed. Whole
+// nodes are freed first, with Approx that's all that is done as it's cheap,
+// otherwise the entries left to remove are flagged deleted in the next node.
+// Limit caps the entries removed, stopping before a node that would exceed it.
+func (v *ValueStream) trim(opts StreamTrimOptions) int {
+	if opts.Strategy != StreamTrimMaxLen && opts.Strategy != StreamTrimMinID {
+		return 0
+	}
+
+	removed := 0
+	for {
+		if opts.Strategy == StreamTrimMaxLen && int64(v.length) <= opts.MaxLen {
+			break
+		}
+		n := v.firstNode()
+		if n == nil {
+			break
+		}
+		count, _, _, _ := n.header()
+		entries := n.entries()
+
+		var whole bool
+		if opts.Strategy == StreamTrimMaxLen {
+			whole = int64(v.length-count) >= opts.MaxLen
+		} else {
+			whole = compareEntryIds(entries[len(entries)-1].ID, opts.MinID) < 0
+		}
+		if whole {
+			if opts.Limit > 0 && int64(removed+count) > opts.Limit {
+				break
+			}
+			v.removeNode(n)
+			v.length -= count
+			removed += count
+			continue
+		}
+		if opts.Approx {
+			break
+		}
+
+		var doomed []*streamEntry
+		for i := range entries {
+			e := &entries[i]
+			if e.deleted() {
+				continue
+			}
+			if opts.Strategy == StreamTrimMaxLen && int64(v.length-len(doomed)) <= opts.MaxLen {
+				break
+			}
+			if opts.Strategy == StreamTrimMinID && compareEntryIds(e.ID, opts.MinID) >= 0 {
+				break
+			}
+			doomed = append(doomed, e)
+		}
+		if len(doomed) > 0 {
+			v.deleteEntries(n, doomed)
+			removed += len(doomed)
+		}
+		break
+	}
+	return removed
+}
+
+// The exact trim that leaves the stream as opts just left it, for replicas:
+// what "~" removes depends on the nodes, which replicas lay out their own way.
+// Like Redis' streamRewriteTrimArgument, MINID is the first entry left.
+func (v *ValueStream) exactTrim(opts StreamTrimOptions) StreamTrimOptions {
+	if !opts.Approx {
+		return opts
+	}
+	exact := StreamTrimOptions{Strategy: opts.Strategy}
+	if opts.Strategy == StreamTrimMaxLen {
+		exact.MaxLen = int64(v.length)
+	} else if first, ok := v.firstID(); ok {
+		exact.MinID = first
+	} else {
+		exact.MinID = maxStreamEntryID
+	}
+	return exact
+}
+
+// Keys and nodes of the radix tree holding the entries
+func (v *ValueStream) radixTreeSize() (int, int) {
+	return v.nodes.Len(), v.nodes.Nodes()
+}
+
+// Check a node read from an RDB file and add it to the stream. The entries
+// must follow the last one of the stream.
+func (v *ValueStream) loadNode(master StreamEntryID, lp []byte) error {
+	r, err := newListpackReader(lp)
+	if err != nil {
+		return err
+	}
+	count, deleted := r.NextInt(), r.NextInt()
+	numFields := r.NextInt()
+	if r.err == nil && (count < 0 || deleted < 0 || numFields < 0) {
+		return fmt.Errorf("invalid stream node master entry")
+	}
+	for i := int64(0); i < numFields; i++ {
+		r.next()
+	}
+	if r.NextInt() != 0 && r.err == nil {
+		return fmt.Errorf("invalid stream node master entry terminator")
+	}
+
+	last, hasLast := v.lastEntryID()
+	var live, total int64
+	for !r.Done() {
+		if r.lp[r.p] >= 0x80 {
+			return fmt.Errorf("invalid stream entry flags")
+		}
+		flags := r.NextInt()
+		id := StreamEntryID{
+			Timestamp: master.Timestamp + uint64(r.NextInt()),
+			Sequence:  master.Sequence + uint64(r.NextInt()),
+		}
+		if (hasLast || total > 0) && compareEntryIds(id, last) <= 0 || compareEntryIds(id, master) < 0 {
+			return fmt.Errorf("stream entries out of order")
+		}
+		last = id
+
+		elements := numFields
+		lpCount := 3 + numFields
+		if flags&streamItemFlagSameFields == 0 {
+			elements = 2 * r.NextInt()
+			lpCount = 4 + elements
+		}
+		for i := int64(0); i < elements; i++ {
+			r.next()
+		}
+		if r.NextInt() != lpCount && r.err == nil {
+			return fmt.Errorf("invalid stream entry lp-count")
+		}
+		if flags&streamItemFlagDeleted == 0 {
+			live++
+		}
+		total++
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if live != count || total != count+deleted {
+		return fmt.Errorf("stream node counts don't match its entries")
+	}
+	if count == 0 {
+		return nil
+	}
+
+	v.nodes.Insert(encodeStreamID(master), &streamNode{master: master, lp: lp})
+	v.memory.Add(int64(streamNodeOverhead + len(lp)))
+	v.length += int(count)
+	v.entriesAdded += uint64(count)
+	return nil
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamNodes(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 250)
+	stream := mustStream(t, db, "s")
+	assert.Equal(t, 3, stream.nodes.Len())
+	keys, nodes := stream.radixTreeSize()
+	assert.Equal(t, 3, keys)
+	assert.Greater(t, nodes, keys)
+
+	// The entries after the master one share its fields
+	node := stream.firstNode()
+	count, deleted, fields, _ := node.header()
+	assert.Equal(t, 100, count)
+	assert.Equal(t, 0, deleted)
+	assert.Equal(t, [][]byte{[]byte("f")}, fields)
+	for _, e := range node.entries() {
+		assert.NotZero(t, e.flags&streamItemFlagSameFields)
+	}
+
+	// Other fields, and values large enough to fill a node by its size
+	big := []byte(strings.Repeat("x", 1000))
+	for i := 1; i <= 5; i++ {
+		_, _, err := db.StreamAdd("s", fmt.Sprintf("300-%d", i), StreamEntryData{[]byte("a"), big, []byte("b"), []byte("-12")}, StreamAddOptions{})
+		assert.NoError(t, err)
+	}
+	// Three fit in the last node before it reaches streamNodeMaxBytes
+	assert.Equal(t, 4, stream.nodes.Len())
+	assert.Equal(t, StreamEntryID{300, 4}, stream.lastNode().master)
+	ids, values, _ := db.StreamRange("s", "250", "+", 0, false)
+	assert.Len(t, ids, 6)
+	assert.Equal(t, StreamEntryData{[]byte("f"), []byte("v")}, values[0])
+	assert.Equal(t, StreamEntryData{[]byte("a"), big, []byte("b"), []byte("-12")}, values[5])
+}
+
+func TestStreamDeleteFlagsAndFreesNodes(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 150)
+	stream := mustStream(t, db, "s")
+
+	_, err := db.StreamDelete("s", []StreamEntryID{{2, 1}, {3, 1}, {150, 1}})
+	assert.NoError(t, err)
+	count, deleted, _, _ := stream.firstNode().header()
+	assert.Equal(t, 98, count)
+	assert.Equal(t, 2, deleted)
+
+	// Reads skip the deleted entries, both ways
+	ids, _, _ := db.StreamRange("s", "-", "5", 3, false)
+	assert.Equal(t, []StreamEntryID{{1, 1}, {4, 1}, {5, 1}}, ids)
+	ids, _, _ = db.StreamRange("s", "-", "4", 0, true)
+	assert.Equal(t, []StreamEntryID{{4, 1}, {1, 1}}, ids)
+	ids, _, _ = db.StreamRange("s", "148", "+", 0, true)
+	assert.Equal(t, []StreamEntryID{{149, 1}, {148, 1}}, ids)
+
+	// Deleting the last live entry of a node frees it
+	before := db.UsedMemory()
+	del := make([]StreamEntryID, 0, 50)
+	for i := 101; i < 150; i++ {
+		del = append(del, StreamEntryID{uint64(i), 1})
+	}
+	n, _ := db.StreamDelete("s", del)
+	assert.Equal(t, 49, n)
+	assert.Equal(t, 1, stream.nodes.Len())
+	assert.Less(t, db.UsedMemory(), before)
+	length, _ := db.StreamLen("s")
+	assert.Equal(t, 98, length)
+
+	// New entries don't go to a node that's full of deleted ones
+	fillStream(t, db, "s", 200, 200)
+	assert.Equal(t, 2, stream.nodes.Len())
+	id, ok := stream.lastEntryID()
+	assert.True(t, ok)
+	assert.Equal(t, StreamEntryID{200, 1}, id)
+}
+
+func TestStreamNodesSavedAsIs(t *testing.T) {
+	db := NewDB(DBOptions{})
+	fillStream(t, db, "s", 1, 120)
+	_, err := db.StreamDelete("s", []StreamEntryID{{5, 1}})
+	assert.NoError(t, err)
+
+	payload, err := db.Dump("s")
+	assert.NoError(t, err)
+	_, err = db.Restore("copy", payload, RestoreOptions{IdleSeconds: -1, Freq: -1})
+	assert.NoError(t, err)
+
+	original, restored := mustStream(t, db, "s"), mustStream(t, db, "copy")
+	assert.Equal(t, original.firstNode().lp, restored.firstNode().lp)
+	assert.Equal(t, original.lastNode().lp, restored.lastNode().lp)
+	assert.Equal(t, 119, restored.length)
+	assert.Equal(t, original.MemoryUsage(), restored.MemoryUsage())
+
+	// Corrupt nodes are refused
+	lp := append([]byte(nil), original.lastNode().lp...)
+	lp[lpHeaderSize] = 50 // count
+	assert.Error(t, newValueStream().loadNode(StreamEntryID{101, 1}, lp))
+	assert.Error(t, newValueStream().loadNode(StreamEntryID{101, 1}, lp[:len(lp)-3]))
+	// Entries must follow the ones already loaded
+	stream := newValueStream()
+	assert.NoError(t, stream.loadNode(StreamEntryID{101, 1}, original.lastNode().lp))
+	assert.Error(t, stream.loadNode(StreamEntryID{1, 1}, original.firstNode().lp))
+}
+
+func TestStreamFieldOrder(t *testing.T) {
+	db := NewDB(DBOptions{})
+	entries := []StreamEntryData{
+		{[]byte("b"), []byte("1"), []byte("a"), []byte("2")},
+		{[]byte("a"), []byte("3"), []byte("b"), []byte("4")},                           // other order, not SAMEFIELDS
+		{[]byte("b"), []byte("5"), []byte("a"), []byte("6")},                           // SAMEFIELDS
+		{[]byte("b"), []byte("7"), []byte("b"), []byte("8")},                           // duplicate field
+		{[]byte("b"), []byte("9"), []byte("a"), []byte("10"), []byte("c"), []byte("")}, // more fields
+	}
+	for i, data := range entries {
+		_, _, err := db.StreamAdd("s", fmt.Sprintf("1-%d", i+1), data, StreamAddOptions{})
+		assert.NoError(t, err)
+	}
+
+	flags := []int64{}
+	for _, e := range mustStream(t, db, "s").firstNode().entries() {
+		flags = append(flags, e.flags&streamItemFlagSameFields)
+	}
+	assert.Equal(t, []int64{streamItemFlagSameFields, 0, streamItemFlagSameFields, 0, 0}, flags)
+
+	_, values, _ := db.StreamRange("s", "-", "+", 0, false)
+	assert.Equal(t, entries, values)
+
+	payload, err := db.Dump("s")
+	assert.NoError(t, err)
+	_, err = db.Restore("copy", payload, RestoreOptions{IdleSeconds: -1, Freq: -1})
+	assert.NoError(t, err)
+	_, values, _ = db.StreamRange("copy", "-", "+", 0, false)
+	assert.Equal(t, entries, values)
+}
+
+/*
+Benchmarks against the previous layout, an ID slice and a map of entries
+*/
+
+type sliceMapStream struct {
+	keys   []StreamEntryID
+	values map[StreamEntryID]map[string][]byte
+}
+
+func newSliceMapStream() *sliceMapStream {
+	return &sliceMapStream{values: make(map[StreamEntryID]map[string][]byte)}
+}
+
+func (s *sliceMapStream) add(id StreamEntryID, data StreamEntryData) {
+	entry := make(map[string][]byte, len(data)/2)
+	for i := 0; i < len(data); i += 2 {
+		entry[string(data[i])] = data[i+1]
+	}
+	s.keys = append(s.keys, id)
+	s.values[id] = entry
+}
+
+const benchStreamEntries = 100_000
+
+func benchEntry(i int) (StreamEntryID, StreamEntryData) {
+	id := StreamEntryID{Timestamp: 1700000000000 + uint64(i/3), Sequence: uint64(i % 3)}
+	return id, StreamEntryData{
+		[]byte("sensor"), []byte(fmt.Sprintf("sensor-%d", i%16)),
+		[]byte("temp"), []byte(fmt.Sprint(20 + i%10)),
+		[]byte("status"), []byte("ok"),
+	}
+}
+
+// Heap bytes per entry held by build
+func reportHeapPerEntry(b *testing.B, build func() any) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	kept := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(kept)
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/benchStreamEntries, "heap-B/entry")
+}
+
+func BenchmarkStreamMemory(b *testing.B) {
+	b.Run("radix", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reportHeapPerEntry(b, func() any {
+				stream := newValueStream()
+				for i := 0; i < benchStreamEntries; i++ {
+					stream.appendEntry(benchEntry(i))
+				}
+				return stream
+			})
+		}
+	})
+	b.Run("slicemap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			reportHeapPerEntry(b, func() any {
+				stream := newSliceMapStream()
+				for i := 0; i < benchStreamEntries; i++ {
+					stream.add(benchEntry(i))
+				}
+				return stream
+			})
+		}
+	})
+}
+
+func BenchmarkStreamAdd(b *testing.B) {
+	b.Run("radix", func(b *testing.B) {
+		stream := newValueStream()
+		for i := 0; i < b.N; i++ {
+			stream.appendEntry(benchEntry(i))
+		}
+	})
+	b.Run("slicemap", func(b *testing.B) {
+		stream := newSliceMapStream()
+		for i := 0; i < b.N; i++ {
+			stream.add(benchEntry(i))
+		}
+	})
+}
+
+// XRANGE of 100 entries at random places
+func BenchmarkStreamRange(b *testing.B) {
+	radix := newValueStream()
+	sliceMap := newSliceMapStream()
+	for i := 0; i < benchStreamEntries; i++ {
+		radix.appendEntry(benchEntry(i))
+		sliceMap.add(benchEntry(i))
+	}
+
+	b.Run("radix", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			start, _ := benchEntry(i * 7919 % benchStreamEntries)
+			radix.read(start, maxStreamEntryID, 100, false)
+		}
+	})
+	b.Run("slicemap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			start, _ := benchEntry(i * 7919 % benchStreamEntries)
+			k := sort.Search(len(sliceMap.keys), func(k int) bool {
+				return compareEntryIds(sliceMap.keys[k], start) >= 0
+			})
+			end := min(k+100, len(sliceMap.keys))
+			ids := append([]StreamEntryID(nil), sliceMap.keys[k:end]...)
+			values := make([]map[string][]byte, len(ids))
+			for j, id := range ids {
+				values[j] = sliceMap.values[id]
+			}
+		}
+	})
+}
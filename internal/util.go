@@ -1,5 +1,17 @@
 package internal
 
+import "strconv"
+
+// ParseValueType is the reverse of DecodeValueType
+func ParseValueType(name string) (ValueType, bool) {
+	for _, t := range []ValueType{ValTypeString, ValTypeList, ValTypeSet, ValTypeZSet, ValTypeHash, ValTypeStream} {
+		if DecodeValueType(t) == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
 func DecodeValueType(t ValueType) string {
 	switch t {
 	case ValTypeString:
@@ -18,3 +30,16 @@ func DecodeValueType(t ValueType) string {
 		return "unknown"
 	}
 }
+
+// ParseInt64 parses b the way Redis' string2ll does: no leading '+',
+// no leading zeros, no whitespace, and it must fit in a signed 64 bit integer.
+func ParseInt64(b []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if strconv.FormatInt(n, 10) != string(b) {
+		return 0, false
+	}
+	return n, true
+}
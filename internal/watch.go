@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Keys watched by clients for WATCH, like Redis' watched_keys. Any change to
+// a watched key, a write, an expiry, an eviction or a flush, marks the
+// watches on it dirty so their EXEC fails.
+
+// Watch is the set of keys a client watches, across dbs
+type Watch struct {
+	dirty atomic.Bool
+	keys  []watchedKey
+}
+
+type watchedKey struct {
+	db  *DB
+	key string
+}
+
+func NewWatch() *Watch {
+	return &Watch{}
+}
+
+type keyWatchers struct {
+	keys map[string]map[*Watch]struct{}
+	mu   sync.Mutex
+}
+
+func newKeyWatchers() *keyWatchers {
+	return &keyWatchers{keys: make(map[string]map[*Watch]struct{})}
+}
+
+func (w *keyWatchers) add(watch *Watch, key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watches, ok := w.keys[key]
+	if !ok {
+		watches = make(map[*Watch]struct{})
+		w.keys[key] = watches
+	}
+	watches[watch] = struct{}{}
+}
+
+func (w *keyWatchers) remove(watch *Watch, key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watches := w.keys[key]
+	delete(watches, watch)
+	if len(watches) == 0 {
+		delete(w.keys, key)
+	}
+}
+
+// Mark the watches on key dirty
+func (w *keyWatchers) touch(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for watch := range w.keys[key] {
+		watch.dirty.Store(true)
+	}
+}
+
+// Mark dirty the watches on the keys for which exists is true, for changes
+// to the whole db
+func (w *keyWatchers) touchExisting(exists func(key string) bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, watches := range w.keys {
+		if !exists(key) {
+			continue
+		}
+		for watch := range watches {
+			watch.dirty.Store(true)
+		}
+	}
+}
+
+// Watch adds keys of db to w. Keys that are expired already are deleted
+// first, so their expiry doesn't count as a change.
+func (db *DB) Watch(w *Watch, keys ...string) {
+	for _, key := range keys {
+		db.lookup(key)
+		if w.watches(db, key) {
+			continue
+		}
+		db.watchers.add(w, key)
+		w.keys = append(w.keys, watchedKey{db: db, key: key})
+	}
+}
+
+func (w *Watch) watches(db *DB, key string) bool {
+	for _, k := range w.keys {
+		if k.db == db && k.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Dirty reports whether a key of w changed since it was watched, a key that
+// expired meanwhile counts as changed
+func (w *Watch) Dirty() bool {
+	// Looking the keys up deletes the expired ones, which touches them
+	for _, k := range w.keys {
+		k.db.lookup(k.key)
+	}
+	return w.dirty.Load()
+}
+
+// Unwatch forgets all the keys of w
+func (w *Watch) Unwatch() {
+	for _, k := range w.keys {
+		k.db.watchers.remove(w, k.key)
+	}
+	w.keys = nil
+	w.dirty.Store(false)
+}
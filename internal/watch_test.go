@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchWrites(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("k", []byte("v"), 0)
+	w := NewWatch()
+	db.Watch(w, "k", "missing")
+	assert.False(t, w.Dirty())
+
+	// Reads and writes to other keys don't count
+	db.StringGet("k")
+	db.StringSet("other", []byte("v"), 0)
+	db.Del("nothing")
+	assert.False(t, w.Dirty())
+
+	db.StringSet("missing", []byte("v"), 0)
+	assert.True(t, w.Dirty())
+
+	w.Unwatch()
+	assert.False(t, w.Dirty())
+	db.StringSet("k", []byte("v2"), 0)
+	assert.False(t, w.Dirty())
+	assert.Empty(t, db.watchers.keys)
+}
+
+func TestWatchExpiry(t *testing.T) {
+	db := NewDB(DBOptions{})
+	db.StringSet("k", []byte("v"), 50)
+	db.StringSet("gone", []byte("v"), 1)
+	time.Sleep(5 * time.Millisecond)
+
+	// Expired already when watched, it's just missing
+	w := NewWatch()
+	db.Watch(w, "gone")
+	assert.False(t, w.Dirty())
+
+	db.Watch(w, "k")
+	assert.False(t, w.Dirty())
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, w.Dirty())
+}
+
+func TestWatchFlushAndSwap(t *testing.T) {
+	db, other := NewDB(DBOptions{}), NewDB(DBOptions{})
+	db.StringSet("k", []byte("v"), 0)
+
+	// Only the watched keys that existed are changed by a flush
+	w := NewWatch()
+	db.Watch(w, "missing")
+	db.Flush()
+	assert.False(t, w.Dirty())
+	w.Unwatch()
+
+	db.StringSet("k", []byte("v"), 0)
+	db.Watch(w, "k")
+	db.Flush()
+	assert.True(t, w.Dirty())
+	w.Unwatch()
+
+	// A key that's only in the other db changes too
+	other.StringSet("k", []byte("v"), 0)
+	db.Watch(w, "k")
+	db.SwapWith(other)
+	assert.True(t, w.Dirty())
+}
@@ -15,7 +15,7 @@ func EncodeNullBulkString() []byte {
 }
 
 func EncodeNullArray() []byte {
-	return []byte(null_bulk_string)
+	return []byte(null_array)
 }
 
 func EncodeBulkString(val string) []byte {
@@ -3,6 +3,7 @@ package resp
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -18,8 +19,24 @@ const (
 
 	CR byte = '\r'
 	LF byte = '\n'
+
+	// Lengths announced by the client are checked before allocating for them,
+	// like Redis' proto-max-bulk-len and its limit on the multibulk length
+	MaxBulkLen      = 512 * 1024 * 1024
+	MaxMultibulkLen = 1024 * 1024
+	// Elements preallocated for an array, more are appended as they arrive
+	multibulkPrealloc = 1024
 )
 
+// Malformed input, the connection can't be read any further
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
 type RESP struct {
 	Type RespType
 	Data [][]byte
@@ -49,11 +66,19 @@ func ReadNextResp(reader *bufio.Reader) (RESP, error) {
 			return resp, err
 		}
 
-		bulkStrLine, err := ReadLine(reader)
-		if err != nil {
+		if size < 0 {
+			return resp, nil // null bulk string
+		}
+		if size > MaxBulkLen {
+			return resp, &ProtocolError{"invalid bulk length"}
+		}
+
+		// Read by length, bulk strings are binary safe and may contain \r\n
+		bulkStrLine := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, bulkStrLine); err != nil {
 			return resp, err
 		}
-		if len(bulkStrLine)-2 != size {
+		if bulkStrLine[size] != CR || bulkStrLine[size+1] != LF {
 			return resp, fmt.Errorf("invalid bulk string length")
 		}
 		resp.Raw = append(resp.Raw, bulkStrLine...)
@@ -65,7 +90,14 @@ func ReadNextResp(reader *bufio.Reader) (RESP, error) {
 			return resp, err
 		}
 
-		resp.Data = make([][]byte, 0, size)
+		if size < 0 {
+			return resp, nil // null array
+		}
+		if size > MaxMultibulkLen {
+			return resp, &ProtocolError{"invalid multibulk length"}
+		}
+
+		resp.Data = make([][]byte, 0, min(size, multibulkPrealloc))
 		for i := 0; i < size; i++ {
 			nxtResp, err := ReadNextResp(reader)
 			if err != nil {